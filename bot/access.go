@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"time"
+)
+
+const notAllowedMessage = "⛔ You are not allowed to use this bot."
+
+// isAdmin reports whether the user is listed in AdminUsers
+func (b *SendToKindleBot) isAdmin(userID int) bool {
+	return containsUser(b.current().adminUsers, userID)
+}
+
+// isAllowed reports whether the user may use the bot. An empty
+// AllowedUsers list allows everyone, admins are always allowed.
+// Users approved in /users are allowed too, blocked ones never
+func (b *SendToKindleBot) isAllowed(userID int) bool {
+	s := b.current()
+	if containsUser(s.adminUsers, userID) {
+		return true
+	}
+	switch b.users.status(userID) {
+	case userBlocked:
+		return false
+	case userApproved:
+		return true
+	}
+	return len(s.allowedUsers) == 0 || containsUser(s.allowedUsers, userID)
+}
+
+// checkAllowed tells the user when they are not allowed to use the bot.
+// The first request of an unknown user is forwarded to the admins
+func (b *SendToKindleBot) checkAllowed(bot *tb.Bot, user *tb.User) bool {
+	record, isNew := b.users.seen(user, time.Now())
+	if b.isAllowed(user.ID) {
+		return true
+	}
+	logging.Warn("Ignoring request: not in the allowed users list", "user", user.ID)
+	if isNew {
+		b.users.setStatus(user.ID, userPending)
+		b.notifyAdmins(fmt.Sprintf("🙋 %s would like to use the bot.", record.displayName()),
+			userKeyboard(user.ID))
+	}
+	if _, err := bot.Send(user, notAllowedMessage); err != nil {
+		logging.Error("Could not send message", "user", user.ID, "err", err)
+	}
+	return false
+}
+
+func containsUser(users []int, userID int) bool {
+	for _, id := range users {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,572 @@
+package bot
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// adminCallbackPrefix starts the callback data of admin buttons:
+	// "admin:approve:<user>", "admin:block:<user>" (with ":list" from /users),
+	// "admin:cancel:<job>" and "admin:drop:<user>" from /queue
+	adminCallbackPrefix = "admin:"
+	adminOnlyMessage    = "⛔ This command is only available to admins."
+	// maxListedEntries limits the users and jobs listed in one message
+	maxListedEntries   = 20
+	queueButtonsPerRow = 4
+	// broadcastInterval keeps broadcasts below Telegram's limit of about
+	// 30 messages per second
+	broadcastInterval = 50 * time.Millisecond
+)
+
+// smtpSteps are the steps of smtpSession in order
+var smtpSteps = []string{"connect", "tls", "auth", "sender", "recipient", "data", "quit"}
+
+// handleAdminCommands registers /stats, /users, /queue, /broadcast and /testsmtp
+func (b *SendToKindleBot) handleAdminCommands(bot *tb.Bot) {
+	bot.Handle("/stats", b.adminOnly(bot, b.statsCommand))
+	bot.Handle("/users", b.adminOnly(bot, b.usersCommand))
+	bot.Handle("/queue", b.adminOnly(bot, b.queueCommand))
+	bot.Handle("/broadcast", b.adminOnly(bot, b.broadcastCommand))
+	bot.Handle("/testsmtp", b.adminOnly(bot, b.testSMTPCommand))
+}
+
+func (b *SendToKindleBot) adminOnly(bot *tb.Bot, command func(bot *tb.Bot, m *tb.Message)) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.isAdmin(m.Sender.ID) {
+			logging.Warn("Ignoring admin command from a non-admin", "user", m.Sender.ID, "command", m.Text)
+			respond(bot, m, adminOnlyMessage)
+			return
+		}
+		command(bot, m)
+	}
+}
+
+// adminCallback handles the buttons of the admin commands
+func (b *SendToKindleBot) adminCallback(bot *tb.Bot, c *tb.Callback) {
+	if !b.isAdmin(c.Sender.ID) {
+		bot.Respond(c, &tb.CallbackResponse{Text: adminOnlyMessage})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(c.Data, adminCallbackPrefix), ":")
+	if len(parts) < 2 {
+		bot.Respond(c, &tb.CallbackResponse{})
+		return
+	}
+	action, arg := parts[0], parts[1]
+	fromList := len(parts) > 2 && parts[2] == "list"
+	logging.Info("Admin action", "user", c.Sender.ID, "action", action, "target", arg)
+
+	switch action {
+	case "approve", "block":
+		userID, err := strconv.Atoi(arg)
+		if err != nil {
+			bot.Respond(c, &tb.CallbackResponse{})
+			return
+		}
+		b.setUserStatus(bot, c, userID, action == "approve", fromList)
+	case "cancel", "drop":
+		var text string
+		if b.cancelQueued(bot, action, arg) {
+			text = "🚫 Cancelled"
+		} else {
+			text = "Already finished"
+		}
+		bot.Respond(c, &tb.CallbackResponse{Text: text})
+		queue, markup := b.queueMessage(time.Now())
+		b.editAdminMessage(bot, c.Message, queue, markup)
+	default:
+		bot.Respond(c, &tb.CallbackResponse{})
+	}
+}
+
+func (b *SendToKindleBot) editAdminMessage(bot *tb.Bot, msg *tb.Message, text string, markup *tb.ReplyMarkup) {
+	if msg == nil {
+		return
+	}
+	if markup == nil {
+		markup = &tb.ReplyMarkup{}
+	}
+	_, err := bot.Edit(msg, text, markup)
+	if err != nil && err != tb.ErrSameMessageContent && err != tb.ErrMessageNotModified {
+		logging.Warn("Could not update admin message", "err", err)
+	}
+}
+
+// statsCommand reports deliveries per user and device and the failure rate
+func (b *SendToKindleBot) statsCommand(bot *tb.Bot, m *tb.Message) {
+	b.cacheMutex.RLock()
+	pending := len(b.fileStateCache)
+	b.cacheMutex.RUnlock()
+	respond(bot, m, formatStats(b.users.since(), b.users.users(), b.users.devices(), b.jobs.count(), pending))
+}
+
+// formatStats renders the /stats message
+func formatStats(since time.Time, users []userRecord, devices map[string]deliveryStats, running, pending int) string {
+	var total deliveryStats
+	active := make([]userRecord, 0, len(users))
+	for _, u := range users {
+		total.Delivered += u.Stats.Delivered
+		total.Failed += u.Stats.Failed
+		if u.Stats.total() > 0 {
+			active = append(active, u)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📊 Statistics")
+	if !since.IsZero() {
+		sb.WriteString(" since " + since.Format("2006-01-02"))
+	}
+	fmt.Fprintf(&sb, "\n\nDeliveries: %d sent, %d failed (%.1f%% failure rate)", total.Delivered, total.Failed, total.failureRate())
+	fmt.Fprintf(&sb, "\nRunning jobs: %d, waiting for a device: %d", running, pending)
+
+	if len(devices) > 0 {
+		names := make([]string, 0, len(devices))
+		for name := range devices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		sb.WriteString("\n\nBy device:")
+		for _, name := range names {
+			fmt.Fprintf(&sb, "\n• %s: %s", name, formatDeliveryStats(devices[name]))
+		}
+	}
+
+	if len(active) > 0 {
+		sort.SliceStable(active, func(i, j int) bool { return active[i].Stats.total() > active[j].Stats.total() })
+		sb.WriteString("\n\nBy user:")
+		for i, u := range active {
+			if i == maxListedEntries {
+				fmt.Fprintf(&sb, "\n… and %d more", len(active)-i)
+				break
+			}
+			fmt.Fprintf(&sb, "\n• %s: %s", u.displayName(), formatDeliveryStats(u.Stats))
+		}
+	}
+	return sb.String()
+}
+
+func formatDeliveryStats(s deliveryStats) string {
+	text := fmt.Sprintf("%d sent, %d failed", s.Delivered, s.Failed)
+	if s.Failed > 0 {
+		text += fmt.Sprintf(" (%.0f%%)", s.failureRate())
+	}
+	return text
+}
+
+// usersCommand lists known users with approve and block buttons
+func (b *SendToKindleBot) usersCommand(bot *tb.Bot, m *tb.Message) {
+	text, markup := b.usersMessage(time.Now())
+	if _, err := bot.Send(m.Sender, text, markup); err != nil {
+		logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
+	}
+}
+
+func (b *SendToKindleBot) usersMessage(now time.Time) (string, *tb.ReplyMarkup) {
+	users := b.users.users()
+	if len(users) == 0 {
+		return "👥 Nobody has used the bot yet.", nil
+	}
+
+	var sb strings.Builder
+	var rows [][]tb.InlineButton
+	fmt.Fprintf(&sb, "👥 Users (%d)\n", len(users))
+	for i, u := range users {
+		if i == maxListedEntries {
+			fmt.Fprintf(&sb, "\n… and %d more", len(users)-i)
+			break
+		}
+		fmt.Fprintf(&sb, "\n• %s - %s", u.displayName(), b.accessLabel(u.ID))
+		if !u.LastSeen.IsZero() {
+			fmt.Fprintf(&sb, ", seen %s ago", now.Sub(u.LastSeen).Round(time.Minute))
+		}
+		if b.isAdmin(u.ID) {
+			continue
+		}
+		rows = append(rows, userButtons(u, true))
+	}
+	return sb.String(), &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// accessLabel describes why a user may or may not use the bot
+func (b *SendToKindleBot) accessLabel(userID int) string {
+	s := b.current()
+	switch {
+	case containsUser(s.adminUsers, userID):
+		return "admin"
+	case b.users.status(userID) == userBlocked:
+		return "⛔ blocked"
+	case b.users.status(userID) == userApproved:
+		return "✅ approved"
+	case len(s.allowedUsers) == 0 || containsUser(s.allowedUsers, userID):
+		return "allowed"
+	case b.users.status(userID) == userPending:
+		return "🙋 waiting for approval"
+	default:
+		return "not allowed"
+	}
+}
+
+// userKeyboard has approve and block buttons for an access request
+func userKeyboard(userID int) *tb.ReplyMarkup {
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{userButtons(userRecord{ID: userID}, false)}}
+}
+
+func userButtons(u userRecord, fromList bool) []tb.InlineButton {
+	suffix, approve, block := "", "✅ Approve", "⛔ Block"
+	id := strconv.Itoa(u.ID)
+	if fromList {
+		name := u.Name
+		if name == "" {
+			name = id
+		}
+		suffix = ":list"
+		approve += " " + name
+		block += " " + name
+	}
+	return []tb.InlineButton{
+		{Text: approve, Data: adminCallbackPrefix + "approve:" + id + suffix},
+		{Text: block, Data: adminCallbackPrefix + "block:" + id + suffix},
+	}
+}
+
+// setUserStatus approves or blocks a user and updates the admin message
+func (b *SendToKindleBot) setUserStatus(bot *tb.Bot, c *tb.Callback, userID int, approve bool, fromList bool) {
+	status, answer := userBlocked, "⛔ Blocked"
+	if approve {
+		status, answer = userApproved, "✅ Approved"
+	}
+	previous := b.users.status(userID)
+	record := b.users.setStatus(userID, status)
+	bot.Respond(c, &tb.CallbackResponse{Text: answer})
+
+	if approve && previous != userApproved {
+		if _, err := bot.Send(&tb.User{ID: userID}, "✅ An admin approved your access, you can send books now."); err != nil {
+			logging.Warn("Could not notify approved user", "user", userID, "err", err)
+		}
+	}
+
+	if fromList {
+		text, markup := b.usersMessage(time.Now())
+		b.editAdminMessage(bot, c.Message, text, markup)
+		return
+	}
+	if c.Message != nil {
+		b.editAdminMessage(bot, c.Message, fmt.Sprintf("%s\n\n%s by %s", c.Message.Text, answer, userName(c.Sender)), nil)
+	}
+	logging.Info("User access changed", "user", record.ID, "status", status, "admin", c.Sender.ID)
+}
+
+// queuedJob is a running job or a file waiting for a device in /queue
+type queuedJob struct {
+	action   string // cancel or drop, see adminCallbackPrefix
+	arg      string // job ID or user ID
+	userID   int
+	fileName string
+	detail   string
+	since    time.Time
+}
+
+// queuedJobs returns running jobs followed by files waiting for a device
+func (b *SendToKindleBot) queuedJobs() []queuedJob {
+	var queued []queuedJob
+	for _, job := range b.jobs.list() {
+		detail := "processing"
+		if job.record.Kind == jobKindSend || job.record.Kind == jobKindScheduled {
+			detail = "sending to " + job.record.DeviceName
+		}
+		queued = append(queued, queuedJob{
+			action:   "cancel",
+			arg:      job.record.ID,
+			userID:   job.record.UserID,
+			fileName: job.record.FileName,
+			detail:   detail,
+			since:    job.started,
+		})
+	}
+
+	var pending []queuedJob
+	b.cacheMutex.RLock()
+	for userID, fileInfo := range b.fileStateCache {
+		if b.jobs.hasActive(userID) {
+			continue
+		}
+		pending = append(pending, queuedJob{
+			action:   "drop",
+			arg:      strconv.Itoa(userID),
+			userID:   userID,
+			fileName: fileInfo["originalFileName"],
+			detail:   "waiting for a device",
+			since:    pendingSince(fileInfo),
+		})
+	}
+	b.cacheMutex.RUnlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].since.Before(pending[j].since) })
+	return append(queued, pending...)
+}
+
+// queueCommand lists running and pending jobs with cancel buttons
+func (b *SendToKindleBot) queueCommand(bot *tb.Bot, m *tb.Message) {
+	text, markup := b.queueMessage(time.Now())
+	if _, err := bot.Send(m.Sender, text, markup); err != nil {
+		logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
+	}
+}
+
+func (b *SendToKindleBot) queueMessage(now time.Time) (string, *tb.ReplyMarkup) {
+	queued := b.queuedJobs()
+	if len(queued) == 0 {
+		return "📋 The queue is empty.", nil
+	}
+	names := make(map[int]string)
+	for _, u := range b.users.users() {
+		names[u.ID] = u.displayName()
+	}
+
+	var sb strings.Builder
+	var buttons []tb.InlineButton
+	fmt.Fprintf(&sb, "📋 Queue (%d)\n", len(queued))
+	for i, job := range queued {
+		if i == maxListedEntries {
+			fmt.Fprintf(&sb, "\n… and %d more", len(queued)-i)
+			break
+		}
+		user, ok := names[job.userID]
+		if !ok {
+			user = strconv.Itoa(job.userID)
+		}
+		fmt.Fprintf(&sb, "\n%d. %s - %s, %s", i+1, job.fileName, user, job.detail)
+		if !job.since.IsZero() {
+			fmt.Fprintf(&sb, " (%s)", now.Sub(job.since).Round(time.Second))
+		}
+		buttons = append(buttons, tb.InlineButton{
+			Text: fmt.Sprintf("❌ %d", i+1),
+			Data: adminCallbackPrefix + job.action + ":" + job.arg,
+		})
+	}
+
+	var rows [][]tb.InlineButton
+	for i := 0; i < len(buttons); i += queueButtonsPerRow {
+		end := i + queueButtonsPerRow
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows = append(rows, buttons[i:end])
+	}
+	return sb.String(), &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// cancelQueued cancels a running job ("cancel" with its ID) or drops a file
+// waiting for a device ("drop" with the user ID)
+func (b *SendToKindleBot) cancelQueued(bot *tb.Bot, action, arg string) bool {
+	if action == "cancel" {
+		return b.jobs.cancelJob(arg)
+	}
+
+	userID, err := strconv.Atoi(arg)
+	if err != nil || b.jobs.hasActive(userID) {
+		return false
+	}
+	b.cacheMutex.Lock()
+	fileInfo, ok := b.fileStateCache[userID]
+	delete(b.fileStateCache, userID)
+	b.cacheMutex.Unlock()
+	if !ok {
+		return false
+	}
+	for _, key := range []string{"filePath", "originalFilePath"} {
+		if path := fileInfo[key]; path != "" {
+			removeSilently(path)
+		}
+	}
+	editPrompt(bot, fileInfo, fmt.Sprintf("🚫 This request was cancelled by an admin: '%s'.", fileInfo["originalFileName"]))
+	return true
+}
+
+// broadcastCommand sends "/broadcast <text>" to every user allowed to use the bot
+func (b *SendToKindleBot) broadcastCommand(bot *tb.Bot, m *tb.Message) {
+	text := strings.TrimSpace(m.Payload)
+	if text == "" {
+		respond(bot, m, "Usage: /broadcast <message>")
+		return
+	}
+	recipients := b.broadcastRecipients(m.Sender.ID)
+	if len(recipients) == 0 {
+		respond(bot, m, "📣 There is nobody to send the message to.")
+		return
+	}
+	respond(bot, m, fmt.Sprintf("📣 Sending to %d user(s)...", len(recipients)))
+
+	go func() {
+		sent, failed := 0, 0
+		for i, id := range recipients {
+			if i > 0 {
+				time.Sleep(broadcastInterval)
+			}
+			if _, err := bot.Send(&tb.User{ID: id}, "📣 "+text); err != nil {
+				logging.Warn("Could not send broadcast", "user", id, "err", err)
+				failed++
+				continue
+			}
+			sent++
+		}
+		logging.Info("Broadcast sent", "admin", m.Sender.ID, "sent", sent, "failed", failed)
+		respond(bot, m, fmt.Sprintf("📣 Broadcast sent to %d user(s), %d failed.", sent, failed))
+	}()
+}
+
+// broadcastRecipients returns the known and configured users who may use
+// the bot, without the sender
+func (b *SendToKindleBot) broadcastRecipients(senderID int) []int {
+	s := b.current()
+	seen := map[int]bool{senderID: true}
+	var recipients []int
+	add := func(id int) {
+		if !seen[id] && b.isAllowed(id) {
+			seen[id] = true
+			recipients = append(recipients, id)
+		}
+	}
+	for _, u := range b.users.users() {
+		add(u.ID)
+	}
+	for _, id := range s.allowedUsers {
+		add(id)
+	}
+	for _, id := range s.adminUsers {
+		add(id)
+	}
+	return recipients
+}
+
+// smtpTarget is an SMTP account and a recipient to test it with
+type smtpTarget struct {
+	name    string
+	profile SMTPProfile
+	to      string
+}
+
+// smtpTargets returns the SMTP account of a device, or of every account
+// when device is empty
+func (s *settings) smtpTargets(device string) ([]smtpTarget, error) {
+	if device != "" {
+		to, ok := s.devices[device]
+		if !ok {
+			return nil, fmt.Errorf("unknown device %q", device)
+		}
+		if transport, ok := s.transports[device]; ok {
+			return nil, fmt.Errorf("%s is not mailed to, it uses %s", device, transport.Type)
+		}
+		return []smtpTarget{{name: device, profile: s.smtpProfileFor(device), to: to}}, nil
+	}
+
+	devices := s.deviceNames()
+	// recipient returns the first device sending with the profile
+	recipient := func(profileName string, fallback string) string {
+		for _, name := range devices {
+			if _, ok := s.transports[name]; ok {
+				continue
+			}
+			if s.deviceProfiles[name] == profileName {
+				return s.devices[name]
+			}
+		}
+		return fallback
+	}
+
+	defaultTo := s.emailTo
+	if defaultTo == "" {
+		defaultTo = recipient("", s.smtp.From)
+	}
+	// Without an SMTP host books only go to other transports or a dry run
+	var targets []smtpTarget
+	if s.smtp.Host != "" {
+		targets = append(targets, smtpTarget{name: "default", profile: s.smtp, to: defaultTo})
+	}
+
+	names := make([]string, 0, len(s.smtpProfiles))
+	for name := range s.smtpProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := s.smtpProfiles[name]
+		targets = append(targets, smtpTarget{name: name, profile: profile, to: recipient(name, profile.From)})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no SMTP account is configured")
+	}
+	return targets, nil
+}
+
+// testSMTPCommand runs "/testsmtp [device]": a live SMTP session up to the
+// recipient for each account, reporting every step. No email is sent
+func (b *SendToKindleBot) testSMTPCommand(bot *tb.Bot, m *tb.Message) {
+	targets, err := b.current().smtpTargets(strings.TrimSpace(m.Payload))
+	if err != nil {
+		respond(bot, m, fmt.Sprintf("❌ %v", err))
+		return
+	}
+	status, err := bot.Send(m.Sender, "🔌 Testing SMTP...")
+	if err != nil {
+		logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
+		return
+	}
+
+	reports := make([]string, 0, len(targets))
+	for _, target := range targets {
+		reports = append(reports, testSMTP(target))
+	}
+	text := strings.Join(reports, "\n\n")
+	if _, err := bot.Edit(status, text); err != nil {
+		respond(bot, m, text)
+	}
+}
+
+// testSMTP runs an SMTP session without data and describes each step
+func testSMTP(target smtpTarget) string {
+	profile := target.profile
+	addr := fmt.Sprintf("%s:%s", profile.Host, profile.Port)
+	auth := smtp.PlainAuth("", profile.From, profile.Password, profile.Host)
+	tlsConfig := &tls.Config{ServerName: profile.Host, InsecureSkipVerify: profile.Insecure}
+
+	// Steps are described in session order, including the skipped ones
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	reached := make(map[string]string)
+	err := smtpSession(ctx, addr, auth, tlsConfig, profile.From, []string{target.to}, nil,
+		func(step string, took time.Duration, _ *smtp.Client, err error) {
+			if err != nil {
+				reached[step] = fmt.Sprintf("❌ %s (%s): %v", step, took.Round(time.Millisecond), err)
+				return
+			}
+			reached[step] = fmt.Sprintf("✅ %s (%s)", step, took.Round(time.Millisecond))
+		})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🔌 %s: %s → %s", target.name, addr, maskEmail(target.to))
+	for _, step := range smtpSteps {
+		switch line, ok := reached[step]; {
+		case ok:
+			sb.WriteString("\n" + line)
+		case err != nil:
+			fmt.Fprintf(&sb, "\n▫️ %s: not reached", step)
+		case step == "data":
+			fmt.Fprintf(&sb, "\n⏭ %s: skipped, no email is sent", step)
+		}
+	}
+	if err != nil {
+		logging.Info("SMTP test failed", "smtp", addr, "step", smtpErrorClass(err), "err", err)
+	} else {
+		logging.Info("SMTP test succeeded", "smtp", addr)
+	}
+	return sb.String()
+}
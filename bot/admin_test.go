@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatStats(t *testing.T) {
+	since := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	users := []userRecord{
+		{ID: 1, Name: "@john", Stats: deliveryStats{Delivered: 3, Failed: 1}},
+		{ID: 2, Stats: deliveryStats{Delivered: 6}},
+		{ID: 3, Name: "@idle"},
+	}
+	devices := map[string]deliveryStats{
+		"Paperwhite": {Delivered: 6},
+		"Oasis":      {Delivered: 3, Failed: 1},
+	}
+
+	want := `📊 Statistics since 2025-03-01
+
+Deliveries: 9 sent, 1 failed (10.0% failure rate)
+Running jobs: 1, waiting for a device: 2
+
+By device:
+• Oasis: 3 sent, 1 failed (25%)
+• Paperwhite: 6 sent, 0 failed
+
+By user:
+• 2: 6 sent, 0 failed
+• @john (1): 3 sent, 1 failed (25%)`
+	if got := formatStats(since, users, devices, 1, 2); got != want {
+		t.Errorf("formatStats() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSettings_smtpTargets(t *testing.T) {
+	work := SMTPProfile{Host: "smtp.work.com", Port: "587", From: "bot@work.com"}
+	spare := SMTPProfile{Host: "smtp.spare.com", Port: "587", From: "bot@spare.com"}
+	s := &settings{
+		devices:        map[string]string{"Oasis": "oasis@kindle.com", "Paperwhite": "pw@kindle.com"},
+		deviceProfiles: map[string]string{"Paperwhite": "work"},
+		smtp:           SMTPProfile{Host: "smtp.gmail.com", Port: "587", From: "bot@gmail.com"},
+		smtpProfiles:   map[string]SMTPProfile{"work": work, "spare": spare},
+	}
+
+	got, err := s.smtpTargets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []smtpTarget{
+		{name: "default", profile: s.smtp, to: "oasis@kindle.com"},
+		{name: "spare", profile: spare, to: "bot@spare.com"},
+		{name: "work", profile: work, to: "pw@kindle.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("smtpTargets() = %+v, want %+v", got, want)
+	}
+
+	got, err = s.smtpTargets("Paperwhite")
+	if err != nil || len(got) != 1 || got[0].profile != work {
+		t.Errorf("smtpTargets(Paperwhite) = %+v, %v, want the work profile", got, err)
+	}
+	if _, err := s.smtpTargets("Voyage"); err == nil {
+		t.Errorf("smtpTargets(Voyage) expected an error")
+	}
+
+	// Without an SMTP host only the profiles are tested
+	s.smtp = SMTPProfile{}
+	if got, err := s.smtpTargets(""); err != nil || len(got) != 2 || got[0].name != "spare" {
+		t.Errorf("smtpTargets() without a default host = %+v, %v, want spare and work", got, err)
+	}
+	s.smtpProfiles = nil
+	if _, err := s.smtpTargets(""); err == nil {
+		t.Errorf("smtpTargets() without SMTP accounts expected an error")
+	}
+}
+
+func TestTestSMTP(t *testing.T) {
+	host, port, _ := net.SplitHostPort(fakeSMTPServer(t))
+	report := testSMTP(smtpTarget{
+		name:    "default",
+		profile: SMTPProfile{Host: host, Port: port, From: "bot@example.com", Password: "secret"},
+		to:      "me@kindle.com",
+	})
+
+	for _, want := range []string{
+		"🔌 default: " + host + ":" + port + " → ***@kindle.com",
+		"✅ connect",
+		"❌ tls",
+		"▫️ auth: not reached",
+		"▫️ quit: not reached",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("testSMTP() =\n%s\nwant it to contain %q", report, want)
+		}
+	}
+}
+
+func TestSendToKindleBot_cancelQueued(t *testing.T) {
+	dir := t.TempDir()
+	prepared := filepath.Join(dir, "book.epub")
+	if err := os.WriteFile(prepared, []byte("book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := &SendToKindleBot{
+		tmpFilesPath: dir,
+		jobs:         newJobTracker(),
+		fileStateCache: map[int]map[string]string{
+			1: {
+				"filePath":         prepared,
+				"originalFileName": "book.fb2",
+				"startedAt":        strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10),
+			},
+		},
+	}
+	if _, err := b.jobs.begin(jobRecord{ID: "abc", Kind: jobKindDocument, UserID: 2, FileName: "other.pdf"}); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := b.queuedJobs()
+	if len(queued) != 2 || queued[0].action != "cancel" || queued[0].arg != "abc" ||
+		queued[1].action != "drop" || queued[1].arg != "1" || queued[1].fileName != "book.fb2" {
+		t.Fatalf("queuedJobs() = %+v, want the running job then the pending file", queued)
+	}
+
+	if !b.cancelQueued(nil, "drop", "1") {
+		t.Errorf("cancelQueued(drop) = false, want true")
+	}
+	if _, err := os.Stat(prepared); !os.IsNotExist(err) {
+		t.Errorf("cancelQueued(drop) kept the prepared file")
+	}
+	if b.cancelQueued(nil, "drop", "1") {
+		t.Errorf("cancelQueued(drop) twice = true, want false")
+	}
+	if !b.cancelQueued(nil, "cancel", "abc") {
+		t.Errorf("cancelQueued(cancel) = false, want true")
+	}
+}
+
+func TestSendToKindleBot_broadcastRecipients(t *testing.T) {
+	b := &SendToKindleBot{AllowedUsers: []int{1, 2}, AdminUsers: []int{9}}
+	b.users, _ = loadUserStore("", time.Now())
+	b.users.setStatus(2, userBlocked)
+	b.users.setStatus(3, userApproved)
+	b.users.setStatus(4, userPending)
+
+	got := b.broadcastRecipients(9)
+	want := map[int]bool{1: true, 3: true}
+	if len(got) != len(want) {
+		t.Fatalf("broadcastRecipients() = %v, want %v", got, want)
+	}
+	for _, id := range got {
+		if !want[id] {
+			t.Errorf("broadcastRecipients() = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// minArticleText is how much text an <article> needs to be taken as the
+// content of a page without scoring its paragraphs
+const minArticleText = 200
+
+// htmlNode is an element or, without a tag, a text node of a parsed page
+type htmlNode struct {
+	tag      string // lower case
+	text     string
+	attrs    map[string]string
+	parent   *htmlNode
+	children []*htmlNode
+}
+
+func (n *htmlNode) attr(name string) string {
+	return n.attrs[name]
+}
+
+// find returns the elements below n with one of tags, in document order
+func (n *htmlNode) find(tags ...string) []*htmlNode {
+	var found []*htmlNode
+	var walk func(*htmlNode)
+	walk = func(node *htmlNode) {
+		for _, child := range node.children {
+			for _, tag := range tags {
+				if child.tag == tag {
+					found = append(found, child)
+					break
+				}
+			}
+			walk(child)
+		}
+	}
+	walk(n)
+	return found
+}
+
+// textContent returns the text below n with collapsed white space
+func (n *htmlNode) textContent() string {
+	var text strings.Builder
+	var walk func(*htmlNode)
+	walk = func(node *htmlNode) {
+		if node.tag == "" {
+			text.WriteString(node.text)
+			text.WriteByte(' ')
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+var (
+	// htmlJunkRe matches elements whose content is not markup, which the
+	// XML decoder could choke on, and comments
+	htmlJunkRe = regexp.MustCompile(`(?is)<(script|style|noscript|template|svg|math)\b.*?</(script|style|noscript|template|svg|math)\s*>|<!--.*?-->`)
+	// htmlBareLessThanRe matches a "<" that does not start a tag
+	htmlBareLessThanRe = regexp.MustCompile(`<([^A-Za-z/!?])`)
+	paragraphBreakRe   = regexp.MustCompile(`\n\s*\n`)
+)
+
+// parseHTML parses a page leniently with encoding/xml: unclosed and void
+// elements are closed, unknown entities kept. It stops at the first error
+// it cannot recover from and returns what was parsed until then
+func parseHTML(page []byte) *htmlNode {
+	page = htmlJunkRe.ReplaceAll(page, nil)
+	page = htmlBareLessThanRe.ReplaceAll(page, []byte("&lt;$1"))
+	decoder := xml.NewDecoder(bytes.NewReader(page))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = charsetReader
+
+	root := &htmlNode{tag: "#document"}
+	current := root
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return root
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &htmlNode{tag: strings.ToLower(t.Name.Local), parent: current, attrs: make(map[string]string)}
+			for _, a := range t.Attr {
+				node.attrs[strings.ToLower(a.Name.Local)] = a.Value
+			}
+			current.children = append(current.children, node)
+			current = node
+		case xml.EndElement:
+			if current.parent != nil {
+				current = current.parent
+			}
+		case xml.CharData:
+			current.children = append(current.children, &htmlNode{text: string(t), parent: current})
+		}
+	}
+}
+
+var (
+	// articleDropped are never part of an article
+	articleDropped = map[string]bool{
+		"nav": true, "aside": true, "footer": true, "form": true, "button": true, "iframe": true, "object": true,
+		"embed": true, "select": true, "textarea": true, "input": true, "head": true, "dialog": true,
+	}
+	// articleNegativeRe and articlePositiveRe are matched against the class
+	// and id of elements, the first removes them, the second favors them
+	articleNegativeRe = regexp.MustCompile(`(?i)\b(comments?|sidebar|footer|menu|nav|share|sharing|social|related|promo|` +
+		`advert|ads?|cookies?|subscribe|newsletter|popup|modal|breadcrumbs?|banner|sponsor)\b`)
+	articlePositiveRe = regexp.MustCompile(`(?i)\b(article|body|content|entry|main|post|story|text)\b`)
+)
+
+// extractArticle returns the title and the main content of a web page,
+// found by scoring paragraphs like Readability does, as XHTML
+func extractArticle(page []byte, base *url.URL) (title, body string) {
+	root := parseHTML(page)
+	title = pageTitle(root)
+	pruneArticle(root)
+	return title, renderXHTML(articleContent(root), base)
+}
+
+// pageTitle returns og:title, <title> or the first <h1>
+func pageTitle(root *htmlNode) string {
+	for _, meta := range root.find("meta") {
+		if meta.attr("property") == "og:title" && strings.TrimSpace(meta.attr("content")) != "" {
+			return strings.TrimSpace(meta.attr("content"))
+		}
+	}
+	for _, tag := range []string{"title", "h1"} {
+		if nodes := root.find(tag); len(nodes) > 0 {
+			if text := nodes[0].textContent(); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// pruneArticle removes navigation, forms, comments, share buttons and the
+// like below n
+func pruneArticle(n *htmlNode) {
+	kept := n.children[:0]
+	for _, child := range n.children {
+		if child.tag != "" && child.tag != "body" && child.tag != "article" && child.tag != "main" {
+			if articleDropped[child.tag] || articleNegativeRe.MatchString(child.attr("class")+" "+child.attr("id")) {
+				continue
+			}
+		}
+		pruneArticle(child)
+		kept = append(kept, child)
+	}
+	n.children = kept
+}
+
+// articleContent returns the element holding the article: the only
+// <article> when there is one, otherwise the element with the best scored
+// paragraphs
+func articleContent(root *htmlNode) *htmlNode {
+	if articles := root.find("article"); len(articles) == 1 && len(articles[0].textContent()) >= minArticleText {
+		return articles[0]
+	}
+	scores := make(map[*htmlNode]float64)
+	for _, p := range root.find("p", "pre", "blockquote") {
+		text := p.textContent()
+		if len(text) < 25 || p.parent == nil {
+			continue
+		}
+		length := float64(len(text)) / 100
+		if length > 3 {
+			length = 3
+		}
+		score := 1 + float64(strings.Count(text, ",")) + length
+		scores[p.parent] += score
+		if grandparent := p.parent.parent; grandparent != nil {
+			scores[grandparent] += score / 2
+		}
+	}
+	var best *htmlNode
+	bestScore := 0.0
+	for node, score := range scores {
+		if articlePositiveRe.MatchString(node.attr("class") + " " + node.attr("id")) {
+			score *= 1.25
+		}
+		score *= 1 - linkDensity(node)
+		if score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if bodies := root.find("body"); len(bodies) > 0 {
+		return bodies[0]
+	}
+	return root
+}
+
+// linkDensity returns the share of the text of n inside links
+func linkDensity(n *htmlNode) float64 {
+	text := len(n.textContent())
+	if text == 0 {
+		return 0
+	}
+	links := 0
+	for _, a := range n.find("a") {
+		links += len(a.textContent())
+	}
+	return float64(links) / float64(text)
+}
+
+// xhtmlAllowed are the elements kept by renderXHTML with their allowed
+// attributes. Other elements are replaced by their content
+var xhtmlAllowed = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "div": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"ul": nil, "ol": nil, "li": nil, "dl": nil, "dt": nil, "dd": nil, "blockquote": nil, "pre": nil,
+	"code": nil, "em": nil, "i": nil, "strong": nil, "b": nil, "u": nil, "s": nil, "sub": nil, "sup": nil,
+	"small": nil, "cite": nil, "q": nil, "abbr": nil, "mark": nil, "del": nil, "ins": nil, "kbd": nil,
+	"figure": nil, "figcaption": nil, "table": nil, "thead": nil, "tbody": nil, "tfoot": nil, "tr": nil,
+	"th": {"colspan", "rowspan"}, "td": {"colspan", "rowspan"}, "a": {"href"},
+}
+
+// xhtmlRenamed maps elements to the one they are rendered as
+var xhtmlRenamed = map[string]string{
+	"h1": "h2", "section": "div", "article": "div", "main": "div", "center": "div", "tt": "code",
+}
+
+// renderXHTML renders n and everything below it as well-formed XHTML for
+// an EPUB chapter: only simple formatting is kept, headings start at <h2>
+// below the chapter title and links are made absolute against base
+func renderXHTML(n *htmlNode, base *url.URL) string {
+	var out strings.Builder
+	for _, child := range n.children {
+		writeXHTML(&out, child, base, false)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func writeXHTML(out *strings.Builder, n *htmlNode, base *url.URL, pre bool) {
+	if n.tag == "" {
+		text := n.text
+		if !pre {
+			text = collapseSpace(text)
+		}
+		out.WriteString(html.EscapeString(text))
+		return
+	}
+	if articleDropped[n.tag] || n.tag == "img" || n.tag == "picture" || n.tag == "video" || n.tag == "audio" {
+		return
+	}
+	tag := n.tag
+	if renamed, ok := xhtmlRenamed[tag]; ok {
+		tag = renamed
+	}
+	attrs, allowed := xhtmlAllowed[tag]
+	if !allowed {
+		for _, child := range n.children {
+			writeXHTML(out, child, base, pre)
+		}
+		return
+	}
+	if tag == "br" || tag == "hr" {
+		out.WriteString("<" + tag + "/>")
+		return
+	}
+
+	var inner strings.Builder
+	for _, child := range n.children {
+		writeXHTML(&inner, child, base, pre || tag == "pre")
+	}
+	content := inner.String()
+	if strings.TrimSpace(content) == "" && tag != "td" && tag != "th" {
+		return
+	}
+	out.WriteString("<" + tag)
+	for _, name := range attrs {
+		value := n.attr(name)
+		if name == "href" {
+			value = absoluteLink(value, base)
+		}
+		if value != "" {
+			out.WriteString(" " + name + `="` + html.EscapeString(value) + `"`)
+		}
+	}
+	out.WriteString(">" + content + "</" + tag + ">")
+	switch tag {
+	case "p", "div", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "li", "dl", "blockquote", "pre", "figure", "table", "tr":
+		out.WriteByte('\n')
+	}
+}
+
+// absoluteLink resolves href against base and returns it when it is an
+// http(s) or mailto link, otherwise nothing
+func absoluteLink(href string, base *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || strings.TrimSpace(href) == "" {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return u.String()
+	}
+	return ""
+}
+
+// collapseSpace replaces every run of white space with a single space
+func collapseSpace(s string) string {
+	var out strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+			if !space {
+				out.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// htmlToXHTML cleans an HTML fragment, such as the content of a feed item,
+// for an EPUB chapter
+func htmlToXHTML(fragment string, base *url.URL) string {
+	return renderXHTML(parseHTML([]byte(fragment)), base)
+}
+
+// textToXHTML renders plain text as paragraphs, one per blank line
+func textToXHTML(text string) string {
+	var out strings.Builder
+	for _, paragraph := range paragraphBreakRe.Split(strings.TrimSpace(text), -1) {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			out.WriteString("<p>" + html.EscapeString(collapseSpace(paragraph)) + "</p>\n")
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// readLimited reads at most limit bytes of r
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(r, limit))
+	return buf.Bytes(), err
+}
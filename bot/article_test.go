@@ -0,0 +1,96 @@
+package bot
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assertWellFormed fails when fragment is not well-formed XML
+func assertWellFormed(t *testing.T, fragment string) {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader("<body>" + fragment + "</body>"))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("not well-formed: %v\n%s", err, fragment)
+		}
+	}
+}
+
+func TestExtractArticle(t *testing.T) {
+	page, err := os.ReadFile(filepath.Join("testdata", "feeds", "article.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("http://blog.test/posts/short.html")
+	title, body := extractArticle(page, base)
+	if title != "Short & sweet" {
+		t.Errorf("title = %q, want %q", title, "Short & sweet")
+	}
+	assertWellFormed(t, body)
+	for _, want := range []string{
+		"<h2>Short &amp; sweet</h2>",
+		"This is the full text of the short post",
+		`<a href="http://blog.test/posts/first.html">link to the first post</a>`,
+		"and a<br/>line break",
+		"1 &lt; 2",
+		"©",
+		"<pre>  indented\n    code</pre>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"newsletter", "Home", "not content", "Share on", "<img", "color: red", "2026 Slow"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("body contains %q:\n%s", unwanted, body)
+		}
+	}
+}
+
+func TestHTMLToXHTML(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+	}{
+		{"formatting is kept", "<p>Hello <b>world</b></p>", "<p>Hello <b>world</b></p>"},
+		{"headings are demoted", "<h1>Title</h1>", "<h2>Title</h2>"},
+		{"attributes are dropped", `<div class="x" onclick="steal()">text</div>`, "<div>text</div>"},
+		{"relative links are resolved", `<a href="post">post</a>`, `<a href="https://example.com/blog/post">post</a>`},
+		{"script links are dropped", `<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"unknown elements are unwrapped", "<span>a</span> <font>b</font>", "a b"},
+		{"empty paragraphs are dropped", "<p></p><p> </p><p>x</p>", "<p>x</p>"},
+		{"white space collapses", "<p>a\n\n   b</p>", "<p>a b</p>"},
+		{"images are dropped", `<p>a<img src="cat.jpg">b</p>`, "<p>ab</p>"},
+		{"entities", "Fish &amp; chips &mdash; &copy;", "Fish &amp; chips — ©"},
+		{"unclosed void elements", "one<br>two<hr>", "one<br/>two<hr/>"},
+		{"scripts are removed", "<script>var a = '<p>';</script><p>text</p>", "<p>text</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := htmlToXHTML(tt.fragment, base)
+			if got != tt.want {
+				t.Errorf("htmlToXHTML(%q) = %q, want %q", tt.fragment, got, tt.want)
+			}
+			assertWellFormed(t, got)
+		})
+	}
+}
+
+func TestTextToXHTML(t *testing.T) {
+	got := textToXHTML("First <line>\nstill first.\n\n  \nSecond & last.\n")
+	want := "<p>First &lt;line&gt; still first.</p>\n<p>Second &amp; last.</p>"
+	if got != want {
+		t.Errorf("textToXHTML() = %q, want %q", got, want)
+	}
+}
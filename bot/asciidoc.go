@@ -0,0 +1,653 @@
+package bot
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	adocTitleRe       = regexp.MustCompile(`^=[ \t]+(.+?)[ \t]*$`)
+	adocSectionRe     = regexp.MustCompile(`^(={2,6})[ \t]+(.+?)(?:[ \t]+=+)?[ \t]*$`)
+	adocAttributeRe   = regexp.MustCompile(`^:(!?[\w][\w-]*?!?):(?:[ \t]+(.*?))?[ \t]*$`)
+	adocBlockAttrRe   = regexp.MustCompile(`^\[([^\[\]]*)\]$`)
+	adocAnchorRe      = regexp.MustCompile(`^\[\[[^\]]*\]\]$`)
+	adocBlockTitleRe  = regexp.MustCompile(`^\.([^.\s].*)$`)
+	adocDelimiterRe   = regexp.MustCompile(`^(-{4,}|\.{4,}|_{4,}|={4,}|\*{4,}|\+{4,}|/{4,}|--)[ \t]*$`)
+	adocListRe        = regexp.MustCompile(`^[ \t]*(\*{1,5}|-|\.{1,5}|\d+\.)[ \t]+(.*)$`)
+	adocDescriptionRe = regexp.MustCompile(`^(\S.*?)(:{2,4}|;;)(?:[ \t]+(.*))?$`)
+	adocCheckRe       = regexp.MustCompile(`^\[([ xX*])\][ \t]+`)
+	adocAdmonitionRe  = regexp.MustCompile(`^(NOTE|TIP|IMPORTANT|WARNING|CAUTION):[ \t]+(.*)$`)
+	adocTableRe       = regexp.MustCompile(`^\|={3,}[ \t]*$`)
+	adocCellSpecRe    = regexp.MustCompile(`^(?:\d+\*|\d*(?:\.\d+)?\+)?[<^>]?(?:\.[<^>])?[adehlmsv]?$`)
+	adocAttrRefRe     = regexp.MustCompile(`\{([\w][\w-]*)\}`)
+	adocAuthorEmailRe = regexp.MustCompile(`\s*<[^>]*>`)
+)
+
+// adocAdmonitions are the labels of the admonition styles
+var adocAdmonitions = map[string]string{
+	"NOTE":      "Note",
+	"TIP":       "Tip",
+	"IMPORTANT": "Important",
+	"WARNING":   "Warning",
+	"CAUTION":   "Caution",
+}
+
+// adocParser parses AsciiDoc documents
+type adocParser struct {
+	doc   *markupDocument
+	attrs map[string]string
+	rules []inlineRule
+}
+
+// parseAsciiDoc parses an AsciiDoc document, its header sets the metadata
+// of the book
+func parseAsciiDoc(content string) *markupDocument {
+	p := &adocParser{doc: newMarkupDocument(), attrs: map[string]string{
+		"nbsp": " ", "sp": " ", "empty": "", "amp": "&", "lt": "<", "gt": ">",
+		"startsb": "[", "endsb": "]", "vbar": "|", "plus": "+", "apos": "'", "quot": `"`,
+	}}
+	p.rules = p.inlineRules()
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	p.doc.Blocks = p.blocks(p.header(lines), true)
+	return p.doc
+}
+
+// header reads the document title, author line and attributes and returns
+// the lines after them
+func (p *adocParser) header(lines []string) []string {
+	i := 0
+	for i < len(lines) && (isBlank(lines[i]) || strings.HasPrefix(lines[i], "//")) {
+		i++
+	}
+	if i == len(lines) || !adocTitleRe.MatchString(lines[i]) {
+		return lines[i:]
+	}
+	p.doc.Title = markupText(p.inline(adocTitleRe.FindStringSubmatch(lines[i])[1]))
+	for i++; i < len(lines) && !isBlank(lines[i]); i++ {
+		switch {
+		case strings.HasPrefix(lines[i], "//"):
+		case adocAttributeRe.MatchString(lines[i]):
+			p.attribute(lines[i])
+		case len(p.doc.Authors) == 0 && !strings.HasPrefix(lines[i], ":"):
+			for _, author := range strings.Split(lines[i], ";") {
+				if author = strings.TrimSpace(adocAuthorEmailRe.ReplaceAllString(author, "")); author != "" {
+					p.doc.Authors = append(p.doc.Authors, author)
+				}
+			}
+		}
+	}
+	return lines[i:]
+}
+
+// attribute sets or unsets (":name!:") a document attribute
+func (p *adocParser) attribute(line string) {
+	m := adocAttributeRe.FindStringSubmatch(line)
+	name := m[1]
+	if strings.HasPrefix(name, "!") || strings.HasSuffix(name, "!") {
+		delete(p.attrs, strings.Trim(name, "!"))
+		return
+	}
+	p.attrs[name] = p.substitute(m[2])
+	switch name {
+	case "author":
+		p.doc.Authors = []string{p.attrs[name]}
+	case "lang":
+		p.doc.Language = p.attrs[name]
+	case "doctitle":
+		p.doc.Title = p.attrs[name]
+	}
+}
+
+// substitute replaces references to defined attributes in text
+func (p *adocParser) substitute(text string) string {
+	return adocAttrRefRe.ReplaceAllStringFunc(text, func(ref string) string {
+		if value, ok := p.attrs[ref[1:len(ref)-1]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// inlineRules returns the rules of the inline markup, footnotes need the
+// parser
+func (p *adocParser) inlineRules() []inlineRule {
+	wrap := func(tag string) func([]string) string {
+		return func(g []string) string { return "<" + tag + ">" + p.inline(g[2]) + "</" + tag + ">" }
+	}
+	code := func(g []string) string {
+		text := g[2]
+		if len(text) > 1 && strings.HasPrefix(text, "+") && strings.HasSuffix(text, "+") {
+			text = text[1 : len(text)-1]
+		}
+		return "<code>" + html.EscapeString(text) + "</code>"
+	}
+	constrained := func(marker string) *regexp.Regexp {
+		m := regexp.QuoteMeta(marker)
+		return regexp.MustCompile(`(^|[^\w;:}` + m + `])` + m + `(\S|\S.*?\S)` + m + `([^\w` + m + `]|$)`)
+	}
+	return []inlineRule{
+		{re: regexp.MustCompile(`()\+\+\+(.+?)\+\+\+()`), render: func(g []string) string { return html.EscapeString(g[2]) }},
+		{re: regexp.MustCompile(`(^|\W)\+(\S|\S.*?\S)\+(\W|$)`), render: func(g []string) string { return html.EscapeString(g[2]) }},
+		{re: regexp.MustCompile("()``(.+?)``()"), render: code},
+		{re: constrained("`"), render: code},
+		{re: regexp.MustCompile(`()footnote:([\w-]*)\[((?:[^\]\\]|\\.)*)\]()`), render: p.footnote},
+		{re: regexp.MustCompile(`()(?:link:)?((?:https?|mailto):[^\s\[]+)\[([^\]]*)\]()`), render: func(g []string) string {
+			text := html.EscapeString(g[2])
+			if g[3] != "" {
+				text = p.inline(g[3])
+			}
+			return markupLink(g[2], text)
+		}},
+		{re: regexp.MustCompile(`()link:([^\s\[]+)\[([^\]]*)\]()`), render: func(g []string) string {
+			if g[3] == "" {
+				return html.EscapeString(g[2])
+			}
+			return p.inline(g[3])
+		}},
+		{re: regexp.MustCompile(`()image::?([^\s\[]+)\[([^\],]*)[^\]]*\]()`), render: func(g []string) string {
+			if g[3] == "" {
+				return ""
+			}
+			return "<em>" + html.EscapeString(g[3]) + "</em>"
+		}},
+		{re: regexp.MustCompile(`()<<([^,>]+)(?:,[ \t]*([^>]+))?>>()`), render: func(g []string) string {
+			if g[3] != "" {
+				return p.inline(g[3])
+			}
+			return html.EscapeString(g[2])
+		}},
+		{re: regexp.MustCompile(`()[ \t]\+[ \t]*()(\n|$)`), render: func([]string) string { return "<br/>" }},
+		bareURLRule,
+		{re: regexp.MustCompile(`()\*\*(.+?)\*\*()`), render: wrap("strong")},
+		{re: regexp.MustCompile(`()__(.+?)__()`), render: wrap("em")},
+		{re: regexp.MustCompile(`()##(.+?)##()`), render: wrap("mark")},
+		{re: constrained("*"), render: wrap("strong")},
+		{re: constrained("_"), render: wrap("em")},
+		{re: constrained("#"), render: wrap("mark")},
+		{re: regexp.MustCompile(`()\^(\S+?)\^()`), render: wrap("sup")},
+		{re: regexp.MustCompile(`()~(\S+?)~()`), render: wrap("sub")},
+	}
+}
+
+// footnote renders footnote:[text], footnote:id[text] and footnote:id[]
+// referencing a footnote with an id again
+func (p *adocParser) footnote(g []string) string {
+	id, text := g[2], strings.ReplaceAll(g[3], `\]`, "]")
+	if text == "" {
+		if _, ok := p.doc.notes.numbers[id]; id == "" || !ok {
+			return ""
+		}
+		return p.doc.notes.ref(id)
+	}
+	content := "<p>" + p.inline(text) + "</p>"
+	if id == "" {
+		return p.doc.notes.inline(content)
+	}
+	p.doc.notes.define(id, content)
+	return p.doc.notes.ref(id)
+}
+
+func (p *adocParser) inline(text string) string {
+	return strings.TrimSpace(renderInline(p.substitute(text), p.rules, html.EscapeString))
+}
+
+// adocAttrs are the attributes of a block: "[source,go]" has the
+// positional attributes source and go
+type adocAttrs struct {
+	positional []string
+	named      map[string]string
+	options    map[string]bool
+}
+
+func parseAdocAttrs(list string) adocAttrs {
+	attrs := adocAttrs{named: make(map[string]string), options: make(map[string]bool)}
+	for i, attr := range splitAdocAttrs(list) {
+		attr = strings.TrimSpace(attr)
+		if name := strings.Index(attr, "="); name > 0 {
+			value := strings.Trim(strings.TrimSpace(attr[name+1:]), `"`)
+			attrs.named[strings.TrimSpace(attr[:name])] = value
+			if strings.TrimSpace(attr[:name]) == "options" || strings.TrimSpace(attr[:name]) == "opts" {
+				for _, option := range strings.Split(value, ",") {
+					attrs.options[strings.TrimSpace(option)] = true
+				}
+			}
+			continue
+		}
+		if i == 0 {
+			// The first attribute can carry %options and #id or .role shorthands
+			parts := strings.Split(attr, "%")
+			for _, option := range parts[1:] {
+				attrs.options[option] = true
+			}
+			attr = parts[0]
+			if cut := strings.IndexAny(attr, "#."); cut >= 0 {
+				attr = attr[:cut]
+			}
+		}
+		attrs.positional = append(attrs.positional, strings.Trim(attr, `"`))
+	}
+	return attrs
+}
+
+// splitAdocAttrs splits an attribute list at the commas outside quotes
+func splitAdocAttrs(list string) []string {
+	var attrs []string
+	quoted := false
+	start := 0
+	for i, c := range list {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			attrs = append(attrs, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(attrs, list[start:])
+}
+
+// style returns the first positional attribute
+func (a adocAttrs) style() string {
+	if len(a.positional) == 0 {
+		return ""
+	}
+	return a.positional[0]
+}
+
+func (a adocAttrs) at(i int) string {
+	if i >= len(a.positional) {
+		return ""
+	}
+	return a.positional[i]
+}
+
+// startsBlock reports whether line ends a paragraph
+func (p *adocParser) startsBlock(line string) bool {
+	return adocSectionRe.MatchString(line) || adocDelimiterRe.MatchString(line) || adocTableRe.MatchString(line) ||
+		adocBlockAttrRe.MatchString(line) || adocListRe.MatchString(line) || adocAttributeRe.MatchString(line) ||
+		(strings.HasPrefix(line, "//") && !strings.HasPrefix(line, "///"))
+}
+
+// blocks parses lines to sections and blocks, sections only at the top
+// level of the document
+func (p *adocParser) blocks(lines []string, top bool) []markupBlock {
+	var blocks []markupBlock
+	var attrs adocAttrs
+	title := ""
+	add := func(xhtml string) {
+		if xhtml != "" && title != "" {
+			xhtml = `<p class="title">` + p.inline(title) + "</p>\n" + xhtml
+		}
+		if xhtml != "" {
+			blocks = append(blocks, markupBlock{HTML: xhtml, Notes: p.doc.notes.take()})
+		}
+		attrs, title = adocAttrs{}, ""
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case adocDelimiterRe.MatchString(line):
+			delimiter := strings.TrimSpace(line)
+			var body []string
+			for i++; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) == delimiter {
+					i++
+					break
+				}
+				body = append(body, lines[i])
+			}
+			add(p.delimited(delimiter, attrs, body))
+		case strings.HasPrefix(line, "//"):
+			i++
+		case adocAttributeRe.MatchString(line):
+			p.attribute(line)
+			i++
+		case adocAnchorRe.MatchString(line):
+			i++
+		case adocBlockAttrRe.MatchString(line):
+			attrs = parseAdocAttrs(adocBlockAttrRe.FindStringSubmatch(line)[1])
+			i++
+		case adocBlockTitleRe.MatchString(line):
+			title = adocBlockTitleRe.FindStringSubmatch(line)[1]
+			i++
+		case adocSectionRe.MatchString(line):
+			m := adocSectionRe.FindStringSubmatch(line)
+			if top {
+				xhtml := p.inline(m[2])
+				blocks = append(blocks, markupBlock{Heading: len(m[1]) - 1, HTML: xhtml, Notes: p.doc.notes.take()})
+				attrs, title = adocAttrs{}, ""
+			} else {
+				add(`<p class="title">` + p.inline(m[2]) + "</p>")
+			}
+			i++
+		case adocTableRe.MatchString(line):
+			var rows []string
+			for i++; i < len(lines) && !adocTableRe.MatchString(lines[i]); i++ {
+				rows = append(rows, lines[i])
+			}
+			i++
+			add(p.table(rows, attrs))
+		case strings.TrimSpace(line) == "'''":
+			add("<hr/>")
+			i++
+		case strings.TrimSpace(line) == "<<<":
+			i++
+		case adocListRe.MatchString(line) || adocDescriptionRe.MatchString(line):
+			var list string
+			list, i = p.list(lines, i)
+			add(list)
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			var literal []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				literal = append(literal, lines[i])
+			}
+			add(markupCode(strings.Join(trimCommonIndent(literal), "\n"), ""))
+		default:
+			paragraph := []string{strings.TrimSpace(line)}
+			for i++; i < len(lines) && !isBlank(lines[i]) && !p.startsBlock(lines[i]); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			add(p.paragraph(paragraph, attrs))
+		}
+	}
+	return blocks
+}
+
+// render renders lines nested in a list or block
+func (p *adocParser) render(lines []string) string {
+	var out []string
+	for _, block := range p.blocks(lines, false) {
+		out = append(out, block.HTML)
+		// The footnotes belong to the block rendering these lines
+		p.doc.notes.pending = append(p.doc.notes.pending, block.Notes...)
+	}
+	return strings.Join(out, "\n")
+}
+
+// paragraph renders the lines of a paragraph in the style of its attributes
+func (p *adocParser) paragraph(lines []string, attrs adocAttrs) string {
+	text := strings.Join(lines, "\n")
+	style := attrs.style()
+	if m := adocAdmonitionRe.FindStringSubmatch(text); m != nil && style == "" {
+		style, text = m[1], m[2]
+	}
+	switch style {
+	case "source", "listing", "literal":
+		return markupCode(text, attrs.at(1))
+	case "quote":
+		return "<blockquote>\n<p>" + p.inline(text) + "</p>" + p.attribution(attrs) + "\n</blockquote>"
+	case "verse":
+		return p.verse(lines, attrs)
+	case "pass":
+		return htmlToXHTML(text, nil)
+	case "comment":
+		return ""
+	}
+	if label, ok := adocAdmonitions[style]; ok {
+		return p.admonition(label, "<p>"+p.inline(text)+"</p>")
+	}
+	return "<p>" + p.inline(text) + "</p>"
+}
+
+// delimited renders a delimited block by its delimiter and attributes
+func (p *adocParser) delimited(delimiter string, attrs adocAttrs, body []string) string {
+	style := attrs.style()
+	if label, ok := adocAdmonitions[style]; ok {
+		return p.admonition(label, p.render(body))
+	}
+	switch {
+	case strings.HasPrefix(delimiter, "////"):
+		return ""
+	case strings.HasPrefix(delimiter, "----"), strings.HasPrefix(delimiter, "...."), style == "source", style == "listing":
+		return markupCode(strings.Join(body, "\n"), attrs.at(1))
+	case strings.HasPrefix(delimiter, "++++"):
+		return htmlToXHTML(strings.Join(body, "\n"), nil)
+	case style == "verse":
+		return p.verse(body, attrs)
+	case strings.HasPrefix(delimiter, "____"), style == "quote":
+		return "<blockquote>\n" + p.render(body) + p.attribution(attrs) + "\n</blockquote>"
+	case strings.HasPrefix(delimiter, "===="):
+		return "<div class=\"example\">\n" + p.render(body) + "\n</div>"
+	case strings.HasPrefix(delimiter, "****"):
+		return "<div class=\"sidebar\">\n" + p.render(body) + "\n</div>"
+	}
+	return "<div>\n" + p.render(body) + "\n</div>"
+}
+
+func (p *adocParser) admonition(label, body string) string {
+	return "<div class=\"admonition\">\n<p class=\"title\">" + label + "</p>\n" + body + "\n</div>"
+}
+
+func (p *adocParser) verse(lines []string, attrs adocAttrs) string {
+	var verse []string
+	for _, line := range lines {
+		verse = append(verse, line[:indentation(line)]+p.inline(line))
+	}
+	return `<p class="verse">` + strings.Join(verse, "<br/>\n") + "</p>" + p.attribution(attrs)
+}
+
+// attribution renders the author and source of a quote or verse
+func (p *adocParser) attribution(attrs adocAttrs) string {
+	var by []string
+	for _, part := range []string{attrs.at(1), attrs.at(2)} {
+		if part = strings.TrimSpace(part); part != "" {
+			by = append(by, p.inline(part))
+		}
+	}
+	if len(by) == 0 {
+		return ""
+	}
+	return "\n<p class=\"attribution\">— " + strings.Join(by, ", ") + "</p>"
+}
+
+// table renders the lines between the |=== delimiters. The columns are
+// counted from the cols attribute or the first line, the first row is the
+// header with the header option or when a blank line follows it
+func (p *adocParser) table(lines []string, attrs adocAttrs) string {
+	columns := 0
+	if cols := attrs.named["cols"]; cols != "" {
+		columns = len(strings.Split(cols, ","))
+		// "3*" repeats one column specification three times
+		if n, err := strconv.Atoi(strings.TrimSuffix(cols, "*")); err == nil && strings.HasSuffix(cols, "*") {
+			columns = n
+		}
+	}
+	var cells []string
+	header := attrs.options["header"]
+	for i, line := range lines {
+		if isBlank(line) {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "|") && len(cells) > 0 {
+			// The text continues the previous cell
+			cells[len(cells)-1] += "\n" + trimmed
+			continue
+		}
+		parts := strings.Split(trimmed, "|")[1:]
+		for j, part := range parts {
+			// A cell specifier such as "2+" right before the pipe belongs to the next cell
+			fields := strings.Fields(part)
+			if j < len(parts)-1 && len(fields) > 0 && !strings.HasSuffix(part, " ") &&
+				adocCellSpecRe.MatchString(fields[len(fields)-1]) {
+				part = strings.TrimSuffix(part, fields[len(fields)-1])
+			}
+			cells = append(cells, strings.TrimSpace(part))
+		}
+		if columns == 0 {
+			columns = len(parts)
+			if i+1 < len(lines) && isBlank(lines[i+1]) && !attrs.options["noheader"] {
+				header = true
+			}
+		}
+	}
+	if columns == 0 {
+		return ""
+	}
+	var rows [][]string
+	for start := 0; start < len(cells); start += columns {
+		var row []string
+		for j := start; j < start+columns; j++ {
+			cell := ""
+			if j < len(cells) {
+				cell = p.inline(cells[j])
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	headerRows := 0
+	if header && len(rows) > 0 {
+		headerRows = 1
+	}
+	return markupTable(rows, headerRows, nil)
+}
+
+// adocItem is a list item before the list is nested
+type adocItem struct {
+	marker string // "*", "..", "::" and so on, numbers are "1."
+	term   string // of a description list
+	text   []string
+	blocks []string // lines of blocks attached with "+"
+}
+
+// list renders the list starting at lines[i] and returns the index after it
+func (p *adocParser) list(lines []string, i int) (string, int) {
+	var items []adocItem
+	for i < len(lines) {
+		line := lines[i]
+		if isBlank(line) {
+			// A blank line ends the list unless another item follows
+			j := i
+			for j < len(lines) && isBlank(lines[j]) {
+				j++
+			}
+			if j == len(lines) || !(adocListRe.MatchString(lines[j]) || adocDescriptionRe.MatchString(lines[j])) {
+				break
+			}
+			i = j
+			continue
+		}
+		var item adocItem
+		if m := adocListRe.FindStringSubmatch(line); m != nil {
+			item = adocItem{marker: m[1], text: []string{m[2]}}
+			if m[1][0] >= '0' && m[1][0] <= '9' {
+				item.marker = "1."
+			}
+		} else if m := adocDescriptionRe.FindStringSubmatch(line); m != nil {
+			item = adocItem{marker: m[2], term: m[1]}
+			if m[3] != "" {
+				item.text = []string{m[3]}
+			}
+		} else {
+			break
+		}
+		for i++; i < len(lines); i++ {
+			next := lines[i]
+			if strings.TrimSpace(next) == "+" {
+				var block []string
+				i, block = p.attached(lines, i+1)
+				item.blocks = append(item.blocks, block...)
+				item.blocks = append(item.blocks, "")
+				i--
+				continue
+			}
+			if isBlank(next) || adocListRe.MatchString(next) || adocDescriptionRe.MatchString(next) || p.startsBlock(next) {
+				break
+			}
+			item.text = append(item.text, strings.TrimSpace(next))
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		// A line looking like a list item in text
+		return "<p>" + p.inline(lines[i]) + "</p>", i + 1
+	}
+	var out []string
+	for j := 0; j < len(items); {
+		var list string
+		list, j = p.renderList(items, j, nil)
+		out = append(out, list)
+	}
+	return strings.Join(out, "\n"), i
+}
+
+// attached returns the lines of the block starting at lines[i] attached to
+// a list item, and the index after it
+func (p *adocParser) attached(lines []string, i int) (int, []string) {
+	var block []string
+	for i < len(lines) && (adocBlockAttrRe.MatchString(lines[i]) || adocBlockTitleRe.MatchString(lines[i])) {
+		block = append(block, lines[i])
+		i++
+	}
+	if i < len(lines) && adocDelimiterRe.MatchString(lines[i]) {
+		delimiter := strings.TrimSpace(lines[i])
+		block = append(block, lines[i])
+		for i++; i < len(lines); i++ {
+			block = append(block, lines[i])
+			if strings.TrimSpace(lines[i]) == delimiter {
+				return i + 1, block
+			}
+		}
+		return i, block
+	}
+	for ; i < len(lines) && !isBlank(lines[i]) && strings.TrimSpace(lines[i]) != "+" &&
+		!adocListRe.MatchString(lines[i]); i++ {
+		block = append(block, lines[i])
+	}
+	return i, block
+}
+
+// renderList renders the items with the marker of items[i] and the lists
+// nested in them, parents are the markers of the enclosing lists
+func (p *adocParser) renderList(items []adocItem, i int, parents []string) (string, int) {
+	marker := items[i].marker
+	tag := "ul"
+	switch {
+	case strings.HasPrefix(marker, ".") || marker == "1.":
+		tag = "ol"
+	case strings.HasPrefix(marker, ":") || marker == ";;":
+		tag = "dl"
+	}
+	var out []string
+	for i < len(items) && items[i].marker == marker {
+		item := items[i]
+		text := strings.Join(item.text, "\n")
+		box := ""
+		if m := adocCheckRe.FindStringSubmatch(text); m != nil && tag == "ul" {
+			box = "☐ "
+			if m[1] != " " {
+				box = "☑ "
+			}
+			text = text[len(m[0]):]
+		}
+		content := box + p.inline(text)
+		if len(item.blocks) > 0 {
+			content += "\n" + p.render(item.blocks)
+		}
+		for i++; i < len(items) && items[i].marker != marker && !containsString(parents, items[i].marker); {
+			var nested string
+			nested, i = p.renderList(items, i, append(parents, marker))
+			content += "\n" + nested
+		}
+		if tag == "dl" {
+			out = append(out, "<dt>"+p.inline(item.term)+"</dt>\n<dd>"+content+"</dd>")
+		} else {
+			out = append(out, "<li>"+content+"</li>")
+		}
+	}
+	return "<" + tag + ">\n" + strings.Join(out, "\n") + "\n</" + tag + ">", i
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
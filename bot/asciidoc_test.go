@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAsciiDoc(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "sections",
+			content: "Preamble.\n\n== One ==\n\n=== Two\n\n==== Three\n\n==Not a section",
+			want:    "<p>Preamble.</p>\n# One\n## Two\n### Three\n<p>==Not a section</p>",
+		},
+		{
+			name:    "inline markup",
+			content: ":product: Widget\n\n*bold* _em_ `x < y` `+{literal}+` #mark# **un**constrained ^sup^ ~sub~ {product} {unknown} a*b*c",
+			want:    "<p><strong>bold</strong> <em>em</em> <code>x &lt; y</code> <code>{literal}</code> <mark>mark</mark> <strong>un</strong>constrained <sup>sup</sup> <sub>sub</sub> Widget {unknown} a*b*c</p>",
+		},
+		{
+			name:    "links",
+			content: "https://asciidoctor.org[The *site*] link:https://go.dev[] link:other.adoc[Other] <<intro,Introduction>> image:pic.png[A picture]\nHard +\nbreak",
+			want:    `<p><a href="https://asciidoctor.org">The <strong>site</strong></a> <a href="https://go.dev">https://go.dev</a> Other Introduction <em>A picture</em>` + "\nHard<br/>\nbreak</p>",
+		},
+		{
+			name:    "lists",
+			content: "* one\n** nested\n* [x] done\n+\nAttached paragraph.\n\n//\n. first\n. second\n\n//\nCPU:: The brain\nRAM::\nMemory",
+			want: "<ul>\n<li>one\n<ul>\n<li>nested</li>\n</ul></li>\n<li>☑ done\n<p>Attached paragraph.</p></li>\n</ul>\n<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n" +
+				"<dl>\n<dt>CPU</dt>\n<dd>The brain</dd>\n<dt>RAM</dt>\n<dd>Memory</dd>\n</dl>",
+		},
+		{
+			name:    "delimited blocks",
+			content: ".Hello\n[source,go]\n----\nif a < b {}\n----\n\n[quote, Albert Einstein]\n____\nImagination.\n____\n\n[WARNING]\n====\nCareful.\n====\n\n****\nAside.\n****\n\n////\nHidden.\n////\n\n....\nliteral\n....",
+			want: "<p class=\"title\">Hello</p>\n<pre><code class=\"language-go\">if a &lt; b {}</code></pre>\n" +
+				"<blockquote>\n<p>Imagination.</p>\n<p class=\"attribution\">— Albert Einstein</p>\n</blockquote>\n" +
+				"<div class=\"admonition\">\n<p class=\"title\">Warning</p>\n<p>Careful.</p>\n</div>\n" +
+				"<div class=\"sidebar\">\n<p>Aside.</p>\n</div>\n<pre><code>literal</code></pre>",
+		},
+		{
+			name:    "paragraph styles",
+			content: "NOTE: Remember.\n\n[verse, Poet]\nRoses are red\nViolets\n\n  indented literal\n\n'''\n\n// comment\n[source]\nx := 1",
+			want: "<div class=\"admonition\">\n<p class=\"title\">Note</p>\n<p>Remember.</p>\n</div>\n" +
+				"<p class=\"verse\">Roses are red<br/>\nViolets</p>\n<p class=\"attribution\">— Poet</p>\n" +
+				"<pre><code>indented literal</code></pre>\n<hr/>\n<pre><code>x := 1</code></pre>",
+		},
+		{
+			name:    "tables",
+			content: "[cols=\"1,1\", options=\"header\"]\n|===\n|Name |Value\n|a |1\n|===\n\n|===\n|H1 |H2\n\n|c1\n|c2\n|===",
+			want: "<table>\n<thead>\n<tr><th>Name</th><th>Value</th></tr>\n</thead>\n<tbody>\n<tr><td>a</td><td>1</td></tr>\n</tbody>\n</table>\n" +
+				"<table>\n<thead>\n<tr><th>H1</th><th>H2</th></tr>\n</thead>\n<tbody>\n<tr><td>c1</td><td>c2</td></tr>\n</tbody>\n</table>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markupBlocks(parseAsciiDoc(tt.content)); got != tt.want {
+				t.Errorf("parseAsciiDoc() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAsciiDoc_headerAndFootnotes(t *testing.T) {
+	doc := parseAsciiDoc("// leading comment\n= The *Guide*\nJane Doe <jane@example.com>; John Roe\n:lang: fr\n\nText footnote:[A *note*.] and footnote:disc[Shared.] again footnote:disc[] and footnote:nope[].\n")
+	if doc.Title != "The Guide" || strings.Join(doc.Authors, ",") != "Jane Doe,John Roe" || doc.Language != "fr" {
+		t.Errorf("parseAsciiDoc() header = %q, %q, %q", doc.Title, doc.Authors, doc.Language)
+	}
+	want := `<p>Text <a epub:type="noteref" href="#fn-1"><sup>1</sup></a> and <a epub:type="noteref" href="#fn-2"><sup>2</sup></a> ` +
+		`again <a epub:type="noteref" href="#fn-2"><sup>2</sup></a> and .</p>`
+	if got := markupBlocks(doc); got != want {
+		t.Errorf("parseAsciiDoc() =\n%s\nwant\n%s", got, want)
+	}
+	if len(doc.Blocks) != 1 || len(doc.Blocks[0].Notes) != 3 {
+		t.Errorf("parseAsciiDoc() notes = %+v", doc.Blocks)
+	}
+	if doc.notes.bodies[1] != "<p>A <strong>note</strong>.</p>" || doc.notes.bodies[2] != "<p>Shared.</p>" {
+		t.Errorf("footnotes = %q", doc.notes.bodies)
+	}
+}
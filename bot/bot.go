@@ -1,29 +1,34 @@
 package bot
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
 	"github.com/scorredoira/email"
 	tb "gopkg.in/tucnak/telebot.v2"
-	"log"
+	"net"
 	"net/mail"
 	"net/smtp"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
-	defaultSMTPPort       = "587"
-	defaultTmpFilesPath   = "/files/"
-	buttonsPerRow         = 2
-	callbackDataPrefix    = "send_kindle:"
-	maxFileNameLength     = 255
-	maxDeviceNameLength   = 100
+	defaultSMTPPort     = "587"
+	smtpsPort           = "465" // implicit TLS, without STARTTLS
+	defaultTmpFilesPath = "/files/"
+	buttonsPerRow       = 2
+	callbackDataPrefix  = "send_kindle:"
+	defaultDeviceName   = "default" // the single device configured with EmailTo
+	maxFileNameLength   = 255
+	maxDeviceNameLength = 100
 )
 
 var (
@@ -42,6 +47,11 @@ var (
 	// ErrInvalidFileName - represents an error for invalid filename
 	ErrInvalidFileName = errors.New("invalid filename")
 
+	// ErrUnknownSMTPProfile - represents a device referring to an SMTP profile that does not exist
+	ErrUnknownSMTPProfile = errors.New("unknown smtp profile")
+	// ErrInvalidSMTPProfile - represents an SMTP profile missing host, sender or password
+	ErrInvalidSMTPProfile = errors.New("smtp profile requires host, from and password")
+
 	errConversion = errors.New("could not convert file")
 	// FIXED: Changed from MOBI to EPUB as Amazon discontinued MOBI support in Send to Kindle service
 	// EPUB is the recommended format for modern Kindle devices (including Paperwhite 2024)
@@ -50,18 +60,65 @@ var (
 
 // SendToKindleBot stores bot configuration
 type SendToKindleBot struct {
-	Token          string
-	EmailFrom      string
-	EmailTo        string            // Single device (fallback)
-	KindleDevices  map[string]string // Multiple devices: name -> email
-	SMTPHost       string
-	SMTPPort       string
-	Password       string
-	SMTPInsecure   bool
-	bot            *tb.Bot
-	fileStateCache map[int]map[string]string // userID -> {filePath, originalFileName}
-	cacheMutex     sync.RWMutex              // FIXED: Added mutex for thread-safe access
-	tmpFilesPath   string                    // FIXED: Made configurable
+	Token             string
+	EmailFrom         string
+	EmailTo           string                     // Single device (fallback)
+	KindleDevices     map[string]string          // Multiple devices: name -> email
+	DeviceTransports  map[string]TransportConfig // devices books are copied or uploaded to instead of mailed
+	SMTPHost          string
+	SMTPPort          string
+	Password          string
+	SMTPInsecure      bool
+	UpdateMode        string                 // polling (default) or webhook
+	WebhookURL        string                 // public URL Telegram posts updates to
+	WebhookListen     string                 // local listen address for the webhook server
+	WebhookSecret     string                 // secret token verified on every webhook request
+	WebhookCert       string                 // optional self-signed certificate uploaded to Telegram
+	WebhookKey        string                 // private key for WebhookCert
+	TelegramAPIURL    string                 // custom Bot API server, empty for api.telegram.org
+	TelegramAPILocal  bool                   // Bot API server runs with --local: large files, local file paths
+	ShutdownTimeout   time.Duration          // how long running jobs may finish on SIGTERM/SIGINT
+	PendingTTL        time.Duration          // how long a file waits for a device to be selected
+	MaxFileSize       int64                  // optional file size limit in bytes, below the Bot API limit
+	SMTPProfiles      map[string]SMTPProfile // named SMTP accounts, used instead of the default one by DeviceProfiles
+	DeviceProfiles    map[string]string      // device name -> SMTP profile name
+	AllowedUsers      []int                  // Telegram user IDs allowed to use the bot, empty allows everyone
+	AdminUsers        []int                  // Telegram user IDs with admin rights, always allowed
+	Converters        []ConverterConfig      // conversion backends, ebook-convert handles everything by default
+	MetricsListen     string                 // address of /metrics, /healthz and /readyz, empty to disable them
+	MinFreeSpace      int64                  // free space the temporary directory needs to be ready
+	SMTPCheckInterval time.Duration          // how long an SMTP readiness check result is reused
+	DryRunFormat      string                 // maildir (default), mbox or eml
+	DryRunPath        string                 // write emails here instead of sending them, empty to send
+	LibraryPath       string                 // keep delivered books here, <tmp>/library when OPDS is on
+	LibraryMaxAge     time.Duration          // how long books are kept, 0 forever
+	OPDSListen        string                 // address of the OPDS catalog, empty to disable it
+	OPDSURL           string                 // public catalog URL shown by /opds
+	CalibreLibrary    string                 // Calibre library searched by /find, empty to disable it
+	CalibreServer     TransportConfig        // Calibre content server every delivered book is added to, empty URL to disable
+	VocabularyFormat  string                 // Anki export of vocab.db uploads: tsv (default) or csv
+	bot               *tb.Bot
+	fileStateCache    map[int]map[string]string // userID -> {filePath, originalFileName}
+	cacheMutex        sync.RWMutex              // FIXED: Added mutex for thread-safe access
+	tmpFilesPath      string                    // FIXED: Made configurable
+	jobs              *jobTracker               // running jobs, drained on shutdown
+	converters        *converterRegistry
+	metrics           *metrics
+	health            *healthChecks
+	pollerHealth      *pollerHealth
+	users             *userStore // known users, access requests and delivery statistics
+	library           *library   // delivered books for the OPDS catalog, nil when disabled
+	calibre           *calibreLibrary
+	clippings         *clippingStore // imported Kindle highlights, notes and bookmarks
+	vocabulary        *vocabularyStore
+	feeds             *feedStore // RSS/Atom subscriptions sent as digests
+	scheduled         *scheduledStore
+	queue             *queueStore // reading queues sent as one book by /sendqueue
+	stopOnce          sync.Once
+	stopped           chan struct{}    // closed when Stop has finished
+	settings          *settings        // reloadable settings, see Reload
+	settingsMutex     sync.RWMutex     // guards settings, loaded, bot and WebhookSecret after Start
+	loaded            *SendToKindleBot // configuration of the last Reload, nil before the first one
 }
 
 // Start starts bot. It is blocking.
@@ -76,140 +133,391 @@ func (b *SendToKindleBot) Start() error {
 		b.tmpFilesPath = defaultTmpFilesPath
 	}
 
-	log.Println("[INFO] Starting Send-to-Kindle bot...")
-	log.Printf("[INFO] Using SMTP: %s:%s\n", b.SMTPHost, b.SMTPPort)
-	log.Printf("[INFO] Using temporary files path: %s\n", b.tmpFilesPath)
+	logging.Info("Starting Send-to-Kindle bot",
+		"smtp", b.SMTPHost+":"+b.SMTPPort, "tmp_files_path", b.tmpFilesPath)
+
+	if b.DryRunPath != "" {
+		logging.Warn("Dry run mode is enabled - emails are written to disk, not sent",
+			"format", b.DryRunFormat, "path", b.DryRunPath)
+	}
 
 	// FIXED: Warn if insecure TLS is enabled
 	if b.SMTPInsecure {
-		log.Println("[WARN] SMTP insecure mode is enabled - TLS certificate verification is disabled!")
+		logging.Warn("SMTP insecure mode is enabled - TLS certificate verification is disabled!")
 	}
 
 	// Initialize file state cache
 	b.fileStateCache = make(map[int]map[string]string)
+	b.jobs = newJobTracker()
+	b.stopped = make(chan struct{})
+	b.metrics = newMetrics()
+	b.health = newHealthChecks()
+	users, err := loadUserStore(filepath.Join(b.tmpFilesPath, usersFileName), time.Now())
+	if err != nil {
+		logging.Error("Could not load users, starting with an empty list", "err", err)
+	}
+	b.users = users
+	clippings, err := loadClippingStore(filepath.Join(b.tmpFilesPath, clippingsFileName))
+	if err != nil {
+		logging.Error("Could not load clippings, starting without them", "err", err)
+	}
+	b.clippings = clippings
+	vocabulary, err := loadVocabularyStore(filepath.Join(b.tmpFilesPath, vocabularyFileName))
+	if err != nil {
+		logging.Error("Could not load exported vocabulary, starting without it", "err", err)
+	}
+	b.vocabulary = vocabulary
+	feeds, err := loadFeedStore(filepath.Join(b.tmpFilesPath, feedsFileName))
+	if err != nil {
+		logging.Error("Could not load feed subscriptions, starting without them", "err", err)
+	}
+	b.feeds = feeds
+	scheduled, err := loadScheduledStore(filepath.Join(b.tmpFilesPath, scheduledFileName))
+	if err != nil {
+		logging.Error("Could not load scheduled deliveries, starting without them", "err", err)
+	}
+	b.scheduled = scheduled
+	queue, err := loadQueueStore(filepath.Join(b.tmpFilesPath, queueFileName), filepath.Join(b.tmpFilesPath, queueDir))
+	if err != nil {
+		logging.Error("Could not load reading queues, starting without them", "err", err)
+	}
+	b.queue = queue
+	if dir := b.libraryPath(); dir != "" {
+		if err := ensureDirectory(dir); err != nil {
+			return fmt.Errorf("could not create library: %w", err)
+		}
+		b.library, err = openLibrary(dir, b.LibraryMaxAge)
+		if err != nil {
+			logging.Error("Could not read the library index, starting with an empty library", "err", err)
+		}
+	}
 
 	// Log available Kindle devices
 	if len(b.KindleDevices) > 0 {
-		log.Printf("[INFO] Available Kindle devices: %d\n", len(b.KindleDevices))
+		logging.Info("Available Kindle devices", "count", len(b.KindleDevices))
 		for name := range b.KindleDevices {
-			log.Printf("[DEBUG]   - %s\n", name)
+			logging.Debug("Kindle device", "device", name)
 		}
-	} else if b.EmailTo != "" {
+	}
+	for name, transport := range b.DeviceTransports {
+		logging.Info("Device without email", "device", name, "type", transport.Type, "address", transport.address())
+	}
+	if len(b.KindleDevices) == 0 && b.EmailTo != "" {
 		// FIXED: Mask email in logs for security
-		log.Printf("[INFO] Using single Kindle device: %s\n", maskEmail(b.EmailTo))
+		logging.Info("Using single Kindle device", "email", b.EmailTo)
 	}
 
+	if b.CalibreLibrary != "" {
+		b.calibre = newCalibreLibrary(b.CalibreLibrary)
+		if books, err := b.calibre.load(); err != nil {
+			logging.Warn("Could not read the Calibre library, /find will fail until it can be read", "err", err)
+		} else {
+			logging.Info("Using Calibre library", "path", b.CalibreLibrary, "books", len(books))
+		}
+	}
+	if b.CalibreServer.URL != "" {
+		logging.Info("Adding delivered books to a Calibre content server", "url", b.CalibreServer.URL,
+			"library", b.CalibreServer.Library)
+	}
+
+	if b.TelegramAPIURL != "" {
+		logging.Info("Using Telegram Bot API server", "url", b.TelegramAPIURL, "local", b.TelegramAPILocal)
+	}
+	logging.Info("Maximum file size", "size", formatFileSize(b.fileSizeLimit()))
+
 	bot, err := tb.NewBot(tb.Settings{
+		URL:    b.TelegramAPIURL,
 		Token:  b.Token,
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+		Poller: b.newPoller(),
 	})
 	if err != nil {
 		return ErrStartup
 	}
+	b.settingsMutex.Lock()
 	b.bot = bot
+	b.settings = b.newSettings()
+	b.settingsMutex.Unlock()
+
+	if err := b.prepareUpdates(bot); err != nil {
+		return err
+	}
 
-	log.Println("[INFO] Bot successfully created and listening for documents...")
+	logging.Info("Bot successfully created and listening for documents")
 	bot.Handle(tb.OnDocument, b.documentHandler(bot))
+	bot.Handle(tb.OnText, b.textHandler(bot))
 	// Handle callback queries for device selection
 	bot.Handle(tb.OnCallback, b.callbackHandler(bot))
+	b.handleAdminCommands(bot)
+	bot.Handle("/highlights", b.highlightsCommand(bot))
+	bot.Handle("/vocab", b.vocabCommand(bot))
+	bot.Handle("/subscribe", b.subscribeCommand(bot))
+	bot.Handle("/unsubscribe", b.unsubscribeCommand(bot))
+	bot.Handle("/digest", b.digestCommand(bot))
+	bot.Handle("/later", b.laterCommand(bot))
+	bot.Handle("/scheduled", b.scheduledCommand(bot))
+	bot.Handle("/timezone", b.timezoneCommand(bot))
+	bot.Handle("/sendqueue", b.sendQueueCommand(bot))
+	if b.OPDSListen != "" {
+		bot.Handle("/opds", b.opdsCommand(bot))
+	}
+	if b.calibre != nil {
+		bot.Handle("/find", b.findCommand(bot))
+	}
+	b.restoreState(bot)
+	go b.stopOnSignal(syscall.SIGTERM, syscall.SIGINT)
+	go b.runJanitor(bot)
+	go b.runDigestScheduler(bot)
+	go b.runScheduler(bot)
+	if b.MetricsListen != "" {
+		go b.serveMonitoring()
+	}
+	if b.OPDSListen != "" {
+		go b.serveOPDS()
+	}
 	bot.Start()
 
+	// bot.Start only returns when Stop was called, wait for it to drain jobs
+	<-b.stopped
 	return nil
 }
 
 func (b *SendToKindleBot) documentHandler(bot *tb.Bot) func(msg *tb.Message) {
 	return func(msg *tb.Message) {
-		doc := msg.Document
-		userID := msg.Sender.ID
-		log.Printf("[DEBUG] Received document: %s from user %d\n", doc.FileName, userID)
-
-		// FIXED: Validate and sanitize filename
-		sanitizedFileName, err := sanitizeFileName(doc.FileName)
-		if err != nil {
-			log.Printf("[ERROR] Invalid filename: %v\n", err)
-			respond(bot, msg, "❌ Invalid filename. Please check the file and try again.")
+		if !b.checkAllowed(bot, msg.Sender) {
 			return
 		}
-
-		// Get file extension and normalize to lowercase
-		extension := strings.ToLower(filepath.Ext(sanitizedFileName))
-		// Remove the leading dot if present
-		if strings.HasPrefix(extension, ".") {
-			extension = extension[1:]
+		if isClippingsFile(msg.Document.FileName) {
+			b.importClippings(bot, msg)
+			return
 		}
+		if isVocabularyFile(msg.Document.FileName) {
+			b.importVocabulary(bot, msg)
+			return
+		}
+		b.processDocument(bot, msg, "", "")
+	}
+}
 
-		// Get filename without extension
-		fileNameWithoutExtension := strings.TrimSuffix(sanitizedFileName, filepath.Ext(sanitizedFileName))
+// processDocument downloads, converts and sends (or offers to send) a
+// document. jobID is the correlation ID in logs, a new one when empty.
+// localPath is a file of the host sent instead of downloading the
+// document, like a book picked with /find; it never comes from an update
+func (b *SendToKindleBot) processDocument(bot *tb.Bot, msg *tb.Message, jobID, localPath string) {
+	doc := msg.Document
+	userID := msg.Sender.ID
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	logger := logging.Default().With("job", jobID, "user", userID)
+	logger.Debug("Received document", "file", doc.FileName, "size", doc.FileSize)
+
+	job, err := b.jobs.begin(jobRecord{
+		ID:       jobID,
+		Kind:     jobKindDocument,
+		UserID:   userID,
+		FileID:   doc.FileID,
+		FilePath: localPath,
+		FileSize: doc.FileSize,
+		FileName: doc.FileName,
+	})
+	if err != nil {
+		respond(bot, msg, "⏳ The bot is restarting. Please send the file again in a minute.")
+		return
+	}
+	defer b.jobs.end(job)
+	ctx := logging.NewContext(job.ctx, logger)
+	// Devices, SMTP accounts and converters of this job, unaffected by reloads
+	settings := b.current()
 
-		// Ensure tmpFilesPath exists
-		if err := ensureDirectory(b.tmpFilesPath); err != nil {
-			log.Printf("[ERROR] Could not create directory %s: %v\n", b.tmpFilesPath, err)
-			respond(bot, msg, "❌ System error: could not prepare file storage")
-			return
+	// FIXED: Validate and sanitize filename
+	sanitizedFileName, err := sanitizeFileName(doc.FileName)
+	if err != nil {
+		logger.Error("Invalid filename", "file", doc.FileName, "err", err)
+		respond(bot, msg, "❌ Invalid filename. Please check the file and try again.")
+		return
+	}
+	// Uploads share tmpFilesPath with the .bot-*.json stores, hidden names
+	// could replace them
+	if strings.HasPrefix(sanitizedFileName, ".") {
+		sanitizedFileName = "_" + strings.TrimLeft(sanitizedFileName, ".")
+	}
+
+	progress := newProgressMessage(bot, msg.Sender, sanitizedFileName)
+	// An admin may cancel the job from /queue, checked between the steps
+	cancelled := func(files ...string) bool {
+		if !b.jobs.cancelled(job) {
+			return false
+		}
+		logger.Info("Job cancelled by an admin")
+		progress.failed("cancelled by an admin")
+		for _, path := range files {
+			removeSilently(path)
 		}
+		return true
+	}
+
+	// Get file extension and normalize to lowercase
+	extension := fileFormat(sanitizedFileName)
+
+	b.metrics.upload(b.metricFormat(extension))
 
-		originalFilePath := filepath.Join(b.tmpFilesPath, sanitizedFileName)
-		if err := bot.Download(&doc.File, originalFilePath); err != nil {
-			log.Printf("[ERROR] Could not download file: %v\n", err)
-			respond(bot, msg, "❌ Could not download file")
+	// Get filename without extension
+	fileNameWithoutExtension := trimFormat(sanitizedFileName)
+
+	// Ensure tmpFilesPath exists
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		logger.Error("Could not create directory", "path", b.tmpFilesPath, "err", err)
+		progress.failed("system error, could not prepare file storage")
+		return
+	}
+
+	originalFilePath := filepath.Join(b.tmpFilesPath, sanitizedFileName)
+	b.jobs.addFile(job, originalFilePath)
+	if localPath != "" {
+		err = b.copyLocalFile(localPath, int64(doc.FileSize), originalFilePath)
+	} else {
+		err = b.downloadFile(ctx, bot, &doc.File, originalFilePath)
+	}
+	if err != nil {
+		logger.Error("Could not download file", "err", err)
+		b.users.recordDelivery(userID, "", false)
+		if errors.Is(err, ErrFileTooLarge) {
+			progress.failed(fmt.Sprintf("file is too large (%s), the limit is %s",
+				formatFileSize(int64(doc.FileSize)), formatFileSize(b.fileSizeLimit())))
 			return
 		}
+		progress.failed("could not download file")
+		return
+	}
+	if cancelled(originalFilePath) {
+		return
+	}
 
-		fileToSend := originalFilePath
-		if needToConvert(extension) {
-			// FIXED: Changed from MOBI to EPUB format
-			log.Printf("[DEBUG] Converting %s to EPUB format...\n", extension)
-			outputFilePath := filepath.Join(b.tmpFilesPath, fileNameWithoutExtension+".epub")
-			if err := convert(originalFilePath, outputFilePath); err != nil {
-				log.Printf("[ERROR] Could not convert file: %v\n", err)
-				respond(bot, msg, "❌ Could not convert file")
-				removeSilently(originalFilePath)
-				return
-			}
-			fileToSend = outputFilePath
-		}
-
-		// Store file info for callback handler (FIXED: with mutex)
-		b.cacheMutex.Lock()
-		if _, exists := b.fileStateCache[userID]; !exists {
-			b.fileStateCache[userID] = make(map[string]string)
-		}
-		b.fileStateCache[userID]["filePath"] = fileToSend
-		b.fileStateCache[userID]["originalFileName"] = sanitizedFileName
-		b.fileStateCache[userID]["originalFilePath"] = originalFilePath
-		b.cacheMutex.Unlock()
-
-		// If only one device, send directly
-		if len(b.KindleDevices) <= 1 && b.EmailTo != "" {
-			log.Printf("[DEBUG] Sending file via email to %s...\n", maskEmail(b.EmailTo))
-			if err := b.sendToKindle(fileToSend, sanitizedFileName, b.EmailTo); err != nil {
-				log.Printf("[ERROR] Could not send file: %v\n", err)
-				respond(bot, msg, "❌ Could not send file. Check logs for details")
-				b.cleanupFiles(userID)
+	fileToSend := originalFilePath
+	if needToConvert(extension) {
+		// FIXED: Changed from MOBI to EPUB format
+		logger.Debug("Converting to EPUB", "format", extension)
+		progress.setStage(stageConverting)
+		outputFilePath := filepath.Join(b.tmpFilesPath, fileNameWithoutExtension+".epub")
+		b.jobs.addFile(job, outputFilePath)
+		converter := settings.converters.forFormat(extension)
+		logger.Debug("Using converter", "converter", converter.name())
+		convertStarted := time.Now()
+		err := converter.convert(ctx, originalFilePath, outputFilePath, progress.setPercent)
+		b.metrics.conversion(converter.name(), time.Since(convertStarted), err)
+		if err != nil {
+			if cancelled(originalFilePath) {
 				return
 			}
-			respond(bot, msg, "✅ File sent successfully to your Kindle!")
-			log.Printf("[INFO] Successfully sent %s to %s\n", sanitizedFileName, maskEmail(b.EmailTo))
-			b.cleanupFiles(userID)
+			logger.Error("Could not convert file", "converter", converter.name(), "err", err)
+			b.users.recordDelivery(userID, "", false)
+			progress.failed("could not convert file")
+			removeSilently(originalFilePath)
 			return
 		}
-
-		// If multiple devices, show selection buttons
-		if len(b.KindleDevices) > 1 {
-			b.showDeviceSelection(bot, msg, userID)
+		fileToSend = outputFilePath
+		if cancelled(originalFilePath, outputFilePath) {
 			return
 		}
+	}
+
+	// Store file info for callback handler (FIXED: with mutex)
+	b.cacheMutex.Lock()
+	if _, exists := b.fileStateCache[userID]; !exists {
+		b.fileStateCache[userID] = make(map[string]string)
+	}
+	b.fileStateCache[userID]["filePath"] = fileToSend
+	b.fileStateCache[userID]["originalFileName"] = sanitizedFileName
+	b.fileStateCache[userID]["originalFilePath"] = originalFilePath
+	b.fileStateCache[userID]["startedAt"] = strconv.FormatInt(progress.startedAt.UnixNano(), 10)
+	b.fileStateCache[userID]["jobID"] = jobID
+	b.cacheMutex.Unlock()
+
+	// If multiple devices, show selection buttons
+	if len(settings.devices) > 1 {
+		b.showDeviceSelection(ctx, bot, msg, progress)
+		return
+	}
 
-		// No devices configured
-		respond(bot, msg, "❌ No Kindle devices configured")
+	// Otherwise send to the default address or the only device directly
+	deviceName, err := settings.resolveDevice("")
+	if err != nil {
+		progress.failed("no devices configured")
+		b.cleanupFiles(userID)
+		return
+	}
+	deliverer, err := b.deliverer(settings, deviceName)
+	if err != nil {
+		logger.Error("Could not deliver file", "device", deviceName, "err", err)
+		progress.failed("device is not configured correctly")
 		b.cleanupFiles(userID)
+		return
+	}
+	progress.setStage(stageSending)
+	if err := deliverer.Deliver(ctx, fileToSend, sanitizedFileName); err != nil {
+		logger.Error("Could not send file", "device", deviceName, "err", err)
+		b.users.recordDelivery(userID, deviceName, false)
+		progress.failed("could not send file, check logs for details")
+		b.cleanupFiles(userID)
+		return
+	}
+	progress.delivered(settings.deliveredText(deviceName))
+	b.metrics.delivered(deviceName)
+	b.users.recordDelivery(userID, deviceName, true)
+	logger.Info("Successfully sent file", "file", sanitizedFileName, "device", deviceName)
+	b.archiveBook(ctx, settings, userID, sanitizedFileName, fileToSend, originalFilePath)
+	b.cleanupFiles(userID)
+}
+
+func (b *SendToKindleBot) showDeviceSelection(ctx context.Context, bot *tb.Bot, msg *tb.Message, progress *progressMessage) {
+	inlineMarkup := b.deviceKeyboard()
+
+	// The status message doubles as the device prompt so the whole job
+	// stays in a single message
+	if progress.msg != nil && progress.askDevice("", inlineMarkup) == nil {
+		b.rememberPrompt(msg.Sender.ID, progress.msg)
+		return
+	}
+
+	responseMsg := fmt.Sprintf("📱 Which device would you like to send '%s' to?\n\nSelect one:",
+		progress.fileName)
+	prompt, err := bot.Send(msg.Sender, responseMsg, inlineMarkup)
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not send device selection", "err", err)
+		respond(bot, msg, "❌ Could not show device selection. Please try again.")
+		return
+	}
+	b.rememberPrompt(msg.Sender.ID, prompt)
+}
+
+// rememberPrompt stores the device selection message of a pending file
+// so the janitor can expire its keyboard
+func (b *SendToKindleBot) rememberPrompt(userID int, prompt *tb.Message) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+	if fileInfo, exists := b.fileStateCache[userID]; exists && prompt.Chat != nil {
+		fileInfo["messageID"] = strconv.Itoa(prompt.ID)
+		fileInfo["chatID"] = strconv.FormatInt(prompt.Chat.ID, 10)
 	}
 }
 
-func (b *SendToKindleBot) showDeviceSelection(bot *tb.Bot, msg *tb.Message, userID int) {
+// deviceKeyboard builds the inline keyboard with one button per Kindle device,
+// a "⏰ Send later" and a "📥 Add to queue" button
+func (b *SendToKindleBot) deviceKeyboard() *tb.ReplyMarkup {
+	markup := b.devicesOnlyKeyboard()
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tb.InlineButton{
+		{Text: "⏰ Send later", Data: laterMenuCallback},
+		{Text: "📥 Add to queue", Data: queueFileCallback},
+	})
+	return markup
+}
+
+// devicesOnlyKeyboard builds the inline keyboard with one button per Kindle
+// device, used once a delivery time was picked
+func (b *SendToKindleBot) devicesOnlyKeyboard() *tb.ReplyMarkup {
 	var buttons []tb.InlineButton
 
-	for deviceName, deviceEmail := range b.KindleDevices {
+	for deviceName, deviceEmail := range b.current().devices {
 		// Create callback data: "send_kindle:deviceName"
 		callbackData := fmt.Sprintf("%s%s", callbackDataPrefix, deviceName)
 		button := tb.InlineButton{
@@ -217,7 +525,7 @@ func (b *SendToKindleBot) showDeviceSelection(bot *tb.Bot, msg *tb.Message, user
 			Data: callbackData,
 		}
 		buttons = append(buttons, button)
-		log.Printf("[DEBUG] Device button: %s (%s)\n", deviceName, maskEmail(deviceEmail))
+		logging.Debug("Device button", "device", deviceName, "email", deviceEmail)
 	}
 
 	// FIXED: Proper button layout with configurable buttons per row
@@ -230,20 +538,9 @@ func (b *SendToKindleBot) showDeviceSelection(bot *tb.Bot, msg *tb.Message, user
 		inlineKeys = append(inlineKeys, buttons[i:end])
 	}
 
-	inlineMarkup := &tb.ReplyMarkup{
+	return &tb.ReplyMarkup{
 		InlineKeyboard: inlineKeys,
 	}
-
-	b.cacheMutex.RLock()
-	originalFileName := b.fileStateCache[userID]["originalFileName"]
-	b.cacheMutex.RUnlock()
-
-	responseMsg := fmt.Sprintf("📱 Which Kindle device would you like to send '%s' to?\n\nSelect one:",
-		originalFileName)
-	if _, err := bot.Send(msg.Sender, responseMsg, inlineMarkup); err != nil {
-		log.Printf("[ERROR] Could not send device selection: %v\n", err)
-		respond(bot, msg, "❌ Could not show device selection. Please try again.")
-	}
 }
 
 func (b *SendToKindleBot) callbackHandler(bot *tb.Bot) func(c *tb.Callback) {
@@ -251,86 +548,215 @@ func (b *SendToKindleBot) callbackHandler(bot *tb.Bot) func(c *tb.Callback) {
 		userID := c.Sender.ID
 		callbackData := c.Data
 
-		log.Printf("[DEBUG] Callback from user %d: %s\n", userID, callbackData)
+		logging.Debug("Callback", "user", userID, "data", callbackData)
+
+		if !b.checkAllowed(bot, c.Sender) {
+			bot.Respond(c, &tb.CallbackResponse{})
+			return
+		}
 
+		if strings.HasPrefix(callbackData, adminCallbackPrefix) {
+			b.adminCallback(bot, c)
+			return
+		}
+		if strings.HasPrefix(callbackData, calibreCallbackPrefix) {
+			b.calibreCallback(bot, c)
+			return
+		}
+		if strings.HasPrefix(callbackData, vocabCallbackPrefix) {
+			b.vocabCallback(bot, c)
+			return
+		}
+		if strings.HasPrefix(callbackData, feedsCallbackPrefix) {
+			b.feedsCallback(bot, c)
+			return
+		}
+		if strings.HasPrefix(callbackData, laterCallbackPrefix) {
+			b.laterCallback(bot, c)
+			return
+		}
+		if strings.HasPrefix(callbackData, queueCallbackPrefix) {
+			b.queueCallback(bot, c)
+			return
+		}
 		if !strings.HasPrefix(callbackData, callbackDataPrefix) {
-			log.Printf("[DEBUG] Unknown callback: %s\n", callbackData)
+			logging.Debug("Unknown callback", "user", userID, "data", callbackData)
 			return
 		}
 
 		deviceName := strings.TrimPrefix(callbackData, callbackDataPrefix)
-		deviceEmail, exists := b.KindleDevices[deviceName]
-		if !exists {
-			log.Printf("[ERROR] Device not found: %s\n", deviceName)
+		if _, exists := b.current().devices[deviceName]; !exists {
+			logging.Error("Device not found", "user", userID, "device", deviceName)
 			bot.Respond(c, &tb.CallbackResponse{})
 			bot.Send(c.Sender, "❌ Device not found")
 			return
 		}
 
-		// Get file info from cache (FIXED: with mutex)
+		// Get file info from cache (FIXED: with mutex). The map is shared,
+		// so read it before unlocking
 		b.cacheMutex.RLock()
 		fileInfo, exists := b.fileStateCache[userID]
+		var fileName, jobID string
+		var startedAt time.Time
+		var scheduled bool
+		if exists {
+			fileName, jobID, startedAt = fileInfo["originalFileName"], fileInfo["jobID"], pendingSince(fileInfo)
+			scheduled = fileInfo["sendAt"] != ""
+		}
 		b.cacheMutex.RUnlock()
 
 		if !exists {
-			log.Printf("[ERROR] No file in cache for user %d\n", userID)
+			logging.Error("No file in cache", "user", userID)
 			bot.Respond(c, &tb.CallbackResponse{})
 			bot.Send(c.Sender, "❌ File not found. Please send it again.")
 			return
 		}
 
-		filePath := fileInfo["filePath"]
-		originalFileName := fileInfo["originalFileName"]
+		bot.Respond(c, &tb.CallbackResponse{})
 
-		// Send to selected device
-		log.Printf("[DEBUG] Sending file to %s (%s)...\n", deviceName, maskEmail(deviceEmail))
-		if err := b.sendToKindle(filePath, originalFileName, deviceEmail); err != nil {
-			log.Printf("[ERROR] Could not send file to %s: %v\n", deviceName, err)
-			bot.Respond(c, &tb.CallbackResponse{})
-			bot.Send(c.Sender, fmt.Sprintf("❌ Could not send to %s. Try again.", deviceName))
+		progress := resumeProgressMessage(bot, c.Message, fileName, startedAt)
+		if scheduled {
+			b.scheduleDelivery(bot, userID, deviceName, progress)
 			return
 		}
+		b.sendToDevice(bot, userID, deviceName, progress, jobID)
+	}
+}
 
-		// Notify success
-		bot.Respond(c, &tb.CallbackResponse{})
-		bot.Send(c.Sender, fmt.Sprintf("✅ Book sent to %s!", deviceName))
-		log.Printf("[INFO] Successfully sent %s to %s (%s)\n", originalFileName, deviceName, maskEmail(deviceEmail))
+// sendToDevice sends the user's prepared file to one of the Kindle devices.
+// jobID is the correlation ID of the document job, a new one when empty
+func (b *SendToKindleBot) sendToDevice(bot *tb.Bot, userID int, deviceName string, progress *progressMessage, jobID string) {
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	logger := logging.Default().With("job", jobID, "user", userID, "device", deviceName)
+
+	settings := b.current()
+	deliverer, err := b.deliverer(settings, deviceName)
+	if err != nil {
+		logger.Error("Device not found", "err", err)
+		progress.failed("device not found")
+		return
+	}
+
+	b.cacheMutex.RLock()
+	fileInfo, exists := b.fileStateCache[userID]
+	var filePath, originalFileName, originalFilePath string
+	if exists {
+		filePath, originalFileName, originalFilePath = fileInfo["filePath"], fileInfo["originalFileName"], fileInfo["originalFilePath"]
+	}
+	b.cacheMutex.RUnlock()
+	if !exists {
+		logger.Error("No file in cache")
+		progress.failed("file not found, please send it again")
+		return
+	}
 
-		// Cleanup
+	job, err := b.jobs.begin(jobRecord{
+		ID:         jobID,
+		Kind:       jobKindSend,
+		UserID:     userID,
+		FileName:   originalFileName,
+		DeviceName: deviceName,
+	})
+	if err != nil {
+		progress.failedWithKeyboard("the bot is restarting, try again in a minute", b.deviceKeyboard())
+		return
+	}
+	defer b.jobs.end(job)
+	// An admin cancel cuts off the delivery too
+	ctx := logging.NewContext(job.ctx, logger)
+	if b.jobs.cancelled(job) {
+		logger.Info("Job cancelled by an admin")
+		progress.failed("cancelled by an admin")
 		b.cleanupFiles(userID)
+		return
+	}
+
+	// Send to selected device
+	progress.setStage(stageSending)
+	if err := deliverer.Deliver(ctx, filePath, originalFileName); err != nil {
+		if b.jobs.cancelled(job) {
+			logger.Info("Job cancelled by an admin", "err", err)
+			progress.failed("cancelled by an admin")
+			b.cleanupFiles(userID)
+			return
+		}
+		logger.Error("Could not send file", "err", err)
+		b.users.recordDelivery(userID, deviceName, false)
+		progress.failedWithKeyboard(fmt.Sprintf("could not send to %s, try again", deviceName), b.deviceKeyboard())
+		return
 	}
+
+	// Notify success
+	progress.delivered(settings.deliveredText(deviceName))
+	b.metrics.delivered(deviceName)
+	b.users.recordDelivery(userID, deviceName, true)
+	logger.Info("Successfully sent file", "file", originalFileName, "address", settings.devices[deviceName])
+	b.archiveBook(ctx, settings, userID, originalFileName, filePath, originalFilePath)
+
+	// Cleanup
+	b.cleanupFiles(userID)
 }
 
-func (b *SendToKindleBot) sendToKindle(filePath string, originalFileName string, kindleEmail string) error {
-	log.Printf("[DEBUG] Sending file via email to %s...\n", maskEmail(kindleEmail))
+// sendToKindle emails a file to kindleEmail, or writes the email to disk
+// when dry is enabled
+func (b *SendToKindleBot) sendToKindle(ctx context.Context, filePath string, originalFileName string, kindleEmail string,
+	profile SMTPProfile, dry dryRun) error {
+	logger := logging.FromContext(ctx)
+	logger.Debug("Sending file via email", "email", kindleEmail, "smtp", profile.Host)
 
 	// Create email with proper subject line
 	subject := fmt.Sprintf("Book: %s", originalFileName)
 	msg := email.NewMessage(subject, "")
-	msg.From = mail.Address{Name: "Send-to-Kindle Bot", Address: b.EmailFrom}
+	msg.From = mail.Address{Name: "Send-to-Kindle Bot", Address: profile.From}
 	msg.To = []string{kindleEmail}
 
 	if err := msg.Attach(filePath); err != nil {
-		log.Printf("[ERROR] Could not attach file: %v\n", err)
+		logger.Error("Could not attach file", "err", err)
 		return err
 	}
 
-	auth := smtp.PlainAuth("", b.EmailFrom, b.Password, b.SMTPHost)
-	addr := fmt.Sprintf("%s:%s", b.SMTPHost, b.SMTPPort)
+	if dry.enabled() {
+		path, err := dry.write(msg.Bytes(), profile.From, originalFileName, time.Now())
+		if err != nil {
+			logger.Error("Could not write dry run email", "path", dry.path, "err", err)
+			return err
+		}
+		logger.Info("Dry run, email written instead of sent", "format", dry.format, "path", path)
+		return nil
+	}
+
+	auth := smtp.PlainAuth("", profile.From, profile.Password, profile.Host)
+	addr := fmt.Sprintf("%s:%s", profile.Host, profile.Port)
 
 	// Configure TLS
 	tlsConfig := &tls.Config{
-		ServerName:         b.SMTPHost,
-		InsecureSkipVerify: b.SMTPInsecure,
+		ServerName:         profile.Host,
+		InsecureSkipVerify: profile.Insecure,
 	}
 
 	// Send with custom TLS config
-	if err := sendEmailWithTLS(addr, auth, msg, tlsConfig); err != nil {
+	started := time.Now()
+	err := sendEmailWithTLS(ctx, addr, auth, msg, tlsConfig)
+	b.metrics.smtpDelivery(time.Since(started), err)
+	if err != nil {
+		logger.Warn("SMTP delivery failed", "step", smtpErrorClass(err), "smtp", addr, "err", err)
 		return err
 	}
+	logger.Debug("Email sent successfully", "duration", time.Since(started).Truncate(time.Millisecond))
 	return nil
 }
 
+// SMTPProfile is an SMTP account books can be sent from
+type SMTPProfile struct {
+	Host     string
+	Port     string
+	From     string
+	Password string
+	Insecure bool
+}
+
 func (b *SendToKindleBot) cleanupFiles(userID int) {
 	b.cacheMutex.Lock()
 	defer b.cacheMutex.Unlock()
@@ -357,27 +783,13 @@ func needToConvert(extension string) bool {
 
 func respond(bot *tb.Bot, m *tb.Message, text string) {
 	if _, err := bot.Send(m.Sender, text); err != nil {
-		log.Printf("[ERROR] Could not send message to user %d: %v\n", m.Sender.ID, err)
-	}
-}
-
-func convert(in, out string) error {
-	log.Printf("[DEBUG] Running ebook-convert: %s -> %s\n", in, out)
-	cmd := exec.Command("ebook-convert", in, out)
-	if err := cmd.Run(); err != nil {
-		log.Printf("[ERROR] ebook-convert error: %v\n", err)
-		return err
+		logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
 	}
-	if _, err := os.Stat(out); errors.Is(err, os.ErrNotExist) {
-		log.Printf("[ERROR] Conversion failed: output file not created\n")
-		return errConversion
-	}
-	return nil
 }
 
 func removeSilently(path string) {
 	if err := os.Remove(path); err != nil {
-		log.Printf("[WARN] Could not delete file %s: %v\n", path, err)
+		logging.Warn("Could not delete file", "path", path, "err", err)
 	}
 }
 
@@ -389,95 +801,231 @@ func (b *SendToKindleBot) verifyConfig() error {
 	if b.Token == "" {
 		return ErrNoToken
 	}
-	if b.Password == "" {
-		return ErrNoPassword
+	if err := b.verifyDelivery(); err != nil {
+		return err
 	}
-	if b.EmailFrom == "" {
-		return ErrNoEmailFrom
+	if err := b.verifyVocabulary(); err != nil {
+		return err
+	}
+	return b.verifyWebhookConfig()
+}
+
+// verifyDelivery checks the SMTP accounts, devices and converters, which is
+// all SendFile needs
+func (b *SendToKindleBot) verifyDelivery() error {
+	if err := b.verifyDryRun(); err != nil {
+		return err
 	}
-	// At least one destination email required
-	if b.EmailTo == "" && len(b.KindleDevices) == 0 {
+	// At least one destination required
+	if b.EmailTo == "" && len(b.KindleDevices) == 0 && len(b.DeviceTransports) == 0 {
 		return ErrNoEmailTo
 	}
-	if b.SMTPHost == "" {
+	if b.CalibreServer.URL != "" {
+		b.CalibreServer.Type = TransportCalibre
+		if _, err := newTransport("calibre server", b.CalibreServer); err != nil {
+			return err
+		}
+	}
+	for name, transport := range b.DeviceTransports {
+		if _, ok := b.KindleDevices[name]; ok {
+			return fmt.Errorf("%w: device %q has both an email and a %s transport", ErrInvalidTransport, name, transport.Type)
+		}
+		if _, err := newTransport(name, transport); err != nil {
+			return err
+		}
+	}
+	// SMTP is only needed to mail books, and a dry run does not connect
+	usesEmail := b.EmailTo != "" || len(b.KindleDevices) > 0
+	if b.Password == "" && usesEmail && b.DryRunPath == "" {
+		return ErrNoPassword
+	}
+	if b.EmailFrom == "" && usesEmail {
+		return ErrNoEmailFrom
+	}
+	if b.SMTPHost == "" && usesEmail && b.DryRunPath == "" {
 		return ErrNoSMTPHost
 	}
 	if b.SMTPPort == "" {
 		b.SMTPPort = defaultSMTPPort
 	}
 	// Remove port from SMTPHost if it contains one
-	if strings.Contains(b.SMTPHost, ":") {
-		parts := strings.Split(b.SMTPHost, ":")
-		b.SMTPHost = parts[0]
-		if len(parts) > 1 && b.SMTPPort == defaultSMTPPort {
-			b.SMTPPort = parts[1]
+	b.SMTPHost, b.SMTPPort = splitSMTPHost(b.SMTPHost, b.SMTPPort)
+
+	for name, profile := range b.SMTPProfiles {
+		if profile.Host == "" || profile.From == "" || profile.Password == "" {
+			return fmt.Errorf("%w: %s", ErrInvalidSMTPProfile, name)
+		}
+		if profile.Port == "" {
+			profile.Port = defaultSMTPPort
 		}
+		profile.Host, profile.Port = splitSMTPHost(profile.Host, profile.Port)
+		b.SMTPProfiles[name] = profile
 	}
+	for device, name := range b.DeviceProfiles {
+		if _, ok := b.SMTPProfiles[name]; !ok {
+			return fmt.Errorf("%w %q for device %s", ErrUnknownSMTPProfile, name, device)
+		}
+	}
+
+	converters, err := newConverterRegistry(b.Converters)
+	if err != nil {
+		return err
+	}
+	b.converters = converters
 	return nil
 }
 
+// splitSMTPHost moves a port given as part of the host ("smtp.example.com:465")
+// into port unless a non-default port was set explicitly
+func splitSMTPHost(host, port string) (string, string) {
+	if !strings.Contains(host, ":") {
+		return host, port
+	}
+	parts := strings.Split(host, ":")
+	if len(parts) > 1 && port == defaultSMTPPort {
+		port = parts[1]
+	}
+	return parts[0], port
+}
+
 // sendEmailWithTLS sends email with custom TLS configuration
-func sendEmailWithTLS(addr string, auth smtp.Auth, msg *email.Message, tlsConfig *tls.Config) error {
+func sendEmailWithTLS(ctx context.Context, addr string, auth smtp.Auth, msg *email.Message, tlsConfig *tls.Config) error {
+	return smtpSession(ctx, addr, auth, tlsConfig, msg.From.Address, msg.To, msg.Bytes(), nil)
+}
+
+// smtpImplicitTLS reports whether the server at addr speaks TLS from the
+// start instead of upgrading with STARTTLS
+func smtpImplicitTLS(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == smtpsPort
+}
+
+// smtpTrace is told the outcome and duration of each step of an SMTP
+// session. c is nil when connecting failed
+type smtpTrace func(step string, took time.Duration, c *smtp.Client, err error)
+
+// smtpSession runs an SMTP session step by step: connect, tls, auth, sender,
+// recipient, data and quit. Without data the session ends after the
+// recipients, nothing is sent. Errors are *smtpError with the failed step.
+// With implicit TLS the tls step is the handshake and the greeting.
+// The connection is cut off when ctx is done, so a job interrupted by the
+// shutdown deadline is not sent after it was saved to be resumed; once the
+// server accepted the data the email counts as sent, even if quit fails
+func smtpSession(ctx context.Context, addr string, auth smtp.Auth, tlsConfig *tls.Config, from string, to []string,
+	data []byte, trace smtpTrace) error {
+	started := time.Now()
+	var c *smtp.Client
+	done := func(step string, err error) error {
+		if trace != nil {
+			trace(step, time.Since(started), c, err)
+		}
+		started = time.Now()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("%w: %v", ctx.Err(), err)
+			}
+			return &smtpError{step: step, err: err}
+		}
+		return nil
+	}
+
 	// Dial to SMTP server
-	c, err := smtp.Dial(addr)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
 	if err != nil {
-		log.Printf("[ERROR] Could not connect to SMTP server %s: %v\n", addr, err)
-		return fmt.Errorf("could not connect to SMTP server: %w", err)
+		return done("connect", fmt.Errorf("could not connect to SMTP server: %w", err))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
-	defer c.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	host, _, _ := net.SplitHostPort(addr)
+	if smtpImplicitTLS(addr) {
+		done("connect", nil)
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return done("tls", fmt.Errorf("could not start TLS: %w", err))
+		}
+		if c, err = smtp.NewClient(tlsConn, host); err != nil {
+			conn.Close()
+			return done("tls", fmt.Errorf("could not connect to SMTP server: %w", err))
+		}
+		defer c.Close()
+		done("tls", nil)
+	} else {
+		if c, err = smtp.NewClient(conn, host); err != nil {
+			conn.Close()
+			return done("connect", fmt.Errorf("could not connect to SMTP server: %w", err))
+		}
+		defer c.Close()
+		done("connect", nil)
 
-	// Start TLS connection
-	if err = c.StartTLS(tlsConfig); err != nil {
-		log.Printf("[ERROR] Could not start TLS: %v\n", err)
-		return fmt.Errorf("could not start TLS: %w", err)
+		// Start TLS connection
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return done("tls", fmt.Errorf("could not start TLS: %w", err))
+		}
+		done("tls", nil)
 	}
 
 	// Authenticate after TLS
 	if err = c.Auth(auth); err != nil {
-		log.Printf("[ERROR] Authentication failed: %v\n", err)
-		return fmt.Errorf("authentication failed (check email and password): %w", err)
+		return done("auth", fmt.Errorf("authentication failed (check email and password): %w", err))
 	}
+	done("auth", nil)
 
 	// Send mail
-	if err = c.Mail(msg.From.Address); err != nil {
-		log.Printf("[ERROR] Could not set sender: %v\n", err)
-		return fmt.Errorf("could not set sender: %w", err)
+	if err = c.Mail(from); err != nil {
+		return done("sender", fmt.Errorf("could not set sender: %w", err))
 	}
+	done("sender", nil)
 
 	// Add recipients
-	for _, to := range msg.To {
-		if err = c.Rcpt(to); err != nil {
-			log.Printf("[ERROR] Could not add recipient %s: %v\n", to, err)
-			return fmt.Errorf("could not add recipient: %w", err)
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return done("recipient", fmt.Errorf("could not add recipient: %w", err))
 		}
 	}
+	done("recipient", nil)
 
 	// Send data
+	if data != nil {
+		if err := writeSMTPData(c, data); err != nil {
+			return done("data", err)
+		}
+		done("data", nil)
+	}
+
+	// Quit
+	if err = c.Quit(); err != nil {
+		err = done("quit", fmt.Errorf("could not close SMTP connection: %w", err))
+		if data != nil {
+			return nil
+		}
+		return err
+	}
+	done("quit", nil)
+	return nil
+}
+
+func writeSMTPData(c *smtp.Client, data []byte) error {
 	w, err := c.Data()
 	if err != nil {
-		log.Printf("[ERROR] Could not start data transmission: %v\n", err)
 		return fmt.Errorf("could not start data transmission: %w", err)
 	}
-
-	_, err = w.Write(msg.Bytes())
-	if err != nil {
-		log.Printf("[ERROR] Could not write message data: %v\n", err)
+	if _, err := w.Write(data); err != nil {
 		return fmt.Errorf("could not write message data: %w", err)
 	}
-
-	err = w.Close()
-	if err != nil {
-		log.Printf("[ERROR] Could not close data transmission: %v\n", err)
+	if err := w.Close(); err != nil {
 		return fmt.Errorf("could not close data transmission: %w", err)
 	}
-
-	// Quit
-	if err = c.Quit(); err != nil {
-		log.Printf("[ERROR] Could not close SMTP connection: %v\n", err)
-		return fmt.Errorf("could not close SMTP connection: %w", err)
-	}
-
-	log.Printf("[DEBUG] Email sent successfully\n")
 	return nil
 }
 
@@ -514,12 +1062,14 @@ func sanitizeFileName(fileName string) (string, error) {
 	return fileName, nil
 }
 
+// pathWithin reports whether path is inside dir
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
 // FIXED: Added maskEmail to hide sensitive information in logs
+// The logger now redacts emails itself, see logging.Redact
 func maskEmail(email string) string {
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		return "***@***"
-	}
-	// Show only domain part
-	return "***@" + parts[1]
+	return logging.MaskEmail(email)
 }
@@ -1,7 +1,12 @@
 package bot
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSendToKindleBot_verifyConfig(t *testing.T) {
@@ -309,3 +314,50 @@ func TestSendToKindleBot_GetTmpFilesPath(t *testing.T) {
 		})
 	}
 }
+
+func TestSMTPSession_cancelled(t *testing.T) {
+	// A server that never answers, like one stuck in DATA
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	result := make(chan error, 1)
+	go func() {
+		result <- smtpSession(ctx, ln.Addr().String(), nil, &tls.Config{}, "bot@example.com",
+			[]string{"me@kindle.com"}, []byte("book"), nil)
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("smtpSession() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("smtpSession() ignored the cancelled context")
+	}
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"smtp.example.com:465": true,
+		"smtp.example.com:587": false,
+		"smtp.example.com:25":  false,
+		"smtp.example.com":     false,
+	} {
+		if got := smtpImplicitTLS(addr); got != want {
+			t.Errorf("smtpImplicitTLS(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
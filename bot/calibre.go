@@ -0,0 +1,335 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	calibreDatabaseName = "metadata.db"
+	// calibreCallbackPrefix starts the callback data of /find buttons:
+	// "calibre:<book id>:<format>"
+	calibreCallbackPrefix = "calibre:"
+	maxFindResults        = 10
+)
+
+// ErrCalibreBookNotFound - represents a book or format missing from the Calibre library
+var ErrCalibreBookNotFound = errors.New("book not found in the calibre library")
+
+// calibreFormat is one file of a Calibre book
+type calibreFormat struct {
+	Format string // upper case as stored by Calibre, e.g. "EPUB"
+	Name   string // file name without the extension
+	Size   int64
+}
+
+// calibreBook is a book of a Calibre library
+type calibreBook struct {
+	ID          int64
+	Title       string
+	Authors     []string
+	Series      string
+	SeriesIndex float64
+	Tags        []string
+	Path        string // directory relative to the library, with slashes
+	Formats     []calibreFormat
+}
+
+// format returns the file of the book in a format, ignoring case
+func (b calibreBook) format(format string) (calibreFormat, bool) {
+	for _, f := range b.Formats {
+		if strings.EqualFold(f.Format, format) {
+			return f, true
+		}
+	}
+	return calibreFormat{}, false
+}
+
+// describe renders the book for /find results, e.g.
+// "Dune — Frank Herbert (Dune #1)"
+func (b calibreBook) describe() string {
+	text := b.Title
+	if len(b.Authors) > 0 {
+		text += " — " + strings.Join(b.Authors, ", ")
+	}
+	if b.Series != "" {
+		text += fmt.Sprintf(" (%s #%s)", b.Series, strconv.FormatFloat(b.SeriesIndex, 'f', -1, 64))
+	}
+	return text
+}
+
+// calibreLibrary reads the books of a Calibre library. metadata.db is
+// read again whenever it changes since Calibre may add books at any time.
+// Books still in metadata.db-wal are missing until Calibre checkpoints it
+type calibreLibrary struct {
+	dir       string
+	mu        sync.Mutex
+	modTime   time.Time
+	size      int64
+	books     []calibreBook
+	walWarned bool // the pending write-ahead log was logged
+}
+
+func newCalibreLibrary(dir string) *calibreLibrary {
+	return &calibreLibrary{dir: dir}
+}
+
+// load returns every book of the library, ordered by ID
+func (c *calibreLibrary) load() ([]calibreBook, error) {
+	path := filepath.Join(c.dir, calibreDatabaseName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pending := sqliteWALPending(path); pending != c.walWarned {
+		if pending {
+			logging.Warn("Calibre has changes in metadata.db-wal that are not read until it checkpoints them, recently added books may be missing",
+				"path", path)
+		}
+		c.walWarned = pending
+	}
+	if c.books != nil && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.books, nil
+	}
+	books, err := readCalibreBooks(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	c.books, c.modTime, c.size = books, info.ModTime(), info.Size()
+	return books, nil
+}
+
+// file returns a book, its file in format and where that file is
+func (c *calibreLibrary) file(id int64, format string) (calibreBook, calibreFormat, string, error) {
+	books, err := c.load()
+	if err != nil {
+		return calibreBook{}, calibreFormat{}, "", err
+	}
+	i := sort.Search(len(books), func(i int) bool { return books[i].ID >= id })
+	if i == len(books) || books[i].ID != id {
+		return calibreBook{}, calibreFormat{}, "", ErrCalibreBookNotFound
+	}
+	book := books[i]
+	f, ok := book.format(format)
+	if !ok {
+		return calibreBook{}, calibreFormat{}, "", ErrCalibreBookNotFound
+	}
+	path := filepath.Join(c.dir, filepath.FromSlash(book.Path), f.Name+"."+strings.ToLower(f.Format))
+	// The database is trusted no further than the library directory
+	if !pathWithin(c.dir, path) {
+		return calibreBook{}, calibreFormat{}, "", ErrCalibreBookNotFound
+	}
+	return book, f, path, nil
+}
+
+// readCalibreBooks reads books with their authors, series, tags and
+// formats from a Calibre metadata.db
+func readCalibreBooks(path string) ([]calibreBook, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tables := make(map[string][]sqliteRow)
+	for _, name := range []string{"books", "authors", "books_authors_link", "series",
+		"books_series_link", "tags", "books_tags_link", "data"} {
+		rows, err := db.table(name)
+		if err != nil {
+			return nil, err
+		}
+		tables[name] = rows
+	}
+	names := func(table string) map[int64]string {
+		byID := make(map[int64]string, len(tables[table]))
+		for _, row := range tables[table] {
+			byID[row.int("id")] = row.text("name")
+		}
+		return byID
+	}
+	authors, series, tags := names("authors"), names("series"), names("tags")
+
+	books := make([]calibreBook, 0, len(tables["books"]))
+	for _, row := range tables["books"] {
+		books = append(books, calibreBook{
+			ID:          row.int("id"),
+			Title:       row.text("title"),
+			SeriesIndex: row.float("series_index"),
+			Path:        row.text("path"),
+		})
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	index := make(map[int64]*calibreBook, len(books))
+	for i := range books {
+		index[books[i].ID] = &books[i]
+	}
+
+	// Links of deleted books can be left behind, they are skipped
+	for _, link := range tables["books_authors_link"] {
+		if book, ok := index[link.int("book")]; ok {
+			if name, ok := authors[link.int("author")]; ok {
+				// Calibre stores a comma in an author's name as "|"
+				book.Authors = append(book.Authors, strings.Replace(name, "|", ",", -1))
+			}
+		}
+	}
+	for _, link := range tables["books_series_link"] {
+		if book, ok := index[link.int("book")]; ok {
+			book.Series = series[link.int("series")]
+		}
+	}
+	for _, link := range tables["books_tags_link"] {
+		if book, ok := index[link.int("book")]; ok {
+			if name, ok := tags[link.int("tag")]; ok {
+				book.Tags = append(book.Tags, name)
+			}
+		}
+	}
+	for _, row := range tables["data"] {
+		if book, ok := index[row.int("book")]; ok {
+			book.Formats = append(book.Formats, calibreFormat{
+				Format: strings.ToUpper(row.text("format")),
+				Name:   row.text("name"),
+				Size:   row.int("uncompressed_size"),
+			})
+		}
+	}
+	return books, nil
+}
+
+// findCalibreBooks returns the books with at least one format whose title,
+// authors, series or tags contain every word of query, ignoring case,
+// sorted by series and title
+func findCalibreBooks(books []calibreBook, query string) []calibreBook {
+	words := strings.Fields(strings.ToLower(query))
+	var found []calibreBook
+	for _, book := range books {
+		if len(book.Formats) == 0 {
+			continue
+		}
+		text := strings.Join(append(append([]string{book.Title, book.Series}, book.Authors...), book.Tags...), " ")
+		if containsWords(strings.ToLower(text), words) {
+			found = append(found, book)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if !strings.EqualFold(found[i].Series, found[j].Series) {
+			return strings.ToLower(seriesOrTitle(found[i])) < strings.ToLower(seriesOrTitle(found[j]))
+		}
+		if found[i].Series != "" && found[i].SeriesIndex != found[j].SeriesIndex {
+			return found[i].SeriesIndex < found[j].SeriesIndex
+		}
+		return strings.ToLower(found[i].Title) < strings.ToLower(found[j].Title)
+	})
+	return found
+}
+
+// seriesOrTitle sorts books of a series next to books titled like it
+func seriesOrTitle(book calibreBook) string {
+	if book.Series != "" {
+		return book.Series
+	}
+	return book.Title
+}
+
+// findResults renders up to maxFindResults books with one button per format
+func findResults(books []calibreBook, query string) (string, *tb.ReplyMarkup) {
+	var text strings.Builder
+	fmt.Fprintf(&text, "🔎 Found %d book(s) for '%s':\n\n", len(books), query)
+	more := len(books) > maxFindResults
+	if more {
+		books = books[:maxFindResults]
+	}
+	var keys [][]tb.InlineButton
+	for i, book := range books {
+		fmt.Fprintf(&text, "%d. %s\n", i+1, book.describe())
+		var row []tb.InlineButton
+		for _, f := range book.Formats {
+			row = append(row, tb.InlineButton{
+				Text: fmt.Sprintf("%d · %s", i+1, f.Format),
+				Data: fmt.Sprintf("%s%d:%s", calibreCallbackPrefix, book.ID, f.Format),
+			})
+		}
+		keys = append(keys, row)
+	}
+	if more {
+		fmt.Fprintf(&text, "\nOnly the first %d are shown, add words to narrow the search.\n", maxFindResults)
+	}
+	text.WriteString("\nPick a format to send:")
+	return text.String(), &tb.ReplyMarkup{InlineKeyboard: keys}
+}
+
+// findCommand handles "/find <query>", a search of the Calibre library
+func (b *SendToKindleBot) findCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		query := strings.TrimSpace(m.Payload)
+		if query == "" {
+			respond(bot, m, "🔎 Usage: /find <title, author, series or tag>")
+			return
+		}
+		books, err := b.calibre.load()
+		if err != nil {
+			logging.Error("Could not read the Calibre library", "user", m.Sender.ID, "err", err)
+			respond(bot, m, "❌ Could not read the library. Please try again later.")
+			return
+		}
+		found := findCalibreBooks(books, query)
+		logging.Debug("Searched the Calibre library", "user", m.Sender.ID, "query", query, "found", len(found))
+		if len(found) == 0 {
+			respond(bot, m, fmt.Sprintf("🔎 Nothing found for '%s'.", query))
+			return
+		}
+		text, markup := findResults(found, query)
+		if _, err := bot.Send(m.Sender, text, markup); err != nil {
+			logging.Error("Could not send search results", "user", m.Sender.ID, "err", err)
+		}
+	}
+}
+
+// calibreCallback sends the book picked from /find results through the
+// usual pipeline, as if the user had uploaded it: conversion when needed,
+// then the device selection
+func (b *SendToKindleBot) calibreCallback(bot *tb.Bot, c *tb.Callback) {
+	bot.Respond(c, &tb.CallbackResponse{})
+	if b.calibre == nil {
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(c.Data, calibreCallbackPrefix), ":", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		logging.Debug("Invalid Calibre callback", "user", c.Sender.ID, "data", c.Data)
+		return
+	}
+	book, f, path, err := b.calibre.file(id, parts[1])
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err != nil {
+		logging.Warn("Could not find Calibre book", "user", c.Sender.ID, "book", id, "format", parts[1], "err", err)
+		bot.Send(c.Sender, "❌ This book is no longer in the library.")
+		return
+	}
+	logging.Info("Sending book from the Calibre library", "user", c.Sender.ID, "book", id, "title", book.Title,
+		"format", f.Format)
+	b.processDocument(bot, &tb.Message{
+		Sender: c.Sender,
+		Document: &tb.Document{
+			File:     tb.File{FileSize: int(f.Size)},
+			FileName: f.Name + "." + strings.ToLower(f.Format),
+		},
+	}, "", path)
+}
@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCalibreLibrary(t *testing.T) {
+	dir := filepath.Join("testdata", "calibre")
+	c := newCalibreLibrary(dir)
+	books, err := c.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if len(books) != 205 {
+		t.Errorf("load() = %d books, want 205", len(books))
+	}
+
+	want := calibreBook{
+		ID:          1,
+		Title:       "Dune",
+		Authors:     []string{"Frank Herbert"},
+		Series:      "Dune",
+		SeriesIndex: 1,
+		Tags:        []string{"Science Fiction"},
+		Path:        "Frank Herbert/Dune (1)",
+		Formats: []calibreFormat{
+			{Format: "EPUB", Name: "Dune - Frank Herbert", Size: 1000},
+			{Format: "AZW3", Name: "Dune - Frank Herbert", Size: 1000},
+		},
+	}
+	if !reflect.DeepEqual(books[0], want) {
+		t.Errorf("load() first book = %+v, want %+v", books[0], want)
+	}
+	if got := books[4].Authors; len(got) != 1 || got[0] != "Tolkien, J.R.R." {
+		t.Errorf("load() authors of The Hobbit = %v, want a comma instead of |", got)
+	}
+
+	book, f, path, err := c.file(1, "azw3")
+	if err != nil || book.ID != 1 || f.Format != "AZW3" {
+		t.Fatalf("file(1, azw3) = %v, %v, %v", book.ID, f, err)
+	}
+	if want := filepath.Join(dir, "Frank Herbert", "Dune (1)", "Dune - Frank Herbert.azw3"); path != want {
+		t.Errorf("file(1, azw3) path = %q, want %q", path, want)
+	}
+	for _, tt := range []struct {
+		id     int64
+		format string
+	}{{id: 1, format: "PDF"}, {id: 5, format: "EPUB"}, {id: 1000, format: "EPUB"}} {
+		if _, _, _, err := c.file(tt.id, tt.format); !errors.Is(err, ErrCalibreBookNotFound) {
+			t.Errorf("file(%d, %s) error = %v, want ErrCalibreBookNotFound", tt.id, tt.format, err)
+		}
+	}
+
+	// The cached books are used while metadata.db is unchanged
+	c.books[0].Path = "../../outside"
+	if _, _, _, err := c.file(1, "EPUB"); !errors.Is(err, ErrCalibreBookNotFound) {
+		t.Errorf("file() outside the library error = %v, want ErrCalibreBookNotFound", err)
+	}
+}
+
+func TestFindCalibreBooks(t *testing.T) {
+	books, err := newCalibreLibrary(filepath.Join("testdata", "calibre")).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "dune", want: []string{"Dune", "Dune Messiah"}},
+		{query: "HERBERT messiah", want: []string{"Dune Messiah"}},
+		{query: "gaiman", want: []string{"Good Omens"}},
+		{query: "russian", want: []string{"War and Peace"}},
+		{query: "fantasy", want: []string{"Good Omens", "The Hobbit"}},
+		{query: "tolkien,", want: []string{"The Hobbit"}},
+		{query: "nothing like this", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []string
+			for _, book := range findCalibreBooks(books, tt.query) {
+				got = append(got, book.Title)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findCalibreBooks(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindResults(t *testing.T) {
+	books, err := newCalibreLibrary(filepath.Join("testdata", "calibre")).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, markup := findResults(findCalibreBooks(books, "dune"), "dune")
+	for _, want := range []string{"Found 2 book(s) for 'dune'", "1. Dune — Frank Herbert (Dune #1)", "2. Dune Messiah"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("findResults() text =\n%s\nwant it to contain %q", text, want)
+		}
+	}
+	if len(markup.InlineKeyboard) != 2 || len(markup.InlineKeyboard[0]) != 2 {
+		t.Fatalf("findResults() keyboard = %+v, want a row per book and a button per format", markup.InlineKeyboard)
+	}
+	if button := markup.InlineKeyboard[0][1]; button.Text != "1 · AZW3" || button.Data != "calibre:1:AZW3" {
+		t.Errorf("findResults() button = %q %q", button.Text, button.Data)
+	}
+
+	text, markup = findResults(findCalibreBooks(books, "filler"), "filler")
+	if len(markup.InlineKeyboard) != maxFindResults || !strings.Contains(text, "Only the first 10") {
+		t.Errorf("findResults() of 199 books = %d rows\n%s", len(markup.InlineKeyboard), text)
+	}
+}
@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1251High maps the bytes 0x80-0xBF of windows-1251, 0xC0-0xFF are
+// А-я in order
+var windows1251High = [64]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021, 0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7, 0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7, 0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+}
+
+// charsetReader decodes the legacy encodings found in FictionBook files
+// and feeds for encoding/xml, which only understands UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "windows-1251", "cp1251", "cp-1251":
+		return &singleByteReader{r: bufio.NewReader(input), decode: decodeWindows1251}, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		return &singleByteReader{r: bufio.NewReader(input), decode: func(c byte) rune { return rune(c) }}, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+func decodeWindows1251(c byte) rune {
+	switch {
+	case c < 0x80:
+		return rune(c)
+	case c < 0xC0:
+		return windows1251High[c-0x80]
+	default:
+		return 0x0410 + rune(c-0xC0)
+	}
+}
+
+// singleByteReader converts a single byte encoding to UTF-8
+type singleByteReader struct {
+	r       *bufio.Reader
+	decode  func(byte) rune
+	pending []byte
+}
+
+func (s *singleByteReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(s.pending) > 0 {
+			copied := copy(p[n:], s.pending)
+			s.pending = s.pending[copied:]
+			n += copied
+			continue
+		}
+		c, err := s.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		var buf [utf8.UTFMax]byte
+		size := utf8.EncodeRune(buf[:], s.decode(c))
+		s.pending = append(s.pending[:0], buf[:size]...)
+	}
+	return n, nil
+}
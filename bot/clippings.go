@@ -0,0 +1,763 @@
+package bot
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// clippingsFileName stores imported highlights per user and book inside
+	// tmpFilesPath
+	clippingsFileName = ".bot-clippings.json"
+	// clippingSeparator ends every entry of My Clippings.txt
+	clippingSeparator     = "=========="
+	maxHighlightResults   = 10
+	maxClippingExportName = 100
+
+	clippingHighlight = "highlight"
+	clippingNote      = "note"
+	clippingBookmark  = "bookmark"
+)
+
+// ErrNoClippings - represents an upload without a single Kindle clipping
+var ErrNoClippings = errors.New("no kindle clippings found")
+
+// clippingKinds are the words naming each kind of clipping in the
+// languages of the Kindle, checked in order
+var clippingKinds = []struct {
+	kind  string
+	words []string
+}{
+	{clippingBookmark, []string{"bookmark", "lesezeichen", "signet", "marcador", "segnalibro", "bladwijzer",
+		"закладка", "ブックマーク", "书签"}},
+	{clippingHighlight, []string{"highlight", "markierung", "surlignement", "subrayado", "evidenziazione",
+		"destaque", "markering", "выделен", "ハイライト", "标注"}},
+	{clippingNote, []string{"note", "notiz", "nota", "notitie", "заметка", "メモ", "笔记"}},
+}
+
+var (
+	// "page 12", "Seite xii", "第 12 页" or "12ページ"
+	clippingPageRe = regexp.MustCompile(`(?i)(?:\bpage|\bseite|p[aá]gina|страниц[аеы]|第)\s*([0-9]+|[ivxlcdm]+\b)|([0-9]+)\s*ページ`)
+	// "Location 170-172", "Loc. 170-72", "Position 170", "位置 #170-172" or "位置No. 170"
+	clippingLocationRe = regexp.MustCompile(`(?i)(?:location|\bloc\.|posici[oó]n|posizione|posi[cç][aã]o|position|positie|` +
+		`emplacement|место|位置(?:\s*no\.)?\s*#?)\s*([0-9]+)(?:\s*-\s*([0-9]+))?`)
+)
+
+// clipping is a highlight, note or bookmark made on a Kindle
+type clipping struct {
+	Kind        string `json:"kind"`
+	Text        string `json:"text,omitempty"`
+	Page        string `json:"page,omitempty"` // may be roman, e.g. "xii"
+	Location    int    `json:"location,omitempty"`
+	LocationEnd int    `json:"location_end,omitempty"`
+	Added       string `json:"added,omitempty"` // as written by the Kindle, in its language
+}
+
+func (c clipping) end() int {
+	if c.LocationEnd > 0 {
+		return c.LocationEnd
+	}
+	return c.Location
+}
+
+// overlaps reports whether two clippings cover a common location, or the
+// same page when the book has no locations, e.g. a PDF
+func (c clipping) overlaps(o clipping) bool {
+	if c.Location > 0 && o.Location > 0 {
+		return c.Location <= o.end() && o.Location <= c.end()
+	}
+	return c.Page != "" && c.Page == o.Page
+}
+
+// position renders where the clipping is, e.g. "Page 12 · Location 170-172"
+func (c clipping) position() string {
+	var parts []string
+	if c.Page != "" {
+		parts = append(parts, "Page "+c.Page)
+	}
+	if c.Location > 0 {
+		location := "Location " + strconv.Itoa(c.Location)
+		if c.LocationEnd > c.Location {
+			location += "-" + strconv.Itoa(c.LocationEnd)
+		}
+		parts = append(parts, location)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// clippingBook holds the clippings of one book, ordered by position
+type clippingBook struct {
+	Title     string     `json:"title"`
+	Author    string     `json:"author,omitempty"`
+	Clippings []clipping `json:"clippings"`
+}
+
+func (b clippingBook) key() string {
+	return strings.ToLower(b.Title + "\x00" + b.Author)
+}
+
+// count returns the number of clippings of a kind
+func (b clippingBook) count(kind string) int {
+	n := 0
+	for _, c := range b.Clippings {
+		if c.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// describe renders the book for /highlights, e.g.
+// "Dune — Frank Herbert (12 highlights, 1 note)"
+func (b clippingBook) describe() string {
+	text := b.Title
+	if b.Author != "" {
+		text += " — " + b.Author
+	}
+	var counts []string
+	for _, kind := range []string{clippingHighlight, clippingNote, clippingBookmark} {
+		switch n := b.count(kind); n {
+		case 0:
+		case 1:
+			counts = append(counts, "1 "+kind)
+		default:
+			counts = append(counts, fmt.Sprintf("%d %ss", n, kind))
+		}
+	}
+	return text + " (" + strings.Join(counts, ", ") + ")"
+}
+
+// parseClippings reads a My Clippings.txt into books in the order they
+// first appear, with repeated clippings removed. Entries that are not
+// clippings are skipped and counted
+func parseClippings(r io.Reader) ([]clippingBook, int, error) {
+	var books []*clippingBook
+	index := make(map[string]*clippingBook)
+	skipped := 0
+	var entry []string
+	flush := func() {
+		if strings.TrimSpace(strings.Join(entry, "")) == "" {
+			return
+		}
+		title, author, c, ok := parseClippingEntry(entry)
+		if !ok {
+			skipped++
+			return
+		}
+		book := &clippingBook{Title: title, Author: author}
+		if existing, ok := index[book.key()]; ok {
+			book = existing
+		} else {
+			index[book.key()] = book
+			books = append(books, book)
+		}
+		book.Clippings = append(book.Clippings, c)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == clippingSeparator {
+			flush()
+			entry = entry[:0]
+			continue
+		}
+		entry = append(entry, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	flush()
+	if len(books) == 0 {
+		return nil, skipped, ErrNoClippings
+	}
+
+	result := make([]clippingBook, 0, len(books))
+	for _, book := range books {
+		book.Clippings = dedupeClippings(book.Clippings)
+		sortClippings(book.Clippings)
+		result = append(result, *book)
+	}
+	return result, skipped, nil
+}
+
+// parseClippingEntry parses the lines between two separators:
+//
+//	Title (Author)
+//	- Your Highlight on page 12 | Location 170-172 | Added on Sunday, 3 March 2019 10:12:01
+//
+//	The highlighted text
+func parseClippingEntry(lines []string) (title, author string, c clipping, ok bool) {
+	for len(lines) > 0 && strings.Trim(lines[0], " \t\ufeff") == "" {
+		lines = lines[1:]
+	}
+	if len(lines) < 2 {
+		return "", "", clipping{}, false
+	}
+	meta := strings.TrimSpace(lines[1])
+	if !strings.HasPrefix(meta, "-") {
+		return "", "", clipping{}, false
+	}
+	c, ok = parseClippingMeta(meta)
+	if !ok {
+		return "", "", clipping{}, false
+	}
+	if c.Kind != clippingBookmark {
+		c.Text = strings.TrimSpace(strings.Join(lines[2:], "\n"))
+		// "<You have reached the clipping limit for this item>" replaces
+		// the text of highlights beyond the publisher's limit
+		limited := strings.HasPrefix(c.Text, "<") && strings.HasSuffix(c.Text, ">") && !strings.Contains(c.Text, "\n")
+		if c.Text == "" || limited {
+			return "", "", clipping{}, false
+		}
+	}
+	title, author = splitClippingTitle(strings.Trim(lines[0], " \t\ufeff"))
+	return title, author, c, true
+}
+
+// parseClippingMeta parses the line describing a clipping: its kind,
+// page, location and, in the last field, when it was added
+func parseClippingMeta(meta string) (clipping, bool) {
+	fields := strings.FieldsFunc(strings.TrimPrefix(meta, "-"), func(r rune) bool { return r == '|' || r == '｜' })
+	var c clipping
+	if len(fields) > 1 {
+		c.Added = strings.TrimSpace(fields[len(fields)-1])
+		fields = fields[:len(fields)-1]
+	}
+	info := strings.ToLower(strings.Join(fields, "|"))
+	for _, kind := range clippingKinds {
+		for _, word := range kind.words {
+			if strings.Contains(info, word) {
+				c.Kind = kind.kind
+				break
+			}
+		}
+		if c.Kind != "" {
+			break
+		}
+	}
+	if c.Kind == "" {
+		return clipping{}, false
+	}
+	if m := clippingPageRe.FindStringSubmatch(info); m != nil {
+		c.Page = m[1] + m[2]
+	}
+	if m := clippingLocationRe.FindStringSubmatch(info); m != nil {
+		c.Location, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			if end := locationEnd(c.Location, m[2]); end > c.Location {
+				c.LocationEnd = end
+			}
+		}
+	}
+	return c, true
+}
+
+// locationEnd expands the end of a location range. Older Kindles shorten
+// it to the digits that differ: "Loc. 1170-72" ends at 1172
+func locationEnd(start int, end string) int {
+	n, err := strconv.Atoi(end)
+	if err != nil || n >= start {
+		return n
+	}
+	scale := 1
+	for range end {
+		scale *= 10
+	}
+	n += start - start%scale
+	if n < start {
+		n += scale
+	}
+	return n
+}
+
+// splitClippingTitle splits "Title (Author)" at the last parenthesis
+func splitClippingTitle(line string) (title, author string) {
+	if !strings.HasSuffix(line, ")") {
+		return line, ""
+	}
+	depth := 0
+	for i := len(line) - 1; i >= 0; i-- {
+		switch line[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				title = strings.TrimSpace(line[:i])
+				if title == "" {
+					return line, ""
+				}
+				return title, strings.TrimSpace(line[i+1 : len(line)-1])
+			}
+		}
+	}
+	return line, ""
+}
+
+// dedupeClippings drops repeated clippings. A Kindle adds a new highlight
+// whenever one is extended or shortened and keeps the old one, so of two
+// overlapping highlights where one text contains the other only the longer
+// is kept, in place of the first
+func dedupeClippings(clippings []clipping) []clipping {
+	var kept []clipping
+	var texts []string
+next:
+	for _, c := range clippings {
+		text := strings.ToLower(strings.Join(strings.Fields(c.Text), " "))
+		for i, k := range kept {
+			if k.Kind != c.Kind {
+				continue
+			}
+			if text == texts[i] && k.Location == c.Location && k.Page == c.Page {
+				continue next
+			}
+			if c.Kind == clippingHighlight && k.overlaps(c) &&
+				(strings.Contains(texts[i], text) || strings.Contains(text, texts[i])) {
+				if len(text) > len(texts[i]) {
+					kept[i], texts[i] = c, text
+				}
+				continue next
+			}
+		}
+		kept = append(kept, c)
+		texts = append(texts, text)
+	}
+	return kept
+}
+
+// sortClippings orders clippings by location, or page for books without
+// locations, keeping the order of the file otherwise
+func sortClippings(clippings []clipping) {
+	page := func(c clipping) int {
+		n, _ := strconv.Atoi(c.Page)
+		return n
+	}
+	sort.SliceStable(clippings, func(i, j int) bool {
+		if clippings[i].Location != clippings[j].Location {
+			return clippings[i].Location < clippings[j].Location
+		}
+		return page(clippings[i]) < page(clippings[j])
+	})
+}
+
+// clippingStore keeps imported clippings per user and book across
+// restarts. All methods do nothing on a nil store
+type clippingStore struct {
+	mu    sync.Mutex
+	path  string
+	books map[int][]*clippingBook
+}
+
+// loadClippingStore reads the store from path. A missing file is an empty
+// store, an unreadable one is reported but still returns an empty store
+func loadClippingStore(path string) (*clippingStore, error) {
+	s := &clippingStore{path: path, books: make(map[int][]*clippingBook)}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var books map[int][]*clippingBook
+	if err := json.Unmarshal(content, &books); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if books != nil {
+		s.books = books
+	}
+	return s, nil
+}
+
+// add merges imported books into those of the user and returns the merged
+// books and how many clippings were new. Importing the same file again
+// adds nothing
+func (s *clippingStore) add(userID int, books []clippingBook) ([]clippingBook, int) {
+	if s == nil {
+		return nil, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := make(map[string]*clippingBook)
+	for _, book := range s.books[userID] {
+		index[book.key()] = book
+	}
+	merged := make([]clippingBook, 0, len(books))
+	added := 0
+	for _, book := range books {
+		existing, ok := index[book.key()]
+		if !ok {
+			existing = &clippingBook{Title: book.Title, Author: book.Author}
+			index[book.key()] = existing
+			s.books[userID] = append(s.books[userID], existing)
+		}
+		before := len(existing.Clippings)
+		existing.Clippings = dedupeClippings(append(existing.Clippings, book.Clippings...))
+		sortClippings(existing.Clippings)
+		added += len(existing.Clippings) - before
+		merged = append(merged, *existing)
+	}
+	s.saveLocked()
+	return merged, added
+}
+
+// list returns the books of a user ordered by title
+func (s *clippingStore) list(userID int) []clippingBook {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books := make([]clippingBook, 0, len(s.books[userID]))
+	for _, book := range s.books[userID] {
+		books = append(books, *book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].key() < books[j].key() })
+	return books
+}
+
+func (s *clippingStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save clippings", "path", s.path, "err", err)
+	}
+}
+
+func (s *clippingStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.books, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// findClippingBooks returns the books whose title or author contain every
+// word of query, ignoring case. A book titled exactly like the query wins
+func findClippingBooks(books []clippingBook, query string) []clippingBook {
+	words := strings.Fields(strings.ToLower(query))
+	var found, exact []clippingBook
+	for _, book := range books {
+		if strings.EqualFold(book.Title, strings.TrimSpace(query)) {
+			exact = append(exact, book)
+		}
+		if containsWords(strings.ToLower(book.Title+" "+book.Author), words) {
+			found = append(found, book)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return found
+}
+
+// entries splits the clippings into highlights with notes and bookmarks
+func (b clippingBook) entries() (entries, bookmarks []clipping) {
+	for _, c := range b.Clippings {
+		if c.Kind == clippingBookmark {
+			bookmarks = append(bookmarks, c)
+		} else {
+			entries = append(entries, c)
+		}
+	}
+	return entries, bookmarks
+}
+
+// clippingsMarkdown renders the clippings of a book as Markdown
+func clippingsMarkdown(book clippingBook) string {
+	var md strings.Builder
+	fmt.Fprintf(&md, "# %s\n\n", book.Title)
+	if book.Author != "" {
+		fmt.Fprintf(&md, "*%s*\n\n", book.Author)
+	}
+	entries, bookmarks := book.entries()
+	for _, c := range entries {
+		if c.Kind == clippingNote {
+			fmt.Fprintf(&md, "**Note:** %s\n\n", c.Text)
+		} else {
+			md.WriteString("> " + strings.Replace(c.Text, "\n", "\n> ", -1) + "\n\n")
+		}
+		if position := c.position(); position != "" {
+			fmt.Fprintf(&md, "— %s\n\n", position)
+		}
+	}
+	if len(bookmarks) > 0 {
+		md.WriteString("## Bookmarks\n\n")
+		for _, c := range bookmarks {
+			fmt.Fprintf(&md, "- %s\n", c.position())
+		}
+	}
+	return strings.TrimRight(md.String(), "\n") + "\n"
+}
+
+var clippingsTemplate = template.Must(template.New("clippings").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Georgia, serif; max-width: 40em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+.text { white-space: pre-wrap; }
+blockquote { border-left: 3px solid #ccc; margin: 1.5em 0; padding-left: 1em; }
+.note { margin: 1.5em 0; }
+.position { color: #777; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Author}}<p><em>{{.Author}}</em></p>
+{{end}}{{range .Entries}}{{if .Note}}<div class="note"><p class="text"><strong>Note:</strong> {{.Text}}</p>
+{{else}}<blockquote><p class="text">{{.Text}}</p>
+{{end}}{{if .Position}}<p class="position">{{.Position}}</p>
+{{end}}{{if .Note}}</div>{{else}}</blockquote>{{end}}
+{{end}}{{if .Bookmarks}}<h2>Bookmarks</h2>
+<ul>
+{{range .Bookmarks}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// clippingsHTML renders the clippings of a book as an HTML page
+func clippingsHTML(book clippingBook) (string, error) {
+	type entry struct {
+		Note     bool
+		Text     string
+		Position string
+	}
+	data := struct {
+		Title     string
+		Author    string
+		Entries   []entry
+		Bookmarks []string
+	}{Title: book.Title, Author: book.Author}
+	entries, bookmarks := book.entries()
+	for _, c := range entries {
+		data.Entries = append(data.Entries, entry{Note: c.Kind == clippingNote, Text: c.Text, Position: c.position()})
+	}
+	for _, c := range bookmarks {
+		data.Bookmarks = append(data.Bookmarks, c.position())
+	}
+	var html bytes.Buffer
+	if err := clippingsTemplate.Execute(&html, data); err != nil {
+		return "", err
+	}
+	return html.String(), nil
+}
+
+// clippingsExportName returns a file name for the exports of a book
+// without the extension, e.g. "Dune - Frank Herbert"
+func clippingsExportName(book clippingBook) string {
+	name := book.Title
+	if book.Author != "" {
+		name += " - " + book.Author
+	}
+	name = strings.NewReplacer("/", "-", "\\", "-").Replace(name)
+	if utf8.RuneCountInString(name) > maxClippingExportName {
+		name = string([]rune(name)[:maxClippingExportName])
+	}
+	name, err := sanitizeFileName(strings.TrimSpace(name))
+	name = strings.TrimLeft(name, ".")
+	if err != nil || name == "" {
+		return "clippings"
+	}
+	return name
+}
+
+// clippingsArchive returns a ZIP with a Markdown and an HTML export of
+// every book
+func clippingsArchive(books []clippingBook) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	used := make(map[string]int)
+	for _, book := range books {
+		name := clippingsExportName(book)
+		used[strings.ToLower(name)]++
+		if n := used[strings.ToLower(name)]; n > 1 {
+			name = fmt.Sprintf("%s (%d)", name, n)
+		}
+		html, err := clippingsHTML(book)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range []struct{ name, content string }{
+			{name + ".md", clippingsMarkdown(book)},
+			{name + ".html", html},
+		} {
+			w, err := archive.Create(file.name)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.WriteString(w, file.content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isClippingsFile reports whether an upload is the My Clippings.txt of a
+// Kindle, also when renamed on the way, e.g. "My Clippings (1).txt"
+func isClippingsFile(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "my clippings") && strings.HasSuffix(name, ".txt")
+}
+
+// importClippings stores the clippings of an uploaded My Clippings.txt
+// instead of sending it to a device and replies with their exports
+func (b *SendToKindleBot) importClippings(bot *tb.Bot, m *tb.Message) {
+	jobID := newJobID()
+	logger := logging.Default().With("job", jobID, "user", m.Sender.ID)
+	ctx := logging.NewContext(context.Background(), logger)
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		logger.Error("Could not create directory", "path", b.tmpFilesPath, "err", err)
+		respond(bot, m, "❌ Could not import your clippings. Please try again later.")
+		return
+	}
+	path := filepath.Join(b.tmpFilesPath, "clippings-"+jobID+".txt")
+	defer os.Remove(path)
+	if err := b.downloadFile(ctx, bot, &m.Document.File, path); err != nil {
+		logger.Error("Could not download clippings", "err", err)
+		if errors.Is(err, ErrFileTooLarge) {
+			respond(bot, m, fmt.Sprintf("❌ The file is too large, the limit is %s.", formatFileSize(b.fileSizeLimit())))
+			return
+		}
+		respond(bot, m, "❌ Could not download your clippings. Please try again.")
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("Could not read clippings", "err", err)
+		respond(bot, m, "❌ Could not import your clippings. Please try again later.")
+		return
+	}
+	books, skipped, err := parseClippings(f)
+	f.Close()
+	if err != nil {
+		logger.Warn("Could not parse clippings", "skipped", skipped, "err", err)
+		respond(bot, m, "❌ No highlights, notes or bookmarks found. Please send the My Clippings.txt "+
+			"from the documents folder of your Kindle.")
+		return
+	}
+	merged, added := b.clippings.add(m.Sender.ID, books)
+	logger.Info("Imported Kindle clippings", "books", len(books), "added", added, "skipped", skipped)
+
+	archive, err := clippingsArchive(merged)
+	if err != nil {
+		logger.Error("Could not export clippings", "err", err)
+		respond(bot, m, "❌ Your clippings were imported but could not be exported.")
+		return
+	}
+	caption := fmt.Sprintf("📝 Imported %d new clipping(s) of %d book(s), exported as Markdown and HTML.\n\n"+
+		"Use /highlights <book> to get them again.", added, len(books))
+	if _, err := bot.Send(m.Sender, &tb.Document{
+		File:     tb.FromReader(bytes.NewReader(archive)),
+		FileName: "clippings.zip",
+		Caption:  caption,
+	}); err != nil {
+		logger.Error("Could not send clippings export", "err", err)
+	}
+}
+
+// highlightsCommand handles "/highlights [book]": the books with imported
+// clippings, or the exports of the book matching the query
+func (b *SendToKindleBot) highlightsCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		books := b.clippings.list(m.Sender.ID)
+		if len(books) == 0 {
+			respond(bot, m, "📝 No highlights yet. Send the My Clippings.txt from the documents folder "+
+				"of your Kindle to import them.")
+			return
+		}
+		query := strings.TrimSpace(m.Payload)
+		found := books
+		if query != "" {
+			found = findClippingBooks(books, query)
+		}
+		switch {
+		case len(found) == 0:
+			respond(bot, m, fmt.Sprintf("📝 No book with highlights matches '%s'.", query))
+		case len(found) == 1 && query != "":
+			b.sendClippingExports(bot, m, found[0])
+		default:
+			respond(bot, m, highlightsList(found, query))
+		}
+	}
+}
+
+// highlightsList renders up to maxHighlightResults books for /highlights
+func highlightsList(books []clippingBook, query string) string {
+	var text strings.Builder
+	if query == "" {
+		fmt.Fprintf(&text, "📝 %d book(s) with highlights:\n\n", len(books))
+	} else {
+		fmt.Fprintf(&text, "📝 %d books match '%s':\n\n", len(books), query)
+	}
+	more := len(books) > maxHighlightResults
+	if more {
+		books = books[:maxHighlightResults]
+	}
+	for i, book := range books {
+		fmt.Fprintf(&text, "%d. %s\n", i+1, book.describe())
+	}
+	if more {
+		fmt.Fprintf(&text, "\nOnly the first %d are shown.\n", maxHighlightResults)
+	}
+	text.WriteString("\nUse /highlights <title or author> to get the highlights of a book.")
+	return text.String()
+}
+
+// sendClippingExports sends the Markdown and HTML exports of a book
+func (b *SendToKindleBot) sendClippingExports(bot *tb.Bot, m *tb.Message, book clippingBook) {
+	html, err := clippingsHTML(book)
+	if err != nil {
+		logging.Error("Could not export clippings", "user", m.Sender.ID, "err", err)
+		respond(bot, m, "❌ Could not export the highlights. Please try again later.")
+		return
+	}
+	name := clippingsExportName(book)
+	for _, doc := range []*tb.Document{
+		{File: tb.FromReader(strings.NewReader(clippingsMarkdown(book))), FileName: name + ".md",
+			Caption: "📝 " + book.describe()},
+		{File: tb.FromReader(strings.NewReader(html)), FileName: name + ".html"},
+	} {
+		if _, err := bot.Send(m.Sender, doc); err != nil {
+			logging.Error("Could not send clippings export", "user", m.Sender.ID, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// clippingsFile joins entries the way a Kindle writes them, with a BOM
+// before the first title and CRLF line endings
+func clippingsFile(entries ...string) string {
+	var file strings.Builder
+	file.WriteString("\ufeff")
+	for _, entry := range entries {
+		file.WriteString(strings.Replace(entry, "\n", "\r\n", -1) + "\r\n==========\r\n")
+	}
+	return file.String()
+}
+
+func TestParseClippingEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		entry  string
+		title  string
+		author string
+		want   clipping
+		ok     bool
+	}{
+		{
+			name:   "english highlight",
+			entry:  "Dune (Frank Herbert)\n- Your Highlight on page 12 | Location 170-172 | Added on Sunday, 3 March 2019 10:12:01\n\nFear is the mind-killer.",
+			title:  "Dune",
+			author: "Frank Herbert",
+			want: clipping{Kind: clippingHighlight, Text: "Fear is the mind-killer.", Page: "12", Location: 170,
+				LocationEnd: 172, Added: "Added on Sunday, 3 March 2019 10:12:01"},
+			ok: true,
+		},
+		{
+			name:   "old kindle with a shortened location",
+			entry:  "Dune (Frank Herbert)\n- Highlight Loc. 1170-72  | Added on Sunday, March 3, 2019, 10:12 PM\n\nText",
+			title:  "Dune",
+			author: "Frank Herbert",
+			want: clipping{Kind: clippingHighlight, Text: "Text", Location: 1170, LocationEnd: 1172,
+				Added: "Added on Sunday, March 3, 2019, 10:12 PM"},
+			ok: true,
+		},
+		{
+			name:   "german note",
+			entry:  "Der Process (Kafka, Franz)\n- Ihre Notiz auf Seite 7 | Position 95 | Hinzugefügt am Sonntag, 3. März 2019 22:12:01\n\nWichtig",
+			title:  "Der Process",
+			author: "Kafka, Franz",
+			want: clipping{Kind: clippingNote, Text: "Wichtig", Page: "7", Location: 95,
+				Added: "Hinzugefügt am Sonntag, 3. März 2019 22:12:01"},
+			ok: true,
+		},
+		{
+			name:  "french bookmark",
+			entry: "L'Étranger (Albert Camus)\n- Votre signet sur la page xii | emplacement 40 | Ajouté le dimanche 3 mars 2019 22:12:01\n\n",
+			title: "L'Étranger", author: "Albert Camus",
+			want: clipping{Kind: clippingBookmark, Page: "xii", Location: 40, Added: "Ajouté le dimanche 3 mars 2019 22:12:01"},
+			ok:   true,
+		},
+		{
+			name:   "spanish highlight",
+			entry:  "Rayuela (Julio Cortázar)\n- Tu subrayado en la página 5 | posición 60-61 | Añadido el domingo, 3 de marzo de 2019 22:12:01\n\nTexto",
+			title:  "Rayuela",
+			author: "Julio Cortázar",
+			want: clipping{Kind: clippingHighlight, Text: "Texto", Page: "5", Location: 60, LocationEnd: 61,
+				Added: "Añadido el domingo, 3 de marzo de 2019 22:12:01"},
+			ok: true,
+		},
+		{
+			name:   "russian highlight",
+			entry:  "Война и мир (Толстой Лев)\n- Ваш выделенный отрывок на странице 3 | место 33-35 | Добавлено: воскресенье, 3 марта 2019 г. в 22:12:01\n\nТекст",
+			title:  "Война и мир",
+			author: "Толстой Лев",
+			want: clipping{Kind: clippingHighlight, Text: "Текст", Page: "3", Location: 33, LocationEnd: 35,
+				Added: "Добавлено: воскресенье, 3 марта 2019 г. в 22:12:01"},
+			ok: true,
+		},
+		{
+			name:   "japanese highlight",
+			entry:  "こころ (夏目漱石)\n- 12ページ|位置No. 170-172のハイライト |作成日: 2019年3月3日日曜日 22:12:01\n\n本文",
+			title:  "こころ",
+			author: "夏目漱石",
+			want: clipping{Kind: clippingHighlight, Text: "本文", Page: "12", Location: 170, LocationEnd: 172,
+				Added: "作成日: 2019年3月3日日曜日 22:12:01"},
+			ok: true,
+		},
+		{
+			name:   "chinese highlight",
+			entry:  "红楼梦 (曹雪芹)\n- 您在第 12 页（位置 #170-172）的标注 | 添加于 2019年3月3日星期日 下午10:12:01\n\n正文",
+			title:  "红楼梦",
+			author: "曹雪芹",
+			want: clipping{Kind: clippingHighlight, Text: "正文", Page: "12", Location: 170, LocationEnd: 172,
+				Added: "添加于 2019年3月3日星期日 下午10:12:01"},
+			ok: true,
+		},
+		{
+			name:  "pdf with pages only and parentheses in the title",
+			entry: "Report (2019 edition) (ACME Corp.)\n- Your Highlight on page 4 | Added on Monday, 4 March 2019 09:00:00\n\nLine one\nLine two",
+			title: "Report (2019 edition)", author: "ACME Corp.",
+			want: clipping{Kind: clippingHighlight, Text: "Line one\nLine two", Page: "4",
+				Added: "Added on Monday, 4 March 2019 09:00:00"},
+			ok: true,
+		},
+		{
+			name:  "personal document without an author",
+			entry: "notes\n- Your Note on Location 5 | Added on Monday, 4 March 2019 09:00:00\n\nText",
+			title: "notes",
+			want:  clipping{Kind: clippingNote, Text: "Text", Location: 5, Added: "Added on Monday, 4 March 2019 09:00:00"},
+			ok:    true,
+		},
+		{
+			name:  "clipping limit",
+			entry: "Dune (Frank Herbert)\n- Your Highlight on Location 500-510 | Added on Sunday, 3 March 2019 10:12:01\n\n<You have reached the clipping limit for this item>",
+		},
+		{
+			name:  "empty highlight",
+			entry: "Dune (Frank Herbert)\n- Your Highlight on Location 500-510 | Added on Sunday, 3 March 2019 10:12:01\n\n",
+		},
+		{
+			name:  "unknown kind",
+			entry: "Dune (Frank Herbert)\n- Your Drawing on Location 500 | Added on Sunday, 3 March 2019 10:12:01\n\nText",
+		},
+		{
+			name:  "not a clipping",
+			entry: "Just some text\nthat is not a clipping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			title, author, got, ok := parseClippingEntry(strings.Split(tt.entry, "\n"))
+			if ok != tt.ok {
+				t.Fatalf("parseClippingEntry() ok = %v, want %v", ok, tt.ok)
+			}
+			if title != tt.title || author != tt.author {
+				t.Errorf("parseClippingEntry() book = %q, %q, want %q, %q", title, author, tt.title, tt.author)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseClippingEntry() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClippings(t *testing.T) {
+	file := clippingsFile(
+		"Dune (Frank Herbert)\n- Your Highlight on page 12 | Location 170-171 | Added on Sunday, 3 March 2019 10:12:01\n\nFear is the mind-killer.",
+		"Dune (Frank Herbert)\n- Your Note on page 12 | Location 172 | Added on Sunday, 3 March 2019 10:13:01\n\nLitany",
+		// The highlight extended, the Kindle keeps both
+		"Dune (Frank Herbert)\n- Your Highlight on page 12 | Location 170-172 | Added on Sunday, 3 March 2019 10:14:01\n\nI must not fear. Fear is the mind-killer.",
+		"Emma (Jane Austen)\n- Your Bookmark on page 3 | Location 40 | Added on Monday, 4 March 2019 09:00:00\n\n",
+		"\ufeffDune (Frank Herbert)\n- Your Highlight on page 2 | Location 20-21 | Added on Tuesday, 5 March 2019 09:00:00\n\nA beginning is the time.",
+		"Emma (Jane Austen)\n- Your Bookmark on page 3 | Location 40 | Added on Monday, 4 March 2019 09:05:00\n\n",
+		"garbage",
+		// Adjacent highlights share a location but not their text
+		"Dune (Frank Herbert)\n- Your Highlight on page 12 | Location 172-174 | Added on Tuesday, 5 March 2019 09:10:00\n\nI will face my fear.",
+	)
+	books, skipped, err := parseClippings(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("parseClippings() error = %v", err)
+	}
+	if skipped != 1 {
+		t.Errorf("parseClippings() skipped = %d, want 1", skipped)
+	}
+	if len(books) != 2 || books[0].Title != "Dune" || books[1].Title != "Emma" {
+		t.Fatalf("parseClippings() = %+v, want Dune and Emma", books)
+	}
+	var texts []string
+	for _, c := range books[0].Clippings {
+		texts = append(texts, c.Text)
+	}
+	want := []string{"A beginning is the time.", "I must not fear. Fear is the mind-killer.", "Litany", "I will face my fear."}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("parseClippings() Dune = %q, want %q", texts, want)
+	}
+	if len(books[1].Clippings) != 1 {
+		t.Errorf("parseClippings() Emma = %+v, want one bookmark", books[1].Clippings)
+	}
+
+	if _, _, err := parseClippings(strings.NewReader("hello\nworld\n")); !errors.Is(err, ErrNoClippings) {
+		t.Errorf("parseClippings(text) error = %v, want ErrNoClippings", err)
+	}
+}
+
+func TestDedupeClippings(t *testing.T) {
+	highlight := func(text string, page string, location, end int) clipping {
+		return clipping{Kind: clippingHighlight, Text: text, Page: page, Location: location, LocationEnd: end}
+	}
+	tests := []struct {
+		name      string
+		clippings []clipping
+		want      []clipping
+	}{
+		{
+			name:      "exact duplicates",
+			clippings: []clipping{highlight("Text", "", 10, 11), highlight("Text ", "", 10, 11)},
+			want:      []clipping{highlight("Text", "", 10, 11)},
+		},
+		{
+			name:      "shortened highlight",
+			clippings: []clipping{highlight("One two three", "", 10, 12), highlight("two", "", 11, 11)},
+			want:      []clipping{highlight("One two three", "", 10, 12)},
+		},
+		{
+			name:      "extended highlight replaces the first",
+			clippings: []clipping{highlight("two", "", 11, 0), highlight("x", "", 30, 0), highlight("One two three", "", 10, 12)},
+			want:      []clipping{highlight("One two three", "", 10, 12), highlight("x", "", 30, 0)},
+		},
+		{
+			name:      "same text elsewhere",
+			clippings: []clipping{highlight("Yes", "", 10, 0), highlight("Yes", "", 90, 0)},
+			want:      []clipping{highlight("Yes", "", 10, 0), highlight("Yes", "", 90, 0)},
+		},
+		{
+			name:      "pdf pages",
+			clippings: []clipping{highlight("A sentence", "4", 0, 0), highlight("A sentence. And more", "4", 0, 0)},
+			want:      []clipping{highlight("A sentence. And more", "4", 0, 0)},
+		},
+		{
+			name: "a note is not a highlight",
+			clippings: []clipping{highlight("Text", "", 10, 0), {Kind: clippingNote, Text: "Text", Location: 10},
+				{Kind: clippingNote, Text: "Text", Location: 10}},
+			want: []clipping{highlight("Text", "", 10, 0), {Kind: clippingNote, Text: "Text", Location: 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupeClippings(tt.clippings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dedupeClippings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClippingStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), clippingsFileName)
+	s, err := loadClippingStore(path)
+	if err != nil {
+		t.Fatalf("loadClippingStore() error = %v", err)
+	}
+	dune := clippingBook{Title: "Dune", Author: "Frank Herbert", Clippings: []clipping{
+		{Kind: clippingHighlight, Text: "two", Location: 11},
+		{Kind: clippingBookmark, Location: 5},
+	}}
+	if _, added := s.add(1, []clippingBook{dune}); added != 2 {
+		t.Errorf("add() added = %d, want 2", added)
+	}
+	if _, added := s.add(1, []clippingBook{dune}); added != 0 {
+		t.Errorf("add() again added = %d, want 0", added)
+	}
+	// A later file has the extended highlight and a new one
+	later := clippingBook{Title: "dune", Author: "frank herbert", Clippings: []clipping{
+		{Kind: clippingHighlight, Text: "one two three", Location: 10, LocationEnd: 12},
+		{Kind: clippingHighlight, Text: "four", Location: 20},
+	}}
+	merged, added := s.add(1, []clippingBook{later})
+	if added != 1 || len(merged) != 1 || len(merged[0].Clippings) != 3 || merged[0].Clippings[1].Text != "one two three" {
+		t.Errorf("add(later) = %+v, %d", merged, added)
+	}
+	s.add(2, []clippingBook{{Title: "Emma", Clippings: []clipping{{Kind: clippingNote, Text: "Hm", Location: 3}}}})
+
+	reloaded, err := loadClippingStore(path)
+	if err != nil {
+		t.Fatalf("loadClippingStore() reload error = %v", err)
+	}
+	if got := reloaded.list(1); len(got) != 1 || got[0].Title != "Dune" || len(got[0].Clippings) != 3 {
+		t.Errorf("list(1) after reload = %+v", got)
+	}
+	if got := reloaded.list(2); len(got) != 1 || got[0].Title != "Emma" {
+		t.Errorf("list(2) after reload = %+v", got)
+	}
+
+	var nilStore *clippingStore
+	if merged, added := nilStore.add(1, []clippingBook{dune}); merged != nil || added != 0 || nilStore.list(1) != nil {
+		t.Error("nil store returned clippings")
+	}
+}
+
+func TestFindClippingBooks(t *testing.T) {
+	books := []clippingBook{
+		{Title: "Dune", Author: "Frank Herbert"},
+		{Title: "Dune Messiah", Author: "Frank Herbert"},
+		{Title: "Emma", Author: "Jane Austen"},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "herbert", want: []string{"Dune", "Dune Messiah"}},
+		{query: "dune", want: []string{"Dune"}},
+		{query: "MESSIAH frank", want: []string{"Dune Messiah"}},
+		{query: "austen emma", want: []string{"Emma"}},
+		{query: "tolkien"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []string
+			for _, book := range findClippingBooks(books, tt.query) {
+				got = append(got, book.Title)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findClippingBooks(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClippingsExports(t *testing.T) {
+	book := clippingBook{Title: "Dune", Author: "Frank Herbert", Clippings: []clipping{
+		{Kind: clippingBookmark, Page: "1", Location: 5},
+		{Kind: clippingHighlight, Text: "Fear is\nthe <mind-killer>.", Page: "12", Location: 170, LocationEnd: 172},
+		{Kind: clippingNote, Text: "Litany", Location: 172},
+	}}
+	wantMarkdown := "# Dune\n\n*Frank Herbert*\n\n" +
+		"> Fear is\n> the <mind-killer>.\n\n— Page 12 · Location 170-172\n\n" +
+		"**Note:** Litany\n\n— Location 172\n\n" +
+		"## Bookmarks\n\n- Page 1 · Location 5\n"
+	if got := clippingsMarkdown(book); got != wantMarkdown {
+		t.Errorf("clippingsMarkdown() = %q, want %q", got, wantMarkdown)
+	}
+
+	html, err := clippingsHTML(book)
+	if err != nil {
+		t.Fatalf("clippingsHTML() error = %v", err)
+	}
+	for _, want := range []string{
+		"<title>Dune</title>",
+		"<blockquote><p class=\"text\">Fear is\nthe &lt;mind-killer&gt;.</p>",
+		"<p class=\"position\">Page 12 · Location 170-172</p>",
+		"<strong>Note:</strong> Litany",
+		"<li>Page 1 · Location 5</li>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("clippingsHTML() does not contain %q:\n%s", want, html)
+		}
+	}
+
+	archive, err := clippingsArchive([]clippingBook{book, book, {Title: "../Notes: 1/2"}})
+	if err != nil {
+		t.Fatalf("clippingsArchive() error = %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("clippingsArchive() is not a zip: %v", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"Dune - Frank Herbert.md", "Dune - Frank Herbert.html",
+		"Dune - Frank Herbert (2).md", "Dune - Frank Herbert (2).html", "-Notes 1-2.md", "-Notes 1-2.html"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("clippingsArchive() files = %q, want %q", names, want)
+	}
+}
+
+func TestIsClippingsFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"My Clippings.txt":     true,
+		"my clippings (1).TXT": true,
+		"My Clippings.pdf":     false,
+		"book.txt":             false,
+	} {
+		if got := isClippingsFile(name); got != want {
+			t.Errorf("isClippingsFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
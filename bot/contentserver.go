@@ -0,0 +1,143 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// calibreJobID is sent with every upload, the server only echoes it back
+const calibreJobID = "1"
+
+// calibreDeliverer adds books to a Calibre library through the content
+// server: /cdb/add-book uploads the file, then /cdb/set-fields sets the
+// metadata the bot extracted. The server must allow writes, e.g. started
+// with --enable-local-write or with a user that may write to the library.
+// Only basic auth is supported, see calibre-server --auth-mode
+type calibreDeliverer struct {
+	server   *url.URL
+	library  string
+	username string
+	password string
+}
+
+func (d *calibreDeliverer) Deliver(ctx context.Context, path, fileName string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var added struct {
+		BookID     int `json:"book_id"`
+		Duplicates []struct {
+			Title string `json:"title"`
+		} `json:"duplicates"`
+	}
+	// "n" makes the server report duplicates instead of adding them again
+	endpoint := d.endpoint("add-book", calibreJobID, "n", deliveredFileName(path, fileName))
+	if err := d.post(ctx, endpoint, "application/octet-stream", f, info.Size(), &added); err != nil {
+		return err
+	}
+	logger := logging.FromContext(ctx)
+	if len(added.Duplicates) > 0 {
+		logger.Info("Book is already in the Calibre library", "title", added.Duplicates[0].Title)
+		return nil
+	}
+	if added.BookID == 0 {
+		return errors.New("calibre did not return the ID of the added book")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"changes":         calibreChanges(extractMetadata(fileName, path)),
+		"loaded_book_ids": []int{added.BookID},
+	})
+	if err != nil {
+		return err
+	}
+	endpoint = d.endpoint("set-fields", strconv.Itoa(added.BookID))
+	if err := d.post(ctx, endpoint, "application/json", bytes.NewReader(body), int64(len(body)), nil); err != nil {
+		return fmt.Errorf("calibre book %d was added without its metadata: %w", added.BookID, err)
+	}
+	logger.Info("Added book to the Calibre library", "book", added.BookID, "server", d.server.Redacted())
+	return nil
+}
+
+// calibreChanges maps metadata to the fields of /cdb/set-fields
+func calibreChanges(m bookMetadata) map[string]interface{} {
+	changes := map[string]interface{}{"title": m.Title}
+	if len(m.Authors) > 0 {
+		changes["authors"] = m.Authors
+	}
+	if m.Language != "" {
+		changes["languages"] = []string{m.Language}
+	}
+	if m.Description != "" {
+		changes["comments"] = m.Description
+	}
+	return changes
+}
+
+// endpoint returns <server>/cdb/<name>/<args>[/<library>]
+func (d *calibreDeliverer) endpoint(name string, args ...string) string {
+	u := *d.server
+	path := strings.TrimSuffix(u.Path, "/") + "/cdb/" + name
+	rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + "/cdb/" + name
+	if d.library != "" {
+		args = append(args, d.library)
+	}
+	for _, arg := range args {
+		path += "/" + arg
+		rawPath += "/" + url.PathEscape(arg)
+	}
+	u.Path, u.RawPath = path, rawPath
+	return u.String()
+}
+
+// post sends a request to the content server and decodes the JSON
+// response into result unless it is nil
+func (d *calibreDeliverer) post(ctx context.Context, endpoint, contentType string, body io.Reader, size int64,
+	result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Calibre explains errors such as a read-only library in plain text
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("calibre server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("could not decode calibre server response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// calibreStandIn mimics the add-book and set-fields endpoints of
+// calibre-server for the library "Books"
+type calibreStandIn struct {
+	mu     sync.Mutex
+	books  map[string]string              // file name -> content
+	fields map[int]map[string]interface{} // book ID -> changes
+	titles map[string]bool                // added file names, duplicates are refused
+}
+
+func (s *calibreStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, password, ok := r.BasicAuth(); !ok || user != "bot" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/calibre/cdb/"), "/")
+	switch {
+	case parts[0] == "add-book" && len(parts) == 5 && parts[4] == "Books":
+		name := parts[3]
+		if s.titles[name] && parts[2] == "n" {
+			fmt.Fprintf(w, `{"duplicates": [{"title": %q, "authors": []}], "fname": %q, "id": %s}`, name, name, parts[1])
+			return
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		s.books[name] = string(content)
+		s.titles[name] = true
+		fmt.Fprintf(w, `{"title": %q, "book_id": %d, "id": %s}`, name, len(s.books), parts[1])
+	case parts[0] == "set-fields" && len(parts) == 3 && parts[2] == "Books":
+		var body struct {
+			Changes map[string]interface{} `json:"changes"`
+			Loaded  []int                  `json:"loaded_book_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var id int
+		fmt.Sscan(parts[1], &id)
+		s.fields[id] = body.Changes
+		fmt.Fprint(w, `{}`)
+	default:
+		http.Error(w, "No library with id: "+parts[len(parts)-1], http.StatusNotFound)
+	}
+}
+
+func newCalibreStandIn(t *testing.T) (*calibreStandIn, *httptest.Server) {
+	standIn := &calibreStandIn{
+		books:  make(map[string]string),
+		fields: make(map[int]map[string]interface{}),
+		titles: make(map[string]bool),
+	}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+	return standIn, server
+}
+
+func TestCalibreDeliverer(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "book.epub")
+	writeTestEPUB(t, book, map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package><metadata><title>Dune</title><creator>Frank Herbert</creator>` +
+			`<language>en</language></metadata></package>`,
+	})
+	standIn, server := newCalibreStandIn(t)
+
+	d, err := newTransport("Calibre", TransportConfig{
+		Type: TransportCalibre, URL: server.URL + "/calibre/", Library: "Books", Username: "bot", Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(context.Background(), book, "Dune Part One.fb2"); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	content, err := os.ReadFile(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := standIn.books["Dune Part One.epub"]; got != string(content) {
+		t.Errorf("Deliver() uploaded %d bytes as %v, want the book as Dune Part One.epub", len(got), standIn.books)
+	}
+	want := map[string]interface{}{"title": "Dune", "authors": []interface{}{"Frank Herbert"}, "languages": []interface{}{"en"}}
+	if got := standIn.fields[1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Deliver() set fields %v, want %v", got, want)
+	}
+
+	// Calibre reports duplicates instead of adding the book again
+	if err := d.Deliver(context.Background(), book, "Dune Part One.fb2"); err != nil || len(standIn.books) != 1 {
+		t.Errorf("Deliver() of a duplicate = %v with %d books, want nil and 1 book", err, len(standIn.books))
+	}
+
+	wrongLibrary := &calibreDeliverer{server: d.(*calibreDeliverer).server, library: "Other", username: "bot", password: "secret"}
+	if err := wrongLibrary.Deliver(context.Background(), book, "book.epub"); err == nil ||
+		!strings.Contains(err.Error(), "No library with id: Other") {
+		t.Errorf("Deliver() to a missing library error = %v, want the server's message", err)
+	}
+}
+
+func TestCalibreDeliverer_endpoint(t *testing.T) {
+	d, err := newTransport("Calibre", TransportConfig{Type: TransportCalibre, URL: "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := d.(*calibreDeliverer).endpoint("add-book", "1", "n", "War & Peace?.epub")
+	if want := "http://localhost:8080/cdb/add-book/1/n/War%20&%20Peace%3F.epub"; got != want {
+		t.Errorf("endpoint() = %q, want %q", got, want)
+	}
+}
+
+func TestSendToKindleBot_archiveBook(t *testing.T) {
+	dir := t.TempDir()
+	book := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(book, []byte("notes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	standIn, server := newCalibreStandIn(t)
+	b := &SendToKindleBot{
+		EmailTo:       "me@kindle.com",
+		CalibreServer: TransportConfig{URL: server.URL + "/calibre", Library: "Books", Username: "bot", Password: "secret"},
+	}
+	var err error
+	if b.library, err = openLibrary(filepath.Join(dir, "library"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	b.archiveBook(context.Background(), b.current(), 1, "Meeting Notes.txt", book)
+	if standIn.books["Meeting Notes.txt"] != "notes" || standIn.fields[1]["title"] != "Meeting Notes" {
+		t.Errorf("archiveBook() added %v with %v to Calibre", standIn.books, standIn.fields)
+	}
+	if books := b.library.list(1); len(books) != 1 || books[0].Title != "Meeting Notes" ||
+		time.Since(books[0].Added) > time.Minute {
+		t.Errorf("archiveBook() library = %+v", books)
+	}
+}
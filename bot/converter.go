@@ -0,0 +1,256 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ConverterTypeCommand runs an external program as "<command> <in> <out> [args...]"
+	ConverterTypeCommand = "command"
+	// ConverterTypeMarkup renders Markdown, Org and AsciiDoc without an external program
+	ConverterTypeMarkup = "markup"
+	// ConverterTypeFB2 converts FictionBook without an external program
+	ConverterTypeFB2 = "fb2"
+
+	defaultConverterCommand = "ebook-convert"
+)
+
+var (
+	// ErrInvalidConverter - represents an invalid converter configuration
+	ErrInvalidConverter = errors.New("invalid converter configuration")
+)
+
+// ConverterConfig configures a conversion backend
+type ConverterConfig struct {
+	Name    string        // unique name used in logs
+	Type    string        // backend type, ConverterTypeCommand by default
+	Command string        // executable for the command type
+	Args    []string      // extra arguments appended after input and output
+	Timeout time.Duration // 0 means no timeout
+	Formats []string      // input extensions it handles, empty for the fallback converter
+}
+
+// converter turns an input document into an EPUB
+type converter interface {
+	name() string
+	convert(ctx context.Context, in, out string, onProgress func(percent int)) error
+}
+
+// checker is implemented by converters depending on something that can be
+// missing at runtime, such as an external program
+type checker interface {
+	check(ctx context.Context) error
+}
+
+// converterRegistry picks the converter for an input format
+type converterRegistry struct {
+	byFormat map[string]converter
+	fallback converter
+}
+
+// newConverterRegistry builds the registry from configuration. Without any
+// configuration ebook-convert handles every format but the markup formats
+// and FB2, which have built-in converters unless configured
+func newConverterRegistry(configs []ConverterConfig) (*converterRegistry, error) {
+	r := &converterRegistry{byFormat: make(map[string]converter)}
+	names := make(map[string]bool)
+
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("%w: converter name not set", ErrInvalidConverter)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("%w: duplicate converter %q", ErrInvalidConverter, cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if cfg.Type == ConverterTypeMarkup && len(cfg.Formats) == 0 {
+			cfg.Formats = MarkupFormats()
+		}
+		if cfg.Type == ConverterTypeFB2 && len(cfg.Formats) == 0 {
+			cfg.Formats = FB2Formats()
+		}
+		c, err := newConverter(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.Formats) == 0 {
+			if r.fallback != nil {
+				return nil, fmt.Errorf("%w: %q and %q are both fallback converters",
+					ErrInvalidConverter, r.fallback.name(), cfg.Name)
+			}
+			r.fallback = c
+			continue
+		}
+		for _, format := range cfg.Formats {
+			format = normalizeFormat(format)
+			if existing, ok := r.byFormat[format]; ok {
+				return nil, fmt.Errorf("%w: format %q handled by both %q and %q",
+					ErrInvalidConverter, format, existing.name(), cfg.Name)
+			}
+			r.byFormat[format] = c
+		}
+	}
+
+	if r.fallback == nil {
+		r.fallback = &commandConverter{cfg: ConverterConfig{Name: defaultConverterCommand, Command: defaultConverterCommand}}
+	}
+	markup := &markupConverter{cfg: ConverterConfig{Name: ConverterTypeMarkup, Type: ConverterTypeMarkup}}
+	for _, format := range MarkupFormats() {
+		if _, ok := r.byFormat[format]; !ok {
+			r.byFormat[format] = markup
+		}
+	}
+	fb2 := &fb2Converter{cfg: ConverterConfig{Name: ConverterTypeFB2, Type: ConverterTypeFB2}}
+	for _, format := range FB2Formats() {
+		if _, ok := r.byFormat[format]; !ok {
+			r.byFormat[format] = fb2
+		}
+	}
+	return r, nil
+}
+
+func newConverter(cfg ConverterConfig) (converter, error) {
+	switch cfg.Type {
+	case "", ConverterTypeCommand:
+		if cfg.Command == "" {
+			return nil, fmt.Errorf("%w: converter %q has no command", ErrInvalidConverter, cfg.Name)
+		}
+		return &commandConverter{cfg: cfg}, nil
+	case ConverterTypeMarkup:
+		for _, format := range cfg.Formats {
+			if _, ok := markupParsers[normalizeFormat(format)]; !ok {
+				return nil, fmt.Errorf("%w: converter %q can't render %q", ErrInvalidConverter, cfg.Name, format)
+			}
+		}
+		return &markupConverter{cfg: cfg}, nil
+	case ConverterTypeFB2:
+		for _, format := range cfg.Formats {
+			if format = normalizeFormat(format); format != "fb2" && format != "fb2.zip" {
+				return nil, fmt.Errorf("%w: converter %q can't read %q", ErrInvalidConverter, cfg.Name, format)
+			}
+		}
+		return &fb2Converter{cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("%w: converter %q has unknown type %q", ErrInvalidConverter, cfg.Name, cfg.Type)
+	}
+}
+
+// forFormat returns the converter for a file extension
+func (r *converterRegistry) forFormat(extension string) converter {
+	if c, ok := r.byFormat[normalizeFormat(extension)]; ok {
+		return c
+	}
+	return r.fallback
+}
+
+// all returns every converter once, sorted by name
+func (r *converterRegistry) all() []converter {
+	seen := make(map[string]converter)
+	for _, c := range r.byFormat {
+		seen[c.name()] = c
+	}
+	seen[r.fallback.name()] = r.fallback
+	converters := make([]converter, 0, len(seen))
+	for _, c := range seen {
+		converters = append(converters, c)
+	}
+	sort.Slice(converters, func(i, j int) bool { return converters[i].name() < converters[j].name() })
+	return converters
+}
+
+func normalizeFormat(extension string) string {
+	return strings.TrimPrefix(strings.ToLower(extension), ".")
+}
+
+// fileFormat returns the format of a file by its name: the extension, or
+// both extensions of a zipped FB2 ("fb2.zip")
+func fileFormat(name string) string {
+	format := normalizeFormat(filepath.Ext(name))
+	if format == "zip" && normalizeFormat(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name)))) == "fb2" {
+		return "fb2.zip"
+	}
+	return format
+}
+
+// trimFormat returns name without the extension(s) of its format
+func trimFormat(name string) string {
+	if format := fileFormat(name); format != "" {
+		return name[:len(name)-len(format)-1]
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// commandConverter runs an external converter such as ebook-convert
+type commandConverter struct {
+	cfg ConverterConfig
+}
+
+func (c *commandConverter) name() string {
+	return c.cfg.Name
+}
+
+// check verifies the command exists and can be started. Some programs
+// don't know --version, so only failing to start it is an error
+func (c *commandConverter) check(ctx context.Context) error {
+	path, err := exec.LookPath(c.cfg.Command)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, path, "--version")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cmd.Wait()
+	return nil
+}
+
+// convert runs the command and reports the percentage it prints in
+// ebook-convert style ("34% ...") to onProgress. The process is killed
+// when ctx is cancelled or the timeout passes
+func (c *commandConverter) convert(ctx context.Context, in, out string, onProgress func(percent int)) error {
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+
+	args := append([]string{in, out}, c.cfg.Args...)
+	logger := logging.FromContext(ctx)
+	logger.Debug("Running converter", "command", c.cfg.Command, "in", in, "out", out)
+	cmd := exec.CommandContext(ctx, c.cfg.Command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		logger.Error("Converter could not start", "command", c.cfg.Command, "err", err)
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if percent, ok := parseConvertProgress(scanner.Text()); ok && onProgress != nil {
+			onProgress(percent)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		logger.Error("Converter failed", "command", c.cfg.Command, "err", err)
+		return err
+	}
+	if _, err := os.Stat(out); errors.Is(err, os.ErrNotExist) {
+		logger.Error("Conversion failed: output file not created", "command", c.cfg.Command)
+		return errConversion
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewConverterRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []ConverterConfig
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "default ebook-convert",
+			format: ".pdf",
+			want:   defaultConverterCommand,
+		},
+		{
+			name: "format specific converter",
+			configs: []ConverterConfig{
+				{Name: "pandoc", Command: "pandoc", Formats: []string{".MD", "org"}},
+			},
+			format: ".md",
+			want:   "pandoc",
+		},
+		{
+			name: "other formats use the fallback",
+			configs: []ConverterConfig{
+				{Name: "pandoc", Command: "pandoc", Formats: []string{"md"}},
+				{Name: "calibre", Command: "ebook-convert"},
+			},
+			format: ".pdf",
+			want:   "calibre",
+		},
+		{
+			name:   "built-in markup converter",
+			format: ".adoc",
+			want:   ConverterTypeMarkup,
+		},
+		{
+			name: "markup converter for some formats",
+			configs: []ConverterConfig{
+				{Name: "markdown", Type: ConverterTypeMarkup, Formats: []string{"md"}},
+				{Name: "pandoc", Command: "pandoc", Formats: []string{"org"}},
+			},
+			format: "md",
+			want:   "markdown",
+		},
+		{
+			name:   "built-in fb2 converter for zipped books",
+			format: "fb2.zip",
+			want:   ConverterTypeFB2,
+		},
+		{
+			name:    "fb2 routed back to ebook-convert",
+			configs: []ConverterConfig{{Name: "calibre", Command: "ebook-convert", Formats: []string{"fb2"}}},
+			format:  "fb2",
+			want:    "calibre",
+		},
+		{
+			name:    "fb2 converter for other formats",
+			configs: []ConverterConfig{{Name: "fb2", Type: ConverterTypeFB2, Formats: []string{"epub"}}},
+			wantErr: true,
+		},
+		{
+			name:    "markup converter for other formats",
+			configs: []ConverterConfig{{Name: "markdown", Type: ConverterTypeMarkup, Formats: []string{"pdf"}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate format",
+			configs: []ConverterConfig{
+				{Name: "a", Command: "a", Formats: []string{"md"}},
+				{Name: "b", Command: "b", Formats: []string{".md"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "two fallbacks",
+			configs: []ConverterConfig{
+				{Name: "a", Command: "a"},
+				{Name: "b", Command: "b"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			configs: []ConverterConfig{{Name: "a", Type: "magic"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newConverterRegistry(tt.configs)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidConverter) {
+					t.Errorf("newConverterRegistry() error = %v, want ErrInvalidConverter", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newConverterRegistry() error = %v", err)
+			}
+			if got := r.forFormat(tt.format).name(); got != tt.want {
+				t.Errorf("forFormat(%q) = %q, want %q", tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantFormat string
+		wantBase   string
+	}{
+		{name: "book.pdf", wantFormat: "pdf", wantBase: "book"},
+		{name: "Book.FB2.ZIP", wantFormat: "fb2.zip", wantBase: "Book"},
+		{name: "book.fb2", wantFormat: "fb2", wantBase: "book"},
+		{name: "photos.zip", wantFormat: "zip", wantBase: "photos"},
+		{name: "v1.2.epub", wantFormat: "epub", wantBase: "v1.2"},
+		{name: "README", wantFormat: "", wantBase: "README"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fileFormat(tt.name); got != tt.wantFormat {
+				t.Errorf("fileFormat(%q) = %q, want %q", tt.name, got, tt.wantFormat)
+			}
+			if got := trimFormat(tt.name); got != tt.wantBase {
+				t.Errorf("trimFormat(%q) = %q, want %q", tt.name, got, tt.wantBase)
+			}
+		})
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []int
+		admins  []int
+		status  string
+		userID  int
+		want    bool
+	}{
+		{name: "everyone without a list", userID: 1, want: true},
+		{name: "listed user", allowed: []int{1, 2}, userID: 2, want: true},
+		{name: "unlisted user", allowed: []int{1, 2}, userID: 3, want: false},
+		{name: "admin always allowed", allowed: []int{1}, admins: []int{3}, userID: 3, want: true},
+		{name: "approved user", allowed: []int{1}, status: userApproved, userID: 3, want: true},
+		{name: "pending user", allowed: []int{1}, status: userPending, userID: 3, want: false},
+		{name: "blocked user", status: userBlocked, userID: 3, want: false},
+		{name: "blocked admin", admins: []int{3}, status: userBlocked, userID: 3, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &SendToKindleBot{AllowedUsers: tt.allowed, AdminUsers: tt.admins}
+			if tt.status != "" {
+				b.users, _ = loadUserStore("", time.Now())
+				b.users.setStatus(tt.userID, tt.status)
+			}
+			if got := b.isAllowed(tt.userID); got != tt.want {
+				t.Errorf("isAllowed(%d) = %v, want %v", tt.userID, got, tt.want)
+			}
+		})
+	}
+}
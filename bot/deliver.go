@@ -0,0 +1,231 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Device transports, see TransportConfig
+const (
+	// TransportEmail mails books with Send to Kindle, the default
+	TransportEmail = "email"
+	// TransportDirectory copies books into a directory such as the mounted
+	// USB storage of a Kobo or PocketBook, or a Dropbox/Syncthing folder
+	TransportDirectory = "directory"
+	// TransportWebDAV uploads books to a WebDAV collection
+	TransportWebDAV = "webdav"
+	// TransportCalibre adds books to a Calibre library through the Calibre
+	// content server
+	TransportCalibre = "calibre"
+
+	uploadTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrInvalidTransport - represents an invalid device transport configuration
+	ErrInvalidTransport = errors.New("invalid device transport")
+	// ErrDirectoryNotFound - represents a missing delivery directory, e.g. an unmounted reader
+	ErrDirectoryNotFound = errors.New("delivery directory not found, is the reader connected?")
+
+	uploadClient = &http.Client{Timeout: uploadTimeout}
+)
+
+// TransportConfig configures how books reach a device that is not mailed
+// to: a directory, a WebDAV collection or a Calibre content server
+type TransportConfig struct {
+	Type     string // TransportDirectory, TransportWebDAV or TransportCalibre
+	Path     string // directory for TransportDirectory
+	URL      string // collection URL for TransportWebDAV, server URL for TransportCalibre
+	Library  string // Calibre library ID, empty for the server's default library
+	Username string // optional basic auth
+	Password string
+}
+
+// address describes where books go, shown in logs and reload diffs
+func (t TransportConfig) address() string {
+	if t.Type == TransportDirectory {
+		return t.Path
+	}
+	return t.URL
+}
+
+// Deliverer delivers a finished book to a device
+type Deliverer interface {
+	// Deliver delivers the file at path, named fileName on the device
+	Deliver(ctx context.Context, path, fileName string) error
+}
+
+func newTransport(device string, cfg TransportConfig) (Deliverer, error) {
+	switch cfg.Type {
+	case TransportDirectory:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("%w: device %q has no path", ErrInvalidTransport, device)
+		}
+		return &directoryDeliverer{dir: cfg.Path}, nil
+	case TransportWebDAV, TransportCalibre:
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: device %q needs an http(s) url", ErrInvalidTransport, device)
+		}
+		if cfg.Type == TransportCalibre {
+			return &calibreDeliverer{server: u, library: cfg.Library, username: cfg.Username, password: cfg.Password}, nil
+		}
+		return &webdavDeliverer{collection: u, username: cfg.Username, password: cfg.Password}, nil
+	default:
+		return nil, fmt.Errorf("%w: device %q has unknown type %q", ErrInvalidTransport, device, cfg.Type)
+	}
+}
+
+// deliverer returns how books reach a device. An empty device means the
+// default address or the only device configured, see resolveDevice
+func (b *SendToKindleBot) deliverer(s *settings, device string) (Deliverer, error) {
+	device, err := s.resolveDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	if cfg, ok := s.transports[device]; ok {
+		return newTransport(device, cfg)
+	}
+	to, ok := s.devices[device]
+	if !ok && device == defaultDeviceName {
+		return &emailDeliverer{bot: b, to: s.emailTo, profile: s.smtp, dryRun: s.dryRun}, nil
+	}
+	return &emailDeliverer{bot: b, to: to, profile: s.smtpProfileFor(device), dryRun: s.dryRun}, nil
+}
+
+// emailDeliverer mails books to a Send to Kindle address
+type emailDeliverer struct {
+	bot     *SendToKindleBot
+	to      string
+	profile SMTPProfile
+	dryRun  dryRun
+}
+
+func (d *emailDeliverer) Deliver(ctx context.Context, path, fileName string) error {
+	return d.bot.sendToKindle(ctx, path, fileName, d.to, d.profile, d.dryRun)
+}
+
+// directoryDeliverer copies books into a directory. The directory itself
+// is never created so nothing is written to an empty mount point
+type directoryDeliverer struct {
+	dir string
+}
+
+func (d *directoryDeliverer) Deliver(ctx context.Context, path, fileName string) error {
+	if info, err := os.Stat(d.dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrDirectoryNotFound, d.dir)
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Copy to a hidden file first so readers and sync tools never pick up
+	// a partial book
+	tmp, err := os.CreateTemp(d.dir, ".send-to-kindle-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Sync matters for USB storage that may be unplugged right after
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	target := availableName(d.dir, deliveredFileName(path, fileName))
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(target, 0644)
+	logging.FromContext(ctx).Info("Copied book", "path", target)
+	return nil
+}
+
+// availableName returns dir/name, or "name (2).ext" and so on when it exists
+func availableName(dir, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	target := filepath.Join(dir, name)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// deliveredFileName is the original name with the extension of the file
+// actually delivered, e.g. "book.fb2" converted to EPUB becomes "book.epub"
+func deliveredFileName(path, fileName string) string {
+	if format := fileFormat(path); format != "" {
+		return trimFormat(fileName) + "." + format
+	}
+	return trimFormat(fileName)
+}
+
+// webdavDeliverer uploads books with a PUT into a WebDAV collection
+type webdavDeliverer struct {
+	collection *url.URL
+	username   string
+	password   string
+}
+
+func (d *webdavDeliverer) Deliver(ctx context.Context, path, fileName string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	target := *d.collection
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + deliveredFileName(path, fileName)
+	target.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		logging.FromContext(ctx).Info("Uploaded book", "url", target.Redacted())
+		return nil
+	default:
+		return fmt.Errorf("webdav upload failed: %s", resp.Status)
+	}
+}
@@ -0,0 +1,146 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendToKindleBot_deliverer(t *testing.T) {
+	work := SMTPProfile{Host: "smtp.work.com", Port: "587", From: "bot@work.com"}
+	s := &settings{
+		emailTo:        "me@kindle.com",
+		devices:        map[string]string{"Oasis": "oasis@kindle.com", "Kobo": "/media/KOBOeReader"},
+		transports:     map[string]TransportConfig{"Kobo": {Type: TransportDirectory, Path: "/media/KOBOeReader"}},
+		deviceProfiles: map[string]string{"Oasis": "work"},
+		smtp:           SMTPProfile{Host: "smtp.gmail.com", Port: "587", From: "bot@gmail.com"},
+		smtpProfiles:   map[string]SMTPProfile{"work": work},
+	}
+	b := &SendToKindleBot{}
+
+	d, err := b.deliverer(s, "Oasis")
+	if email, ok := d.(*emailDeliverer); err != nil || !ok || email.to != "oasis@kindle.com" || email.profile != work {
+		t.Errorf("deliverer(Oasis) = %+v, %v, want email with the work profile", d, err)
+	}
+	d, err = b.deliverer(s, defaultDeviceName)
+	if email, ok := d.(*emailDeliverer); err != nil || !ok || email.to != "me@kindle.com" || email.profile != s.smtp {
+		t.Errorf("deliverer(default) = %+v, %v, want email to the default address", d, err)
+	}
+	d, err = b.deliverer(s, "Kobo")
+	if dir, ok := d.(*directoryDeliverer); err != nil || !ok || dir.dir != "/media/KOBOeReader" {
+		t.Errorf("deliverer(Kobo) = %+v, %v, want a directory", d, err)
+	}
+	if _, err := b.deliverer(s, ""); !errors.Is(err, ErrDeviceRequired) {
+		t.Errorf("deliverer(\"\") error = %v, want ErrDeviceRequired", err)
+	}
+}
+
+func TestDirectoryDeliverer(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(book, []byte("epub"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	d := &directoryDeliverer{dir: dir}
+
+	for i := 0; i < 2; i++ {
+		if err := d.Deliver(context.Background(), book, "War and Peace.fb2"); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+	assertFileContent(t, filepath.Join(dir, "War and Peace.epub"), "epub")
+	assertFileContent(t, filepath.Join(dir, "War and Peace (2).epub"), "epub")
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Deliver() left %d files, want 2", len(entries))
+	}
+
+	missing := &directoryDeliverer{dir: filepath.Join(dir, "unmounted")}
+	if err := missing.Deliver(context.Background(), book, "book.epub"); !errors.Is(err, ErrDirectoryNotFound) {
+		t.Errorf("Deliver() to a missing directory error = %v, want ErrDirectoryNotFound", err)
+	}
+	if _, err := os.Stat(missing.dir); !os.IsNotExist(err) {
+		t.Errorf("Deliver() created the missing directory")
+	}
+}
+
+func TestWebDAVDeliverer(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(book, []byte("epub"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var uploaded map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "reader" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		uploaded[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		cfg      TransportConfig
+		fileName string
+		wantPath string
+		wantErr  bool
+	}{
+		{
+			name:     "upload",
+			cfg:      TransportConfig{Type: TransportWebDAV, URL: server.URL + "/books/", Username: "reader", Password: "secret"},
+			fileName: "War & Peace?.fb2",
+			wantPath: "/books/War & Peace?.epub",
+		},
+		{
+			name:     "wrong password",
+			cfg:      TransportConfig{Type: TransportWebDAV, URL: server.URL + "/books", Username: "reader", Password: "wrong"},
+			fileName: "book.epub",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploaded = make(map[string]string)
+			d, err := newTransport("PocketBook", tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.Deliver(context.Background(), book, tt.fileName)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Deliver() expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Deliver() error = %v", err)
+			}
+			if uploaded[tt.wantPath] != "epub" {
+				t.Errorf("Deliver() uploaded %v, want %s", uploaded, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestNewTransport_invalid(t *testing.T) {
+	for _, cfg := range []TransportConfig{
+		{Type: TransportDirectory},
+		{Type: TransportWebDAV, URL: "ftp://example.com/books"},
+		{Type: "usb", Path: "/media"},
+	} {
+		if _, err := newTransport("Kobo", cfg); !errors.Is(err, ErrInvalidTransport) {
+			t.Errorf("newTransport(%+v) error = %v, want ErrInvalidTransport", cfg, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package bot
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnknownDevice - represents a device name that is not configured
+	ErrUnknownDevice = errors.New("unknown device")
+	// ErrDeviceRequired - represents a missing device name when several devices are configured
+	ErrDeviceRequired = errors.New("several devices configured, choose one")
+	// ErrSMTPTestFailed - represents an SMTP account that failed TestSMTP
+	ErrSMTPTestFailed = errors.New("smtp test failed")
+)
+
+// SendFile sends a local file the way a document sent in Telegram is sent:
+// it is converted when needed and delivered to the device, or to the only
+// device when device is empty. onProgress gets the conversion percentage
+func (b *SendToKindleBot) SendFile(ctx context.Context, path, device string, onProgress func(percent int)) error {
+	if err := b.verifyDelivery(); err != nil {
+		return err
+	}
+	settings := b.current()
+	deliverer, err := b.deliverer(settings, device)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	fileName, err := sanitizeFileName(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	fileToSend := path
+	extension := fileFormat(fileName)
+	if needToConvert(extension) {
+		dir, err := ioutil.TempDir("", "send-to-kindle-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		out := filepath.Join(dir, trimFormat(fileName)+".epub")
+		converter := settings.converters.forFormat(extension)
+		logging.FromContext(ctx).Info("Converting to EPUB", "file", fileName, "converter", converter.name())
+		if err := converter.convert(ctx, path, out, onProgress); err != nil {
+			return fmt.Errorf("%w with %s: %v", errConversion, converter.name(), err)
+		}
+		fileToSend = out
+	}
+	return deliverer.Deliver(ctx, fileToSend, fileName)
+}
+
+// ConvertFile converts in to out with the converter configured for the
+// format of in and returns the name of that converter
+func (b *SendToKindleBot) ConvertFile(ctx context.Context, in, out string, onProgress func(percent int)) (string, error) {
+	converters, err := newConverterRegistry(b.Converters)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(in); err != nil {
+		return "", err
+	}
+	converter := converters.forFormat(fileFormat(in))
+	return converter.name(), converter.convert(ctx, in, out, onProgress)
+}
+
+// resolveDevice checks a device name. An empty device means the default
+// address (defaultDeviceName) or the only device configured
+func (s *settings) resolveDevice(device string) (string, error) {
+	if device == "" {
+		switch {
+		case len(s.devices) > 1:
+			return "", fmt.Errorf("%w: %s", ErrDeviceRequired, strings.Join(s.deviceNames(), ", "))
+		case s.emailTo != "":
+			return defaultDeviceName, nil
+		case len(s.devices) == 0:
+			return "", ErrNoEmailTo
+		}
+		for name := range s.devices {
+			device = name
+		}
+	}
+	if _, ok := s.devices[device]; !ok && (device != defaultDeviceName || s.emailTo == "") {
+		return "", fmt.Errorf("%w %q", ErrUnknownDevice, device)
+	}
+	return device, nil
+}
+
+// deliveredText is the reply once a book reached the device
+func (s *settings) deliveredText(device string) string {
+	text := fmt.Sprintf("sent to %s", device)
+	if _, ok := s.devices[device]; !ok {
+		text = "sent to your Kindle"
+	}
+	if _, ok := s.transports[device]; ok {
+		return text
+	}
+	return text + dryRunNote(s.dryRun)
+}
+
+// usesEmail reports whether any device is mailed to, which needs SMTP
+func (s *settings) usesEmail() bool {
+	return s.emailTo != "" || len(s.devices) > len(s.transports)
+}
+
+// deviceNames returns the configured device names, sorted
+func (s *settings) deviceNames() []string {
+	names := make([]string, 0, len(s.devices))
+	for name := range s.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestSMTP runs an SMTP session up to the recipient with the account of a
+// device, or with every account when device is empty, and writes each step
+// to w. No email is sent. It fails when any account fails
+func (b *SendToKindleBot) TestSMTP(device string, w io.Writer) error {
+	if err := b.verifyDelivery(); err != nil {
+		return err
+	}
+	targets, err := b.current().smtpTargets(device)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, target := range targets {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if err := writeSMTPTest(w, target); err != nil {
+			failed = append(failed, target.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", ErrSMTPTestFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// writeSMTPTest tests one account, describing every step in detail
+func writeSMTPTest(w io.Writer, target smtpTarget) error {
+	profile := target.profile
+	addr := fmt.Sprintf("%s:%s", profile.Host, profile.Port)
+	fmt.Fprintf(w, "SMTP account %s: %s, from %s, to %s\n", target.name, addr, profile.From, target.to)
+	if profile.Insecure {
+		fmt.Fprintln(w, "  certificate verification is disabled (insecure mode)")
+	}
+
+	auth := smtp.PlainAuth("", profile.From, profile.Password, profile.Host)
+	tlsConfig := &tls.Config{ServerName: profile.Host, InsecureSkipVerify: profile.Insecure}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	reached := make(map[string]string)
+	err := smtpSession(ctx, addr, auth, tlsConfig, profile.From, []string{target.to}, nil,
+		func(step string, took time.Duration, c *smtp.Client, err error) {
+			if err != nil {
+				reached[step] = fmt.Sprintf("  %-10s FAILED %6s  %v\n", step, took.Round(time.Millisecond), err)
+				return
+			}
+			reached[step] = fmt.Sprintf("  %-10s ok     %6s  %s\n", step, took.Round(time.Millisecond),
+				smtpStepDetail(step, c, profile, target.to))
+		})
+	for _, step := range smtpSteps {
+		switch line, ok := reached[step]; {
+		case ok:
+			io.WriteString(w, line)
+		case err != nil:
+			fmt.Fprintf(w, "  %-10s not reached\n", step)
+		case step == "data":
+			fmt.Fprintf(w, "  %-10s skipped         no email is sent\n", step)
+		}
+	}
+	return err
+}
+
+// smtpStepDetail describes what a successful step did
+func smtpStepDetail(step string, c *smtp.Client, profile SMTPProfile, to string) string {
+	switch step {
+	case "connect":
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			return "server offers STARTTLS"
+		}
+		return "server does not offer STARTTLS"
+	case "tls":
+		state, ok := c.TLSConnectionState()
+		if !ok {
+			return ""
+		}
+		detail := tlsVersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			detail += fmt.Sprintf(", certificate %s valid until %s",
+				cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+		}
+		return detail
+	case "auth":
+		detail := "PLAIN as " + profile.From
+		if _, mechanisms := c.Extension("AUTH"); mechanisms != "" {
+			detail += " (server offers " + mechanisms + ")"
+		}
+		return detail
+	case "sender":
+		return "MAIL FROM:<" + profile.From + ">"
+	case "recipient":
+		return "RCPT TO:<" + to + ">"
+	}
+	return ""
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS 0x%04x", version)
+}
@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSettings_resolveDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *settings
+		device   string
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "default address",
+			settings: &settings{emailTo: "me@kindle.com"},
+			want:     defaultDeviceName,
+		},
+		{
+			name:     "only device",
+			settings: &settings{devices: map[string]string{"Kobo": "/media/KOBOeReader"}},
+			want:     "Kobo",
+		},
+		{
+			name:     "named device",
+			settings: &settings{devices: map[string]string{"Oasis": "oasis@kindle.com", "Paperwhite": "pw@kindle.com"}},
+			device:   "Paperwhite",
+			want:     "Paperwhite",
+		},
+		{
+			name:     "several devices",
+			settings: &settings{devices: map[string]string{"Oasis": "oasis@kindle.com", "Paperwhite": "pw@kindle.com"}},
+			wantErr:  ErrDeviceRequired,
+		},
+		{
+			name:     "unknown device",
+			settings: &settings{emailTo: "me@kindle.com"},
+			device:   "Voyage",
+			wantErr:  ErrUnknownDevice,
+		},
+		{
+			name:     "no devices",
+			settings: &settings{},
+			wantErr:  ErrNoEmailTo,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.settings.resolveDevice(tt.device)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("resolveDevice() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveDevice() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendToKindleBot_ConvertFile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "notes.md")
+	out := filepath.Join(dir, "notes.epub")
+	if err := os.WriteFile(in, []byte("# Notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := &SendToKindleBot{Converters: []ConverterConfig{
+		{Name: "copy", Command: "cp", Formats: []string{"md"}},
+		{Name: "fallback", Command: "false"},
+	}}
+
+	name, err := b.ConvertFile(context.Background(), in, out, nil)
+	if err != nil || name != "copy" {
+		t.Fatalf("ConvertFile() = %q, %v, want copy", name, err)
+	}
+	if content, err := os.ReadFile(out); err != nil || string(content) != "# Notes" {
+		t.Errorf("ConvertFile() output = %q, %v", content, err)
+	}
+	if _, err := b.ConvertFile(context.Background(), filepath.Join(dir, "missing.md"), out, nil); err == nil {
+		t.Errorf("ConvertFile() expected an error for a missing file")
+	}
+}
+
+func TestWriteSMTPTest(t *testing.T) {
+	host, port, _ := net.SplitHostPort(fakeSMTPServer(t))
+	var w bytes.Buffer
+	err := writeSMTPTest(&w, smtpTarget{
+		name:    "default",
+		profile: SMTPProfile{Host: host, Port: port, From: "bot@example.com", Password: "secret"},
+		to:      "me@kindle.com",
+	})
+	if err == nil {
+		t.Errorf("writeSMTPTest() expected a TLS error")
+	}
+
+	report := w.String()
+	for _, want := range []string{
+		"SMTP account default: " + host + ":" + port + ", from bot@example.com, to me@kindle.com",
+		"server offers STARTTLS",
+		"tls        FAILED",
+		"auth       not reached",
+		"recipient  not reached",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("writeSMTPTest() =\n%s\nwant it to contain %q", report, want)
+		}
+	}
+	if strings.Contains(report, "secret") {
+		t.Errorf("writeSMTPTest() shows the password:\n%s", report)
+	}
+}
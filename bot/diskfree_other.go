@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package bot
+
+// diskFree is not implemented on this platform, the free space check is skipped
+func diskFree(path string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
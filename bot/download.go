@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// cloudFileSizeLimit is the getFile limit of api.telegram.org
+	cloudFileSizeLimit = 20 << 20
+	// localFileSizeLimit is the limit of telegram-bot-api running with --local
+	localFileSizeLimit = 2000 << 20
+)
+
+// ErrFileTooLarge - represents a file exceeding the active download limit
+var ErrFileTooLarge = errors.New("file exceeds the download limit")
+
+// fileSizeLimit returns the largest file the configured Bot API server
+// lets the bot download, lowered by MaxFileSize when set
+func (b *SendToKindleBot) fileSizeLimit() int64 {
+	limit := int64(cloudFileSizeLimit)
+	if b.TelegramAPILocal {
+		limit = localFileSizeLimit
+	}
+	if max := b.current().maxFileSize; max > 0 && max < limit {
+		return max
+	}
+	return limit
+}
+
+// downloadFile saves a Telegram file to dest. With a local Bot API server
+// the file is copied straight from the path the server reports, falling
+// back to downloading it over HTTP when that path is not accessible.
+// file.FileLocal is ignored: anyone posting updates can set it
+func (b *SendToKindleBot) downloadFile(ctx context.Context, bot *tb.Bot, file *tb.File, dest string) error {
+	if file.FileID == "" {
+		return errors.New("file has no file_id")
+	}
+	if int64(file.FileSize) > b.fileSizeLimit() {
+		return ErrFileTooLarge
+	}
+
+	if b.TelegramAPILocal {
+		f, err := bot.FileByID(file.FileID)
+		if err != nil {
+			return wrapDownloadError(err)
+		}
+		if filepath.IsAbs(f.FilePath) {
+			err := copyFile(f.FilePath, dest)
+			if err == nil {
+				logging.FromContext(ctx).Debug("Copied file from local Bot API storage", "path", f.FilePath)
+				return nil
+			}
+			logging.FromContext(ctx).Warn("Could not read from local Bot API storage, downloading instead",
+				"path", f.FilePath, "err", err)
+		}
+	}
+
+	return wrapDownloadError(bot.Download(file, dest))
+}
+
+// copyLocalFile copies a file of the host such as a book of the Calibre
+// library, only MaxFileSize applies to it. src must never come from an
+// update
+func (b *SendToKindleBot) copyLocalFile(src string, size int64, dest string) error {
+	if max := b.current().maxFileSize; max > 0 && size > max {
+		return ErrFileTooLarge
+	}
+	return copyFile(src, dest)
+}
+
+// wrapDownloadError maps Telegram's "file is too big" to ErrFileTooLarge
+func wrapDownloadError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "file is too big") {
+		return ErrFileTooLarge
+	}
+	return err
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		removeSilently(dest)
+		return err
+	}
+	return out.Close()
+}
+
+// formatFileSize renders a byte count for users, e.g. "20 MB"
+func formatFileSize(size int64) string {
+	const unit = 1 << 20
+	if size < unit {
+		return fmt.Sprintf("%d KB", (size+1023)/1024)
+	}
+	mb := float64(size) / unit
+	if mb == float64(int64(mb)) {
+		return fmt.Sprintf("%d MB", int64(mb))
+	}
+	return fmt.Sprintf("%.1f MB", mb)
+}
@@ -0,0 +1,114 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatFileSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		want string
+	}{
+		{name: "kilobytes", size: 1500, want: "2 KB"},
+		{name: "exact megabytes", size: 20 << 20, want: "20 MB"},
+		{name: "fractional megabytes", size: 35*(1<<20) + 200*1024, want: "35.2 MB"},
+		{name: "local limit", size: localFileSizeLimit, want: "2000 MB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatFileSize(tt.size); got != tt.want {
+				t.Errorf("formatFileSize() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendToKindleBot_downloadFile(t *testing.T) {
+	storage := t.TempDir()
+	localPath := filepath.Join(storage, "documents", "file_1.fb2")
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localPath, []byte("book contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/botTOKEN/getFile":
+			fmt.Fprintf(w, `{"ok": true, "result": {"file_id": "id", "file_path": %q}}`, localPath)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	bot, err := tb.NewBot(tb.Settings{URL: api.URL, Token: "TOKEN", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("copies from local Bot API storage", func(t *testing.T) {
+		b := &SendToKindleBot{TelegramAPILocal: true}
+		dest := filepath.Join(t.TempDir(), "book.fb2")
+		file := &tb.File{FileID: "id", FileSize: 13}
+		if err := b.downloadFile(context.Background(), bot, file, dest); err != nil {
+			t.Fatalf("downloadFile() error = %v", err)
+		}
+		data, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "book contents" {
+			t.Errorf("downloadFile() contents = %q", data)
+		}
+	})
+
+	t.Run("copies local files", func(t *testing.T) {
+		b := &SendToKindleBot{}
+		dest := filepath.Join(t.TempDir(), "book.fb2")
+		if err := b.copyLocalFile(localPath, cloudFileSizeLimit+1, dest); err != nil {
+			t.Fatalf("copyLocalFile() error = %v", err)
+		}
+		assertFileContent(t, dest, "book contents")
+	})
+
+	t.Run("ignores file_local of updates", func(t *testing.T) {
+		b := &SendToKindleBot{}
+		dest := filepath.Join(t.TempDir(), "book.fb2")
+		file := &tb.File{FileLocal: localPath, FileSize: 13}
+		if err := b.downloadFile(context.Background(), bot, file, dest); err == nil {
+			t.Fatal("downloadFile() copied a path from the update")
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("downloadFile() created %s", dest)
+		}
+	})
+
+	t.Run("rejects files above the cloud limit", func(t *testing.T) {
+		b := &SendToKindleBot{}
+		file := &tb.File{FileID: "id", FileSize: cloudFileSizeLimit + 1}
+		if err := b.downloadFile(context.Background(), bot, file, filepath.Join(t.TempDir(), "book.fb2")); err != ErrFileTooLarge {
+			t.Errorf("downloadFile() error = %v, want %v", err, ErrFileTooLarge)
+		}
+	})
+
+	t.Run("rejects files above the local limit", func(t *testing.T) {
+		b := &SendToKindleBot{TelegramAPILocal: true}
+		file := &tb.File{FileID: "id", FileSize: localFileSizeLimit + 1}
+		if err := b.downloadFile(context.Background(), bot, file, filepath.Join(t.TempDir(), "book.fb2")); err != ErrFileTooLarge {
+			t.Errorf("downloadFile() error = %v, want %v", err, ErrFileTooLarge)
+		}
+	})
+}
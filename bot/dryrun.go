@@ -0,0 +1,184 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dry run formats, see SendToKindleBot.DryRunFormat
+const (
+	DryRunMaildir = "maildir" // one file per message in new/ of a maildir
+	DryRunMbox    = "mbox"    // messages appended to a single mbox file
+	DryRunEML     = "eml"     // one .eml file per message in a directory
+)
+
+// ErrInvalidDryRunFormat - represents a dry run format other than maildir, mbox or eml
+var ErrInvalidDryRunFormat = errors.New("dry run format must be maildir, mbox or eml")
+
+var (
+	mboxMutex         sync.Mutex // serializes appends to mbox files
+	dryRunDeliveries  uint64     // makes maildir file names unique within the process
+	dryRunHostReplace = strings.NewReplacer("/", "\\057", ":", "\\072")
+)
+
+// dryRun writes rendered messages to disk instead of sending them. It is
+// disabled when path is empty
+type dryRun struct {
+	format string
+	path   string
+}
+
+func (d dryRun) enabled() bool {
+	return d.path != ""
+}
+
+// String describes the destination, e.g. "maildir /files/outbox"
+func (d dryRun) String() string {
+	if !d.enabled() {
+		return "off"
+	}
+	return d.format + " " + d.path
+}
+
+// write stores a rendered message and returns the file it was written to.
+// name is the book, used in .eml file names
+func (d dryRun) write(msg []byte, from, name string, now time.Time) (string, error) {
+	switch d.format {
+	case DryRunMbox:
+		return d.path, appendMbox(d.path, msg, from, now)
+	case DryRunEML:
+		return writeEML(d.path, msg, name, now)
+	default:
+		return writeMaildir(d.path, msg, now)
+	}
+}
+
+// writeMaildir delivers the message the maildir way: written to tmp/, then
+// moved to new/ so readers never see a partial message
+func writeMaildir(dir string, msg []byte, now time.Time) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&dryRunDeliveries, 1), dryRunHostReplace.Replace(host))
+
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// appendMbox appends the message to an mboxrd file: a "From " separator
+// line, the message with "From " lines quoted as ">From ", a blank line
+func appendMbox(path string, msg []byte, from string, now time.Time) error {
+	if err := ensureDirectory(filepath.Dir(path)); err != nil {
+		return err
+	}
+	mboxMutex.Lock()
+	defer mboxMutex.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, now.UTC().Format(time.ANSIC))
+	buf.Write(quoteMboxFrom(msg))
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// quoteMboxFrom prefixes lines matching ">*From " with one more ">"
+func quoteMboxFrom(msg []byte) []byte {
+	lines := bytes.SplitAfter(msg, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			lines[i] = append([]byte(">"), line...)
+		}
+	}
+	return bytes.Join(lines, nil)
+}
+
+// writeEML writes the message to a new .eml file named after the time and
+// the book, e.g. 20250301-120000.000-book.eml
+func writeEML(dir string, msg []byte, name string, now time.Time) (string, error) {
+	if err := ensureDirectory(dir); err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	base = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, base)
+	prefix := now.UTC().Format("20060102-150405.000")
+	for i := 0; ; i++ {
+		fileName := fmt.Sprintf("%s-%s.eml", prefix, base)
+		if i > 0 {
+			fileName = fmt.Sprintf("%s-%s-%d.eml", prefix, base, i)
+		}
+		path := filepath.Join(dir, fileName)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(msg); err != nil {
+			f.Close()
+			os.Remove(path)
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+// verifyDryRun checks and normalizes DryRunFormat
+func (b *SendToKindleBot) verifyDryRun() error {
+	b.DryRunFormat = strings.ToLower(b.DryRunFormat)
+	switch b.DryRunFormat {
+	case "":
+		b.DryRunFormat = DryRunMaildir
+	case DryRunMaildir, DryRunMbox, DryRunEML:
+	default:
+		return fmt.Errorf("%w, got %q", ErrInvalidDryRunFormat, b.DryRunFormat)
+	}
+	return nil
+}
+
+// dryRunNote is appended to the reply of a delivery made in dry run mode
+func dryRunNote(d dryRun) string {
+	if !d.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("\n\n🧪 Dry run: nothing was emailed, the message was saved to the %s", d.format)
+}
@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRun_write(t *testing.T) {
+	msg := []byte("Subject: Book: book.epub\r\n\r\nFrom the author\r\n>From a quote\r\n")
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("maildir", func(t *testing.T) {
+		dir := t.TempDir()
+		path, err := dryRun{format: DryRunMaildir, path: dir}.write(msg, "bot@example.com", "book.epub", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != filepath.Join(dir, "new") {
+			t.Errorf("write() = %s, want a file in new/", path)
+		}
+		assertFileContent(t, path, string(msg))
+		if entries, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(entries) != 0 {
+			t.Errorf("write() left %d files in tmp/", len(entries))
+		}
+	})
+
+	t.Run("eml", func(t *testing.T) {
+		dir := t.TempDir()
+		d := dryRun{format: DryRunEML, path: dir}
+		first, err := d.write(msg, "bot@example.com", "my/book.epub", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := d.write(msg, "bot@example.com", "my/book.epub", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(first) != "20250301-120000.000-my_book.eml" || first == second {
+			t.Errorf("write() = %s then %s, want two files named after the book", first, second)
+		}
+		assertFileContent(t, second, string(msg))
+	})
+
+	t.Run("mbox", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "outbox.mbox")
+		d := dryRun{format: DryRunMbox, path: path}
+		for i := 0; i < 2; i++ {
+			if _, err := d.write(msg, "bot@example.com", "book.epub", now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		message := "From bot@example.com Sat Mar  1 12:00:00 2025\n" +
+			"Subject: Book: book.epub\r\n\r\n>From the author\r\n>>From a quote\r\n\n"
+		assertFileContent(t, path, message+message)
+	})
+}
+
+func TestSendToKindleBot_SendFile_dryRun(t *testing.T) {
+	dir := t.TempDir()
+	book := filepath.Join(dir, "book.txt")
+	if err := os.WriteFile(book, []byte("Once upon a time"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outbox := filepath.Join(dir, "outbox")
+	b := &SendToKindleBot{
+		EmailFrom:    "bot@example.com",
+		EmailTo:      "me@kindle.com",
+		DryRunFormat: DryRunEML,
+		DryRunPath:   outbox,
+	}
+
+	if err := b.SendFile(context.Background(), book, "", nil); err != nil {
+		t.Fatalf("SendFile() error = %v", err)
+	}
+	entries, err := ioutil.ReadDir(outbox)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("SendFile() wrote %d emails, %v", len(entries), err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(outbox, entries[0].Name()))
+	for _, want := range []string{"To: me@kindle.com", "From: \"Send-to-Kindle Bot\" <bot@example.com>", "T25jZSB1cG9uIGEgdGltZQ=="} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("email =\n%s\nwant it to contain %q", content, want)
+		}
+	}
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != want {
+		t.Errorf("%s =\n%q\nwant\n%q", filepath.Base(path), content, want)
+	}
+}
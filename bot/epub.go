@@ -0,0 +1,304 @@
+package bot
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"text/template"
+	"time"
+)
+
+// epubDefaultStyle is used by books without a stylesheet of their own
+const epubDefaultStyle = `body { font-family: serif; line-height: 1.4; }
+h1, h2, h3 { font-family: sans-serif; }
+blockquote { margin: 1em 1.5em; font-style: italic; }
+.small { font-size: 0.85em; color: #555; }
+`
+
+// epubBook is a book written by writeEPUB
+type epubBook struct {
+	ID       string // unique identifier, a new urn:uuid when empty
+	Title    string
+	Authors  []string
+	Language string    // BCP 47, "en" when empty
+	Modified time.Time // now when zero
+	Style    string    // CSS of every chapter, epubDefaultStyle when empty
+	Chapters []epubChapter
+
+	Description string
+	Series      string // series the book belongs to, if any
+	SeriesIndex string // position of the book in Series, if known
+	Images      []epubImage
+	Cover       string // Href of the cover in Images, if any
+}
+
+// epubImage is an image referenced by the chapters as its Href
+type epubImage struct {
+	Href      string // relative to the chapters, like "images/cover.jpg"
+	MediaType string
+	Data      []byte
+}
+
+// epubChapter is one XHTML document of the book, listed in the table of
+// contents by its title
+type epubChapter struct {
+	Title    string
+	Body     string        // well-formed XHTML content of <body>
+	Sections []epubSection // listed below the chapter in the table of contents
+	Hidden   bool          // left out of the table of contents, like a cover page
+}
+
+// epubSection is a heading inside a chapter, linked by its id
+type epubSection struct {
+	ID    string
+	Title string
+}
+
+// epubNavPoint is an entry of the EPUB 2 table of contents, which numbers
+// all entries in reading order
+type epubNavPoint struct {
+	Order    int
+	Title    string
+	Src      string
+	Children []epubNavPoint
+}
+
+// NavPoints returns the table of contents of book for toc.ncx, exported
+// for the template
+func (book epubBook) NavPoints() []epubNavPoint {
+	var points []epubNavPoint
+	order := 0
+	for i, chapter := range book.Chapters {
+		if chapter.Hidden {
+			continue
+		}
+		order++
+		point := epubNavPoint{Order: order, Title: chapter.Title, Src: epubChapterHref(i)}
+		for _, section := range chapter.Sections {
+			order++
+			point.Children = append(point.Children,
+				epubNavPoint{Order: order, Title: section.Title, Src: epubChapterHref(i) + "#" + section.ID})
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// CoverID returns the manifest id of the cover image, exported for the
+// template
+func (book epubBook) CoverID() string {
+	for i, image := range book.Images {
+		if image.Href == book.Cover {
+			return fmt.Sprintf("image-%d", i)
+		}
+	}
+	return ""
+}
+
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{
+	"xml":  html.EscapeString,
+	"href": epubChapterHref,
+}).Parse(`
+{{define "container.xml"}}<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+{{end}}
+{{define "content.opf"}}<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="{{xml .Language}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{xml .ID}}</dc:identifier>
+    <dc:title>{{xml .Title}}</dc:title>
+{{- range .Authors}}
+    <dc:creator>{{xml .}}</dc:creator>
+{{- end}}
+    <dc:language>{{xml .Language}}</dc:language>
+{{- with .Description}}
+    <dc:description>{{xml .}}</dc:description>
+{{- end}}
+    <meta property="dcterms:modified">{{.Modified.UTC.Format "2006-01-02T15:04:05Z"}}</meta>
+{{- if .Series}}
+    <meta property="belongs-to-collection" id="series">{{xml .Series}}</meta>
+    <meta refines="#series" property="collection-type">series</meta>
+{{- with .SeriesIndex}}
+    <meta refines="#series" property="group-position">{{xml .}}</meta>
+{{- end}}
+    <meta name="calibre:series" content="{{xml .Series}}"/>
+{{- with .SeriesIndex}}
+    <meta name="calibre:series_index" content="{{xml .}}"/>
+{{- end}}
+{{- end}}
+{{- with .CoverID}}
+    <meta name="cover" content="{{.}}"/>
+{{- end}}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+{{- range $i, $c := .Chapters}}
+    <item id="chapter-{{$i}}" href="{{href $i}}" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range $i, $image := .Images}}
+    <item id="image-{{$i}}" href="{{xml $image.Href}}" media-type="{{xml $image.MediaType}}"{{if eq $image.Href $.Cover}} properties="cover-image"{{end}}/>
+{{- end}}
+  </manifest>
+  <spine toc="ncx">
+{{- range $i, $c := .Chapters}}
+    <itemref idref="chapter-{{$i}}"/>
+{{- end}}
+  </spine>
+</package>
+{{end}}
+{{define "nav.xhtml"}}<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{xml .Language}}">
+<head><title>{{xml .Title}}</title></head>
+<body>
+  <nav epub:type="toc">
+    <h1>{{xml .Title}}</h1>
+    <ol>
+{{- range $i, $c := .Chapters}}{{if not $c.Hidden}}
+      <li><a href="{{href $i}}">{{xml $c.Title}}</a>
+{{- if $c.Sections}}
+        <ol>
+{{- range $c.Sections}}
+          <li><a href="{{href $i}}#{{xml .ID}}">{{xml .Title}}</a></li>
+{{- end}}
+        </ol>
+{{- end}}</li>
+{{- end}}{{end}}
+    </ol>
+  </nav>
+</body>
+</html>
+{{end}}
+{{define "toc.ncx"}}<?xml version="1.0" encoding="utf-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head><meta name="dtb:uid" content="{{xml .ID}}"/></head>
+  <docTitle><text>{{xml .Title}}</text></docTitle>
+  <navMap>
+{{- range .NavPoints}}{{template "navPoint" .}}{{end}}
+  </navMap>
+</ncx>
+{{end}}
+{{define "navPoint"}}
+    <navPoint id="nav-{{.Order}}" playOrder="{{.Order}}"><navLabel><text>{{xml .Title}}</text></navLabel><content src="{{xml .Src}}"/>
+{{- range .Children}}{{template "navPoint" .}}{{end}}</navPoint>
+{{- end}}
+{{define "chapter"}}<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{xml .Language}}">
+<head>
+  <title>{{xml .Chapter.Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+{{.Chapter.Body}}
+</body>
+</html>
+{{end}}`))
+
+// writeEPUB writes book as an EPUB 3 file with an EPUB 2 table of contents
+// for older readers
+func writeEPUB(path string, book epubBook) (err error) {
+	if book.ID == "" {
+		book.ID = "urn:uuid:" + newUUID()
+	}
+	if book.Language == "" {
+		book.Language = "en"
+	}
+	if book.Modified.IsZero() {
+		book.Modified = time.Now()
+	}
+	if book.Style == "" {
+		book.Style = epubDefaultStyle
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	archive := zip.NewWriter(f)
+	// The mimetype comes first and uncompressed so readers can sniff it
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "application/epub+zip"); err != nil {
+		return err
+	}
+
+	type epubFile struct {
+		name, template string
+		data           interface{}
+	}
+	files := []epubFile{
+		{"META-INF/container.xml", "container.xml", book},
+		{"OEBPS/content.opf", "content.opf", book},
+		{"OEBPS/nav.xhtml", "nav.xhtml", book},
+		{"OEBPS/toc.ncx", "toc.ncx", book},
+	}
+	for i, chapter := range book.Chapters {
+		files = append(files, epubFile{"OEBPS/" + epubChapterHref(i), "chapter", struct {
+			Language string
+			Chapter  epubChapter
+		}{book.Language, chapter}})
+	}
+	for _, file := range files {
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if err := epubTemplates.ExecuteTemplate(w, file.template, file.data); err != nil {
+			return err
+		}
+	}
+	for _, image := range book.Images {
+		w, err := archive.Create("OEBPS/" + image.Href)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(image.Data); err != nil {
+			return err
+		}
+	}
+	w, err = archive.Create("OEBPS/style.css")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, book.Style); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// epubChapterHref returns the file name of the i-th chapter, for links
+// between chapters
+func epubChapterHref(i int) string {
+	return fmt.Sprintf("chapter-%d.xhtml", i)
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("00000000-0000-4000-8000-%012x", time.Now().UnixNano()&0xffffffffffff)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteEPUB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book.epub")
+	book := epubBook{
+		Title:    "Tom & Jerry <Collected>",
+		Authors:  []string{"William Hanna", "Joseph Barbera"},
+		Language: "en-GB",
+		Modified: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Chapters: []epubChapter{
+			{Title: "One", Body: "<h1>One</h1>\n<p>Cat &amp; mouse</p>"},
+			{Title: "Two & more", Body: "<p>Two</p>"},
+		},
+	}
+	if err := writeEPUB(path, book); err != nil {
+		t.Fatalf("writeEPUB() error = %v", err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("writeEPUB() did not write a zip: %v", err)
+	}
+	defer r.Close()
+	if first := r.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("first file = %s (method %d), want an uncompressed mimetype", first.Name, first.Method)
+	}
+	files := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+		if strings.HasSuffix(f.Name, ".xhtml") || strings.HasSuffix(f.Name, ".opf") || strings.HasSuffix(f.Name, ".ncx") {
+			// Every document must be well-formed XML
+			decoder := xml.NewDecoder(strings.NewReader(files[f.Name]))
+			for {
+				if _, err := decoder.Token(); err != nil {
+					if err != io.EOF {
+						t.Errorf("%s is not well-formed: %v", f.Name, err)
+					}
+					break
+				}
+			}
+		}
+	}
+	if files["mimetype"] != "application/epub+zip" {
+		t.Errorf("mimetype = %q", files["mimetype"])
+	}
+	for name, want := range map[string]string{
+		"OEBPS/content.opf":     `<dc:title>Tom &amp; Jerry &lt;Collected&gt;</dc:title>`,
+		"OEBPS/toc.ncx":         `<text>Two &amp; more</text>`,
+		"OEBPS/nav.xhtml":       `<a href="chapter-1.xhtml">Two &amp; more</a>`,
+		"OEBPS/chapter-0.xhtml": "<p>Cat &amp; mouse</p>",
+		"OEBPS/style.css":       epubDefaultStyle,
+	} {
+		if !strings.Contains(files[name], want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, files[name])
+		}
+	}
+	if !strings.Contains(files["OEBPS/content.opf"], `<meta property="dcterms:modified">2026-10-18T12:00:00Z</meta>`) {
+		t.Errorf("content.opf has no modification time:\n%s", files["OEBPS/content.opf"])
+	}
+
+	m := extractMetadata("book.epub", path)
+	if m.Title != book.Title || strings.Join(m.Authors, ", ") != "William Hanna, Joseph Barbera" || m.Language != "en-GB" {
+		t.Errorf("extractMetadata() = %+v", m)
+	}
+}
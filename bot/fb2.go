@@ -0,0 +1,669 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// fb2Style is added to epubDefaultStyle for books converted from FB2
+const fb2Style = `p { margin: 0; text-indent: 1.5em; }
+h1, h2, h3, h4, h5, h6 { text-align: center; margin: 1em 0; }
+.title, .subtitle { text-align: center; font-weight: bold; text-indent: 0; margin: 0.5em 0; }
+.epigraph { margin: 1em 0 1em 30%; }
+.cite { margin: 1em 1.5em; }
+.poem { margin: 1em 0 1em 2em; }
+.stanza { margin: 0.5em 0; }
+.v, .text-author, .date, .empty-line { text-indent: 0; }
+.text-author { text-align: right; font-style: italic; }
+.date { text-align: right; }
+.image, .cover { text-align: center; margin: 1em 0; }
+img { max-width: 100%; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #999; padding: 0.2em 0.5em; }
+aside { font-size: 0.85em; margin: 0.5em 0; }
+aside p { text-indent: 0; }
+`
+
+// maxFB2Size limits the FictionBook read from a zip, which can be much
+// larger than the upload itself
+const maxFB2Size = 100 << 20
+
+// fb2ImageTypes maps the image types readers display to their extension
+var fb2ImageTypes = map[string]string{
+	"image/jpeg":    "jpg",
+	"image/png":     "png",
+	"image/gif":     "gif",
+	"image/svg+xml": "svg",
+}
+
+// FB2Formats returns the extensions read by FB2 converters
+func FB2Formats() []string {
+	return []string{"fb2", "fb2.zip"}
+}
+
+// fb2Converter converts FictionBook 2 documents to EPUB without an external
+// program
+type fb2Converter struct {
+	cfg ConverterConfig
+}
+
+func (c *fb2Converter) name() string {
+	return c.cfg.Name
+}
+
+func (c *fb2Converter) convert(ctx context.Context, in, out string, onProgress func(percent int)) error {
+	content, err := readFB2File(in)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errConversion, filepath.Base(in), err)
+	}
+	doc, err := parseFB2(content)
+	if err != nil {
+		return fmt.Errorf("%w: %s is not a valid FB2 file: %v", errConversion, filepath.Base(in), err)
+	}
+	book := doc.book(trimFormat(filepath.Base(in)))
+	if len(book.Chapters) == 0 {
+		return fmt.Errorf("%w: %s is empty", errConversion, filepath.Base(in))
+	}
+	return writeEPUB(out, book)
+}
+
+// readFB2File returns the FictionBook in path, taken from the first .fb2
+// file of a zip
+func readFB2File(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return data, nil
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range archive.File {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".fb2") {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		content, err := ioutil.ReadAll(io.LimitReader(rc, maxFB2Size+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > maxFB2Size {
+			return nil, fmt.Errorf("%s is larger than %s", file.Name, formatFileSize(maxFB2Size))
+		}
+		return content, nil
+	}
+	return nil, errors.New("zip has no .fb2 file")
+}
+
+// fb2Node is an element of a FictionBook body, or text when Name is empty
+type fb2Node struct {
+	Name     string
+	Text     string
+	Attrs    map[string]string // by local name, e.g. "href" for l:href
+	Children []*fb2Node
+}
+
+// child returns the first child element called name
+func (n *fb2Node) child(name string) *fb2Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// text returns the text of n, a line per paragraph. Note references are
+// left out
+func (n *fb2Node) text() string {
+	if n.Name == "" {
+		return n.Text
+	}
+	if n.Name == "a" && n.Attrs["type"] == "note" {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range n.Children {
+		b.WriteString(c.text())
+	}
+	switch n.Name {
+	case "p", "v", "subtitle", "text-author":
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// walk calls fn for n and every element below it
+func (n *fb2Node) walk(fn func(*fb2Node)) {
+	if n.Name == "" {
+		return
+	}
+	fn(n)
+	for _, c := range n.Children {
+		c.walk(fn)
+	}
+}
+
+// fb2Binary is an embedded file, base64 encoded
+type fb2Binary struct {
+	ID          string `xml:"id,attr"`
+	ContentType string `xml:"content-type,attr"`
+	Data        string `xml:",chardata"`
+}
+
+// fb2Document is a parsed FictionBook: the first body is the book, the
+// others hold its notes
+type fb2Document struct {
+	Info     fb2TitleInfo
+	Bodies   []*fb2Node
+	Binaries map[string]fb2Binary
+}
+
+// parseFB2 parses a FictionBook in UTF-8 or one of the legacy encodings of
+// charsetReader
+func parseFB2(content []byte) (*fb2Document, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(fb2Clean(content)))
+	decoder.CharsetReader = charsetReader
+	decoder.Entity = xml.HTMLEntity
+	doc := &fb2Document{Binaries: make(map[string]fb2Binary)}
+	root := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "FictionBook":
+			root = true
+		case "title-info":
+			if err := decoder.DecodeElement(&doc.Info, &start); err != nil {
+				return nil, err
+			}
+		case "body":
+			body, err := parseFB2Node(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+			doc.Bodies = append(doc.Bodies, body)
+		case "binary":
+			var binary fb2Binary
+			if err := decoder.DecodeElement(&binary, &start); err != nil {
+				return nil, err
+			}
+			doc.Binaries[binary.ID] = binary
+		}
+	}
+	if !root {
+		return nil, errors.New("no FictionBook element")
+	}
+	return doc, nil
+}
+
+// fb2Clean drops the control characters XML does not allow, byte by byte
+// as the encoding is not known yet
+func fb2Clean(content []byte) []byte {
+	clean := content[:0:0]
+	for _, c := range content {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			continue
+		}
+		clean = append(clean, c)
+	}
+	return clean
+}
+
+func parseFB2Node(decoder *xml.Decoder, start xml.StartElement) (*fb2Node, error) {
+	node := &fb2Node{Name: start.Name.Local, Attrs: make(map[string]string)}
+	for _, attr := range start.Attr {
+		node.Attrs[attr.Name.Local] = attr.Value
+	}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := parseFB2Node(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+		case xml.CharData:
+			node.Children = append(node.Children, &fb2Node{Text: string(t)})
+		case xml.EndElement:
+			return node, nil
+		}
+	}
+}
+
+// fb2Part is a chapter of the book before it is rendered
+type fb2Part struct {
+	title string
+	nodes []*fb2Node
+	kind  int
+}
+
+const (
+	fb2Cover   = iota // the cover image
+	fb2Intro          // what the main body has before its sections
+	fb2Section        // a top level section of the main body
+	fb2Notes          // a body of notes
+)
+
+// book converts the document to an EPUB: a cover page, then a chapter per
+// top level section with the next level in the table of contents and a
+// chapter per body of notes, which are EPUB 3 popup footnotes. Untitled
+// books are called title
+func (d *fb2Document) book(title string) epubBook {
+	metadata := d.Info.metadata()
+	if metadata.Title != "" {
+		title = metadata.Title
+	}
+	book := epubBook{
+		Title:       title,
+		Authors:     metadata.Authors,
+		Language:    metadata.Language,
+		Description: metadata.Description,
+		Style:       epubDefaultStyle + fb2Style,
+	}
+	if len(d.Info.Sequences) > 0 {
+		book.Series = strings.TrimSpace(d.Info.Sequences[0].Name)
+		book.SeriesIndex = strings.TrimSpace(d.Info.Sequences[0].Number)
+	}
+	r := &fb2Renderer{
+		doc:     d,
+		book:    &book,
+		images:  make(map[string]string),
+		ids:     make(map[string]string),
+		targets: make(map[string]int),
+		notes:   make(map[string]bool),
+	}
+
+	// Plan the chapters first, links can point to any of them
+	var parts []fb2Part
+	for _, image := range d.Info.Coverpage.Images {
+		if href := r.image(strings.TrimPrefix(image.Href, "#")); href != "" {
+			book.Cover = href
+			parts = append(parts, fb2Part{title: title, kind: fb2Cover})
+			break
+		}
+	}
+	for i, body := range d.Bodies {
+		if i > 0 {
+			parts = append(parts, fb2Part{title: r.titleText(body, "Notes"), nodes: []*fb2Node{body}, kind: fb2Notes})
+			continue
+		}
+		// The title, epigraphs and images before the first section open the book
+		var intro, sections []fb2Part
+		for _, c := range body.Children {
+			switch {
+			case c.Name == "section":
+				sections = append(sections, fb2Part{title: r.titleText(c, ""), nodes: []*fb2Node{c}, kind: fb2Section})
+			case c.Name != "" && len(sections) == 0:
+				if len(intro) == 0 {
+					intro = append(intro, fb2Part{title: title, kind: fb2Intro})
+				}
+				intro[0].nodes = append(intro[0].nodes, c)
+			}
+		}
+		parts = append(append(parts, intro...), sections...)
+	}
+	for i, part := range parts {
+		for _, node := range part.nodes {
+			node.walk(func(n *fb2Node) {
+				if id := n.Attrs["id"]; id != "" {
+					r.addTarget(id, i)
+				}
+				if part.kind == fb2Notes && n.Name == "section" && n.Attrs["id"] != "" && n.child("section") == nil {
+					r.notes[r.ids[n.Attrs["id"]]] = true
+				}
+			})
+		}
+	}
+
+	for _, part := range parts {
+		chapter := epubChapter{Title: part.title}
+		var out strings.Builder
+		switch part.kind {
+		case fb2Cover:
+			chapter.Hidden = true
+			fmt.Fprintf(&out, "<div class=\"cover\"><img src=\"%s\" alt=\"%s\"/></div>", html.EscapeString(book.Cover), html.EscapeString(title))
+		case fb2Intro:
+			for _, n := range part.nodes {
+				r.block(&out, n, 1, &chapter)
+			}
+		case fb2Section:
+			r.section(&out, part.nodes[0], 1, &chapter)
+		case fb2Notes:
+			for _, n := range part.nodes[0].Children {
+				r.block(&out, n, 1, &chapter)
+			}
+		}
+		chapter.Body = strings.TrimSpace(out.String())
+		book.Chapters = append(book.Chapters, chapter)
+	}
+	return book
+}
+
+// fb2Renderer renders the bodies of a document to XHTML
+type fb2Renderer struct {
+	doc      *fb2Document
+	book     *epubBook
+	images   map[string]string // binary id to its Href in book.Images
+	ids      map[string]string // FB2 id to its unique XML id
+	targets  map[string]int    // XML id to the chapter it is in
+	notes    map[string]bool   // XML ids of the sections rendered as footnotes
+	sections int               // section ids generated so far
+}
+
+// titleText returns the title of a section or body for the table of
+// contents: its title, or else the beginning of its text or fallback
+func (r *fb2Renderer) titleText(n *fb2Node, fallback string) string {
+	if title := n.child("title"); title != nil {
+		if text := strings.Join(strings.Fields(title.text()), " "); text != "" {
+			return text
+		}
+	}
+	if fallback != "" {
+		return fallback
+	}
+	return queueTitle(n.text())
+}
+
+// section renders a section at depth, the top level being 1. Sections at
+// depth 2 are listed in the table of contents
+func (r *fb2Renderer) section(out *strings.Builder, n *fb2Node, depth int, chapter *epubChapter) {
+	id := r.ids[n.Attrs["id"]]
+	if id == "" {
+		for {
+			r.sections++
+			id = fmt.Sprintf("section-%d", r.sections)
+			if _, taken := r.targets[id]; !taken {
+				break
+			}
+		}
+	} else if r.notes[id] {
+		r.note(out, n, id)
+		return
+	}
+	if depth == 2 && chapter != nil && n.child("title") != nil {
+		chapter.Sections = append(chapter.Sections, epubSection{ID: id, Title: r.titleText(n, "")})
+	}
+	fmt.Fprintf(out, "<div class=\"section\" id=\"%s\">\n", id)
+	for _, c := range n.Children {
+		r.block(out, c, depth, chapter)
+	}
+	out.WriteString("</div>\n")
+}
+
+// note renders a section of a body of notes as a popup footnote, its
+// title is the label
+func (r *fb2Renderer) note(out *strings.Builder, n *fb2Node, id string) {
+	var body strings.Builder
+	label := ""
+	for _, c := range n.Children {
+		if c.Name == "title" {
+			label = html.EscapeString(strings.Join(strings.Fields(c.text()), " "))
+			continue
+		}
+		r.block(&body, c, 6, nil)
+	}
+	content := strings.TrimSpace(body.String())
+	if label != "" {
+		if strings.HasPrefix(content, "<p>") {
+			content = "<p><b>" + label + "</b> " + strings.TrimPrefix(content, "<p>")
+		} else {
+			content = "<p><b>" + label + "</b></p>\n" + content
+		}
+	}
+	fmt.Fprintf(out, "<aside epub:type=\"footnote\" id=\"%s\">\n%s\n</aside>\n", id, content)
+}
+
+// block renders an element of a section at depth
+func (r *fb2Renderer) block(out *strings.Builder, n *fb2Node, depth int, chapter *epubChapter) {
+	switch n.Name {
+	case "":
+	case "section":
+		r.section(out, n, depth+1, chapter)
+	case "title":
+		level := depth
+		if level > 6 {
+			level = 6
+		}
+		fmt.Fprintf(out, "<h%d%s>%s</h%d>\n", level, r.id(n), r.title(n), level)
+	case "p", "subtitle", "text-author", "date", "v":
+		class := ""
+		if n.Name != "p" {
+			class = ` class="` + n.Name + `"`
+		}
+		fmt.Fprintf(out, "<p%s%s>%s</p>\n", class, r.id(n), r.inline(n))
+	case "empty-line":
+		out.WriteString("<p class=\"empty-line\">&#160;</p>\n")
+	case "image":
+		if img := r.img(n); img != "" {
+			fmt.Fprintf(out, "<div class=\"image\"%s>%s</div>\n", r.id(n), img)
+		}
+	case "epigraph", "cite":
+		fmt.Fprintf(out, "<blockquote class=\"%s\"%s>\n", n.Name, r.id(n))
+		r.blocks(out, n, depth, chapter)
+		out.WriteString("</blockquote>\n")
+	case "annotation", "poem", "stanza":
+		fmt.Fprintf(out, "<div class=\"%s\"%s>\n", n.Name, r.id(n))
+		r.blocks(out, n, depth, chapter)
+		out.WriteString("</div>\n")
+	case "table":
+		r.table(out, n)
+	default:
+		r.blocks(out, n, depth, chapter)
+	}
+}
+
+// blocks renders the children of an element nested in a section, their
+// titles are not headings
+func (r *fb2Renderer) blocks(out *strings.Builder, n *fb2Node, depth int, chapter *epubChapter) {
+	for _, c := range n.Children {
+		if c.Name == "title" {
+			fmt.Fprintf(out, "<p class=\"title\"%s>%s</p>\n", r.id(c), r.title(c))
+			continue
+		}
+		r.block(out, c, depth, chapter)
+	}
+}
+
+// title renders the paragraphs of a title as lines
+func (r *fb2Renderer) title(n *fb2Node) string {
+	var lines []string
+	for _, c := range n.Children {
+		if c.Name == "p" {
+			lines = append(lines, r.inline(c))
+		}
+	}
+	return strings.Join(lines, "<br/>")
+}
+
+func (r *fb2Renderer) table(out *strings.Builder, n *fb2Node) {
+	out.WriteString("<table>\n")
+	for _, row := range n.Children {
+		if row.Name != "tr" {
+			continue
+		}
+		out.WriteString("<tr>")
+		for _, cell := range row.Children {
+			if cell.Name != "th" && cell.Name != "td" {
+				continue
+			}
+			attrs := ""
+			for _, span := range []string{"colspan", "rowspan"} {
+				if value := cell.Attrs[span]; value != "" && strings.Trim(value, "0123456789") == "" {
+					attrs += fmt.Sprintf(" %s=\"%s\"", span, value)
+				}
+			}
+			switch align := cell.Attrs["align"]; align {
+			case "left", "right", "center":
+				attrs += ` style="text-align: ` + align + `"`
+			}
+			fmt.Fprintf(out, "<%s%s>%s</%s>", cell.Name, attrs, r.inline(cell), cell.Name)
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("</table>\n")
+}
+
+// inline renders the content of a paragraph
+func (r *fb2Renderer) inline(n *fb2Node) string {
+	var out strings.Builder
+	for _, c := range n.Children {
+		switch c.Name {
+		case "":
+			out.WriteString(html.EscapeString(c.Text))
+		case "strong", "sub", "sup", "code":
+			out.WriteString("<" + c.Name + ">" + r.inline(c) + "</" + c.Name + ">")
+		case "emphasis":
+			out.WriteString("<em>" + r.inline(c) + "</em>")
+		case "strikethrough":
+			out.WriteString("<del>" + r.inline(c) + "</del>")
+		case "a":
+			out.WriteString(r.link(c))
+		case "image":
+			out.WriteString(r.img(c))
+		default:
+			out.WriteString(r.inline(c))
+		}
+	}
+	return out.String()
+}
+
+// link renders a link: to a note as a popup footnote reference, to another
+// part of the book to the chapter it is in, or to the web
+func (r *fb2Renderer) link(n *fb2Node) string {
+	content := r.inline(n)
+	href := n.Attrs["href"]
+	if !strings.HasPrefix(href, "#") {
+		return markupLink(href, content)
+	}
+	id, ok := r.ids[href[1:]]
+	if !ok {
+		return content
+	}
+	chapter := r.targets[id]
+	target := html.EscapeString(epubChapterHref(chapter) + "#" + id)
+	if n.Attrs["type"] == "note" || r.notes[id] {
+		if !strings.HasPrefix(content, "<sup>") {
+			content = "<sup>" + content + "</sup>"
+		}
+		return `<a epub:type="noteref" href="` + target + `">` + content + "</a>"
+	}
+	return `<a href="` + target + `">` + content + "</a>"
+}
+
+// img renders an image, or nothing when its binary is missing or not an
+// image readers display
+func (r *fb2Renderer) img(n *fb2Node) string {
+	href := r.image(strings.TrimPrefix(n.Attrs["href"], "#"))
+	if href == "" {
+		return ""
+	}
+	return `<img src="` + html.EscapeString(href) + `" alt="` + html.EscapeString(n.Attrs["alt"]) + `"/>`
+}
+
+// image adds the binary id to the book the first time it is used and
+// returns its Href, empty when it can't be used
+func (r *fb2Renderer) image(id string) string {
+	if href, ok := r.images[id]; ok {
+		return href
+	}
+	r.images[id] = ""
+	binary, ok := r.doc.Binaries[id]
+	if !ok {
+		return ""
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(binary.Data), ""))
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(binary.ContentType))
+	if mediaType == "image/jpg" {
+		mediaType = "image/jpeg"
+	}
+	if _, ok := fb2ImageTypes[mediaType]; !ok {
+		mediaType = http.DetectContentType(data)
+	}
+	extension, ok := fb2ImageTypes[mediaType]
+	if !ok {
+		return ""
+	}
+	href := fmt.Sprintf("images/image-%d.%s", len(r.book.Images), extension)
+	r.book.Images = append(r.book.Images, epubImage{Href: href, MediaType: mediaType, Data: data})
+	r.images[id] = href
+	return href
+}
+
+// id renders the id attribute of an element, if it has one
+func (r *fb2Renderer) id(n *fb2Node) string {
+	if id := r.ids[n.Attrs["id"]]; id != "" {
+		return ` id="` + id + `"`
+	}
+	return ""
+}
+
+// addTarget registers the FB2 id of an element in a chapter. Distinct ids
+// like "note 1" and "note_1" make the same XML id, later ones get a suffix
+func (r *fb2Renderer) addTarget(id string, chapter int) {
+	if _, ok := r.ids[id]; ok {
+		return
+	}
+	xmlID := fb2ID(id)
+	for n := 2; ; n++ {
+		if _, taken := r.targets[xmlID]; !taken {
+			break
+		}
+		xmlID = fmt.Sprintf("%s-%d", fb2ID(id), n)
+	}
+	r.ids[id] = xmlID
+	r.targets[xmlID] = chapter
+}
+
+// fb2ID makes an FB2 id a valid XML id, FB2 books use ids like "1" or
+// "note 1"
+func fb2ID(id string) string {
+	if id == "" {
+		return ""
+	}
+	id = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+	if first := []rune(id)[0]; !unicode.IsLetter(first) && first != '_' {
+		id = "id-" + id
+	}
+	return id
+}
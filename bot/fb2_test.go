@@ -0,0 +1,225 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPNG is a 1x1 PNG, base64 encoded
+const testPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+const testFB2 = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info>
+    <author><first-name>Jane</first-name><last-name>Doe</last-name></author>
+    <book-title>Field Guide</book-title>
+    <annotation><p>About birds.</p></annotation>
+    <coverpage><image l:href="#cover.png"/></coverpage>
+    <lang>en</lang>
+    <sequence name="Nature" number="2"/>
+  </title-info>
+</description>
+<body>
+  <title><p>Jane Doe</p><p>Field Guide</p></title>
+  <epigraph><p>Look up.</p><text-author>A. Birder</text-author></epigraph>
+  <section id="birds">
+    <title><p>Birds</p></title>
+    <p>Owls<a l:href="#n1" type="note">1</a> hunt at night &amp; sleep by day.</p>
+    <section>
+      <title><p>Owls</p></title>
+      <poem><title><p>Night</p></title><stanza><v>Who</v><v>who</v></stanza><text-author>Owl</text-author></poem>
+      <image l:href="#cover.png"/>
+    </section>
+  </section>
+  <section>
+    <p>An untitled section about <strong>trees</strong>, see <a l:href="#birds">birds</a>.</p>
+    <table><tr><th>Oak</th><td align="center" colspan="2">Ash</td></tr></table>
+    <empty-line/>
+    <cite><p>Trees are tall.</p></cite>
+  </section>
+</body>
+<body name="notes">
+  <title><p>Notes</p></title>
+  <section id="n1"><title><p>1</p></title><p>Mostly.</p></section>
+</body>
+<binary id="cover.png" content-type="image/png">` + testPNG + `</binary>
+</FictionBook>
+`
+
+func TestFB2DocumentBook(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		wantTitle    string
+		wantChapters []string // title: sections
+		wantBody     []string // content of each chapter
+	}{
+		{
+			name:         "book",
+			content:      testFB2,
+			wantTitle:    "Field Guide",
+			wantChapters: []string{"Field Guide:", "Field Guide:", "Birds:Owls", "An untitled section about trees, see birds.:", "Notes:"},
+			wantBody: []string{
+				`<div class="cover"><img src="images/image-0.png" alt="Field Guide"/></div>`,
+				"<h1>Jane Doe<br/>Field Guide</h1>",
+				`Owls<a epub:type="noteref" href="chapter-4.xhtml#n1"><sup>1</sup></a> hunt at night &amp; sleep by day.`,
+				`see <a href="chapter-2.xhtml#birds">birds</a>`,
+				"<aside epub:type=\"footnote\" id=\"n1\">\n<p><b>1</b> Mostly.</p>\n</aside>",
+			},
+		},
+		{
+			name:         "untitled book with numeric ids",
+			content:      `<FictionBook><body><section id="1"><title><p>One</p></title><p>Text<a l:href="#2">*</a></p></section></body><body><section id="2"><p>Note</p></section></body></FictionBook>`,
+			wantTitle:    "book",
+			wantChapters: []string{"One:", "Notes:"},
+			wantBody: []string{
+				`<div class="section" id="id-1">`,
+				"<aside epub:type=\"footnote\" id=\"id-2\">\n<p>Note</p>\n</aside>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseFB2([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("parseFB2() error = %v", err)
+			}
+			book := doc.book("book")
+			if book.Title != tt.wantTitle {
+				t.Errorf("book().Title = %q, want %q", book.Title, tt.wantTitle)
+			}
+			var chapters []string
+			for _, chapter := range book.Chapters {
+				var sections []string
+				for _, section := range chapter.Sections {
+					sections = append(sections, section.Title)
+				}
+				chapters = append(chapters, chapter.Title+":"+strings.Join(sections, ","))
+			}
+			if strings.Join(chapters, "|") != strings.Join(tt.wantChapters, "|") {
+				t.Fatalf("book() chapters = %q, want %q", chapters, tt.wantChapters)
+			}
+			for _, want := range tt.wantBody {
+				found := false
+				for _, chapter := range book.Chapters {
+					found = found || strings.Contains(chapter.Body, want)
+				}
+				if !found {
+					t.Errorf("no chapter contains %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestFB2Converter(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "guide.fb2.zip")
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(f)
+	w, _ := archive.Create("guide.fb2")
+	io.WriteString(w, testFB2)
+	archive.Close()
+	f.Close()
+
+	out := filepath.Join(dir, "guide.epub")
+	c := &fb2Converter{cfg: ConverterConfig{Name: ConverterTypeFB2}}
+	if err := c.convert(context.Background(), in, out, nil); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+	epub, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epub.Close()
+	files := make(map[string]string)
+	for _, file := range epub.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[file.Name] = string(data)
+		if strings.HasSuffix(file.Name, ".xhtml") || strings.HasSuffix(file.Name, ".ncx") || strings.HasSuffix(file.Name, ".opf") {
+			// Every document must be well-formed XML
+			decoder := xml.NewDecoder(strings.NewReader(string(data)))
+			for {
+				if _, err := decoder.Token(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Errorf("%s is not well-formed: %v\n%s", file.Name, err, data)
+					break
+				}
+			}
+		}
+	}
+	for name, want := range map[string]string{
+		"OEBPS/content.opf":     `<item id="image-0" href="images/image-0.png" media-type="image/png" properties="cover-image"/>`,
+		"OEBPS/nav.xhtml":       `<a href="chapter-2.xhtml#section-1">Owls</a>`,
+		"OEBPS/chapter-2.xhtml": `<p class="v">Who</p>`,
+		"OEBPS/chapter-3.xhtml": `<td colspan="2" style="text-align: center">Ash</td>`,
+		"OEBPS/style.css":       ".epigraph",
+	} {
+		if !strings.Contains(files[name], want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, files[name])
+		}
+	}
+	for _, want := range []string{
+		`<meta refines="#series" property="group-position">2</meta>`,
+		`<meta name="calibre:series" content="Nature"/>`,
+		`<meta name="cover" content="image-0"/>`,
+		"<dc:description>About birds.</dc:description>",
+	} {
+		if !strings.Contains(files["OEBPS/content.opf"], want) {
+			t.Errorf("content.opf does not contain %q", want)
+		}
+	}
+	if files["OEBPS/images/image-0.png"] == "" {
+		t.Error("cover image not written")
+	}
+	if strings.Contains(files["OEBPS/nav.xhtml"], "chapter-0.xhtml") {
+		t.Error("cover page listed in the table of contents")
+	}
+
+	// Legacy encodings are common
+	cp1251 := filepath.Join(dir, "legacy.fb2")
+	content := append([]byte(`<?xml version="1.0" encoding="windows-1251"?><FictionBook><description><title-info><book-title>`),
+		0xCA, 0xED, 0xE8, 0xE3, 0xE0)
+	content = append(content, []byte("</book-title></title-info></description><body><section><p>\x01Text</p></section></body></FictionBook>")...)
+	ioutil.WriteFile(cp1251, content, 0600)
+	if err := c.convert(context.Background(), cp1251, out, nil); err != nil {
+		t.Fatalf("convert(windows-1251) error = %v", err)
+	}
+	if got := epubTitle(t, out); got != "Книга" {
+		t.Errorf("windows-1251 title = %q, want %q", got, "Книга")
+	}
+
+	invalid := filepath.Join(dir, "invalid.fb2")
+	ioutil.WriteFile(invalid, []byte("<FictionBook><body>"), 0600)
+	if err := c.convert(context.Background(), invalid, out, nil); !errors.Is(err, errConversion) {
+		t.Errorf("convert(invalid) error = %v, want errConversion", err)
+	}
+}
+
+// epubTitle returns the title in the package document of an EPUB
+func epubTitle(t *testing.T, path string) string {
+	t.Helper()
+	m, err := epubMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Title
+}
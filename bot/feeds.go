@@ -0,0 +1,1144 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"html"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	feedsFileName       = ".bot-feeds.json"
+	feedsCallbackPrefix = "feeds:"
+	feedsDeviceCallback = feedsCallbackPrefix + "device:"
+	feedUserAgent       = "send-to-kindle-telegram-bot (+https://github.com/michaelfmnk/send-to-kindle-telegram-bot)"
+	// feedFetchTimeout bounds fetching one feed or article page
+	feedFetchTimeout = 30 * time.Second
+	// maxFeedSize is how much of a feed or article page is read
+	maxFeedSize = 10 << 20
+	// maxFeedsPerUser caps the subscriptions of a user
+	maxFeedsPerUser = 50
+	// maxDigestItemsPerFeed and maxDigestItems cap the articles of one digest,
+	// the newest items of a feed win
+	maxDigestItemsPerFeed = 10
+	maxDigestItems        = 50
+	// maxSeenItems is how many delivered item IDs are remembered per feed
+	maxSeenItems = 500
+	// minFeedContent is how much text the content of an item needs to be
+	// used as is, shorter items are summaries and their page is fetched
+	minFeedContent = 1500
+)
+
+var (
+	// ErrNotAFeed - represents a document that is neither RSS nor Atom
+	ErrNotAFeed = errors.New("not an RSS or Atom feed")
+	// ErrInvalidFeedURL - represents a feed URL that is not http(s)
+	ErrInvalidFeedURL = errors.New("feed url must be an http(s) url")
+	// ErrTooManyFeeds - represents a subscription above maxFeedsPerUser
+	ErrTooManyFeeds = errors.New("too many feeds")
+	// ErrInvalidSchedule - represents a digest schedule that cannot be parsed
+	ErrInvalidSchedule = errors.New(`schedule must be "daily HH:MM" or "weekly <day> HH:MM"`)
+	// ErrNoFeeds - represents a digest of a user without subscriptions
+	ErrNoFeeds = errors.New("no feeds subscribed")
+	// ErrPrivateAddress - represents a feed or page on a loopback, private or link-local address
+	ErrPrivateAddress = errors.New("address is not public")
+
+	// defaultDigestSchedule is used until a user picks a schedule
+	defaultDigestSchedule = digestSchedule{Hour: 7}
+
+	// feedClient fetches feeds and article pages. It only connects to public
+	// addresses, checked after DNS resolution and on every redirect, so
+	// users can't make the bot fetch from its own network. It uses no proxy,
+	// the check has to see the address of the site itself
+	feedClient = &http.Client{Timeout: feedFetchTimeout, Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: publicDialControl}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+
+	// publicAddress reports whether feeds and pages may be fetched from ip,
+	// a variable so tests can serve fixtures on the loopback address
+	publicAddress = isPublicAddress
+
+	// nonPublicNetworks are special-purpose ranges not covered by the
+	// methods of net.IP: "this network", carrier-grade NAT (also used for
+	// cloud metadata), IETF protocol assignments, benchmarking and reserved
+	nonPublicNetworks = []*net.IPNet{
+		mustParseCIDR("0.0.0.0/8"),
+		mustParseCIDR("100.64.0.0/10"),
+		mustParseCIDR("192.0.0.0/24"),
+		mustParseCIDR("198.18.0.0/15"),
+		mustParseCIDR("240.0.0.0/4"),
+	}
+
+	feedDateLayouts = []string{
+		time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST",
+		"2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04 -0700", time.RFC822Z, time.RFC822,
+		"2006-01-02T15:04:05", "2006-01-02",
+	}
+)
+
+// feedItem is an entry of an RSS or Atom feed
+type feedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	Author    string
+	Published time.Time
+	Content   string // HTML, the full text or a summary
+}
+
+// feed is a parsed RSS or Atom feed
+type feed struct {
+	Title string
+	Link  string
+	Items []feedItem // newest first
+}
+
+// feedDocument decodes RSS 2.0, RSS 1.0 (RDF) and Atom documents alike,
+// only the fields of the root element in use are set
+type feedDocument struct {
+	XMLName xml.Name
+	Channel struct {
+		Title string    `xml:"title"`
+		Links []string  `xml:"link"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"` // RSS 1.0 keeps them next to the channel
+	Title   feedText    `xml:"title"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Links       []string `xml:"link"`
+	GUID        string   `xml:"guid"`
+	About       string   `xml:"about,attr"`
+	Description string   `xml:"description"`
+	Content     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	PubDate     string   `xml:"pubDate"`
+	Date        string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   feedText   `xml:"title"`
+	Links   []atomLink `xml:"link"`
+	Content feedText   `xml:"content"`
+	Summary feedText   `xml:"summary"`
+	Authors []struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// feedText is an Atom text construct
+type feedText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+// html returns the text construct as HTML
+func (t feedText) html() string {
+	switch strings.ToLower(t.Type) {
+	case "xhtml":
+		return t.Inner
+	case "html", "text/html":
+		return t.Text
+	}
+	return textToXHTML(t.Text)
+}
+
+// alternateLink returns the link to the page of an Atom feed or entry
+func alternateLink(links []atomLink) string {
+	for _, link := range links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// firstText returns the first of values that is not blank, trimmed
+func firstText(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// plainText returns the text of a title that may contain markup
+func plainText(s string) string {
+	if strings.ContainsAny(s, "<&") {
+		return parseHTML([]byte(s)).textContent()
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// parseFeedDate parses the date formats found in feeds, zero when unknown
+func parseFeedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseFeed parses an RSS or Atom feed. Relative links are resolved against
+// base, the URL the feed was fetched from
+func parseFeed(content []byte, base *url.URL) (*feed, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = charsetReader
+	var doc feedDocument
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAFeed, err)
+	}
+
+	f := &feed{}
+	switch strings.ToLower(doc.XMLName.Local) {
+	case "rss", "rdf":
+		f.Title = plainText(doc.Channel.Title)
+		f.Link = absoluteLink(firstText(doc.Channel.Links...), base)
+		items := doc.Channel.Items
+		if len(items) == 0 {
+			items = doc.Items
+		}
+		for _, item := range items {
+			link := absoluteLink(firstText(item.Links...), base)
+			f.Items = append(f.Items, feedItem{
+				ID:        firstText(item.GUID, item.About, link, item.Title+" "+item.PubDate),
+				Title:     plainText(item.Title),
+				Link:      link,
+				Author:    firstText(item.Creator, item.Author),
+				Published: parseFeedDate(firstText(item.PubDate, item.Date)),
+				Content:   firstText(item.Content, item.Description),
+			})
+		}
+	case "feed":
+		f.Title = plainText(doc.Title.Text)
+		f.Link = absoluteLink(alternateLink(doc.Links), base)
+		for _, entry := range doc.Entries {
+			link := absoluteLink(alternateLink(entry.Links), base)
+			item := feedItem{
+				ID:        firstText(entry.ID, link, entry.Title.Text+" "+entry.Updated),
+				Title:     plainText(entry.Title.Text),
+				Link:      link,
+				Published: parseFeedDate(firstText(entry.Published, entry.Updated)),
+				Content:   firstText(entry.Content.html(), entry.Summary.html()),
+			}
+			if len(entry.Authors) > 0 {
+				item.Author = strings.TrimSpace(entry.Authors[0].Name)
+			}
+			f.Items = append(f.Items, item)
+		}
+	default:
+		return nil, fmt.Errorf("%w: root element <%s>", ErrNotAFeed, doc.XMLName.Local)
+	}
+
+	// Feeds are usually newest first already, only sort when every item is dated
+	dated := true
+	for _, item := range f.Items {
+		dated = dated && !item.Published.IsZero()
+	}
+	if dated {
+		sort.SliceStable(f.Items, func(i, j int) bool { return f.Items[i].Published.After(f.Items[j].Published) })
+	}
+	return f, nil
+}
+
+// parseFeedURL checks that a feed or article URL is http(s)
+func parseFeedURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w, got %q", ErrInvalidFeedURL, raw)
+	}
+	return u, nil
+}
+
+// isPublicAddress reports whether ip is a global unicast address outside
+// private, loopback, link-local and other special-purpose ranges
+func isPublicAddress(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicDialControl refuses connections to addresses that are not public
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// fetchPage downloads at most maxFeedSize bytes of an http(s) URL and
+// returns them with the URL they came from after redirects
+func fetchPage(ctx context.Context, raw string) ([]byte, *url.URL, error) {
+	u, err := parseFeedURL(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, feedFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, text/html;q=0.8, */*;q=0.5")
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	content, err := readLimited(resp.Body, maxFeedSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Pages declare legacy encodings in the header, feeds in their XML declaration
+	if mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil &&
+		mediaType == "text/html" && params["charset"] != "" {
+		if r, err := charsetReader(params["charset"], bytes.NewReader(content)); err == nil {
+			if decoded, err := ioutil.ReadAll(r); err == nil {
+				content = decoded
+			}
+		}
+	}
+	return content, resp.Request.URL, nil
+}
+
+// fetchFeed downloads and parses a feed. For a web page it follows the
+// feed the page links to, and returns the URL of the feed it read
+func fetchFeed(ctx context.Context, raw string) (*feed, string, error) {
+	content, u, err := fetchPage(ctx, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := parseFeed(content, u)
+	if errors.Is(err, ErrNotAFeed) {
+		if link := feedLink(content, u); link != "" && link != u.String() {
+			if content, u, err = fetchPage(ctx, link); err != nil {
+				return nil, "", err
+			}
+			f, err = parseFeed(content, u)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, u.String(), nil
+}
+
+// feedLink returns the feed a web page announces with
+// <link rel="alternate" type="application/rss+xml">
+func feedLink(page []byte, base *url.URL) string {
+	for _, link := range parseHTML(page).find("link") {
+		kind := strings.ToLower(link.attr("type"))
+		if strings.Contains(strings.ToLower(link.attr("rel")), "alternate") &&
+			(kind == "application/rss+xml" || kind == "application/atom+xml") {
+			return absoluteLink(link.attr("href"), base)
+		}
+	}
+	return ""
+}
+
+// fetchArticle downloads the page of an item and returns its main content
+func fetchArticle(ctx context.Context, link string) (string, error) {
+	page, u, err := fetchPage(ctx, link)
+	if err != nil {
+		return "", err
+	}
+	_, body := extractArticle(page, u)
+	if body == "" {
+		return "", fmt.Errorf("no article found at %s", u)
+	}
+	return body, nil
+}
+
+// articleBody returns the content of an item as XHTML: its own content when
+// it is long enough to be the full text, otherwise the article extracted
+// from its page, or the summary when that fails
+func articleBody(ctx context.Context, item feedItem, base *url.URL) string {
+	body := htmlToXHTML(item.Content, base)
+	if item.Link == "" || len(parseHTML([]byte(body)).textContent()) >= minFeedContent {
+		return body
+	}
+	article, err := fetchArticle(ctx, item.Link)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not fetch article, using the feed content", "url", item.Link, "err", err)
+		return body
+	}
+	if len(article) < len(body) {
+		return body
+	}
+	return article
+}
+
+// digestSchedule is when a user gets the digest, in the time zone of the bot
+type digestSchedule struct {
+	Weekly  bool         `json:"weekly,omitempty"`
+	Weekday time.Weekday `json:"weekday,omitempty"`
+	Hour    int          `json:"hour"`
+	Minute  int          `json:"minute"`
+}
+
+// parseDigestSchedule parses "daily [HH:MM]" or "weekly [day] [HH:MM]",
+// the time defaults to 07:00 and the day to Monday
+func parseDigestSchedule(s string) (digestSchedule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 3 {
+		return digestSchedule{}, ErrInvalidSchedule
+	}
+	schedule := defaultDigestSchedule
+	switch fields[0] {
+	case "daily":
+	case "weekly":
+		schedule.Weekly = true
+		schedule.Weekday = time.Monday
+		if len(fields) > 1 && !strings.Contains(fields[1], ":") {
+			day, ok := parseWeekday(fields[1])
+			if !ok {
+				return digestSchedule{}, fmt.Errorf("%w: unknown day %q", ErrInvalidSchedule, fields[1])
+			}
+			schedule.Weekday = day
+			fields = fields[1:]
+		}
+	default:
+		return digestSchedule{}, ErrInvalidSchedule
+	}
+	switch len(fields) {
+	case 1:
+	case 2:
+		clock, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return digestSchedule{}, fmt.Errorf("%w: invalid time %q", ErrInvalidSchedule, fields[1])
+		}
+		schedule.Hour, schedule.Minute = clock.Hour(), clock.Minute()
+	default:
+		return digestSchedule{}, ErrInvalidSchedule
+	}
+	return schedule, nil
+}
+
+// parseWeekday accepts English day names and their abbreviations
+func parseWeekday(s string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if len(s) >= 2 && strings.HasPrefix(name, s) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+func (s digestSchedule) String() string {
+	if s.Weekly {
+		return fmt.Sprintf("weekly on %s at %02d:%02d", s.Weekday, s.Hour, s.Minute)
+	}
+	return fmt.Sprintf("daily at %02d:%02d", s.Hour, s.Minute)
+}
+
+// last returns the latest scheduled time at or before now
+func (s digestSchedule) last(now time.Time) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), s.Hour, s.Minute, 0, 0, now.Location())
+	days := 1
+	if s.Weekly {
+		days = 7
+		t = t.AddDate(0, 0, -((int(now.Weekday()) - int(s.Weekday) + 7) % 7))
+	}
+	if t.After(now) {
+		t = t.AddDate(0, 0, -days)
+	}
+	return t
+}
+
+// next returns the first scheduled time after now
+func (s digestSchedule) next(now time.Time) time.Time {
+	if s.Weekly {
+		return s.last(now).AddDate(0, 0, 7)
+	}
+	return s.last(now).AddDate(0, 0, 1)
+}
+
+// feedSubscription is a feed a user subscribed to
+type feedSubscription struct {
+	URL   string    `json:"url"`
+	Title string    `json:"title"`
+	Added time.Time `json:"added"`
+	Seen  []string  `json:"seen,omitempty"` // IDs of delivered items, oldest first
+}
+
+// feedUser are the subscriptions and digest settings of a user
+type feedUser struct {
+	Feeds    []*feedSubscription `json:"feeds"`
+	Schedule digestSchedule      `json:"schedule"`
+	Device   string              `json:"device,omitempty"` // empty for the only device
+	LastRun  time.Time           `json:"last_run"`
+}
+
+// feedStore keeps the feed subscriptions of every user across restarts.
+// All methods do nothing on a nil store
+type feedStore struct {
+	mu      sync.Mutex
+	path    string
+	users   map[int]*feedUser
+	running map[int]bool // users whose digest is being prepared
+}
+
+// loadFeedStore reads the store from path. A missing file is an empty
+// store, an unreadable one is reported but still returns an empty store
+func loadFeedStore(path string) (*feedStore, error) {
+	s := &feedStore{path: path, users: make(map[int]*feedUser), running: make(map[int]bool)}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var users map[int]*feedUser
+	if err := json.Unmarshal(content, &users); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if users != nil {
+		s.users = users
+	}
+	return s, nil
+}
+
+// subscribe adds a feed. It returns false when the user already subscribed
+// to it. The first subscription starts the default schedule from now
+func (s *feedStore) subscribe(userID int, feedURL, title string, now time.Time) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		u = &feedUser{Schedule: defaultDigestSchedule, LastRun: now}
+		s.users[userID] = u
+	}
+	for _, subscription := range u.Feeds {
+		if subscription.URL == feedURL {
+			return false, nil
+		}
+	}
+	if len(u.Feeds) >= maxFeedsPerUser {
+		return false, fmt.Errorf("%w, the limit is %d", ErrTooManyFeeds, maxFeedsPerUser)
+	}
+	u.Feeds = append(u.Feeds, &feedSubscription{URL: feedURL, Title: title, Added: now})
+	s.saveLocked()
+	return true, nil
+}
+
+// unsubscribe removes a feed given by its number in the list, from 1, or
+// its URL
+func (s *feedStore) unsubscribe(userID int, feed string) (feedSubscription, bool) {
+	if s == nil {
+		return feedSubscription{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return feedSubscription{}, false
+	}
+	n, err := strconv.Atoi(feed)
+	for i, subscription := range u.Feeds {
+		if (err == nil && i == n-1) || subscription.URL == feed {
+			u.Feeds = append(u.Feeds[:i], u.Feeds[i+1:]...)
+			s.saveLocked()
+			return *subscription, true
+		}
+	}
+	return feedSubscription{}, false
+}
+
+// user returns a copy of the subscriptions of a user
+func (s *feedStore) user(userID int) (feedUser, bool) {
+	if s == nil {
+		return feedUser{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return feedUser{}, false
+	}
+	copied := *u
+	copied.Feeds = make([]*feedSubscription, len(u.Feeds))
+	for i, subscription := range u.Feeds {
+		feed := *subscription
+		feed.Seen = append([]string(nil), subscription.Seen...)
+		copied.Feeds[i] = &feed
+	}
+	return copied, true
+}
+
+// setSchedule changes when the user gets the digest
+func (s *feedStore) setSchedule(userID int, schedule digestSchedule) bool {
+	return s.update(userID, func(u *feedUser) { u.Schedule = schedule })
+}
+
+// setDevice changes the device the digest is delivered to
+func (s *feedStore) setDevice(userID int, device string) bool {
+	return s.update(userID, func(u *feedUser) { u.Device = device })
+}
+
+// markRun records that the digest of the user ran at now
+func (s *feedStore) markRun(userID int, now time.Time) bool {
+	return s.update(userID, func(u *feedUser) { u.LastRun = now })
+}
+
+// markSeen records delivered items of a feed
+func (s *feedStore) markSeen(userID int, feedURL string, ids []string) bool {
+	return s.update(userID, func(u *feedUser) {
+		for _, subscription := range u.Feeds {
+			if subscription.URL == feedURL {
+				subscription.Seen = append(subscription.Seen, ids...)
+				if len(subscription.Seen) > maxSeenItems {
+					subscription.Seen = subscription.Seen[len(subscription.Seen)-maxSeenItems:]
+				}
+			}
+		}
+	})
+}
+
+func (s *feedStore) update(userID int, change func(u *feedUser)) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return false
+	}
+	change(u)
+	s.saveLocked()
+	return true
+}
+
+// due returns the users with feeds whose digest was scheduled since their
+// last run, evaluating schedules in the time zone location returns for a
+// user. A digest missed while the bot was down runs once
+func (s *feedStore) due(now time.Time, location func(userID int) *time.Location) []int {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []int
+	for userID, u := range s.users {
+		if len(u.Feeds) > 0 && u.Schedule.last(now.In(location(userID))).After(u.LastRun) {
+			due = append(due, userID)
+		}
+	}
+	sort.Ints(due)
+	return due
+}
+
+// begin marks the digest of a user as being prepared, false when it
+// already is
+func (s *feedStore) begin(userID int) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[userID] {
+		return false
+	}
+	s.running[userID] = true
+	return true
+}
+
+func (s *feedStore) end(userID int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.running, userID)
+	s.mu.Unlock()
+}
+
+func (s *feedStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save feeds", "path", s.path, "err", err)
+	}
+}
+
+func (s *feedStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// digestArticle is an item of a digest with its content
+type digestArticle struct {
+	Feed string
+	Item feedItem
+	Body string // XHTML
+}
+
+// digestResult summarizes a digest
+type digestResult struct {
+	Articles int
+	Device   string
+	Failed   []string // feeds that could not be fetched
+}
+
+// collectDigest fetches the feeds and returns their items that were not
+// delivered yet, with the IDs of those items per feed URL. Feeds that fail
+// are skipped and returned
+func collectDigest(ctx context.Context, feeds []*feedSubscription) ([]digestArticle, map[string][]string, []string) {
+	logger := logging.FromContext(ctx)
+	var articles []digestArticle
+	var failed []string
+	seen := make(map[string][]string)
+	for _, subscription := range feeds {
+		if len(articles) >= maxDigestItems {
+			break
+		}
+		f, _, err := fetchFeed(ctx, subscription.URL)
+		if err != nil {
+			logger.Warn("Could not fetch feed", "url", subscription.URL, "err", err)
+			failed = append(failed, subscription.Title)
+			continue
+		}
+		delivered := make(map[string]bool, len(subscription.Seen))
+		for _, id := range subscription.Seen {
+			delivered[id] = true
+		}
+		title := firstText(subscription.Title, f.Title, subscription.URL)
+		base, _ := url.Parse(subscription.URL)
+		added := 0
+		for _, item := range f.Items {
+			if delivered[item.ID] {
+				continue
+			}
+			// Older items past the limits are skipped for good
+			seen[subscription.URL] = append(seen[subscription.URL], item.ID)
+			if added >= maxDigestItemsPerFeed || len(articles) >= maxDigestItems {
+				continue
+			}
+			articles = append(articles, digestArticle{Feed: title, Item: item, Body: articleBody(ctx, item, base)})
+			added++
+		}
+		logger.Debug("Fetched feed", "url", subscription.URL, "items", len(f.Items), "new", added)
+	}
+	return articles, seen, failed
+}
+
+// digestBook bundles articles into a book that starts with a table of
+// contents grouped by feed
+func digestBook(articles []digestArticle, now time.Time) epubBook {
+	book := epubBook{
+		Title:    "News Digest " + now.Format("2006-01-02"),
+		Modified: now,
+	}
+	var contents strings.Builder
+	contents.WriteString("<h1>" + html.EscapeString(book.Title) + "</h1>\n")
+	feed := ""
+	for i, article := range articles {
+		if article.Feed != feed {
+			if feed != "" {
+				contents.WriteString("</ul>\n")
+			}
+			feed = article.Feed
+			contents.WriteString("<h2>" + html.EscapeString(feed) + "</h2>\n<ul>\n")
+		}
+		// The contents page is the first chapter
+		contents.WriteString(`<li><a href="` + epubChapterHref(i+1) + `">` + html.EscapeString(articleTitle(article.Item)) + "</a></li>\n")
+	}
+	if feed != "" {
+		contents.WriteString("</ul>\n")
+	}
+	book.Chapters = append(book.Chapters, epubChapter{Title: "Contents", Body: contents.String()})
+
+	for _, article := range articles {
+		item := article.Item
+		byline := []string{html.EscapeString(article.Feed)}
+		if item.Author != "" {
+			byline = append(byline, html.EscapeString(item.Author))
+		}
+		if !item.Published.IsZero() {
+			byline = append(byline, item.Published.Format("2 Jan 2006"))
+		}
+		if item.Link != "" {
+			byline = append(byline, `<a href="`+html.EscapeString(item.Link)+`">Original</a>`)
+		}
+		book.Chapters = append(book.Chapters, epubChapter{
+			Title: articleTitle(item),
+			Body: "<h1>" + html.EscapeString(articleTitle(item)) + "</h1>\n" +
+				`<p class="small">` + strings.Join(byline, " · ") + "</p>\n" + article.Body,
+		})
+	}
+	return book
+}
+
+func articleTitle(item feedItem) string {
+	return firstText(item.Title, item.Link, "Untitled")
+}
+
+// digestDevice returns the device the digest of a user goes to: the one
+// picked, or the only device
+func (s *settings) digestDevice(u feedUser) (string, error) {
+	if u.Device != "" {
+		if device, err := s.resolveDevice(u.Device); err == nil {
+			return device, nil
+		}
+	}
+	return s.resolveDevice("")
+}
+
+// sendDigest delivers the items of the feeds of a user that were not
+// delivered yet as one EPUB. Nothing is sent when there are no new items
+func (b *SendToKindleBot) sendDigest(ctx context.Context, job *activeJob, userID int, now time.Time) (digestResult, error) {
+	u, ok := b.feeds.user(userID)
+	if !ok || len(u.Feeds) == 0 {
+		return digestResult{}, ErrNoFeeds
+	}
+	settings := b.current()
+	device, err := settings.digestDevice(u)
+	if err != nil {
+		return digestResult{}, err
+	}
+	deliverer, err := b.deliverer(settings, device)
+	if err != nil {
+		return digestResult{}, err
+	}
+
+	articles, seen, failed := collectDigest(ctx, u.Feeds)
+	result := digestResult{Articles: len(articles), Device: device, Failed: failed}
+	if len(articles) == 0 {
+		for feedURL, ids := range seen {
+			b.feeds.markSeen(userID, feedURL, ids)
+		}
+		return result, nil
+	}
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		return result, err
+	}
+	book := digestBook(articles, now)
+	path := filepath.Join(b.tmpFilesPath, "digest-"+newJobID()+".epub")
+	b.jobs.addFile(job, path)
+	defer os.Remove(path)
+	if err := writeEPUB(path, book); err != nil {
+		return result, err
+	}
+	fileName := book.Title + ".epub"
+	if err := deliverer.Deliver(ctx, path, fileName); err != nil {
+		b.users.recordDelivery(userID, device, false)
+		return result, err
+	}
+	b.metrics.delivered(device)
+	b.users.recordDelivery(userID, device, true)
+	for feedURL, ids := range seen {
+		b.feeds.markSeen(userID, feedURL, ids)
+	}
+	b.archiveBook(ctx, settings, userID, fileName, path)
+	return result, nil
+}
+
+// runDigest sends the digest of a user and reports the outcome to them.
+// quiet skips the report when there was nothing new, for scheduled runs.
+// It returns false when the digest was not started, as one is already
+// being prepared
+func (b *SendToKindleBot) runDigest(bot *tb.Bot, userID int, jobID string, quiet bool) bool {
+	user := &tb.User{ID: userID}
+	if !b.feeds.begin(userID) {
+		if !quiet {
+			bot.Send(user, "📰 Your digest is already being prepared.")
+		}
+		return false
+	}
+	defer b.feeds.end(userID)
+	job, err := b.jobs.begin(jobRecord{ID: jobID, Kind: jobKindDigest, UserID: userID, FileName: "news digest"})
+	if err != nil {
+		return false
+	}
+	defer b.jobs.end(job)
+	logger := logging.Default().With("job", jobID, "user", userID)
+	ctx := logging.NewContext(job.ctx, logger)
+
+	result, err := b.sendDigest(ctx, job, userID, time.Now().In(b.userLocation(userID)))
+	var failed string
+	if len(result.Failed) > 0 {
+		failed = "\n\n⚠️ Could not fetch: " + strings.Join(result.Failed, ", ")
+	}
+	switch {
+	case errors.Is(err, ErrDeviceRequired):
+		logger.Warn("Digest has no device", "err", err)
+		bot.Send(user, "❌ Could not send your digest: choose a device with /digest device first.")
+	case err != nil:
+		logger.Error("Could not send digest", "err", err)
+		bot.Send(user, "❌ Could not send your digest. It is tried again at the next scheduled time, "+
+			"or now with /digest now."+failed)
+	case result.Articles == 0:
+		logger.Info("No new articles for the digest", "failed", len(result.Failed))
+		if !quiet || len(result.Failed) > 0 {
+			bot.Send(user, "📰 Nothing new in your feeds."+failed)
+		}
+	default:
+		logger.Info("Sent digest", "articles", result.Articles, "device", result.Device)
+		bot.Send(user, fmt.Sprintf("📰 Digest with %d article(s) %s.%s", result.Articles,
+			b.current().deliveredText(result.Device), failed))
+	}
+	return true
+}
+
+// runDigestScheduler starts the digests that are due every minute until the
+// bot is stopped
+func (b *SendToKindleBot) runDigestScheduler(bot *tb.Bot) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, userID := range b.feeds.due(now, b.userLocation) {
+				go b.runScheduledDigest(bot, userID, now)
+			}
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+// runScheduledDigest runs the digest of a user that is due at now. The run
+// is recorded once the digest is done so a crash does not lose it, and a
+// digest already being prepared leaves the run due for the next minute
+func (b *SendToKindleBot) runScheduledDigest(bot *tb.Bot, userID int, now time.Time) {
+	if b.runDigest(bot, userID, newJobID(), true) {
+		b.feeds.markRun(userID, now)
+	}
+}
+
+// subscribeCommand handles "/subscribe [url]": subscribing to a feed, or
+// listing the subscriptions
+func (b *SendToKindleBot) subscribeCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		raw := strings.TrimSpace(m.Payload)
+		if raw == "" {
+			respond(bot, m, b.feedsText(m.Sender.ID))
+			return
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		f, feedURL, err := fetchFeed(context.Background(), raw)
+		if err != nil {
+			logging.Info("Could not subscribe to feed", "user", m.Sender.ID, "url", raw, "err", err)
+			respond(bot, m, fmt.Sprintf("❌ Could not read a feed at %s: %v", raw, err))
+			return
+		}
+		title := firstText(f.Title, feedURL)
+		added, err := b.feeds.subscribe(m.Sender.ID, feedURL, title, time.Now())
+		if err != nil {
+			respond(bot, m, fmt.Sprintf("❌ Could not subscribe: %v.", err))
+			return
+		}
+		if !added {
+			respond(bot, m, fmt.Sprintf("📰 You already subscribed to %s.", title))
+			return
+		}
+		logging.Info("Subscribed to feed", "user", m.Sender.ID, "url", feedURL, "items", len(f.Items))
+		u, _ := b.feeds.user(m.Sender.ID)
+		text := fmt.Sprintf("📰 Subscribed to %s (%d item(s)). Your digest is sent %s.", title, len(f.Items), u.Schedule)
+		if _, err := b.current().digestDevice(u); errors.Is(err, ErrDeviceRequired) {
+			bot.Send(m.Sender, text+"\n\nWhich device should get it?", b.digestDeviceKeyboard())
+			return
+		}
+		respond(bot, m, text)
+	}
+}
+
+// unsubscribeCommand handles "/unsubscribe <number|url>"
+func (b *SendToKindleBot) unsubscribeCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		arg := strings.TrimSpace(m.Payload)
+		if arg == "" {
+			respond(bot, m, "Usage: /unsubscribe <number or url>, see /subscribe for the numbers.")
+			return
+		}
+		subscription, ok := b.feeds.unsubscribe(m.Sender.ID, arg)
+		if !ok {
+			respond(bot, m, "❌ No such feed, see /subscribe for your feeds.")
+			return
+		}
+		logging.Info("Unsubscribed from feed", "user", m.Sender.ID, "url", subscription.URL)
+		respond(bot, m, fmt.Sprintf("📰 Unsubscribed from %s.", subscription.Title))
+	}
+}
+
+// digestCommand handles "/digest [now|device|daily HH:MM|weekly <day> HH:MM]"
+func (b *SendToKindleBot) digestCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		arg := strings.ToLower(strings.TrimSpace(m.Payload))
+		u, ok := b.feeds.user(m.Sender.ID)
+		if !ok || len(u.Feeds) == 0 {
+			respond(bot, m, "📰 You have no feeds yet, add one with /subscribe <url>.")
+			return
+		}
+		switch arg {
+		case "":
+			respond(bot, m, b.feedsText(m.Sender.ID))
+		case "now":
+			respond(bot, m, "📰 Preparing your digest...")
+			go b.runDigest(bot, m.Sender.ID, newJobID(), false)
+		case "device":
+			if len(b.current().devices) < 2 {
+				respond(bot, m, "📰 Your digest goes to your only device.")
+				return
+			}
+			bot.Send(m.Sender, "Which device should get your digest?", b.digestDeviceKeyboard())
+		default:
+			schedule, err := parseDigestSchedule(arg)
+			if err != nil {
+				respond(bot, m, fmt.Sprintf("❌ %v, e.g. /digest daily 7:00 or /digest weekly sat 9:30.", err))
+				return
+			}
+			b.feeds.setSchedule(m.Sender.ID, schedule)
+			logging.Info("Changed digest schedule", "user", m.Sender.ID, "schedule", schedule.String())
+			respond(bot, m, fmt.Sprintf("📰 Your digest is sent %s, next on %s.", schedule,
+				schedule.next(time.Now().In(b.userLocation(m.Sender.ID))).Format("Mon 2 Jan 15:04")))
+		}
+	}
+}
+
+// feedsText lists the subscriptions and the digest settings of a user
+func (b *SendToKindleBot) feedsText(userID int) string {
+	u, ok := b.feeds.user(userID)
+	if !ok || len(u.Feeds) == 0 {
+		return "📰 You have no feeds yet. Add a blog with /subscribe <feed-url>, its new articles are sent " +
+			"to your Kindle as one digest " + defaultDigestSchedule.String() + "."
+	}
+	var text strings.Builder
+	text.WriteString("📰 Your feeds:\n")
+	for i, subscription := range u.Feeds {
+		fmt.Fprintf(&text, "%d. %s\n%s\n", i+1, subscription.Title, subscription.URL)
+	}
+	next := u.Schedule.next(time.Now().In(b.userLocation(userID)))
+	fmt.Fprintf(&text, "\nDigest: %s, next on %s", u.Schedule, next.Format("Mon 2 Jan 15:04"))
+	if device, err := b.current().digestDevice(u); err == nil && device != defaultDeviceName {
+		fmt.Fprintf(&text, " to %s", device)
+	}
+	text.WriteString(".\n\n/unsubscribe <number> removes a feed, /digest daily 7:00 or /digest weekly sat 9:30 " +
+		"changes the schedule, /digest now sends it now.")
+	if len(b.current().devices) > 1 {
+		text.WriteString(" /digest device picks the device.")
+	}
+	return text.String()
+}
+
+// digestDeviceKeyboard offers the configured devices for the digest
+func (b *SendToKindleBot) digestDeviceKeyboard() *tb.ReplyMarkup {
+	var rows [][]tb.InlineButton
+	for i, name := range b.current().deviceNames() {
+		if i%buttonsPerRow == 0 {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], tb.InlineButton{Text: name, Data: feedsDeviceCallback + name})
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// feedsCallback handles the device buttons of digestDeviceKeyboard
+func (b *SendToKindleBot) feedsCallback(bot *tb.Bot, c *tb.Callback) {
+	bot.Respond(c, &tb.CallbackResponse{})
+	device := strings.TrimPrefix(c.Data, feedsDeviceCallback)
+	if !strings.HasPrefix(c.Data, feedsDeviceCallback) {
+		logging.Debug("Invalid feeds callback", "user", c.Sender.ID, "data", c.Data)
+		return
+	}
+	if _, ok := b.current().devices[device]; !ok {
+		bot.Send(c.Sender, "❌ Device not found")
+		return
+	}
+	if !b.feeds.setDevice(c.Sender.ID, device) {
+		bot.Send(c.Sender, "📰 You have no feeds yet, add one with /subscribe <url>.")
+		return
+	}
+	logging.Info("Changed digest device", "user", c.Sender.ID, "device", device)
+	bot.Send(c.Sender, fmt.Sprintf("📰 Your digest goes to %s.", device))
+}
@@ -0,0 +1,511 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFeedServer serves the fixtures of testdata/feeds: the feeds, the page
+// of the short post, which links to the RSS feed, also as a blog page, and
+// a page without a feed
+func newFeedServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	allowLoopbackFetch(t)
+	files := map[string]struct{ file, contentType string }{
+		"/rss.xml":          {"rss.xml", "application/rss+xml"},
+		"/atom.xml":         {"atom.xml", "application/atom+xml"},
+		"/posts/short.html": {"article.html", "text/html; charset=utf-8"},
+		"/blog":             {"article.html", "text/html"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/about" {
+			w.Write([]byte("<html><body><p>No feed here</p></body></html>"))
+			return
+		}
+		fixture, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		content, err := ioutil.ReadFile(filepath.Join("testdata", "feeds", fixture.file))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", fixture.contentType)
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// allowLoopbackFetch lets fetchPage reach test servers on the loopback
+// address until the test ends
+func allowLoopbackFetch(t *testing.T) {
+	public := publicAddress
+	publicAddress = func(ip net.IP) bool { return ip.IsLoopback() || public(ip) }
+	t.Cleanup(func() { publicAddress = public })
+}
+
+func TestFetchPage_privateAddress(t *testing.T) {
+	// A server on the loopback address stands in for the bot's own network
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fetched %s from a private address", r.URL)
+	}))
+	defer server.Close()
+	if _, _, err := fetchPage(context.Background(), server.URL+"/admin"); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("fetchPage(loopback) error = %v, want ErrPrivateAddress", err)
+	}
+
+	for address, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.100.100.200": false,
+		"::1":             false,
+		"fd00:ec2::254":   false,
+		"::ffff:10.0.0.1": false,
+		"0.0.0.0":         false,
+	} {
+		if got := isPublicAddress(net.ParseIP(address)); got != want {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "feeds", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestParseFeed(t *testing.T) {
+	date := func(s string) time.Time {
+		d, _ := time.Parse(time.RFC3339, s)
+		return d
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		base    string
+		title   string
+		link    string
+		items   []feedItem
+	}{
+		{
+			name:    "rss",
+			content: readFixture(t, "rss.xml"),
+			base:    "http://blog.test/rss.xml",
+			title:   "Slow Reading",
+			link:    "https://example.com/",
+			items: []feedItem{
+				{ID: "post-2", Title: "Short & sweet", Link: "http://blog.test/posts/short.html", Author: "Ada",
+					Published: date("2026-10-17T08:00:00Z"),
+					Content:   `<p>Only a teaser, <a href="/posts/short.html">read on</a>.</p>`},
+				{ID: "post-1", Title: "The first post", Link: "http://blog.test/posts/first.html",
+					Published: date("2026-10-15T08:00:00Z"),
+					Content:   "<p>The full text of the first post.</p><script>alert(1)</script><p>It has <b>two</b> paragraphs.</p>"},
+			},
+		},
+		{
+			name:    "atom",
+			content: readFixture(t, "atom.xml"),
+			base:    "https://notes.example.org/atom.xml",
+			title:   "Notes from the field",
+			link:    "https://notes.example.org/",
+			items: []feedItem{
+				{ID: "tag:notes.example.org,2026:newer", Title: "Newer entry", Link: "https://notes.example.org/newer",
+					Author: "Grace", Published: date("2026-10-16T12:00:00Z"),
+					Content: `<div xmlns="http://www.w3.org/1999/xhtml"><p>Inline <strong>XHTML</strong> content.</p></div>`},
+				{ID: "tag:notes.example.org,2026:older", Title: "Older entry", Link: "https://notes.example.org/older",
+					Published: date("2026-10-01T12:00:00Z"),
+					Content:   "<p>Plain text summary.</p>\n<p>Second paragraph.</p>"},
+			},
+		},
+		{
+			name: "rss 1.0",
+			content: []byte(`<?xml version="1.0"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <channel rdf:about="http://old.test/"><title>Old school</title><link>http://old.test/</link></channel>
+  <item rdf:about="http://old.test/1"><title>One</title><link>http://old.test/1</link><dc:date>2026-10-02</dc:date><description>First</description></item>
+</rdf:RDF>`),
+			base:  "http://old.test/index.rdf",
+			title: "Old school",
+			link:  "http://old.test/",
+			items: []feedItem{
+				{ID: "http://old.test/1", Title: "One", Link: "http://old.test/1", Published: date("2026-10-02T00:00:00Z"),
+					Content: "First"},
+			},
+		},
+		{
+			name: "windows-1251",
+			content: append([]byte(`<?xml version="1.0" encoding="windows-1251"?><rss><channel><title>`),
+				append([]byte{0xcd, 0xee, 0xe2, 0xee, 0xf1, 0xf2, 0xe8}, []byte(`</title></channel></rss>`)...)...),
+			base:  "http://news.test/rss",
+			title: "Новости",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _ := url.Parse(tt.base)
+			f, err := parseFeed(tt.content, base)
+			if err != nil {
+				t.Fatalf("parseFeed() error = %v", err)
+			}
+			if f.Title != tt.title || f.Link != tt.link {
+				t.Errorf("parseFeed() = %q, %q, want %q, %q", f.Title, f.Link, tt.title, tt.link)
+			}
+			for i := range f.Items {
+				f.Items[i].Published = f.Items[i].Published.UTC()
+			}
+			if !reflect.DeepEqual(f.Items, tt.items) {
+				t.Errorf("parseFeed() items =\n%+v\nwant\n%+v", f.Items, tt.items)
+			}
+		})
+	}
+
+	if _, err := parseFeed(readFixture(t, "article.html"), nil); !errors.Is(err, ErrNotAFeed) {
+		t.Errorf("parseFeed(html) error = %v, want ErrNotAFeed", err)
+	}
+}
+
+func TestFetchFeed(t *testing.T) {
+	server := newFeedServer(t)
+	tests := []struct {
+		name    string
+		url     string
+		feedURL string
+		title   string
+		err     error
+	}{
+		{name: "rss", url: server.URL + "/rss.xml", feedURL: server.URL + "/rss.xml", title: "Slow Reading"},
+		{name: "atom", url: server.URL + "/atom.xml", feedURL: server.URL + "/atom.xml", title: "Notes from the field"},
+		{name: "feed linked from a page", url: server.URL + "/blog", feedURL: server.URL + "/rss.xml", title: "Slow Reading"},
+		{name: "page without a feed", url: server.URL + "/about", err: ErrNotAFeed},
+		{name: "not http", url: "file:///etc/passwd", err: ErrInvalidFeedURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, feedURL, err := fetchFeed(context.Background(), tt.url)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("fetchFeed() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchFeed() error = %v", err)
+			}
+			if feedURL != tt.feedURL || f.Title != tt.title {
+				t.Errorf("fetchFeed() = %q, %q, want %q, %q", f.Title, feedURL, tt.title, tt.feedURL)
+			}
+		})
+	}
+
+	if _, _, err := fetchFeed(context.Background(), server.URL+"/missing.xml"); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Errorf("fetchFeed(missing) error = %v, want 404", err)
+	}
+}
+
+func TestArticleBody(t *testing.T) {
+	server := newFeedServer(t)
+	base, _ := url.Parse(server.URL + "/rss.xml")
+	tests := []struct {
+		name string
+		item feedItem
+		want string
+	}{
+		{
+			name: "teaser is replaced by the page",
+			item: feedItem{Link: server.URL + "/posts/short.html", Content: "<p>Only a teaser</p>"},
+			want: "This is the full text of the short post",
+		},
+		{
+			name: "content is kept when the page fails",
+			item: feedItem{Link: server.URL + "/posts/first.html", Content: "<p>The full text</p>"},
+			want: "<p>The full text</p>",
+		},
+		{
+			name: "long content is used as is",
+			item: feedItem{Link: server.URL + "/posts/short.html",
+				Content: "<p>" + strings.Repeat("Long enough. ", minFeedContent/10) + "</p>"},
+			want: "<p>Long enough. Long enough.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := articleBody(context.Background(), tt.item, base); !strings.Contains(got, tt.want) {
+				t.Errorf("articleBody() = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDigestSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     digestSchedule
+		err      bool
+	}{
+		{schedule: "daily", want: digestSchedule{Hour: 7}},
+		{schedule: "daily 6:30", want: digestSchedule{Hour: 6, Minute: 30}},
+		{schedule: "Daily 18:05", want: digestSchedule{Hour: 18, Minute: 5}},
+		{schedule: "weekly", want: digestSchedule{Weekly: true, Weekday: time.Monday, Hour: 7}},
+		{schedule: "weekly sat 9:30", want: digestSchedule{Weekly: true, Weekday: time.Saturday, Hour: 9, Minute: 30}},
+		{schedule: "weekly sunday", want: digestSchedule{Weekly: true, Weekday: time.Sunday, Hour: 7}},
+		{schedule: "weekly 20:00", want: digestSchedule{Weekly: true, Weekday: time.Monday, Hour: 20}},
+		{schedule: "weekly t 9:00", err: true},
+		{schedule: "daily 25:00", err: true},
+		{schedule: "hourly", err: true},
+		{schedule: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			got, err := parseDigestSchedule(tt.schedule)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidSchedule) {
+					t.Errorf("parseDigestSchedule() error = %v, want ErrInvalidSchedule", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseDigestSchedule() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestSchedule_last(t *testing.T) {
+	at := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02 15:04", s)
+		return d
+	}
+	// 2026-10-18 is a Sunday
+	tests := []struct {
+		name     string
+		schedule digestSchedule
+		now      string
+		want     string
+		next     string
+	}{
+		{"daily after the time", digestSchedule{Hour: 7}, "2026-10-18 09:00", "2026-10-18 07:00", "2026-10-19 07:00"},
+		{"daily at the time", digestSchedule{Hour: 7}, "2026-10-18 07:00", "2026-10-18 07:00", "2026-10-19 07:00"},
+		{"daily before the time", digestSchedule{Hour: 7}, "2026-10-18 06:59", "2026-10-17 07:00", "2026-10-18 07:00"},
+		{"weekly later in the week", digestSchedule{Weekly: true, Weekday: time.Monday, Hour: 7}, "2026-10-18 09:00",
+			"2026-10-12 07:00", "2026-10-19 07:00"},
+		{"weekly on the day", digestSchedule{Weekly: true, Weekday: time.Sunday, Hour: 7}, "2026-10-18 09:00",
+			"2026-10-18 07:00", "2026-10-25 07:00"},
+		{"weekly on the day before the time", digestSchedule{Weekly: true, Weekday: time.Sunday, Hour: 7},
+			"2026-10-18 06:00", "2026-10-11 07:00", "2026-10-18 07:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.last(at(tt.now)); !got.Equal(at(tt.want)) {
+				t.Errorf("last(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+			if got := tt.schedule.next(at(tt.now)); !got.Equal(at(tt.next)) {
+				t.Errorf("next(%s) = %s, want %s", tt.now, got, tt.next)
+			}
+		})
+	}
+}
+
+func TestFeedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), feedsFileName)
+	s, err := loadFeedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	utc := func(int) *time.Location { return time.UTC }
+
+	if added, err := s.subscribe(1, "https://a.test/rss", "A", subscribed); !added || err != nil {
+		t.Fatalf("subscribe() = %v, %v, want added", added, err)
+	}
+	if added, _ := s.subscribe(1, "https://a.test/rss", "A", subscribed); added {
+		t.Error("subscribe() added the same feed twice")
+	}
+	s.subscribe(1, "https://b.test/atom", "B", subscribed)
+	if due := s.due(subscribed.Add(time.Hour), utc); len(due) != 0 {
+		t.Errorf("due() right after subscribing = %v, want none", due)
+	}
+	next := time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)
+	if due := s.due(next, utc); !reflect.DeepEqual(due, []int{1}) {
+		t.Errorf("due(next morning) = %v, want [1]", due)
+	}
+	s.markRun(1, next)
+	if due := s.due(next.Add(time.Minute), utc); len(due) != 0 {
+		t.Errorf("due() after the run = %v, want none", due)
+	}
+
+	// Schedules are evaluated in the time zone of the user
+	moscow := func(int) *time.Location { return time.FixedZone("MSK", 3*60*60) }
+	s.subscribe(3, "https://a.test/rss", "A", subscribed)
+	if due := s.due(next.Add(-3*time.Hour-time.Minute), moscow); len(due) != 0 {
+		t.Errorf("due(06:59 in the user's zone) = %v, want none", due)
+	}
+	if due := s.due(next.Add(-3*time.Hour), moscow); !reflect.DeepEqual(due, []int{3}) {
+		t.Errorf("due(07:00 in the user's zone) = %v, want [3]", due)
+	}
+	s.unsubscribe(3, "1")
+
+	ids := make([]string, maxSeenItems+10)
+	for i := range ids {
+		ids[i] = strings.Repeat("x", i%7) + string(rune('a'+i%26))
+	}
+	s.markSeen(1, "https://a.test/rss", ids)
+	s.setSchedule(1, digestSchedule{Weekly: true, Weekday: time.Friday, Hour: 18})
+	if s.setDevice(2, "Kobo") {
+		t.Error("setDevice() of a user without feeds = true")
+	}
+
+	// Everything survives a restart
+	s, err = loadFeedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, ok := s.user(1)
+	if !ok || len(u.Feeds) != 2 || !u.LastRun.Equal(next) || u.Schedule.Weekday != time.Friday {
+		t.Fatalf("user() after reload = %+v, %v", u, ok)
+	}
+	if seen := u.Feeds[0].Seen; len(seen) != maxSeenItems || seen[len(seen)-1] != ids[len(ids)-1] {
+		t.Errorf("Seen has %d IDs, want the last %d", len(seen), maxSeenItems)
+	}
+
+	if !s.begin(1) || s.begin(1) {
+		t.Error("begin() allowed two digests of the same user")
+	}
+	s.end(1)
+	if !s.begin(1) {
+		t.Error("begin() after end() = false")
+	}
+
+	if removed, ok := s.unsubscribe(1, "2"); !ok || removed.URL != "https://b.test/atom" {
+		t.Errorf("unsubscribe(2) = %+v, %v", removed, ok)
+	}
+	if removed, ok := s.unsubscribe(1, "https://a.test/rss"); !ok || removed.Title != "A" {
+		t.Errorf("unsubscribe(url) = %+v, %v", removed, ok)
+	}
+	if _, ok := s.unsubscribe(1, "1"); ok {
+		t.Error("unsubscribe() removed a feed from an empty list")
+	}
+	if due := s.due(next.AddDate(0, 0, 14), utc); len(due) != 0 {
+		t.Errorf("due() without feeds = %v, want none", due)
+	}
+
+	var nilStore *feedStore
+	if added, err := nilStore.subscribe(1, "https://a.test/rss", "A", subscribed); added || err != nil {
+		t.Errorf("nil subscribe() = %v, %v", added, err)
+	}
+	if nilStore.due(next, utc) != nil || nilStore.begin(1) {
+		t.Error("nil store is not empty")
+	}
+}
+
+func TestRunScheduledDigest_running(t *testing.T) {
+	b := &SendToKindleBot{
+		jobs:  newJobTracker(),
+		feeds: &feedStore{users: make(map[int]*feedUser), running: make(map[int]bool)},
+	}
+	subscribed := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	b.feeds.subscribe(1, "https://a.test/rss", "A", subscribed)
+	next := time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)
+
+	// A digest already being prepared keeps the run due
+	b.feeds.begin(1)
+	b.runScheduledDigest(nil, 1, next)
+	b.feeds.end(1)
+	if due := b.feeds.due(next.Add(time.Minute), b.userLocation); !reflect.DeepEqual(due, []int{1}) {
+		t.Errorf("due() after a skipped run = %v, want [1]", due)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	server := newFeedServer(t)
+	kobo := t.TempDir()
+	b := &SendToKindleBot{
+		DeviceTransports: map[string]TransportConfig{"Kobo": {Type: TransportDirectory, Path: kobo}},
+		tmpFilesPath:     t.TempDir(),
+		jobs:             newJobTracker(),
+		feeds:            &feedStore{users: make(map[int]*feedUser), running: make(map[int]bool)},
+	}
+	now := time.Date(2026, 10, 18, 7, 0, 0, 0, time.UTC)
+	b.feeds.subscribe(1, server.URL+"/rss.xml", "Slow Reading", now)
+	b.feeds.subscribe(1, server.URL+"/gone.xml", "Gone", now)
+	job, err := b.jobs.begin(jobRecord{Kind: jobKindDigest, UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.jobs.end(job)
+
+	result, err := b.sendDigest(context.Background(), job, 1, now)
+	if err != nil {
+		t.Fatalf("sendDigest() error = %v", err)
+	}
+	if result.Articles != 2 || result.Device != "Kobo" || !reflect.DeepEqual(result.Failed, []string{"Gone"}) {
+		t.Errorf("sendDigest() = %+v, want 2 articles to Kobo and Gone failed", result)
+	}
+
+	archive, err := zip.OpenReader(filepath.Join(kobo, "News Digest 2026-10-18.epub"))
+	if err != nil {
+		t.Fatalf("digest not delivered: %v", err)
+	}
+	defer archive.Close()
+	chapters := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		chapters[file.Name] = string(content)
+	}
+	for name, want := range map[string]string{
+		"OEBPS/chapter-0.xhtml": `<li><a href="chapter-1.xhtml">Short &amp; sweet</a></li>`,
+		"OEBPS/chapter-1.xhtml": "This is the full text of the short post",
+		"OEBPS/chapter-2.xhtml": "<p>It has <b>two</b> paragraphs.</p>",
+		"OEBPS/nav.xhtml":       "The first post",
+	} {
+		if !strings.Contains(chapters[name], want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, chapters[name])
+		}
+	}
+	if strings.Contains(chapters["OEBPS/chapter-2.xhtml"], "alert") {
+		t.Error("digest contains the script of the feed")
+	}
+
+	// The delivered items are not sent again
+	result, err = b.sendDigest(context.Background(), job, 1, now.AddDate(0, 0, 1))
+	if err != nil || result.Articles != 0 {
+		t.Errorf("second sendDigest() = %+v, %v, want nothing new", result, err)
+	}
+	if entries, _ := ioutil.ReadDir(kobo); len(entries) != 1 {
+		t.Errorf("Kobo has %d files, want 1", len(entries))
+	}
+	if entries, _ := ioutil.ReadDir(b.tmpFilesPath); len(entries) != 0 {
+		t.Errorf("sendDigest() left %d temporary files", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(kobo, "News Digest 2026-10-19.epub")); err == nil {
+		t.Error("an empty digest was delivered")
+	}
+}
@@ -0,0 +1,275 @@
+package bot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMinFreeSpace is the free space the temporary directory needs to be ready
+	DefaultMinFreeSpace = 100 << 20
+	// DefaultSMTPCheckInterval is how long an SMTP check result is reused
+	DefaultSMTPCheckInterval = 5 * time.Minute
+
+	converterCheckInterval = 10 * time.Minute
+	healthCheckTimeout     = 10 * time.Second
+)
+
+var errDiskFreeUnsupported = errors.New("free space check not supported on this platform")
+
+// healthCheck is the result of one check in a /healthz or /readyz response
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// cachedCheck runs a check at most once per interval. Concurrent callers
+// wait for the running check and share its result, so probes cannot flood
+// the SMTP server
+type cachedCheck struct {
+	mu      sync.Mutex
+	run     func() error
+	checked time.Time
+	err     error
+}
+
+func (c *cachedCheck) result(now time.Time, interval time.Duration) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() || now.Sub(c.checked) >= interval {
+		c.err = c.run()
+		c.checked = now
+	}
+	return c.checked, c.err
+}
+
+// healthChecks holds the cached checks by key, e.g. "smtp:smtp.gmail.com:587"
+type healthChecks struct {
+	mu     sync.Mutex
+	checks map[string]*cachedCheck
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{checks: make(map[string]*cachedCheck)}
+}
+
+func (h *healthChecks) run(key string, interval time.Duration, now time.Time, check func() error) healthCheck {
+	h.mu.Lock()
+	c, ok := h.checks[key]
+	if !ok {
+		c = &cachedCheck{run: check}
+		h.checks[key] = c
+	}
+	h.mu.Unlock()
+
+	checked, err := c.result(now, interval)
+	age := now.Sub(checked).Truncate(time.Second)
+	if err != nil {
+		return healthCheck{Name: key, Detail: fmt.Sprintf("%v (checked %s ago)", err, age)}
+	}
+	return healthCheck{Name: key, OK: true, Detail: fmt.Sprintf("checked %s ago", age)}
+}
+
+// ServeHealthz reports whether the bot is alive: updates are being received
+func (b *SendToKindleBot) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, []healthCheck{b.checkPoller(time.Now())})
+}
+
+// ServeReadyz reports whether the bot can process documents: updates are
+// received, the temporary directory is usable, converters can be run and
+// the SMTP servers answer, or the dry run destination is writable
+func (b *SendToKindleBot) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	checks := []healthCheck{b.checkPoller(now), b.checkTmpDir()}
+	checks = append(checks, b.checkConverters(now)...)
+	if dry := b.current().dryRun; dry.enabled() {
+		checks = append(checks, checkDryRun(dry))
+	} else if b.current().usesEmail() {
+		checks = append(checks, b.checkSMTP(now)...)
+	}
+	writeHealthReport(w, checks)
+}
+
+func writeHealthReport(w http.ResponseWriter, checks []healthCheck) {
+	report := healthReport{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (b *SendToKindleBot) checkPoller(now time.Time) healthCheck {
+	if b.pollerHealth == nil {
+		return healthCheck{Name: "updates", Detail: "not started"}
+	}
+	ok, detail := b.pollerHealth.check(now)
+	return healthCheck{Name: "updates", OK: ok, Detail: detail}
+}
+
+// checkTmpDir verifies the temporary directory is writable and has at
+// least MinFreeSpace available
+func (b *SendToKindleBot) checkTmpDir() healthCheck {
+	check := healthCheck{Name: "tmp_dir"}
+	dir := b.GetTmpFilesPath()
+	if err := checkWritable(dir); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	free, err := diskFree(dir)
+	switch {
+	case errors.Is(err, errDiskFreeUnsupported):
+		check.OK, check.Detail = true, "writable"
+	case err != nil:
+		check.Detail = fmt.Sprintf("could not get free space: %v", err)
+	case free < b.minFreeSpace():
+		check.Detail = fmt.Sprintf("only %s free, need %s", formatFileSize(free), formatFileSize(b.minFreeSpace()))
+	default:
+		check.OK, check.Detail = true, fmt.Sprintf("writable, %s free", formatFileSize(free))
+	}
+	return check
+}
+
+// checkConverters verifies every configured converter can be run
+func (b *SendToKindleBot) checkConverters(now time.Time) []healthCheck {
+	registry := b.current().converters
+	if registry == nil {
+		return nil
+	}
+	var checks []healthCheck
+	for _, c := range registry.all() {
+		checkable, ok := c.(checker)
+		if !ok {
+			continue
+		}
+		checks = append(checks, b.health.run("converter:"+c.name(), converterCheckInterval, now, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			return checkable.check(ctx)
+		}))
+	}
+	return checks
+}
+
+// checkSMTP verifies each SMTP server answers EHLO. Results are cached for
+// SMTPCheckInterval
+func (b *SendToKindleBot) checkSMTP(now time.Time) []healthCheck {
+	s := b.current()
+	// Servers to whether one of their profiles skips certificate verification
+	servers := map[string]bool{net.JoinHostPort(s.smtp.Host, s.smtp.Port): s.smtp.Insecure}
+	for _, profile := range s.smtpProfiles {
+		addr := net.JoinHostPort(profile.Host, profile.Port)
+		servers[addr] = servers[addr] || profile.Insecure
+	}
+	addrs := make([]string, 0, len(servers))
+	for addr := range servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	interval := b.SMTPCheckInterval
+	if interval <= 0 {
+		interval = DefaultSMTPCheckInterval
+	}
+	checks := make([]healthCheck, 0, len(addrs))
+	for _, addr := range addrs {
+		addr, insecure := addr, servers[addr]
+		checks = append(checks, b.health.run("smtp:"+addr, interval, now, func() error {
+			return smtpHello(addr, insecure)
+		}))
+	}
+	return checks
+}
+
+// checkDryRun verifies the directory dry run emails are written to is writable
+func checkDryRun(dry dryRun) healthCheck {
+	check := healthCheck{Name: "dry_run"}
+	dir := dry.path
+	if dry.format == DryRunMbox {
+		dir = filepath.Dir(dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK, check.Detail = true, dry.String()
+	return check
+}
+
+// checkWritable creates dir if needed and writes a file to it
+func checkWritable(dir string) error {
+	if err := ensureDirectory(dir); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".healthcheck-")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	_, err = f.WriteString("ok")
+	f.Close()
+	os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	return nil
+}
+
+func (b *SendToKindleBot) minFreeSpace() int64 {
+	if b.MinFreeSpace > 0 {
+		return b.MinFreeSpace
+	}
+	return DefaultMinFreeSpace
+}
+
+// smtpHello connects to an SMTP server, waits for its greeting and sends
+// EHLO. Servers with implicit TLS are greeted after the TLS handshake,
+// insecure skips the verification of their certificate
+func smtpHello(addr string, insecure bool) error {
+	host, _, _ := net.SplitHostPort(addr)
+	dialer := &net.Dialer{Timeout: healthCheckTimeout, Deadline: time.Now().Add(healthCheckTimeout)}
+	var conn net.Conn
+	var err error
+	if smtpImplicitTLS(addr) {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host, InsecureSkipVerify: insecure})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	return c.Quit()
+}
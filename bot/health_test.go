@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer answers the greeting, EHLO and QUIT
+func fakeSMTPServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("220 fake ESMTP\r\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					switch strings.ToUpper(strings.Fields(scanner.Text())[0]) {
+					case "EHLO":
+						conn.Write([]byte("250-fake\r\n250 STARTTLS\r\n"))
+					case "QUIT":
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("502 not implemented\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestPollerHealth_check(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		health *pollerHealth
+		want   bool
+	}{
+		{name: "not running", health: &pollerHealth{mode: UpdateModePolling}, want: false},
+		{name: "recent poll", health: &pollerHealth{mode: UpdateModePolling, running: true, lastPoll: now.Add(-time.Second)}, want: true},
+		{name: "stale poll", health: &pollerHealth{mode: UpdateModePolling, running: true, lastPoll: now.Add(-2 * pollStaleAfter)}, want: false},
+		{name: "webhook without updates", health: &pollerHealth{mode: UpdateModeWebhook, running: true, lastPoll: now.Add(-time.Hour)}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, detail := tt.health.check(now); got != tt.want {
+				t.Errorf("check() = %v (%s), want %v", got, detail, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTmpDir(t *testing.T) {
+	b := &SendToKindleBot{}
+	b.SetTmpFilesPath(t.TempDir())
+
+	b.MinFreeSpace = 1
+	if check := b.checkTmpDir(); !check.OK {
+		t.Errorf("checkTmpDir() = %+v, want ok", check)
+	}
+
+	if _, err := diskFree(b.GetTmpFilesPath()); errors.Is(err, errDiskFreeUnsupported) {
+		return
+	}
+	b.MinFreeSpace = 1 << 62
+	if check := b.checkTmpDir(); check.OK || !strings.Contains(check.Detail, "free, need") {
+		t.Errorf("checkTmpDir() = %+v, want not enough free space", check)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	c := &cachedCheck{run: func() error {
+		calls++
+		return nil
+	}}
+	now := time.Now()
+	c.result(now, time.Minute)
+	c.result(now.Add(30*time.Second), time.Minute)
+	if calls != 1 {
+		t.Errorf("result() ran the check %d times within the interval, want 1", calls)
+	}
+	c.result(now.Add(time.Minute), time.Minute)
+	if calls != 2 {
+		t.Errorf("result() ran the check %d times after the interval, want 2", calls)
+	}
+}
+
+func TestServeReadyz(t *testing.T) {
+	smtpHost, smtpPort, _ := net.SplitHostPort(fakeSMTPServer(t))
+
+	tests := []struct {
+		name       string
+		converter  string
+		smtpPort   string
+		wantStatus int
+		wantFailed []string
+	}{
+		{name: "ready", converter: "sh", smtpPort: smtpPort, wantStatus: 200},
+		{name: "missing converter", converter: "no-such-converter", smtpPort: smtpPort, wantStatus: 503,
+			wantFailed: []string{"converter:no-such-converter"}},
+		{name: "smtp down", converter: "sh", smtpPort: "1", wantStatus: 503,
+			wantFailed: []string{"smtp:" + net.JoinHostPort(smtpHost, "1")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &SendToKindleBot{
+				Token:        "token",
+				EmailFrom:    "bot@example.com",
+				Password:     "secret",
+				EmailTo:      "kindle@kindle.com",
+				SMTPHost:     smtpHost,
+				SMTPPort:     tt.smtpPort,
+				MinFreeSpace: 1,
+				Converters:   []ConverterConfig{{Name: tt.converter, Command: tt.converter}},
+				health:       newHealthChecks(),
+				pollerHealth: &pollerHealth{mode: UpdateModePolling, running: true, lastPoll: time.Now()},
+			}
+			b.SetTmpFilesPath(t.TempDir())
+			if err := b.verifyConfig(); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			b.ServeReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("ServeReadyz() status = %d, want %d\n%s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			var report healthReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			for _, check := range report.Checks {
+				if !check.OK {
+					failed = append(failed, check.Name)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.wantFailed, ",") {
+				t.Errorf("ServeReadyz() failed checks = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPendingTTL is how long a prepared file waits for a device selection
+	DefaultPendingTTL = 24 * time.Hour
+	// maxJanitorInterval caps the time between two sweeps
+	maxJanitorInterval = 10 * time.Minute
+)
+
+// sweepResult summarizes a janitor run
+type sweepResult struct {
+	expired   int   // pending requests that timed out
+	removed   int   // files deleted
+	reclaimed int64 // bytes freed
+}
+
+// pendingTTL returns PendingTTL or its default
+func (b *SendToKindleBot) pendingTTL() time.Duration {
+	if ttl := b.current().pendingTTL; ttl > 0 {
+		return ttl
+	}
+	return DefaultPendingTTL
+}
+
+// runJanitor periodically expires pending requests and removes orphaned
+// temporary files until the bot is stopped
+func (b *SendToKindleBot) runJanitor(bot *tb.Bot) {
+	interval := b.pendingTTL() / 4
+	if interval > maxJanitorInterval {
+		interval = maxJanitorInterval
+	}
+	logging.Info("Janitor started", "pending_ttl", b.pendingTTL())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			result := b.sweep(bot, time.Now())
+			if result.removed > 0 || result.expired > 0 {
+				logging.Info("Janitor swept temporary files", "expired", result.expired,
+					"removed", result.removed, "reclaimed", formatFileSize(result.reclaimed))
+			}
+			if removed := b.library.prune(time.Now()); removed > 0 {
+				logging.Info("Janitor removed old books from the library", "removed", removed)
+			}
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+// sweep expires pending requests older than the TTL, removes their files and
+// deletes files in tmpFilesPath that no request or running job refers to
+func (b *SendToKindleBot) sweep(bot *tb.Bot, now time.Time) sweepResult {
+	var result sweepResult
+	ttl := b.pendingTTL()
+
+	var expired []map[string]string
+	b.cacheMutex.Lock()
+	for userID, fileInfo := range b.fileStateCache {
+		if b.jobs != nil && b.jobs.hasActive(userID) {
+			continue
+		}
+		if now.Sub(pendingSince(fileInfo)) < ttl {
+			continue
+		}
+		expired = append(expired, fileInfo)
+		delete(b.fileStateCache, userID)
+	}
+	b.cacheMutex.Unlock()
+
+	for _, fileInfo := range expired {
+		result.expired++
+		for _, key := range []string{"filePath", "originalFilePath"} {
+			if path := fileInfo[key]; path != "" {
+				result.add(removeCounted(path))
+			}
+		}
+		if bot != nil {
+			expirePrompt(bot, fileInfo)
+		}
+	}
+
+	b.sweepOrphans(now.Add(-ttl), &result)
+	return result
+}
+
+// sweepOrphans removes files older than cutoff that are not referenced by
+// a pending request or a running job, e.g. leftovers from a crash
+func (b *SendToKindleBot) sweepOrphans(cutoff time.Time, result *sweepResult) {
+	entries, err := ioutil.ReadDir(b.GetTmpFilesPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warn("Janitor could not list directory", "path", b.GetTmpFilesPath(), "err", err)
+		}
+		return
+	}
+
+	referenced := make(map[string]bool)
+	b.cacheMutex.RLock()
+	for _, fileInfo := range b.fileStateCache {
+		referenced[filepath.Clean(fileInfo["filePath"])] = true
+		referenced[filepath.Clean(fileInfo["originalFilePath"])] = true
+	}
+	b.cacheMutex.RUnlock()
+	if b.jobs != nil {
+		for _, path := range b.jobs.activeFiles() {
+			referenced[filepath.Clean(path)] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || isStateFile(entry.Name()) || entry.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Clean(filepath.Join(b.GetTmpFilesPath(), entry.Name()))
+		if referenced[path] {
+			continue
+		}
+		logging.Debug("Janitor removing orphaned file", "path", path)
+		result.add(removeCounted(path))
+	}
+}
+
+func (r *sweepResult) add(size int64, removed bool) {
+	if removed {
+		r.removed++
+		r.reclaimed += size
+	}
+}
+
+// removeCounted deletes a file and reports its size
+func removeCounted(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	if err := os.Remove(path); err != nil {
+		logging.Warn("Could not delete file", "path", path, "err", err)
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// isStateFile reports whether name is one of the files the bot keeps between
+// restarts, such as stateFileName and usersFileName, or a temporary copy of one
+func isStateFile(name string) bool {
+	return strings.HasPrefix(name, ".bot-")
+}
+
+// pendingSince returns when a pending request was created
+func pendingSince(fileInfo map[string]string) time.Time {
+	nanos, err := strconv.ParseInt(fileInfo["startedAt"], 10, 64)
+	if err != nil {
+		// Entries without a timestamp predate it and are treated as expired
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// expirePrompt replaces the device selection keyboard with an expiry notice
+func expirePrompt(bot *tb.Bot, fileInfo map[string]string) {
+	editPrompt(bot, fileInfo, fmt.Sprintf("⌛ This request expired, please resend '%s'.", fileInfo["originalFileName"]))
+}
+
+// editPrompt replaces the device selection message and its keyboard with text
+func editPrompt(bot *tb.Bot, fileInfo map[string]string, text string) {
+	chatID, err := strconv.ParseInt(fileInfo["chatID"], 10, 64)
+	if err != nil || fileInfo["messageID"] == "" {
+		return
+	}
+	prompt := tb.StoredMessage{MessageID: fileInfo["messageID"], ChatID: chatID}
+	if _, err := bot.Edit(prompt, text); err != nil {
+		logging.Warn("Could not update device selection", "err", err)
+	}
+}
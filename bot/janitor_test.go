@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeAged(t *testing.T, path string, size int, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendToKindleBot_sweep(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ttl := time.Hour
+
+	stale := filepath.Join(dir, "stale.epub")
+	staleOriginal := filepath.Join(dir, "stale.fb2")
+	fresh := filepath.Join(dir, "fresh.epub")
+	orphan := filepath.Join(dir, "orphan.epub")
+	newOrphan := filepath.Join(dir, "uploading.pdf")
+	writeAged(t, stale, 100, 2*time.Hour)
+	writeAged(t, staleOriginal, 50, 2*time.Hour)
+	writeAged(t, fresh, 10, 2*time.Hour)
+	writeAged(t, orphan, 1000, 3*time.Hour)
+	writeAged(t, newOrphan, 10, time.Minute)
+	writeAged(t, filepath.Join(dir, stateFileName), 10, 3*time.Hour)
+	writeAged(t, filepath.Join(dir, usersFileName), 10, 3*time.Hour)
+
+	b := &SendToKindleBot{
+		PendingTTL:   ttl,
+		tmpFilesPath: dir,
+		fileStateCache: map[int]map[string]string{
+			1: {
+				"filePath":         stale,
+				"originalFilePath": staleOriginal,
+				"startedAt":        strconv.FormatInt(now.Add(-2*time.Hour).UnixNano(), 10),
+			},
+			2: {
+				"filePath":  fresh,
+				"startedAt": strconv.FormatInt(now.Add(-time.Minute).UnixNano(), 10),
+			},
+		},
+	}
+
+	result := b.sweep(nil, now)
+
+	if result.expired != 1 {
+		t.Errorf("sweep() expired = %d, want 1", result.expired)
+	}
+	if result.removed != 3 {
+		t.Errorf("sweep() removed = %d, want 3", result.removed)
+	}
+	if result.reclaimed != 1150 {
+		t.Errorf("sweep() reclaimed = %d, want 1150", result.reclaimed)
+	}
+	if _, ok := b.fileStateCache[1]; ok {
+		t.Errorf("sweep() kept the expired request")
+	}
+	if _, ok := b.fileStateCache[2]; !ok {
+		t.Errorf("sweep() expired a fresh request")
+	}
+	for _, path := range []string{fresh, newOrphan, filepath.Join(dir, stateFileName), filepath.Join(dir, usersFileName)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("sweep() removed %s", filepath.Base(path))
+		}
+	}
+}
+
+func TestSendToKindleBot_sweepKeepsActiveJobs(t *testing.T) {
+	dir := t.TempDir()
+	downloading := filepath.Join(dir, "big.pdf")
+	writeAged(t, downloading, 10, 2*time.Hour)
+
+	b := &SendToKindleBot{
+		PendingTTL:     time.Hour,
+		tmpFilesPath:   dir,
+		fileStateCache: map[int]map[string]string{3: {"filePath": downloading}},
+		jobs:           newJobTracker(),
+	}
+	job, err := b.jobs.begin(jobRecord{Kind: jobKindSend, UserID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.jobs.addFile(job, downloading)
+
+	if result := b.sweep(nil, time.Now()); result.expired != 0 || result.removed != 0 {
+		t.Errorf("sweep() touched a running job: %+v", result)
+	}
+}
@@ -0,0 +1,303 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// libraryIndexName is the index of a library directory
+const libraryIndexName = "library.json"
+
+// libraryFile is one format of a stored book
+type libraryFile struct {
+	Name   string `json:"name"`
+	Format string `json:"format"` // extension without the dot, e.g. "epub"
+	Size   int64  `json:"size"`
+}
+
+// libraryBook is a delivered book kept for the OPDS catalog
+type libraryBook struct {
+	ID     string        `json:"id"`
+	UserID int           `json:"user_id"`
+	Added  time.Time     `json:"added"`
+	Files  []libraryFile `json:"files"`
+	bookMetadata
+}
+
+// file returns the stored file with the given name
+func (b libraryBook) file(name string) (libraryFile, bool) {
+	for _, f := range b.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return libraryFile{}, false
+}
+
+// library keeps delivered books, original and converted, per user in
+// <dir>/<user>/<book>/. All methods do nothing on a nil library
+type library struct {
+	mu     sync.Mutex
+	dir    string
+	maxAge time.Duration // 0 keeps books forever
+	books  map[string]*libraryBook
+}
+
+// openLibrary reads the index of dir. A missing index is an empty library
+func openLibrary(dir string, maxAge time.Duration) (*library, error) {
+	l := &library{dir: dir, maxAge: maxAge, books: make(map[string]*libraryBook)}
+	content, err := ioutil.ReadFile(filepath.Join(dir, libraryIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	var books []*libraryBook
+	if err := json.Unmarshal(content, &books); err != nil {
+		return l, fmt.Errorf("could not parse %s: %w", libraryIndexName, err)
+	}
+	for _, book := range books {
+		l.books[book.ID] = book
+	}
+	return l, nil
+}
+
+// add stores copies of files as a new book of the user
+func (l *library) add(userID int, metadata bookMetadata, now time.Time, files ...string) (libraryBook, error) {
+	if l == nil {
+		return libraryBook{}, nil
+	}
+	id, err := newBookID()
+	if err != nil {
+		return libraryBook{}, err
+	}
+	book := &libraryBook{ID: id, UserID: userID, Added: now, bookMetadata: metadata}
+	dir := l.bookDir(*book)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return libraryBook{}, err
+	}
+	for _, path := range files {
+		name := filepath.Base(path)
+		if _, exists := book.file(name); exists || path == "" {
+			continue
+		}
+		size, err := linkOrCopy(path, filepath.Join(dir, name))
+		if err != nil {
+			os.RemoveAll(dir)
+			return libraryBook{}, err
+		}
+		book.Files = append(book.Files, libraryFile{Name: name, Format: normalizeFormat(filepath.Ext(name)), Size: size})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.books[id] = book
+	return *book, l.saveLocked()
+}
+
+// list returns the books of a user, newest first
+func (l *library) list(userID int) []libraryBook {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var books []libraryBook
+	for _, book := range l.books {
+		if book.UserID == userID {
+			books = append(books, *book)
+		}
+	}
+	sort.Slice(books, func(i, j int) bool {
+		if !books[i].Added.Equal(books[j].Added) {
+			return books[i].Added.After(books[j].Added)
+		}
+		return books[i].ID < books[j].ID
+	})
+	return books
+}
+
+// book returns a book of the user
+func (l *library) book(userID int, id string) (libraryBook, bool) {
+	if l == nil {
+		return libraryBook{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	book, ok := l.books[id]
+	if !ok || book.UserID != userID {
+		return libraryBook{}, false
+	}
+	return *book, true
+}
+
+// path returns where a file of a book is stored
+func (l *library) path(book libraryBook, f libraryFile) string {
+	return filepath.Join(l.bookDir(book), f.Name)
+}
+
+func (l *library) bookDir(book libraryBook) string {
+	return filepath.Join(l.dir, strconv.Itoa(book.UserID), book.ID)
+}
+
+// prune removes books older than maxAge and returns how many
+func (l *library) prune(now time.Time) int {
+	if l == nil || l.maxAge <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	removed := 0
+	for id, book := range l.books {
+		if now.Sub(book.Added) < l.maxAge {
+			continue
+		}
+		if err := os.RemoveAll(l.bookDir(*book)); err != nil {
+			logging.Warn("Could not remove book", "book", id, "err", err)
+			continue
+		}
+		delete(l.books, id)
+		removed++
+	}
+	if removed > 0 {
+		if err := l.saveLocked(); err != nil {
+			logging.Warn("Could not save library", "path", l.dir, "err", err)
+		}
+	}
+	return removed
+}
+
+func (l *library) saveLocked() error {
+	books := make([]*libraryBook, 0, len(l.books))
+	for _, book := range l.books {
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	content, err := json.MarshalIndent(books, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, libraryIndexName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// linkOrCopy hard links src to dst, copying when that is not possible,
+// e.g. across file systems, and returns the size
+func linkOrCopy(src, dst string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return info.Size(), nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return size, err
+}
+
+func newBookID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// searchBooks returns the books whose title, authors or file names contain
+// every word of query, ignoring case
+func searchBooks(books []libraryBook, query string) []libraryBook {
+	words := strings.Fields(strings.ToLower(query))
+	var found []libraryBook
+	for _, book := range books {
+		text := strings.ToLower(book.Title + " " + book.author())
+		for _, f := range book.Files {
+			text += " " + strings.ToLower(f.Name)
+		}
+		if containsWords(text, words) {
+			found = append(found, book)
+		}
+	}
+	return found
+}
+
+// containsWords reports whether text contains every one of words
+func containsWords(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// libraryPath returns LibraryPath, <tmp>/library when only the OPDS
+// catalog is enabled, or empty when books are not kept
+func (b *SendToKindleBot) libraryPath() string {
+	if b.LibraryPath != "" {
+		return b.LibraryPath
+	}
+	if b.OPDSListen != "" {
+		return filepath.Join(b.GetTmpFilesPath(), "library")
+	}
+	return ""
+}
+
+// archiveBook adds a delivered book to the Calibre content server and
+// keeps it in the library, when they are configured. files[0] is the file
+// that was delivered. Failures are only logged, the book did arrive
+func (b *SendToKindleBot) archiveBook(ctx context.Context, s *settings, userID int, fileName string, files ...string) {
+	logger := logging.FromContext(ctx)
+	if s.calibreServer.URL != "" && len(files) > 0 {
+		deliverer, err := newTransport("calibre server", s.calibreServer)
+		if err == nil {
+			err = deliverer.Deliver(ctx, files[0], fileName)
+		}
+		if err != nil {
+			logger.Warn("Could not add book to the Calibre library", "err", err)
+		}
+	}
+	if b.library == nil {
+		return
+	}
+	metadata := extractMetadata(fileName, files...)
+	book, err := b.library.add(userID, metadata, time.Now(), files...)
+	if err != nil {
+		logger.Warn("Could not add book to the library", "err", err)
+		return
+	}
+	logger.Debug("Added book to the library", "book", book.ID, "title", book.Title)
+}
@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLibrary(t *testing.T) {
+	src := t.TempDir()
+	original := filepath.Join(src, "book.fb2")
+	converted := filepath.Join(src, "book.epub")
+	for _, path := range []string{original, converted} {
+		if err := os.WriteFile(path, []byte(filepath.Ext(path)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	l, err := openLibrary(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("openLibrary() error = %v", err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old, err := l.add(1, bookMetadata{Title: "Old"}, now.Add(-48*time.Hour), original)
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	book, err := l.add(1, bookMetadata{Title: "War and Peace", Authors: []string{"Leo Tolstoy"}}, now, converted, original, "")
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if len(book.Files) != 2 || book.Files[0].Format != "epub" || book.Files[1].Format != "fb2" {
+		t.Errorf("add() files = %+v, want epub and fb2", book.Files)
+	}
+	if _, err := l.add(2, bookMetadata{Title: "Other"}, now, original); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	if books := l.list(1); len(books) != 2 || books[0].ID != book.ID || books[1].ID != old.ID {
+		t.Errorf("list(1) = %+v, want newest first", books)
+	}
+	if _, ok := l.book(2, book.ID); ok {
+		t.Errorf("book() returned a book of another user")
+	}
+	f, _ := book.file("book.epub")
+	assertFileContent(t, l.path(book, f), ".epub")
+
+	reopened, err := openLibrary(dir, 24*time.Hour)
+	if err != nil || len(reopened.list(1)) != 2 {
+		t.Fatalf("openLibrary() after add = %d books, %v, want 2", len(reopened.list(1)), err)
+	}
+	if removed := reopened.prune(now); removed != 1 {
+		t.Errorf("prune() = %d, want 1", removed)
+	}
+	if _, err := os.Stat(reopened.bookDir(old)); !os.IsNotExist(err) {
+		t.Errorf("prune() kept the files of the old book")
+	}
+	if _, ok := reopened.book(1, book.ID); !ok {
+		t.Errorf("prune() removed a recent book")
+	}
+
+	var disabled *library
+	if _, err := disabled.add(1, bookMetadata{}, now, original); err != nil || disabled.list(1) != nil || disabled.prune(now) != 0 {
+		t.Errorf("nil library should do nothing")
+	}
+}
+
+func TestSearchBooks(t *testing.T) {
+	books := []libraryBook{
+		{ID: "1", bookMetadata: bookMetadata{Title: "War and Peace", Authors: []string{"Leo Tolstoy"}}},
+		{ID: "2", bookMetadata: bookMetadata{Title: "Anna Karenina", Authors: []string{"Leo Tolstoy"}}},
+		{ID: "3", bookMetadata: bookMetadata{Title: "Notes"}, Files: []libraryFile{{Name: "dune-notes.pdf"}}},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "tolstoy", want: []string{"1", "2"}},
+		{query: "PEACE leo", want: []string{"1"}},
+		{query: "dune", want: []string{"3"}},
+		{query: "tolstoy dune", want: nil},
+		{query: "", want: []string{"1", "2", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []string
+			for _, book := range searchBooks(books, tt.query) {
+				got = append(got, book.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("searchBooks(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("searchBooks(%q) = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,912 @@
+package bot
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	mdHeadingRe     = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRuleRe        = regexp.MustCompile(`^(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdSetextRe      = regexp.MustCompile(`^(=+|-+)[ \t]*$`)
+	mdFenceRe       = regexp.MustCompile("^(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdListItemRe    = regexp.MustCompile(`^([-+*]|\d{1,9}[.)])([ \t]+|$)`)
+	mdFootnoteDefRe = regexp.MustCompile(`^\[\^([^\]\s]+)\]:[ \t]?(.*)$`)
+	mdLinkDefRe     = regexp.MustCompile(`^\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+(?:"[^"]*"|'[^']*'|\([^)]*\)))?[ \t]*$`)
+	mdTableDelimRe  = regexp.MustCompile(`^\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?$`)
+	mdHTMLBlockRe   = regexp.MustCompile(`(?i)^<(?:!--|/?(?:address|article|aside|blockquote|details|div|dl|fieldset|figure|footer|form|h[1-6]|header|hr|nav|ol|p|pre|section|summary|table|ul)(?:[\s/>]|$))`)
+	mdTaskRe        = regexp.MustCompile(`^\[([ xX])\][ \t]+`)
+	mdAutolinkRe    = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*|[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)*)>`)
+	mdEntityRe      = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	mdBreakTagRe    = regexp.MustCompile(`(?i)^<br\s*/?>`)
+)
+
+// mdBlock is a Markdown block before its inline content is rendered, which
+// needs every link reference and footnote definition of the document
+type mdBlock struct {
+	kind     string // heading, paragraph, code, quote, list, table, rule, html
+	level    int    // of a heading
+	text     string // inline text, code or HTML
+	info     string // language of fenced code
+	children []mdBlock
+	items    []mdItem
+	ordered  bool
+	start    int
+	loose    bool
+	rows     [][]string
+	align    []string
+}
+
+// mdItem is a list item, task is "" for plain items, " " or "x" for tasks
+type mdItem struct {
+	task   string
+	blocks []mdBlock
+}
+
+// mdParser parses CommonMark with the GFM tables, task lists, strikethrough
+// and autolinks, and footnotes
+type mdParser struct {
+	doc   *markupDocument
+	links map[string]string    // link references by normalized label
+	notes map[string][]mdBlock // footnote definitions by label
+	order []string             // footnote labels in definition order
+	seen  map[string]bool      // footnotes rendered already
+}
+
+// parseMarkdown parses a Markdown document with optional YAML front matter
+// holding its title, author and lang
+func parseMarkdown(content string) *markupDocument {
+	p := &mdParser{
+		doc:   newMarkupDocument(),
+		links: make(map[string]string),
+		notes: make(map[string][]mdBlock),
+		seen:  make(map[string]bool),
+	}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	lines = p.frontMatter(lines)
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+	for _, block := range p.blocks(lines) {
+		if block.kind == "heading" {
+			p.doc.add(block.level, p.inline(block.text))
+			continue
+		}
+		p.doc.add(0, p.render(block, false))
+	}
+	for _, label := range p.order {
+		if !p.seen[label] {
+			continue
+		}
+		var body strings.Builder
+		for _, block := range p.notes[label] {
+			body.WriteString(p.render(block, false) + "\n")
+		}
+		p.doc.notes.define(label, body.String())
+	}
+	return p.doc
+}
+
+// frontMatter reads a leading YAML block between "---" lines and returns
+// the lines after it
+func (p *mdParser) frontMatter(lines []string) []string {
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return lines
+	}
+	for i := 1; i < len(lines); i++ {
+		if end := strings.TrimSpace(lines[i]); end != "---" && end != "..." {
+			continue
+		}
+		var meta struct {
+			Title    string      `yaml:"title"`
+			Author   interface{} `yaml:"author"`
+			Authors  []string    `yaml:"authors"`
+			Lang     string      `yaml:"lang"`
+			Language string      `yaml:"language"`
+		}
+		if err := yaml.Unmarshal([]byte(strings.Join(lines[1:i], "\n")), &meta); err != nil {
+			return lines
+		}
+		p.doc.Title = meta.Title
+		p.doc.Authors = meta.Authors
+		switch author := meta.Author.(type) {
+		case string:
+			p.doc.Authors = append(p.doc.Authors, author)
+		case []interface{}:
+			for _, name := range author {
+				p.doc.Authors = append(p.doc.Authors, fmt.Sprint(name))
+			}
+		}
+		p.doc.Language = meta.Lang
+		if p.doc.Language == "" {
+			p.doc.Language = meta.Language
+		}
+		return lines[i+1:]
+	}
+	return lines
+}
+
+// expandTabs replaces the tabs of indentation with spaces to tab stops of 4
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var out strings.Builder
+	column := 0
+	for i, r := range line {
+		if r == '\t' {
+			spaces := 4 - column%4
+			out.WriteString(strings.Repeat(" ", spaces))
+			column += spaces
+			continue
+		}
+		if r != ' ' {
+			out.WriteString(line[i:])
+			break
+		}
+		out.WriteByte(' ')
+		column++
+	}
+	return out.String()
+}
+
+// indentation returns the number of leading spaces of line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// interrupts reports whether line starts a block that ends a paragraph
+func (p *mdParser) interrupts(line string) bool {
+	if indentation(line) >= 4 {
+		return false
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	if mdHeadingRe.MatchString(trimmed) || mdRuleRe.MatchString(trimmed) || mdFenceRe.MatchString(trimmed) ||
+		strings.HasPrefix(trimmed, ">") || mdHTMLBlockRe.MatchString(trimmed) {
+		return true
+	}
+	// Only bullets and lists starting at 1 interrupt a paragraph, and not
+	// when they are empty
+	if m := mdListItemRe.FindStringSubmatch(trimmed); m != nil && strings.TrimSpace(trimmed[len(m[0]):]) != "" {
+		return !strings.ContainsAny(m[1], ".)") || m[1][:len(m[1])-1] == "1"
+	}
+	return false
+}
+
+// blocks parses lines into blocks
+func (p *mdParser) blocks(lines []string) []mdBlock {
+	var blocks []mdBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+		indent := indentation(line)
+		if indent >= 4 {
+			var code []string
+			for ; i < len(lines) && (isBlank(lines[i]) || indentation(lines[i]) >= 4); i++ {
+				if len(lines[i]) >= 4 {
+					code = append(code, lines[i][4:])
+				} else {
+					code = append(code, "")
+				}
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			blocks = append(blocks, mdBlock{kind: "code", text: strings.Join(code, "\n")})
+			continue
+		}
+		trimmed := line[indent:]
+
+		if m := mdFenceRe.FindStringSubmatch(trimmed); m != nil {
+			fence := m[1]
+			var code []string
+			for i++; i < len(lines); i++ {
+				closing := strings.TrimSpace(lines[i])
+				if indentation(lines[i]) < 4 && strings.HasPrefix(closing, fence) &&
+					strings.Trim(closing, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, trimIndent(lines[i], indent))
+			}
+			info := strings.Fields(m[2])
+			block := mdBlock{kind: "code", text: strings.Join(code, "\n")}
+			if len(info) > 0 {
+				block.info = info[0]
+			}
+			blocks = append(blocks, block)
+			continue
+		}
+		if m := mdHeadingRe.FindStringSubmatch(trimmed); m != nil {
+			blocks = append(blocks, mdBlock{kind: "heading", level: len(m[1]), text: strings.TrimSpace(m[2])})
+			i++
+			continue
+		}
+		if mdRuleRe.MatchString(trimmed) {
+			blocks = append(blocks, mdBlock{kind: "rule"})
+			i++
+			continue
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			var quoted []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				next := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(next, ">") && indentation(lines[i]) < 4 {
+					next = strings.TrimPrefix(next[1:], " ")
+				} else if len(quoted) == 0 || p.interrupts(lines[i]) {
+					break
+				}
+				quoted = append(quoted, next)
+			}
+			blocks = append(blocks, mdBlock{kind: "quote", children: p.blocks(quoted)})
+			continue
+		}
+		if mdListItemRe.MatchString(trimmed) {
+			var block mdBlock
+			block, i = p.list(lines, i)
+			blocks = append(blocks, block)
+			continue
+		}
+		if mdHTMLBlockRe.MatchString(trimmed) {
+			var raw []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				raw = append(raw, lines[i])
+			}
+			blocks = append(blocks, mdBlock{kind: "html", text: strings.Join(raw, "\n")})
+			continue
+		}
+		if m := mdFootnoteDefRe.FindStringSubmatch(trimmed); m != nil {
+			body := []string{m[2]}
+			for i++; i < len(lines); i++ {
+				if isBlank(lines[i]) {
+					if i+1 < len(lines) && indentation(lines[i+1]) >= 4 {
+						body = append(body, "")
+						continue
+					}
+					break
+				}
+				if indentation(lines[i]) >= 4 {
+					body = append(body, lines[i][4:])
+				} else if !isBlank(body[len(body)-1]) && !p.interrupts(lines[i]) &&
+					!mdFootnoteDefRe.MatchString(strings.TrimSpace(lines[i])) {
+					body = append(body, lines[i])
+				} else {
+					break
+				}
+			}
+			label := strings.ToLower(m[1])
+			if _, ok := p.notes[label]; !ok {
+				p.order = append(p.order, label)
+			}
+			p.notes[label] = p.blocks(body)
+			continue
+		}
+		if m := mdLinkDefRe.FindStringSubmatch(trimmed); m != nil {
+			label := mdLabel(m[1])
+			if _, ok := p.links[label]; !ok {
+				p.links[label] = m[2]
+			}
+			i++
+			continue
+		}
+		if strings.Contains(trimmed, "|") && i+1 < len(lines) && mdTableDelimRe.MatchString(strings.TrimSpace(lines[i+1])) {
+			header := mdCells(trimmed)
+			delims := mdCells(strings.TrimSpace(lines[i+1]))
+			if len(header) == len(delims) {
+				var block mdBlock
+				block, i = p.table(lines, i, header, delims)
+				blocks = append(blocks, block)
+				continue
+			}
+		}
+
+		paragraph := []string{strings.TrimLeft(line, " ")}
+		heading := 0
+		for i++; i < len(lines) && !isBlank(lines[i]); i++ {
+			if m := mdSetextRe.FindStringSubmatch(strings.TrimSpace(lines[i])); m != nil && indentation(lines[i]) < 4 {
+				heading = 2
+				if m[1][0] == '=' {
+					heading = 1
+				}
+				i++
+				break
+			}
+			if p.interrupts(lines[i]) {
+				break
+			}
+			paragraph = append(paragraph, strings.TrimLeft(lines[i], " "))
+		}
+		text := strings.TrimRight(strings.Join(paragraph, "\n"), " ")
+		if heading > 0 {
+			blocks = append(blocks, mdBlock{kind: "heading", level: heading, text: text})
+		} else {
+			blocks = append(blocks, mdBlock{kind: "paragraph", text: text})
+		}
+	}
+	return blocks
+}
+
+// trimIndent removes up to n spaces of indentation from line
+func trimIndent(line string, n int) string {
+	if indent := indentation(line); indent < n {
+		n = indent
+	}
+	return line[n:]
+}
+
+// list parses the list starting at lines[i] and returns the index after it
+func (p *mdParser) list(lines []string, i int) (mdBlock, int) {
+	indent := indentation(lines[i])
+	first := mdListItemRe.FindStringSubmatch(lines[i][indent:])
+	marker := first[1]
+	block := mdBlock{kind: "list", ordered: strings.ContainsAny(marker, ".)")}
+	if block.ordered {
+		block.start, _ = strconv.Atoi(marker[:len(marker)-1])
+	}
+	sameList := func(m []string) bool {
+		if m == nil {
+			return false
+		}
+		if block.ordered {
+			return strings.ContainsAny(m[1], ".)") && m[1][len(m[1])-1] == marker[len(marker)-1]
+		}
+		return m[1] == marker
+	}
+
+	blankBetween := false
+	for i < len(lines) {
+		indent := indentation(lines[i])
+		m := mdListItemRe.FindStringSubmatch(lines[i][indent:])
+		if indent >= 4 || !sameList(m) {
+			break
+		}
+		rest := lines[i][indent+len(m[0]):]
+		width := indent + len(m[1]) + len(m[2])
+		switch {
+		case rest == "":
+			width = indent + len(m[1]) + 1
+		case len(m[2]) > 4:
+			// Indented code right after the marker
+			width = indent + len(m[1]) + 1
+			rest = strings.Repeat(" ", len(m[2])-1) + rest
+		}
+		body := []string{rest}
+		blank := false
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				body = append(body, "")
+				blank = true
+				continue
+			}
+			if indentation(line) >= width {
+				// A blank line between the blocks of an item makes the list loose
+				block.loose = block.loose || blank
+				body = append(body, line[width:])
+				blank = false
+				continue
+			}
+			if !blank && !p.interrupts(line) && !mdListItemRe.MatchString(strings.TrimLeft(line, " ")) {
+				// Lazy continuation of a paragraph
+				body = append(body, strings.TrimLeft(line, " "))
+				continue
+			}
+			break
+		}
+		for len(body) > 1 && isBlank(body[len(body)-1]) {
+			body = body[:len(body)-1]
+		}
+		if blankBetween {
+			block.loose = true
+		}
+		blankBetween = blank
+
+		item := mdItem{}
+		if !block.ordered {
+			if task := mdTaskRe.FindStringSubmatch(body[0]); task != nil {
+				item.task = strings.ToLower(task[1])
+				body[0] = body[0][len(task[0]):]
+			}
+		}
+		item.blocks = p.blocks(body)
+		block.items = append(block.items, item)
+	}
+	return block, i
+}
+
+// table parses a GFM table starting at lines[i] with the header and
+// delimiter row given
+func (p *mdParser) table(lines []string, i int, header, delims []string) (mdBlock, int) {
+	block := mdBlock{kind: "table", rows: [][]string{header}}
+	for _, delim := range delims {
+		switch {
+		case strings.HasPrefix(delim, ":") && strings.HasSuffix(delim, ":"):
+			block.align = append(block.align, "center")
+		case strings.HasSuffix(delim, ":"):
+			block.align = append(block.align, "right")
+		case strings.HasPrefix(delim, ":"):
+			block.align = append(block.align, "left")
+		default:
+			block.align = append(block.align, "")
+		}
+	}
+	for i += 2; i < len(lines) && !isBlank(lines[i]) && !p.interrupts(lines[i]); i++ {
+		cells := mdCells(strings.TrimSpace(lines[i]))
+		// Rows have the cells of the header, extra cells are dropped
+		for len(cells) < len(header) {
+			cells = append(cells, "")
+		}
+		block.rows = append(block.rows, cells[:len(header)])
+	}
+	return block, i
+}
+
+// mdCells splits a table row at the pipes that are not escaped or in code
+func mdCells(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	if strings.HasSuffix(row, "|") && !strings.HasSuffix(row, `\|`) {
+		row = row[:len(row)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	code := false
+	for i := 0; i < len(row); i++ {
+		switch c := row[i]; {
+		case c == '\\' && i+1 < len(row) && row[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case c == '`':
+			code = !code
+			cell.WriteByte(c)
+		case c == '|' && !code:
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(c)
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// mdLabel normalizes the label of a link reference
+func mdLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// render renders a block, tight renders paragraphs without <p> as in the
+// items of tight lists
+func (p *mdParser) render(block mdBlock, tight bool) string {
+	switch block.kind {
+	case "heading":
+		// Headings nested in lists or quotes stay where they are
+		level := block.level + 1
+		if level > 6 {
+			level = 6
+		}
+		return fmt.Sprintf("<h%d>%s</h%d>", level, p.inline(block.text), level)
+	case "paragraph":
+		if tight {
+			return p.inline(block.text)
+		}
+		return "<p>" + p.inline(block.text) + "</p>"
+	case "code":
+		return markupCode(block.text, block.info)
+	case "rule":
+		return "<hr/>"
+	case "html":
+		return htmlToXHTML(block.text, nil)
+	case "quote":
+		return "<blockquote>\n" + p.renderAll(block.children, false) + "\n</blockquote>"
+	case "table":
+		rows := make([][]string, len(block.rows))
+		for i, row := range block.rows {
+			for _, cell := range row {
+				rows[i] = append(rows[i], p.inline(cell))
+			}
+		}
+		return markupTable(rows, 1, block.align)
+	case "list":
+		tag, start := "ul", ""
+		if block.ordered {
+			tag = "ol"
+			if block.start != 1 {
+				start = fmt.Sprintf(` start="%d"`, block.start)
+			}
+		}
+		var out strings.Builder
+		out.WriteString("<" + tag + start + ">\n")
+		for _, item := range block.items {
+			out.WriteString("<li>")
+			switch item.task {
+			case " ":
+				out.WriteString("☐ ")
+			case "x":
+				out.WriteString("☑ ")
+			}
+			out.WriteString(p.renderAll(item.blocks, !block.loose))
+			out.WriteString("</li>\n")
+		}
+		out.WriteString("</" + tag + ">")
+		return out.String()
+	}
+	return ""
+}
+
+func (p *mdParser) renderAll(blocks []mdBlock, tight bool) string {
+	rendered := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		rendered = append(rendered, p.render(block, tight))
+	}
+	return strings.Join(rendered, "\n")
+}
+
+// mdNode is rendered inline content or a run of emphasis delimiters
+type mdNode struct {
+	html     string
+	delim    byte // '*', '_' or '~' for a run of delimiters
+	count    int
+	canOpen  bool
+	canClose bool
+	open     string // tags opened after the remaining delimiters
+	close    string // tags closed before the remaining delimiters
+}
+
+// inline renders the inline content of a block
+func (p *mdParser) inline(text string) string {
+	var nodes []mdNode
+	var plain strings.Builder
+	flush := func() {
+		if plain.Len() > 0 {
+			nodes = append(nodes, mdNode{html: plain.String()})
+			plain.Reset()
+		}
+	}
+	emit := func(xhtml string) {
+		flush()
+		nodes = append(nodes, mdNode{html: xhtml})
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			emit("<br/>\n")
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			plain.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			run := countRun(text[i:], '`')
+			if end := strings.Index(text[i+run:], strings.Repeat("`", run)); end >= 0 && countRun(text[i+run+end:], '`') == run {
+				code := strings.ReplaceAll(text[i+run:i+run+end], "\n", " ")
+				if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				emit("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+				continue
+			}
+			plain.WriteString(text[i : i+run])
+			i += run
+			continue
+		case c == '*' || c == '_' || c == '~':
+			run := countRun(text[i:], c)
+			before, _ := utf8.DecodeLastRuneInString(text[:i])
+			after, _ := utf8.DecodeRuneInString(text[i+run:])
+			if i == 0 {
+				before = ' '
+			}
+			if i+run == len(text) {
+				after = ' '
+			}
+			left := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+			right := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+			node := mdNode{delim: c, count: run, canOpen: left, canClose: right}
+			if c == '_' {
+				node.canOpen = left && (!right || isPunct(before))
+				node.canClose = right && (!left || isPunct(after))
+			}
+			if c == '~' && run > 2 {
+				node.canOpen, node.canClose = false, false
+			}
+			flush()
+			nodes = append(nodes, node)
+			i += run
+			continue
+		case c == '!' && strings.HasPrefix(text[i:], "!["):
+			// Images are not downloaded, their description stays in the text
+			if _, alt, end, ok := p.link(text, i+1); ok {
+				if alt != "" {
+					emit("<em>" + alt + "</em>")
+				}
+				i = end
+				continue
+			}
+		case c == '[':
+			if label := footnoteRef(text[i:]); label != "" {
+				if _, ok := p.notes[strings.ToLower(label)]; ok {
+					p.seen[strings.ToLower(label)] = true
+					emit(p.doc.notes.ref(strings.ToLower(label)))
+					i += len(label) + 3
+					continue
+				}
+			}
+			if target, content, end, ok := p.link(text, i); ok {
+				emit(markupLink(target, content))
+				i = end
+				continue
+			}
+		case c == '<':
+			if m := mdAutolinkRe.FindStringSubmatch(text[i:]); m != nil {
+				target := m[1]
+				if strings.Contains(target, "@") && !strings.Contains(target, ":") {
+					target = "mailto:" + target
+				}
+				emit(markupLink(target, html.EscapeString(m[1])))
+				i += len(m[0])
+				continue
+			}
+			if m := mdBreakTagRe.FindString(text[i:]); m != "" {
+				emit("<br/>")
+				i += len(m)
+				continue
+			}
+		case c == '&':
+			if m := mdEntityRe.FindString(text[i:]); m != "" {
+				plain.WriteString(html.EscapeString(html.UnescapeString(m)))
+				i += len(m)
+				continue
+			}
+		case c == '\n':
+			if strings.HasSuffix(text[:i], "  ") {
+				flush()
+				if last := len(nodes) - 1; last >= 0 && nodes[last].delim == 0 {
+					nodes[last].html = strings.TrimRight(nodes[last].html, " ")
+				}
+				emit("<br/>\n")
+			} else {
+				plain.WriteString("\n")
+			}
+			i++
+			continue
+		case c == 'h' || c == 'w':
+			if loc := bareURLRe.FindStringSubmatchIndex(text[i:]); loc != nil && loc[3] == 0 && mdWordStart(text, i) {
+				emit(bareURLRule.render([]string{"", "", text[i : i+loc[5]]}))
+				i += loc[5]
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		plain.WriteString(html.EscapeString(string(r)))
+		i += size
+	}
+	flush()
+	return mdEmphasis(nodes)
+}
+
+// link parses the link at text[i] ("[text](url)", "[text][ref]" or
+// "[ref]") and returns its target and rendered text with the index after it
+func (p *mdParser) link(text string, i int) (string, string, int, bool) {
+	end := closingBracket(text, i)
+	if end < 0 {
+		return "", "", 0, false
+	}
+	label := text[i+1 : end]
+	rest := text[end+1:]
+	if strings.HasPrefix(rest, "(") {
+		if target, n, ok := linkDestination(rest); ok {
+			return target, p.inline(label), end + 1 + n, true
+		}
+	}
+	if strings.HasPrefix(rest, "[") {
+		if close := strings.IndexByte(rest, ']'); close > 0 {
+			ref := rest[1:close]
+			if ref == "" {
+				ref = label
+			}
+			if target, ok := p.links[mdLabel(ref)]; ok {
+				return target, p.inline(label), end + 1 + close + 1, true
+			}
+		}
+	}
+	if target, ok := p.links[mdLabel(label)]; ok {
+		return target, p.inline(label), end + 1, true
+	}
+	return "", "", 0, false
+}
+
+// closingBracket returns the index of the "]" matching the "[" at text[i]
+func closingBracket(text string, i int) int {
+	depth := 0
+	for j := i; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '`':
+			run := countRun(text[j:], '`')
+			if end := strings.Index(text[j+run:], strings.Repeat("`", run)); end >= 0 {
+				j += run + end + run - 1
+			} else {
+				j += run - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// linkDestination parses "(url "title")" at the start of s and returns the
+// url and the length of it
+func linkDestination(s string) (string, int, bool) {
+	i := 1
+	for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+		i++
+	}
+	var target string
+	if i < len(s) && s[i] == '<' {
+		end := strings.IndexAny(s[i:], ">\n")
+		if end < 0 || s[i+end] != '>' {
+			return "", 0, false
+		}
+		target = s[i+1 : i+end]
+		i += end + 1
+	} else {
+		start, depth := i, 0
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				continue
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			} else if c == ' ' || c == '\n' || c < 0x20 {
+				break
+			}
+		}
+		target = s[start:i]
+	}
+	for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+		i++
+	}
+	if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '(') {
+		closer := s[i]
+		if closer == '(' {
+			closer = ')'
+		}
+		end := strings.IndexByte(s[i+1:], closer)
+		if end < 0 {
+			return "", 0, false
+		}
+		i += end + 2
+		for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+			i++
+		}
+	}
+	if i >= len(s) || s[i] != ')' {
+		return "", 0, false
+	}
+	return html.UnescapeString(target), i + 1, true
+}
+
+// footnoteRef returns the label of a footnote reference "[^label]" at the
+// start of s
+func footnoteRef(s string) string {
+	if !strings.HasPrefix(s, "[^") {
+		return ""
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 3 || strings.ContainsAny(s[2:end], " \t\n[") {
+		return ""
+	}
+	return s[2:end]
+}
+
+// mdEmphasis matches the runs of delimiters to emphasis, strong emphasis
+// and strikethrough and renders the nodes
+func mdEmphasis(nodes []mdNode) string {
+	for closer := range nodes {
+		for nodes[closer].delim != 0 && nodes[closer].canClose && nodes[closer].count > 0 {
+			c := &nodes[closer]
+			opener := -1
+			for j := closer - 1; j >= 0; j-- {
+				o := nodes[j]
+				if o.delim != c.delim || !o.canOpen || o.count == 0 {
+					continue
+				}
+				if c.delim == '~' && o.count != c.count {
+					continue
+				}
+				// The rule of 3 keeps "*a**b*" from matching ** with *
+				if c.delim != '~' && (o.canClose || c.canOpen) && (o.count+c.count)%3 == 0 &&
+					(o.count%3 != 0 || c.count%3 != 0) {
+					continue
+				}
+				opener = j
+				break
+			}
+			if opener < 0 {
+				break
+			}
+			o := &nodes[opener]
+			use, tag := 1, "em"
+			switch {
+			case c.delim == '~':
+				use, tag = c.count, "del"
+			case o.count >= 2 && c.count >= 2:
+				use, tag = 2, "strong"
+			}
+			o.count -= use
+			c.count -= use
+			o.open = "<" + tag + ">" + o.open
+			c.close = c.close + "</" + tag + ">"
+			// Delimiters between them can't match anything outside any more
+			for j := opener + 1; j < closer; j++ {
+				nodes[j].canOpen, nodes[j].canClose = false, false
+			}
+		}
+	}
+	var out strings.Builder
+	for _, node := range nodes {
+		if node.delim == 0 {
+			out.WriteString(node.html)
+			continue
+		}
+		out.WriteString(node.close)
+		out.WriteString(strings.Repeat(string(node.delim), node.count))
+		out.WriteString(node.open)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// mdWordStart reports whether text[i] starts a word, for GFM autolinks
+func mdWordStart(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return unicode.IsSpace(r) || r == '(' || r == '*' || r == '_' || r == '~'
+}
+
+func countRun(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
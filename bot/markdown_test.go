@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "headings",
+			content: "# One #\n\nSetext\n======\n\nTwo\n---\n\n####### not a heading",
+			want:    "# One\n# Setext\n## Two\n<p>####### not a heading</p>",
+		},
+		{
+			name:    "emphasis",
+			content: "*em* **strong** ***both*** _a_b_ snake_case_name ~~del~~ 2 * 3 * 4",
+			want:    "<p><em>em</em> <strong>strong</strong> <em><strong>both</strong></em> <em>a_b</em> snake_case_name <del>del</del> 2 * 3 * 4</p>",
+		},
+		{
+			name:    "code spans and escapes",
+			content: "`a < b` ``x ` y`` \\*not\\* &copy; &bogus; <b>",
+			want:    "<p><code>a &lt; b</code> <code>x ` y</code> *not* © &amp;bogus; &lt;b&gt;</p>",
+		},
+		{
+			name:    "links",
+			content: "[inline](https://a.test \"Title\") [ref][r] [r] <https://auto.test> https://bare.test. [local](notes.md) ![a picture](pic.png)\n\n[r]: https://r.test",
+			want: `<p><a href="https://a.test">inline</a> <a href="https://r.test">ref</a> <a href="https://r.test">r</a> ` +
+				`<a href="https://auto.test">https://auto.test</a> <a href="https://bare.test">https://bare.test</a>. local <em>a picture</em></p>`,
+		},
+		{
+			name:    "line breaks",
+			content: "one  \ntwo\\\nthree\nfour",
+			want:    "<p>one<br/>\ntwo<br/>\nthree\nfour</p>",
+		},
+		{
+			name:    "code blocks",
+			content: "```python title\nprint('<hi>')\n```\n\n    indented\n\n      more\n\n~~~\nunclosed",
+			want:    "<pre><code class=\"language-python\">print(&#39;&lt;hi&gt;&#39;)</code></pre>\n<pre><code>indented\n\n  more</code></pre>\n<pre><code>unclosed</code></pre>",
+		},
+		{
+			name:    "tight and loose lists",
+			content: "- a\n- b\n  * nested\n- [x] done\n- [ ] todo\n\n3. three\n\n4. four",
+			want:    "<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>nested</li>\n</ul></li>\n<li>☑ done</li>\n<li>☐ todo</li>\n</ul>\n<ol start=\"3\">\n<li><p>three</p></li>\n<li><p>four</p></li>\n</ol>",
+		},
+		{
+			name:    "list interrupting a paragraph",
+			content: "Shopping:\n- milk\n- bread\n\nThe year\n1984. was",
+			want:    "<p>Shopping:</p>\n<ul>\n<li>milk</li>\n<li>bread</li>\n</ul>\n<p>The year\n1984. was</p>",
+		},
+		{
+			name:    "blockquote with lazy continuation",
+			content: "> # Quote\n> first\nlazy\n\n---",
+			want:    "<blockquote>\n<h2>Quote</h2>\n<p>first\nlazy</p>\n</blockquote>\n<hr/>",
+		},
+		{
+			name:    "table",
+			content: "| Name | Qty |\n|:-----|----:|\n| `a\\|b` | **2** |\n| short |\n\nafter",
+			want: "<table>\n<thead>\n<tr><th style=\"text-align: left\">Name</th><th style=\"text-align: right\">Qty</th></tr>\n</thead>\n<tbody>\n" +
+				"<tr><td style=\"text-align: left\"><code>a|b</code></td><td style=\"text-align: right\"><strong>2</strong></td></tr>\n" +
+				"<tr><td style=\"text-align: left\">short</td><td style=\"text-align: right\"></td></tr>\n</tbody>\n</table>\n<p>after</p>",
+		},
+		{
+			name:    "html block",
+			content: "<div class=\"note\">\n<script>alert(1)</script><p onclick=\"x()\">Hi</p>\n</div>",
+			want:    "<div> <p>Hi</p>\n </div>",
+		},
+		{
+			name:    "undefined footnote",
+			content: "Text[^missing]",
+			want:    "<p>Text[^missing]</p>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markupBlocks(parseMarkdown(tt.content)); strings.TrimSpace(got) != tt.want {
+				t.Errorf("parseMarkdown() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdown_metadata(t *testing.T) {
+	doc := parseMarkdown("---\ntitle: Field Notes\nauthor: [Ann, Bob]\nlang: de\n---\n# Intro\n\nText[^1].\n\n[^1]: A *note*.\n\n    With a second paragraph.\n")
+	if doc.Title != "Field Notes" || strings.Join(doc.Authors, ",") != "Ann,Bob" || doc.Language != "de" {
+		t.Errorf("parseMarkdown() metadata = %q, %q, %q", doc.Title, doc.Authors, doc.Language)
+	}
+	if len(doc.Blocks) != 2 || len(doc.Blocks[1].Notes) != 1 {
+		t.Fatalf("parseMarkdown() blocks = %+v", doc.Blocks)
+	}
+	if want := "<p>A <em>note</em>.</p>\n<p>With a second paragraph.</p>\n"; doc.notes.bodies[1] != want {
+		t.Errorf("footnote = %q, want %q", doc.notes.bodies[1], want)
+	}
+
+	doc = parseMarkdown("---\nnot: [valid\n---\ntext")
+	if doc.Title != "" || !strings.Contains(markupBlocks(doc), "text") {
+		t.Errorf("parseMarkdown() with invalid front matter = %q, %s", doc.Title, markupBlocks(doc))
+	}
+}
@@ -0,0 +1,393 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// markupStyle is added to epubDefaultStyle for books rendered from markup
+const markupStyle = `pre, code, kbd { font-family: monospace; }
+pre { white-space: pre-wrap; font-size: 0.85em; margin: 1em 0; padding: 0.5em; border-left: 3px solid #999; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #999; padding: 0.2em 0.5em; }
+th { font-weight: bold; }
+dt { font-weight: bold; }
+.title { font-weight: bold; margin-bottom: 0.2em; }
+.admonition, .sidebar, .example { border: 1px solid #999; padding: 0 0.5em; margin: 1em 0; }
+.verse { white-space: pre-wrap; }
+.attribution { text-align: right; font-style: italic; }
+aside { font-size: 0.85em; }
+`
+
+// markupParsers maps the extensions of the markup formats rendered by the
+// bot itself to their parser
+var markupParsers = map[string]func(content string) *markupDocument{
+	"md":       parseMarkdown,
+	"markdown": parseMarkdown,
+	"mdown":    parseMarkdown,
+	"mkd":      parseMarkdown,
+	"org":      parseOrg,
+	"adoc":     parseAsciiDoc,
+	"asciidoc": parseAsciiDoc,
+}
+
+// MarkupFormats returns the extensions rendered by markup converters, sorted
+func MarkupFormats() []string {
+	formats := make([]string, 0, len(markupParsers))
+	for format := range markupParsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// markupConverter renders Markdown, Org and AsciiDoc documents to EPUB
+// without an external program
+type markupConverter struct {
+	cfg ConverterConfig
+}
+
+func (c *markupConverter) name() string {
+	return c.cfg.Name
+}
+
+func (c *markupConverter) convert(ctx context.Context, in, out string, onProgress func(percent int)) error {
+	parse, ok := markupParsers[normalizeFormat(filepath.Ext(in))]
+	if !ok {
+		return fmt.Errorf("%w: %s is not Markdown, Org or AsciiDoc", errConversion, filepath.Base(in))
+	}
+	content, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	doc := parse(strings.Map(xmlChar, strings.ToValidUTF8(string(content), "�")))
+	if len(doc.Blocks) == 0 {
+		return fmt.Errorf("%w: %s is empty", errConversion, filepath.Base(in))
+	}
+	return writeEPUB(out, doc.book(strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))))
+}
+
+// xmlChar drops the control characters XML does not allow
+func xmlChar(r rune) rune {
+	if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+		return -1
+	}
+	return r
+}
+
+// markupDocument is a parsed markup document: headings and blocks of
+// XHTML in document order
+type markupDocument struct {
+	Title    string
+	Authors  []string
+	Language string
+	Blocks   []markupBlock
+	notes    markupNotes
+}
+
+// markupBlock is a heading or a block of content
+type markupBlock struct {
+	Heading int    // level of a heading, 0 for content
+	HTML    string // XHTML of the block, the inline content of a heading
+	Notes   []int  // footnotes referenced in the block
+}
+
+func newMarkupDocument() *markupDocument {
+	return &markupDocument{notes: markupNotes{numbers: make(map[string]int), bodies: make(map[int]string)}}
+}
+
+// add appends a block with the footnotes referenced since the last one
+func (d *markupDocument) add(heading int, xhtml string) {
+	if strings.TrimSpace(xhtml) == "" {
+		d.notes.pending = nil
+		return
+	}
+	d.Blocks = append(d.Blocks, markupBlock{Heading: heading, HTML: xhtml, Notes: d.notes.take()})
+}
+
+// markupNotes numbers footnotes in the order they are referenced. They are
+// rendered as EPUB 3 popup footnotes at the end of each chapter using them
+type markupNotes struct {
+	numbers map[string]int
+	bodies  map[int]string // XHTML by number
+	pending []int          // referenced since the last block
+	count   int
+}
+
+func (n *markupNotes) number(label string) int {
+	number, ok := n.numbers[label]
+	if !ok {
+		n.count++
+		number = n.count
+		n.numbers[label] = number
+	}
+	return number
+}
+
+// markupNoteRefRe matches the links rendered by ref
+var markupNoteRefRe = regexp.MustCompile(`<a epub:type="noteref"[^>]*><sup>\d+</sup></a>`)
+
+// ref returns the link to the footnote label
+func (n *markupNotes) ref(label string) string {
+	number := n.number(label)
+	n.pending = append(n.pending, number)
+	return fmt.Sprintf(`<a epub:type="noteref" href="#fn-%d"><sup>%d</sup></a>`, number, number)
+}
+
+// take returns the footnotes referenced since the last call
+func (n *markupNotes) take() []int {
+	pending := n.pending
+	n.pending = nil
+	return pending
+}
+
+// define sets the XHTML of the footnote label
+func (n *markupNotes) define(label, xhtml string) {
+	n.bodies[n.number(label)] = xhtml
+}
+
+// inline returns the link to a footnote written where it is referenced
+func (n *markupNotes) inline(xhtml string) string {
+	label := "\x00" + strconv.Itoa(n.count+1)
+	n.define(label, xhtml)
+	return n.ref(label)
+}
+
+// aside renders footnote number at the end of a chapter
+func (n *markupNotes) aside(number int) string {
+	body := strings.TrimSpace(n.bodies[number])
+	label := fmt.Sprintf("<b>%d.</b> ", number)
+	if strings.HasPrefix(body, "<p>") {
+		body = "<p>" + label + strings.TrimPrefix(body, "<p>")
+	} else {
+		body = "<p>" + label + body + "</p>"
+	}
+	return fmt.Sprintf("<aside epub:type=\"footnote\" id=\"fn-%d\">\n%s\n</aside>", number, body)
+}
+
+// book splits the document into chapters at its top level headings, the
+// next level is listed in the table of contents. A single heading above
+// all others is the title of the book, untitled books are called title
+func (d *markupDocument) book(title string) epubBook {
+	blocks := d.Blocks
+	if d.Title != "" {
+		title = d.Title
+	} else if top := topHeadings(blocks); len(top) == 1 && top[0] == 0 {
+		title = markupText(blocks[0].HTML)
+		blocks = blocks[1:]
+	}
+	book := epubBook{
+		Title:    title,
+		Authors:  d.Authors,
+		Language: d.Language,
+		Style:    epubDefaultStyle + markupStyle,
+	}
+	split := 0
+	if top := topHeadings(blocks); len(top) > 0 {
+		split = blocks[top[0]].Heading
+	}
+
+	var chapter *epubChapter
+	var body strings.Builder
+	var notes []int
+	sections := 0
+	finish := func() {
+		if chapter == nil {
+			return
+		}
+		chapter.Body = strings.TrimSpace(body.String())
+		seen := make(map[int]bool)
+		for _, number := range notes {
+			if !seen[number] {
+				seen[number] = true
+				chapter.Body += "\n" + d.notes.aside(number)
+			}
+		}
+		book.Chapters = append(book.Chapters, *chapter)
+		chapter, notes = nil, nil
+		body.Reset()
+	}
+	for _, block := range blocks {
+		if block.Heading > 0 && block.Heading <= split {
+			finish()
+			chapter = &epubChapter{Title: markupText(block.HTML)}
+			body.WriteString("<h1>" + block.HTML + "</h1>\n")
+			notes = append(notes, block.Notes...)
+			continue
+		}
+		if chapter == nil {
+			chapter = &epubChapter{Title: title}
+		}
+		notes = append(notes, block.Notes...)
+		if block.Heading == 0 {
+			body.WriteString(block.HTML + "\n")
+			continue
+		}
+		level := block.Heading - split + 1
+		if level > 6 {
+			level = 6
+		}
+		sections++
+		id := fmt.Sprintf("section-%d", sections)
+		if level == 2 {
+			chapter.Sections = append(chapter.Sections, epubSection{ID: id, Title: markupText(block.HTML)})
+		}
+		fmt.Fprintf(&body, "<h%d id=\"%s\">%s</h%d>\n", level, id, block.HTML, level)
+	}
+	finish()
+	return book
+}
+
+// topHeadings returns the indexes of the headings of the highest level
+func topHeadings(blocks []markupBlock) []int {
+	var top []int
+	level := 0
+	for i, block := range blocks {
+		switch {
+		case block.Heading == 0:
+		case level == 0 || block.Heading < level:
+			level = block.Heading
+			top = []int{i}
+		case block.Heading == level:
+			top = append(top, i)
+		}
+	}
+	return top
+}
+
+// markupTagRe matches the tags of inline XHTML
+var markupTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// markupText returns the text of inline XHTML, for titles. Footnote
+// references are left out
+func markupText(xhtml string) string {
+	xhtml = markupNoteRefRe.ReplaceAllString(xhtml, "")
+	return strings.Join(strings.Fields(html.UnescapeString(markupTagRe.ReplaceAllString(xhtml, ""))), " ")
+}
+
+// markupLink renders a link to target, or only its text when target is
+// not an http(s) or mailto link
+func markupLink(target, text string) string {
+	href := absoluteLink(target, nil)
+	if href == "" {
+		return text
+	}
+	if text == "" {
+		text = html.EscapeString(target)
+	}
+	return `<a href="` + html.EscapeString(href) + `">` + text + "</a>"
+}
+
+// markupCode renders a code block, lang is its language if known
+func markupCode(code, lang string) string {
+	class := ""
+	if lang != "" {
+		class = ` class="language-` + html.EscapeString(lang) + `"`
+	}
+	return "<pre><code" + class + ">" + html.EscapeString(strings.TrimRight(code, "\n")) + "</code></pre>"
+}
+
+// markupTable renders rows of XHTML cells, the first header rows with <th>.
+// align holds the text-align of each column, if any
+func markupTable(rows [][]string, header int, align []string) string {
+	var out strings.Builder
+	out.WriteString("<table>\n")
+	for i, row := range rows {
+		if i == 0 && header > 0 {
+			out.WriteString("<thead>\n")
+		}
+		if i == header {
+			out.WriteString("<tbody>\n")
+		}
+		cell := "td"
+		if i < header {
+			cell = "th"
+		}
+		out.WriteString("<tr>")
+		for j, content := range row {
+			style := ""
+			if j < len(align) && align[j] != "" {
+				style = ` style="text-align: ` + align[j] + `"`
+			}
+			out.WriteString("<" + cell + style + ">" + content + "</" + cell + ">")
+		}
+		out.WriteString("</tr>\n")
+		if i == header-1 {
+			out.WriteString("</thead>\n")
+		}
+	}
+	if len(rows) > header {
+		out.WriteString("</tbody>\n")
+	}
+	out.WriteString("</table>")
+	return out.String()
+}
+
+// inlineRule is a span of inline markup found by a regular expression. The
+// first group of re is text before the span and its last group text after
+// it, matched to check the boundaries of the span but not consumed
+type inlineRule struct {
+	re     *regexp.Regexp
+	render func(groups []string) string
+}
+
+// renderInline renders s with the earliest matching rule at each position,
+// text between spans goes through text
+func renderInline(s string, rules []inlineRule, text func(string) string) string {
+	var out strings.Builder
+	for s != "" {
+		start, end, best := -1, -1, -1
+		var groups []string
+		for i, rule := range rules {
+			loc := rule.re.FindStringSubmatchIndex(s)
+			if loc == nil {
+				continue
+			}
+			// The span starts after the leading group and ends before the trailing one
+			spanStart, spanEnd := loc[3], loc[len(loc)-2]
+			if spanEnd < 0 {
+				spanEnd = loc[1]
+			}
+			if start >= 0 && spanStart >= start {
+				continue
+			}
+			if spanEnd <= spanStart {
+				continue
+			}
+			start, end, best = spanStart, spanEnd, i
+			groups = make([]string, len(loc)/2)
+			for g := range groups {
+				if loc[2*g] >= 0 {
+					groups[g] = s[loc[2*g]:loc[2*g+1]]
+				}
+			}
+		}
+		if best < 0 {
+			out.WriteString(text(s))
+			break
+		}
+		out.WriteString(text(s[:start]))
+		out.WriteString(rules[best].render(groups))
+		s = s[end:]
+	}
+	return out.String()
+}
+
+// bareURLRe matches links written as text
+var bareURLRe = regexp.MustCompile(`(^|[\s(<\[])((?:https?://|www\.)[^\s<>"\]]*[^\s<>"\].,;:!?)'])()`)
+
+// bareURLRule links URLs written as text
+var bareURLRule = inlineRule{re: bareURLRe, render: func(groups []string) string {
+	target := groups[2]
+	if strings.HasPrefix(target, "www.") {
+		target = "http://" + target
+	}
+	return markupLink(target, html.EscapeString(groups[2]))
+}}
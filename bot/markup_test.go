@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMarkupDocumentBook(t *testing.T) {
+	tests := []struct {
+		name         string
+		title        string
+		blocks       []markupBlock
+		wantTitle    string
+		wantChapters []string // title: sections
+	}{
+		{
+			name:         "no headings",
+			blocks:       []markupBlock{{HTML: "<p>Text</p>"}},
+			wantTitle:    "notes",
+			wantChapters: []string{"notes:"},
+		},
+		{
+			name: "single top heading is the title",
+			blocks: []markupBlock{
+				{Heading: 1, HTML: "The <em>Book</em>"},
+				{HTML: "<p>Preface</p>"},
+				{Heading: 2, HTML: "One"},
+				{Heading: 3, HTML: "One.One"},
+				{Heading: 4, HTML: "Deep"},
+				{Heading: 2, HTML: "Two"},
+			},
+			wantTitle:    "The Book",
+			wantChapters: []string{"The Book:", "One:One.One", "Two:"},
+		},
+		{
+			name:  "document title",
+			title: "Notes",
+			blocks: []markupBlock{
+				{Heading: 2, HTML: "First"},
+				{Heading: 3, HTML: "A"},
+				{Heading: 3, HTML: "B"},
+				{Heading: 2, HTML: "Second"},
+			},
+			wantTitle:    "Notes",
+			wantChapters: []string{"First:A,B", "Second:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := newMarkupDocument()
+			doc.Title, doc.Blocks = tt.title, tt.blocks
+			book := doc.book("notes")
+			if book.Title != tt.wantTitle {
+				t.Errorf("book().Title = %q, want %q", book.Title, tt.wantTitle)
+			}
+			var chapters []string
+			for _, chapter := range book.Chapters {
+				var sections []string
+				for _, section := range chapter.Sections {
+					sections = append(sections, section.Title)
+				}
+				chapters = append(chapters, chapter.Title+":"+strings.Join(sections, ","))
+			}
+			if strings.Join(chapters, "|") != strings.Join(tt.wantChapters, "|") {
+				t.Errorf("book() chapters = %q, want %q", chapters, tt.wantChapters)
+			}
+		})
+	}
+}
+
+func TestMarkupDocumentBook_footnotes(t *testing.T) {
+	doc := parseMarkdown("# One\n\nText[^a] and[^b].\n\n# Two\n\nAgain[^a].\n\n[^a]: First note.\n[^b]: Second note.\n")
+	book := doc.book("notes")
+	if len(book.Chapters) != 2 {
+		t.Fatalf("book() has %d chapters, want 2", len(book.Chapters))
+	}
+	want := []string{`id="fn-1"`, `id="fn-2"`, "<b>1.</b> First note.", "<b>2.</b> Second note."}
+	for _, s := range want {
+		if !strings.Contains(book.Chapters[0].Body, s) {
+			t.Errorf("first chapter does not contain %q:\n%s", s, book.Chapters[0].Body)
+		}
+	}
+	if body := book.Chapters[1].Body; !strings.Contains(body, `id="fn-1"`) || strings.Contains(body, `id="fn-2"`) {
+		t.Errorf("second chapter has the wrong footnotes:\n%s", body)
+	}
+}
+
+func TestMarkupConverter(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "guide.adoc")
+	content := "= Field Guide\nJane Doe\n:lang: en\n\n== Birds\n\nSee footnote:[Or not.]\n\n=== Owls\n\n[source,go]\n----\nif a < b {}\n----\n\n== Trees\n\n|===\n|Oak |Ash\n|===\n"
+	if err := ioutil.WriteFile(in, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "guide.epub")
+	c := &markupConverter{cfg: ConverterConfig{Name: ConverterTypeMarkup}}
+	if err := c.convert(context.Background(), in, out, nil); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+
+	archive, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[file.Name] = string(data)
+		if strings.HasSuffix(file.Name, ".xhtml") || strings.HasSuffix(file.Name, ".ncx") {
+			// Every document must be well-formed XML
+			decoder := xml.NewDecoder(strings.NewReader(string(data)))
+			for {
+				if _, err := decoder.Token(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Errorf("%s is not well-formed: %v\n%s", file.Name, err, data)
+					break
+				}
+			}
+		}
+	}
+	for name, want := range map[string]string{
+		"OEBPS/content.opf":     "<dc:creator>Jane Doe</dc:creator>",
+		"OEBPS/nav.xhtml":       `<a href="chapter-0.xhtml#section-1">Owls</a>`,
+		"OEBPS/toc.ncx":         `<content src="chapter-0.xhtml#section-1"/>`,
+		"OEBPS/chapter-0.xhtml": `<aside epub:type="footnote" id="fn-1">`,
+		"OEBPS/chapter-1.xhtml": "<td>Oak</td>",
+		"OEBPS/style.css":       "pre, code",
+	} {
+		if !strings.Contains(files[name], want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, files[name])
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.md")
+	ioutil.WriteFile(empty, []byte("\n\n"), 0600)
+	if err := c.convert(context.Background(), empty, out, nil); !errors.Is(err, errConversion) {
+		t.Errorf("convert(empty) error = %v, want errConversion", err)
+	}
+}
+
+// markupBlocks renders the blocks of doc for comparison, headings as
+// "#<level> <html>"
+func markupBlocks(doc *markupDocument) string {
+	var blocks []string
+	for _, block := range doc.Blocks {
+		if block.Heading > 0 {
+			blocks = append(blocks, strings.Repeat("#", block.Heading)+" "+block.HTML)
+			continue
+		}
+		blocks = append(blocks, block.HTML)
+	}
+	return strings.Join(blocks, "\n")
+}
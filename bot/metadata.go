@@ -0,0 +1,215 @@
+package bot
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// bookMetadata describes a book for the library and upload targets
+type bookMetadata struct {
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// author returns the authors joined for display, empty when unknown
+func (m bookMetadata) author() string {
+	return strings.Join(m.Authors, ", ")
+}
+
+// extractMetadata reads the metadata of the first file that has any, in
+// the order given, e.g. the converted EPUB then the original upload. The
+// title falls back to fileName without its extension
+func extractMetadata(fileName string, paths ...string) bookMetadata {
+	for _, p := range paths {
+		var m bookMetadata
+		var err error
+		switch normalizeFormat(filepath.Ext(p)) {
+		case "epub":
+			m, err = epubMetadata(p)
+		case "fb2":
+			m, err = fb2Metadata(p)
+		default:
+			continue
+		}
+		if err == nil && m.Title != "" {
+			return m
+		}
+	}
+	return bookMetadata{Title: trimFormat(fileName)}
+}
+
+var errNoPackage = errors.New("epub has no package document")
+
+// epubMetadata reads the Dublin Core metadata of the OPF package document
+func epubMetadata(p string) (bookMetadata, error) {
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return bookMetadata{}, err
+	}
+	defer r.Close()
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := decodeZipXML(&r.Reader, "META-INF/container.xml", &container); err != nil {
+		return bookMetadata{}, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return bookMetadata{}, errNoPackage
+	}
+
+	var pkg struct {
+		Titles       []string `xml:"metadata>title"`
+		Creators     []string `xml:"metadata>creator"`
+		Languages    []string `xml:"metadata>language"`
+		Descriptions []string `xml:"metadata>description"`
+	}
+	if err := decodeZipXML(&r.Reader, path.Clean(container.Rootfiles[0].FullPath), &pkg); err != nil {
+		return bookMetadata{}, err
+	}
+	m := bookMetadata{
+		Title:       first(pkg.Titles),
+		Language:    first(pkg.Languages),
+		Description: first(pkg.Descriptions),
+	}
+	for _, creator := range pkg.Creators {
+		if creator = strings.TrimSpace(creator); creator != "" {
+			m.Authors = append(m.Authors, creator)
+		}
+	}
+	return m, nil
+}
+
+func decodeZipXML(r *zip.Reader, name string, v interface{}) error {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return xml.NewDecoder(rc).Decode(v)
+	}
+	return os.ErrNotExist
+}
+
+// fb2TitleInfo is the <title-info> of a FictionBook document
+type fb2TitleInfo struct {
+	Title   string `xml:"book-title"`
+	Authors []struct {
+		First    string `xml:"first-name"`
+		Middle   string `xml:"middle-name"`
+		Last     string `xml:"last-name"`
+		Nickname string `xml:"nickname"`
+	} `xml:"author"`
+	Lang       string `xml:"lang"`
+	Annotation struct {
+		Text string `xml:",innerxml"`
+	} `xml:"annotation"`
+	Sequences []struct {
+		Name   string `xml:"name,attr"`
+		Number string `xml:"number,attr"`
+	} `xml:"sequence"`
+	Coverpage struct {
+		Images []struct {
+			Href string `xml:"href,attr"`
+		} `xml:"image"`
+	} `xml:"coverpage"`
+}
+
+// fb2Metadata reads <title-info> without decoding the rest of the book,
+// which is mostly embedded images
+func fb2Metadata(p string) (bookMetadata, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return bookMetadata{}, err
+	}
+	defer f.Close()
+	return readFB2Metadata(f)
+}
+
+func readFB2Metadata(r io.Reader) (bookMetadata, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return bookMetadata{}, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "title-info":
+			var info fb2TitleInfo
+			if err := decoder.DecodeElement(&info, &start); err != nil {
+				return bookMetadata{}, err
+			}
+			return info.metadata(), nil
+		case "body":
+			return bookMetadata{}, errors.New("fb2 has no title-info")
+		}
+	}
+}
+
+func (info fb2TitleInfo) metadata() bookMetadata {
+	m := bookMetadata{
+		Title:       strings.TrimSpace(info.Title),
+		Language:    strings.TrimSpace(info.Lang),
+		Description: strings.TrimSpace(stripTags(info.Annotation.Text)),
+	}
+	for _, a := range info.Authors {
+		name := strings.Join(strings.Fields(a.First+" "+a.Middle+" "+a.Last), " ")
+		if name == "" {
+			name = strings.TrimSpace(a.Nickname)
+		}
+		if name != "" {
+			m.Authors = append(m.Authors, name)
+		}
+	}
+	return m
+}
+
+// stripTags removes markup from an XML fragment, keeping paragraphs apart
+func stripTags(fragment string) string {
+	var b strings.Builder
+	decoder := xml.NewDecoder(strings.NewReader("<x>" + fragment + "</x>"))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == "p" {
+				b.WriteString("\n")
+			}
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func first(values []string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestEPUB(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractMetadata(t *testing.T) {
+	dir := t.TempDir()
+	epub := filepath.Join(dir, "book.epub")
+	writeTestEPUB(t, epub, map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Dune</dc:title>
+    <dc:creator>Frank Herbert</dc:creator>
+    <dc:language>en</dc:language>
+  </metadata>
+</package>`,
+	})
+	broken := filepath.Join(dir, "broken.epub")
+	if err := os.WriteFile(broken, []byte("not a zip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// "Война и мир" and "Лев Толстой" in windows-1251
+	fb2 := filepath.Join(dir, "book.fb2")
+	content := "<?xml version=\"1.0\" encoding=\"windows-1251\"?>\n" +
+		"<FictionBook xmlns=\"http://www.gribuser.ru/xml/fictionbook/2.0\"><description><title-info>" +
+		"<author><first-name>\xcb\xe5\xe2</first-name><last-name>\xd2\xee\xeb\xf1\xf2\xee\xe9</last-name></author>" +
+		"<book-title>\xc2\xee\xe9\xed\xe0 \xe8 \xec\xe8\xf0</book-title>" +
+		"<annotation><p>First</p><p><emphasis>second</emphasis></p></annotation><lang>ru</lang>" +
+		"</title-info></description><body><p>text</p></body></FictionBook>"
+	if err := os.WriteFile(fb2, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fileName string
+		paths    []string
+		want     bookMetadata
+	}{
+		{
+			name:     "epub",
+			fileName: "dune.epub",
+			paths:    []string{epub},
+			want:     bookMetadata{Title: "Dune", Authors: []string{"Frank Herbert"}, Language: "en"},
+		},
+		{
+			name:     "fb2 in windows-1251",
+			fileName: "book.fb2",
+			paths:    []string{fb2},
+			want: bookMetadata{Title: "Война и мир", Authors: []string{"Лев Толстой"}, Language: "ru",
+				Description: "First second"},
+		},
+		{
+			name:     "falls back to the next file",
+			fileName: "book.fb2",
+			paths:    []string{broken, fb2},
+			want: bookMetadata{Title: "Война и мир", Authors: []string{"Лев Толстой"}, Language: "ru",
+				Description: "First second"},
+		},
+		{
+			name:     "falls back to the file name",
+			fileName: "Some Notes.pdf",
+			paths:    []string{broken, filepath.Join(dir, "notes.pdf")},
+			want:     bookMetadata{Title: "Some Notes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractMetadata(tt.fileName, tt.paths...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
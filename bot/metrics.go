@@ -0,0 +1,337 @@
+package bot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "sendtokindle"
+
+var (
+	conversionBuckets = []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	smtpBuckets       = []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+	// metricFormats are the upload formats reported by name, others are
+	// counted as "other" to keep the number of series bounded
+	metricFormats = []string{"azw", "azw3", "cbr", "cbz", "djvu", "fb2", "lit", "md", "mobi", "odt", "pdb", "prc", "zip"}
+)
+
+// smtpError is a delivery failure with the step it happened in, which is
+// the error class in metrics
+type smtpError struct {
+	step string
+	err  error
+}
+
+func (e *smtpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *smtpError) Unwrap() error {
+	return e.err
+}
+
+// smtpErrorClass returns the step a delivery failed in, e.g. "auth"
+func smtpErrorClass(err error) string {
+	var smtpErr *smtpError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.step
+	}
+	return "other"
+}
+
+// metrics collects counters and histograms in the Prometheus text format.
+// A nil *metrics discards everything
+type metrics struct {
+	mu                 sync.Mutex
+	uploads            *counterVec
+	conversionDuration *histogramVec
+	conversionFailures *counterVec
+	smtpDuration       *histogramVec
+	smtpErrors         *counterVec
+	deliveries         *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		uploads: newCounterVec("uploads_total",
+			"Documents received, by file format.", "format"),
+		conversionDuration: newHistogramVec("conversion_duration_seconds",
+			"Time spent converting documents, by converter.", "backend", conversionBuckets),
+		conversionFailures: newCounterVec("conversion_failures_total",
+			"Failed conversions, by converter.", "backend"),
+		smtpDuration: newHistogramVec("smtp_delivery_duration_seconds",
+			"Time spent delivering books over SMTP.", "", smtpBuckets),
+		smtpErrors: newCounterVec("smtp_errors_total",
+			"Failed SMTP deliveries, by the step that failed.", "class"),
+		deliveries: newCounterVec("deliveries_total",
+			"Books delivered, by device.", "device"),
+	}
+}
+
+func (m *metrics) upload(format string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads.inc(format)
+}
+
+func (m *metrics) conversion(backend string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conversionDuration.observe(backend, duration.Seconds())
+	if err != nil {
+		m.conversionFailures.inc(backend)
+	}
+}
+
+func (m *metrics) smtpDelivery(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.smtpDuration.observe("", duration.Seconds())
+	if err != nil {
+		m.smtpErrors.inc(smtpErrorClass(err))
+	}
+}
+
+func (m *metrics) delivered(device string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries.inc(device)
+}
+
+// write renders the collected metrics
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads.write(w)
+	m.conversionDuration.write(w)
+	m.conversionFailures.write(w)
+	m.smtpDuration.write(w)
+	m.smtpErrors.write(w)
+	m.deliveries.write(w)
+}
+
+// metricFormat maps a file extension to the format label of uploads_total
+func (b *SendToKindleBot) metricFormat(extension string) string {
+	extension = normalizeFormat(extension)
+	for _, format := range supportedFormats {
+		if format == extension {
+			return extension
+		}
+	}
+	for _, format := range metricFormats {
+		if format == extension {
+			return extension
+		}
+	}
+	if converters := b.current().converters; converters != nil {
+		if _, ok := converters.byFormat[extension]; ok {
+			return extension
+		}
+	}
+	return "other"
+}
+
+// ServeMetrics writes the metrics in the Prometheus text exposition format
+func (b *SendToKindleBot) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	if b.metrics != nil {
+		b.metrics.write(out)
+	}
+
+	running := 0
+	if b.jobs != nil {
+		running = b.jobs.count()
+	}
+	writeGauge(out, "jobs_running", "Documents being converted or sent right now.", float64(running))
+
+	b.cacheMutex.RLock()
+	pending := len(b.fileStateCache)
+	b.cacheMutex.RUnlock()
+	writeGauge(out, "pending_requests", "Converted books waiting for a device to be selected.", float64(pending))
+
+	files, size := tmpDirUsage(b.GetTmpFilesPath())
+	writeGauge(out, "tmp_dir_files", "Files in the temporary directory.", float64(files))
+	writeGauge(out, "tmp_dir_bytes", "Size of the files in the temporary directory.", float64(size))
+}
+
+// serveMonitoring serves metrics and health checks until the bot is stopped
+func (b *SendToKindleBot) serveMonitoring() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", b.ServeMetrics)
+	mux.HandleFunc("/healthz", b.ServeHealthz)
+	mux.HandleFunc("/readyz", b.ServeReadyz)
+	server := &http.Server{Addr: b.MetricsListen, Handler: mux}
+
+	go func() {
+		<-b.stopped
+		server.Close()
+	}()
+
+	logging.Info("Serving /metrics, /healthz and /readyz", "listen", b.MetricsListen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Error("Monitoring server stopped", "err", err)
+	}
+}
+
+func tmpDirUsage(dir string) (int, int64) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	var (
+		files int
+		size  int64
+	)
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			files++
+			size += entry.Size()
+		}
+	}
+	return files, size
+}
+
+// counterVec is a counter with one label
+type counterVec struct {
+	name, help, label string
+	values            map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: metricsNamespace + "_" + name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.values[labelValue]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, value := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels(c.label, value), formatFloat(c.values[value]))
+	}
+}
+
+// histogramVec is a histogram with at most one label
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+	series            map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    metricsNamespace + "_" + name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(labelValue string, value float64) {
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucketLabels(h.label, key, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucketLabels(h.label, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels(h.label, key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(h.label, key), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	name = metricsNamespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func labels(label, value string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf("{%s=\"%s\"}", label, escapeLabelValue(value))
+}
+
+func bucketLabels(label, value, le string) string {
+	if label == "" {
+		return fmt.Sprintf("{le=\"%s\"}", le)
+	}
+	return fmt.Sprintf("{%s=\"%s\",le=\"%s\"}", label, escapeLabelValue(value), le)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
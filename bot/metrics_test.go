@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_write(t *testing.T) {
+	m := newMetrics()
+	m.upload("pdf")
+	m.upload("pdf")
+	m.conversion("ebook-convert", 3*time.Second, nil)
+	m.conversion("ebook-convert", 45*time.Second, errConversion)
+	m.smtpDelivery(700*time.Millisecond, nil)
+	m.smtpDelivery(2*time.Second, &smtpError{step: "auth", err: errors.New("535 bad credentials")})
+	m.delivered(`Kid's "Kindle"`)
+
+	var out strings.Builder
+	m.write(&out)
+	got := out.String()
+
+	for _, want := range []string{
+		"# TYPE sendtokindle_uploads_total counter\n",
+		`sendtokindle_uploads_total{format="pdf"} 2`,
+		`sendtokindle_conversion_duration_seconds_bucket{backend="ebook-convert",le="5"} 1`,
+		`sendtokindle_conversion_duration_seconds_bucket{backend="ebook-convert",le="60"} 2`,
+		`sendtokindle_conversion_duration_seconds_bucket{backend="ebook-convert",le="+Inf"} 2`,
+		`sendtokindle_conversion_duration_seconds_sum{backend="ebook-convert"} 48`,
+		`sendtokindle_conversion_failures_total{backend="ebook-convert"} 1`,
+		`sendtokindle_smtp_delivery_duration_seconds_bucket{le="1"} 1`,
+		`sendtokindle_smtp_delivery_duration_seconds_count 2`,
+		`sendtokindle_smtp_errors_total{class="auth"} 1`,
+		`sendtokindle_deliveries_total{device="Kid's \"Kindle\""} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("write() output does not contain %s\n%s", want, got)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	b := &SendToKindleBot{metrics: newMetrics(), jobs: newJobTracker(), fileStateCache: map[int]map[string]string{1: {}}}
+	b.SetTmpFilesPath(t.TempDir())
+	if err := os.WriteFile(filepath.Join(b.GetTmpFilesPath(), "book.epub"), make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.jobs.begin(jobRecord{Kind: jobKindDocument, UserID: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	b.ServeMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+
+	for _, want := range []string{
+		"sendtokindle_jobs_running 1\n",
+		"sendtokindle_pending_requests 1\n",
+		"sendtokindle_tmp_dir_files 1\n",
+		"sendtokindle_tmp_dir_bytes 1024\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ServeMetrics() output does not contain %q\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricFormat(t *testing.T) {
+	b := &SendToKindleBot{}
+	for extension, want := range map[string]string{"pdf": "pdf", ".FB2": "fb2", "exe": "other"} {
+		if got := b.metricFormat(extension); got != want {
+			t.Errorf("metricFormat(%q) = %q, want %q", extension, got, want)
+		}
+	}
+}
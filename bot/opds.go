@@ -0,0 +1,503 @@
+package bot
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opdsPrefix      = "/opds"
+	opdsPageSize    = 50
+	opdsRealm       = "Send-to-Kindle library"
+	opdsPasswordLen = 12
+
+	atomNamespace      = "http://www.w3.org/2005/Atom"
+	opdsNamespace      = "http://opds-spec.org/2010/catalog"
+	dcNamespace        = "http://purl.org/dc/terms/"
+	opdsNavigationType = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquireType    = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsAcquisitionRel = "http://opds-spec.org/acquisition"
+	openSearchType     = "application/opensearchdescription+xml"
+)
+
+// bookMediaTypes are the media types of acquisition links by format
+var bookMediaTypes = map[string]string{
+	"epub": "application/epub+zip",
+	"pdf":  "application/pdf",
+	"fb2":  "application/x-fictionbook+xml",
+	"mobi": "application/x-mobipocket-ebook",
+	"azw3": "application/vnd.amazon.ebook",
+	"txt":  "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+	"htm":  "text/html; charset=utf-8",
+	"rtf":  "application/rtf",
+	"doc":  "application/msword",
+	"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"djvu": "image/vnd.djvu",
+	"cbz":  "application/vnd.comicbook+zip",
+}
+
+func bookMediaType(format string) string {
+	if t, ok := bookMediaTypes[format]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension("." + format); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+type opdsFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	XmlnsOPDS string      `xml:"xmlns:opds,attr"`
+	XmlnsDC   string      `xml:"xmlns:dc,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []opdsLink  `xml:"link"`
+	Entries   []opdsEntry `xml:"entry"`
+}
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Size  int64  `xml:"length,attr,omitempty"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsEntry struct {
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Authors  []opdsAuthor `xml:"author"`
+	Language string       `xml:"dc:language,omitempty"`
+	Issued   string       `xml:"dc:issued,omitempty"`
+	Summary  string       `xml:"summary,omitempty"`
+	Content  *opdsContent `xml:"content"`
+	Links    []opdsLink   `xml:"link"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type openSearchDescription struct {
+	XMLName     xml.Name `xml:"OpenSearchDescription"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	ShortName   string   `xml:"ShortName"`
+	Description string   `xml:"Description"`
+	URL         struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// opdsHandler serves the OPDS 1.2 catalog of each user's library:
+//
+//	/opds                    navigation: recent, by author, search
+//	/opds/recent?page=N      every book, newest first
+//	/opds/authors            one entry per author
+//	/opds/author?name=X      books of an author
+//	/opds/search?q=X         books matching every word of X
+//	/opds/opensearch.xml     search description
+//	/opds/books/<id>/<file>  download of a stored file
+//
+// Every request needs HTTP basic auth with the Telegram user ID and the
+// password given by the /opds command
+func (b *SendToKindleBot) opdsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := b.opdsUser(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+opdsRealm+`", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		page := b.opdsPage(r.URL.Path)
+		switch {
+		case page == "" || page == "/":
+			b.opdsRoot(w)
+		case page == "/recent":
+			b.opdsBooks(w, r, "Recently sent", b.library.list(userID))
+		case page == "/authors":
+			b.opdsAuthors(w, b.library.list(userID))
+		case page == "/author":
+			name := r.URL.Query().Get("name")
+			b.opdsBooks(w, r, name, booksByAuthor(b.library.list(userID), name))
+		case page == "/search":
+			query := r.URL.Query().Get("q")
+			b.opdsBooks(w, r, fmt.Sprintf("Search: %s", query), searchBooks(b.library.list(userID), query))
+		case page == "/opensearch.xml":
+			b.opdsOpenSearch(w)
+		case strings.HasPrefix(page, "/books/"):
+			b.opdsDownload(w, r, userID, strings.TrimPrefix(page, "/books/"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// opdsUser authenticates a request, returning the user ID
+func (b *SendToKindleBot) opdsUser(r *http.Request) (int, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return 0, false
+	}
+	userID, err := strconv.Atoi(strings.TrimSpace(username))
+	if err != nil || !b.isAllowed(userID) {
+		return 0, false
+	}
+	stored := b.users.opdsHash(userID)
+	if stored == "" {
+		return 0, false
+	}
+	hash := hashOPDSPassword(password)
+	return userID, subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1
+}
+
+func hashOPDSPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOPDSPassword returns a random password that is easy to type on a reader
+func newOPDSPassword() (string, error) {
+	raw := make([]byte, opdsPasswordLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(raw)
+	return strings.NewReplacer("-", "x", "_", "y").Replace(password)[:opdsPasswordLen], nil
+}
+
+func (b *SendToKindleBot) newOPDSFeed(id, title string, updated time.Time, links ...opdsLink) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:     atomNamespace,
+		XmlnsOPDS: opdsNamespace,
+		XmlnsDC:   dcNamespace,
+		ID:        "urn:send-to-kindle:" + id,
+		Title:     title,
+		Updated:   formatAtomTime(updated),
+		Links: append([]opdsLink{
+			{Rel: "start", Href: b.opdsHref(""), Type: opdsNavigationType},
+			{Rel: "search", Href: b.opdsHref("/opensearch.xml"), Type: openSearchType},
+		}, links...),
+	}
+}
+
+func (b *SendToKindleBot) opdsRoot(w http.ResponseWriter) {
+	now := time.Now()
+	feed := b.newOPDSFeed("root", "Send-to-Kindle library", now,
+		opdsLink{Rel: "self", Href: b.opdsHref(""), Type: opdsNavigationType})
+	for _, nav := range []struct{ id, title, href, kind, summary string }{
+		{"recent", "Recently sent", "/recent", opdsAcquireType, "Books sent to the bot, newest first"},
+		{"authors", "By author", "/authors", opdsNavigationType, "Books grouped by author"},
+	} {
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   nav.title,
+			ID:      "urn:send-to-kindle:" + nav.id,
+			Updated: formatAtomTime(now),
+			Content: &opdsContent{Type: "text", Text: nav.summary},
+			Links:   []opdsLink{{Rel: "subsection", Href: b.opdsHref(nav.href), Type: nav.kind}},
+		})
+	}
+	writeOPDS(w, opdsNavigationType, feed)
+}
+
+// opdsBooks writes an acquisition feed, opdsPageSize books per page
+func (b *SendToKindleBot) opdsBooks(w http.ResponseWriter, r *http.Request, title string, books []libraryBook) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	updated := time.Now()
+	if len(books) > 0 {
+		updated = books[0].Added
+	}
+
+	// Links are built from the public path, the proxy may have rewritten r.URL
+	public := *r.URL
+	public.Path = b.opdsHref(b.opdsPage(r.URL.Path))
+	self := pageURL(&public, page)
+	feed := b.newOPDSFeed(strings.TrimPrefix(r.URL.Path, "/")+"?"+r.URL.RawQuery, title, updated,
+		opdsLink{Rel: "self", Href: self, Type: opdsAcquireType},
+		opdsLink{Rel: "up", Href: b.opdsHref(""), Type: opdsNavigationType})
+	start := (page - 1) * opdsPageSize
+	if start+opdsPageSize < len(books) {
+		feed.Links = append(feed.Links, opdsLink{Rel: "next", Href: pageURL(&public, page+1), Type: opdsAcquireType})
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, opdsLink{Rel: "previous", Href: pageURL(&public, page-1), Type: opdsAcquireType})
+	}
+	for i := start; i < len(books) && i < start+opdsPageSize; i++ {
+		feed.Entries = append(feed.Entries, b.bookEntry(books[i]))
+	}
+	writeOPDS(w, opdsAcquireType, feed)
+}
+
+func (b *SendToKindleBot) bookEntry(book libraryBook) opdsEntry {
+	entry := opdsEntry{
+		Title:    book.Title,
+		ID:       "urn:send-to-kindle:book:" + book.ID,
+		Updated:  formatAtomTime(book.Added),
+		Language: book.Language,
+		Summary:  book.Description,
+	}
+	for _, author := range book.Authors {
+		entry.Authors = append(entry.Authors, opdsAuthor{Name: author})
+	}
+	for _, f := range book.Files {
+		entry.Links = append(entry.Links, opdsLink{
+			Rel:   opdsAcquisitionRel,
+			Href:  b.opdsHref("/books/" + book.ID + "/" + url.PathEscape(f.Name)),
+			Type:  bookMediaType(f.Format),
+			Title: strings.ToUpper(f.Format),
+			Size:  f.Size,
+		})
+	}
+	return entry
+}
+
+func (b *SendToKindleBot) opdsAuthors(w http.ResponseWriter, books []libraryBook) {
+	counts := make(map[string]int)
+	for _, book := range books {
+		for _, author := range bookAuthors(book) {
+			counts[author]++
+		}
+	}
+	authors := make([]string, 0, len(counts))
+	for author := range counts {
+		authors = append(authors, author)
+	}
+	sort.Slice(authors, func(i, j int) bool { return strings.ToLower(authors[i]) < strings.ToLower(authors[j]) })
+
+	now := time.Now()
+	feed := b.newOPDSFeed("authors", "By author", now,
+		opdsLink{Rel: "self", Href: b.opdsHref("/authors"), Type: opdsNavigationType},
+		opdsLink{Rel: "up", Href: b.opdsHref(""), Type: opdsNavigationType})
+	for _, author := range authors {
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   author,
+			ID:      "urn:send-to-kindle:author:" + url.QueryEscape(author),
+			Updated: formatAtomTime(now),
+			Content: &opdsContent{Type: "text", Text: fmt.Sprintf("%d book(s)", counts[author])},
+			Links: []opdsLink{{
+				Rel:  "subsection",
+				Href: b.opdsHref("/author?name=" + url.QueryEscape(author)),
+				Type: opdsAcquireType,
+			}},
+		})
+	}
+	writeOPDS(w, opdsNavigationType, feed)
+}
+
+// unknownAuthor groups books without author metadata
+const unknownAuthor = "Unknown author"
+
+func bookAuthors(book libraryBook) []string {
+	if len(book.Authors) == 0 {
+		return []string{unknownAuthor}
+	}
+	return book.Authors
+}
+
+func booksByAuthor(books []libraryBook, name string) []libraryBook {
+	var found []libraryBook
+	for _, book := range books {
+		for _, author := range bookAuthors(book) {
+			if author == name {
+				found = append(found, book)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func (b *SendToKindleBot) opdsOpenSearch(w http.ResponseWriter) {
+	description := openSearchDescription{
+		Xmlns:       "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:   "Library",
+		Description: "Search the books you sent to the bot",
+	}
+	description.URL.Type = opdsAcquireType
+	description.URL.Template = b.opdsHref("/search?q={searchTerms}")
+	writeOPDS(w, openSearchType, description)
+}
+
+func (b *SendToKindleBot) opdsDownload(w http.ResponseWriter, r *http.Request, userID int, path string) {
+	id, name, ok := splitBookPath(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	book, ok := b.library.book(userID, id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, ok := book.file(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", bookMediaType(f.Format))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	http.ServeFile(w, r, b.library.path(book, f))
+}
+
+// splitBookPath splits "<id>/<file name>" of a download URL
+func splitBookPath(path string) (string, string, bool) {
+	i := strings.Index(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return "", "", false
+	}
+	name := path[i+1:]
+	if strings.Contains(name, "/") || name != filepath.Base(name) {
+		return "", "", false
+	}
+	return path[:i], name, true
+}
+
+func pageURL(u *url.URL, page int) string {
+	query := u.Query()
+	query.Del("page")
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	if encoded := query.Encode(); encoded != "" {
+		return u.Path + "?" + encoded
+	}
+	return u.Path
+}
+
+// opdsBase returns the path of the catalog as clients see it: the path of
+// OPDSURL, so links keep working behind a proxy serving the catalog under
+// another path, or opdsPrefix
+func (b *SendToKindleBot) opdsBase() string {
+	if b.OPDSURL == "" {
+		return opdsPrefix
+	}
+	u, err := url.Parse(b.OPDSURL)
+	if err != nil {
+		return opdsPrefix
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// opdsHref returns the link to a page of the catalog, like "/recent"
+func (b *SendToKindleBot) opdsHref(page string) string {
+	if href := b.opdsBase() + page; href != "" {
+		return href
+	}
+	return "/"
+}
+
+// opdsPage returns the page of the catalog a request path is for, the path
+// may start with the public path or with opdsPrefix
+func (b *SendToKindleBot) opdsPage(path string) string {
+	for _, prefix := range []string{b.opdsBase(), opdsPrefix} {
+		if prefix != "" && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+			return strings.TrimPrefix(path, prefix)
+		}
+	}
+	return path
+}
+
+func formatAtomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func writeOPDS(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType+";charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logging.Warn("Could not write OPDS feed", "err", err)
+	}
+}
+
+// serveOPDS serves the catalog until the bot is stopped
+func (b *SendToKindleBot) serveOPDS() {
+	mux := http.NewServeMux()
+	mux.Handle(opdsPrefix, b.opdsHandler())
+	mux.Handle(opdsPrefix+"/", b.opdsHandler())
+	// A proxy may also pass the public path on unchanged
+	if base := b.opdsBase(); base != opdsPrefix {
+		if base != "" {
+			mux.Handle(base, b.opdsHandler())
+		}
+		mux.Handle(base+"/", b.opdsHandler())
+	}
+	server := &http.Server{Addr: b.OPDSListen, Handler: mux}
+
+	go func() {
+		<-b.stopped
+		server.Close()
+	}()
+
+	logging.Info("Serving the OPDS catalog", "listen", b.OPDSListen, "library", b.library.dir)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Error("OPDS server stopped", "err", err)
+	}
+}
+
+// opdsCommand handles "/opds [reset]": it tells the user where the catalog
+// is and their credentials. A password is generated the first time and on
+// reset, only its hash is stored so it is shown once
+func (b *SendToKindleBot) opdsCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		text := fmt.Sprintf("📚 Your library has %d book(s).\n\nOPDS catalog: %s\nUsername: %d\n",
+			len(b.library.list(m.Sender.ID)), b.opdsURL(), m.Sender.ID)
+
+		if b.users.opdsHash(m.Sender.ID) != "" && strings.TrimSpace(m.Payload) != "reset" {
+			text += "Password: the one sent before, /opds reset for a new one"
+			respond(bot, m, text)
+			return
+		}
+		password, err := newOPDSPassword()
+		if err != nil {
+			logging.Error("Could not generate an OPDS password", "user", m.Sender.ID, "err", err)
+			respond(bot, m, "❌ Could not create a password, please try again.")
+			return
+		}
+		b.users.setOPDSHash(m.Sender.ID, hashOPDSPassword(password))
+		text += fmt.Sprintf("Password: %s\n\nAdd the catalog in KOReader, Moon+ Reader or any OPDS app. "+
+			"The password is only shown once; /opds reset replaces it.", password)
+		respond(bot, m, text)
+	}
+}
+
+// opdsURL returns the public catalog URL, or a hint when it is not configured
+func (b *SendToKindleBot) opdsURL() string {
+	if b.OPDSURL == "" {
+		return "port " + strings.TrimPrefix(b.OPDSListen, ":") + " of the bot's server, path " + opdsPrefix
+	}
+	return b.OPDSURL
+}
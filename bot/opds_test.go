@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendToKindleBot_opdsHandler(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "dune.epub")
+	if err := os.WriteFile(book, []byte("epub"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := &SendToKindleBot{AllowedUsers: []int{1, 2}}
+	b.users, _ = loadUserStore("", time.Now())
+	b.users.setOPDSHash(1, hashOPDSPassword("secret"))
+	b.users.setOPDSHash(2, hashOPDSPassword("other"))
+	var err error
+	if b.library, err = openLibrary(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	dune, err := b.library.add(1, bookMetadata{Title: "Dune", Authors: []string{"Frank Herbert"}}, time.Now(), book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(b.opdsHandler())
+	defer server.Close()
+
+	get := func(path, user, password string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		status   int
+		contains []string
+	}{
+		{name: "no credentials", path: "/opds", status: http.StatusUnauthorized},
+		{name: "wrong password", path: "/opds", user: "1", password: "guess", status: http.StatusUnauthorized},
+		{name: "user not allowed", path: "/opds", user: "3", password: "secret", status: http.StatusUnauthorized},
+		{
+			name: "root", path: "/opds", user: "1", password: "secret", status: http.StatusOK,
+			contains: []string{`href="/opds/recent"`, `href="/opds/authors"`, `rel="search"`},
+		},
+		{
+			name: "recent", path: "/opds/recent", user: "1", password: "secret", status: http.StatusOK,
+			contains: []string{"<title>Dune</title>", "<name>Frank Herbert</name>",
+				`rel="http://opds-spec.org/acquisition" href="/opds/books/` + dune.ID + `/dune.epub" type="application/epub+zip"`},
+		},
+		{
+			name: "author", path: "/opds/author?name=Frank+Herbert", user: "1", password: "secret", status: http.StatusOK,
+			contains: []string{"<title>Dune</title>"},
+		},
+		{
+			name: "download", path: "/opds/books/" + dune.ID + "/dune.epub", user: "1", password: "secret",
+			status: http.StatusOK, contains: []string{"epub"},
+		},
+		{
+			name: "book of another user", path: "/opds/books/" + dune.ID + "/dune.epub", user: "2", password: "other",
+			status: http.StatusNotFound,
+		},
+		{
+			name: "path outside the book", path: "/opds/books/" + dune.ID + "/..%2f..%2flibrary.json", user: "1",
+			password: "secret", status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(tt.path, tt.user, tt.password)
+			if status != tt.status {
+				t.Fatalf("GET %s status = %d, want %d", tt.path, status, tt.status)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(body, want) {
+					t.Errorf("GET %s =\n%s\nwant it to contain %s", tt.path, body, want)
+				}
+			}
+		})
+	}
+
+	if _, body := get("/opds/recent", "2", "other"); strings.Contains(body, "Dune") {
+		t.Errorf("recent books of user 2 contain a book of user 1")
+	}
+
+	// Behind a proxy serving the catalog under a sub-path, links use the
+	// public path whether the proxy strips it or not
+	b.OPDSURL = "https://books.example.com/kindle/opds"
+	for _, path := range []string{"/opds/recent?page=1", "/kindle/opds/recent?page=1"} {
+		status, body := get(path, "1", "secret")
+		if status != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", path, status, http.StatusOK)
+		}
+		for _, want := range []string{`rel="self" href="/kindle/opds/recent"`, `rel="start" href="/kindle/opds"`,
+			`href="/kindle/opds/books/` + dune.ID + `/dune.epub"`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("GET %s =\n%s\nwant it to contain %s", path, body, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package bot
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	orgHeadingRe     = regexp.MustCompile(`^(\*+)[ \t]+(.*?)[ \t]*$`)
+	orgKeywordRe     = regexp.MustCompile(`^[ \t]*#\+([A-Za-z_]+):[ \t]*(.*?)[ \t]*$`)
+	orgBeginRe       = regexp.MustCompile(`(?i)^[ \t]*#\+begin_([a-z]+)[ \t]*(.*?)[ \t]*$`)
+	orgDrawerRe      = regexp.MustCompile(`^[ \t]*:([A-Za-z_-]+):[ \t]*$`)
+	orgPlanningRe    = regexp.MustCompile(`^[ \t]*(?:SCHEDULED|DEADLINE|CLOSED):`)
+	orgFixedRe       = regexp.MustCompile(`^[ \t]*:(?:[ \t]|$)`)
+	orgRuleRe        = regexp.MustCompile(`^[ \t]*-{5,}[ \t]*$`)
+	orgListItemRe    = regexp.MustCompile(`^([ \t]*)([-+*]|\d+[.)])(?:[ \t]+(.*))?$`)
+	orgCheckboxRe    = regexp.MustCompile(`^\[([ Xx-])\][ \t]+`)
+	orgDescriptionRe = regexp.MustCompile(`^(.*?)[ \t]+::(?:[ \t]+(.*))?$`)
+	orgFootnoteDefRe = regexp.MustCompile(`^\[fn:([^\]]+)\][ \t]*(.*)$`)
+	orgTodoRe        = regexp.MustCompile(`^(?:TODO|DONE|NEXT|WAITING|CANCELLED|CANCELED)[ \t]+`)
+	orgPriorityRe    = regexp.MustCompile(`^\[#[A-Za-z0-9]\][ \t]*`)
+	orgTagsRe        = regexp.MustCompile(`[ \t]+:[\w@#%:]+:$`)
+)
+
+var (
+	// orgEmphasisRules render *bold*, /italic/, _underline_, =verbatim=,
+	// ~code~ and +strike-through+
+	orgEmphasisRules []inlineRule
+	// orgInlineRules render the inline markup of Org but footnotes
+	orgInlineRules []inlineRule
+)
+
+// init builds the rules, which render the content of their spans with
+// the rules themselves
+func init() {
+	orgEmphasisRules = []inlineRule{
+		orgEmphasis("=", func(s string) string { return "<code>" + html.EscapeString(s) + "</code>" }),
+		orgEmphasis("~", func(s string) string { return "<code>" + html.EscapeString(s) + "</code>" }),
+		orgEmphasis("*", orgWrap("strong")),
+		orgEmphasis("/", orgWrap("em")),
+		orgEmphasis("_", orgWrap("u")),
+		orgEmphasis("+", orgWrap("del")),
+	}
+	orgInlineRules = []inlineRule{
+		{re: regexp.MustCompile(`()\[\[([^\]]+)\](?:\[([^\]]+)\])?\]()`), render: func(g []string) string {
+			text := html.EscapeString(g[2])
+			if g[3] != "" {
+				text = renderInline(g[3], orgEmphasisRules, html.EscapeString)
+			}
+			return markupLink(g[2], text)
+		}},
+		{re: regexp.MustCompile(`(^|[^\\])\\\\[ \t]*()(\n|$)`), render: func([]string) string { return "<br/>" }},
+		bareURLRule,
+	}
+	orgInlineRules = append(orgInlineRules, orgEmphasisRules...)
+}
+
+// orgEmphasis matches text between two markers with the boundaries Org
+// requires around them
+func orgEmphasis(marker string, render func(string) string) inlineRule {
+	m := regexp.QuoteMeta(marker)
+	re := regexp.MustCompile(`(^|[\s\-({'"])` + m + `([^\s]|[^\s].*?[^\s])` + m + `([\s\-.,:!?;'")}\[]|$)`)
+	return inlineRule{re: re, render: func(g []string) string { return render(g[2]) }}
+}
+
+func orgWrap(tag string) func(string) string {
+	return func(s string) string {
+		return "<" + tag + ">" + renderInline(s, orgEmphasisRules, html.EscapeString) + "</" + tag + ">"
+	}
+}
+
+// orgParser parses Org mode documents
+type orgParser struct {
+	doc   *markupDocument
+	notes map[string]string // footnote definitions by label
+	order []string
+	rules []inlineRule
+}
+
+// parseOrg parses an Org mode document, #+TITLE, #+AUTHOR and #+LANGUAGE
+// set the metadata of the book
+func parseOrg(content string) *markupDocument {
+	p := &orgParser{doc: newMarkupDocument(), notes: make(map[string]string)}
+	p.rules = append([]inlineRule{{
+		re:     regexp.MustCompile(`()\[fn:([^\]:]*)(?::([^\]]*))?\]()`),
+		render: p.footnote,
+	}}, orgInlineRules...)
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	lines = p.footnoteDefinitions(lines)
+	p.doc.Blocks = p.blocks(lines, true)
+	for _, label := range p.order {
+		if _, ok := p.doc.notes.numbers[label]; ok {
+			p.doc.notes.define(label, "<p>"+p.inline(p.notes[label])+"</p>")
+		}
+	}
+	return p.doc
+}
+
+// footnoteDefinitions takes the "[fn:label] text" paragraphs out of lines
+func (p *orgParser) footnoteDefinitions(lines []string) []string {
+	var rest []string
+	for i := 0; i < len(lines); i++ {
+		m := orgFootnoteDefRe.FindStringSubmatch(lines[i])
+		if m == nil {
+			rest = append(rest, lines[i])
+			continue
+		}
+		text := []string{m[2]}
+		for i+1 < len(lines) && !isBlank(lines[i+1]) && !orgHeadingRe.MatchString(lines[i+1]) &&
+			!orgFootnoteDefRe.MatchString(lines[i+1]) {
+			i++
+			text = append(text, strings.TrimSpace(lines[i]))
+		}
+		if _, ok := p.notes[m[1]]; !ok {
+			p.order = append(p.order, m[1])
+		}
+		p.notes[m[1]] = strings.Join(text, "\n")
+	}
+	return rest
+}
+
+// footnote renders [fn:label], [fn:label:text] and [fn::text]
+func (p *orgParser) footnote(g []string) string {
+	label, text := g[2], g[3]
+	if text != "" {
+		content := "<p>" + p.inline(text) + "</p>"
+		if label == "" {
+			return p.doc.notes.inline(content)
+		}
+		p.doc.notes.define(label, content)
+		return p.doc.notes.ref(label)
+	}
+	_, defined := p.notes[label]
+	if _, inline := p.doc.notes.numbers[label]; !defined && !inline {
+		return html.EscapeString("[fn:" + label + "]")
+	}
+	return p.doc.notes.ref(label)
+}
+
+func (p *orgParser) inline(text string) string {
+	return strings.TrimSpace(renderInline(text, p.rules, html.EscapeString))
+}
+
+// startsBlock reports whether line ends a paragraph
+func (p *orgParser) startsBlock(line string) bool {
+	return orgHeadingRe.MatchString(line) || orgKeywordRe.MatchString(line) || orgBeginRe.MatchString(line) ||
+		orgListItemRe.MatchString(line) || orgFixedRe.MatchString(line) || orgRuleRe.MatchString(line) ||
+		orgDrawerRe.MatchString(line) || strings.HasPrefix(strings.TrimSpace(line), "|") ||
+		strings.HasPrefix(line, "# ") || line == "#"
+}
+
+// blocks parses lines to headings and blocks, headings only at the top
+// level of the document
+func (p *orgParser) blocks(lines []string, top bool) []markupBlock {
+	var blocks []markupBlock
+	add := func(xhtml string) {
+		if xhtml != "" {
+			blocks = append(blocks, markupBlock{HTML: xhtml, Notes: p.doc.notes.take()})
+		}
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(line, "# ") || line == "#" || orgPlanningRe.MatchString(line):
+			i++
+		case top && orgHeadingRe.MatchString(line):
+			title := orgHeadingRe.FindStringSubmatch(line)
+			text := orgTagsRe.ReplaceAllString(title[2], "")
+			text = orgPriorityRe.ReplaceAllString(orgTodoRe.ReplaceAllString(text, ""), "")
+			xhtml := p.inline(text)
+			blocks = append(blocks, markupBlock{Heading: len(title[1]), HTML: xhtml, Notes: p.doc.notes.take()})
+			i++
+		case orgBeginRe.MatchString(line):
+			m := orgBeginRe.FindStringSubmatch(line)
+			kind := strings.ToLower(m[1])
+			var body []string
+			for i++; i < len(lines); i++ {
+				if strings.EqualFold(strings.TrimSpace(lines[i]), "#+end_"+kind) {
+					i++
+					break
+				}
+				body = append(body, lines[i])
+			}
+			add(p.block(kind, m[2], body))
+		case orgKeywordRe.MatchString(line):
+			m := orgKeywordRe.FindStringSubmatch(line)
+			switch strings.ToUpper(m[1]) {
+			case "TITLE":
+				p.doc.Title = markupText(p.inline(m[2]))
+			case "AUTHOR":
+				p.doc.Authors = append(p.doc.Authors, m[2])
+			case "LANGUAGE":
+				p.doc.Language = m[2]
+			}
+			i++
+		case orgDrawerRe.MatchString(line):
+			// Property and logbook drawers hold metadata, not content
+			for i++; i < len(lines); i++ {
+				if strings.EqualFold(strings.TrimSpace(lines[i]), ":END:") {
+					i++
+					break
+				}
+			}
+		case orgFixedRe.MatchString(line):
+			var code []string
+			for ; i < len(lines) && orgFixedRe.MatchString(lines[i]); i++ {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(strings.TrimLeft(lines[i], " \t"), ":"), " "))
+			}
+			add(markupCode(strings.Join(code, "\n"), ""))
+		case orgRuleRe.MatchString(line):
+			add("<hr/>")
+			i++
+		case strings.HasPrefix(trimmed, "|"):
+			var rows []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+				rows = append(rows, strings.TrimSpace(lines[i]))
+			}
+			add(p.table(rows))
+		case orgListItemRe.MatchString(line) && (!top || !orgHeadingRe.MatchString(line)):
+			var list string
+			list, i = p.list(lines, i)
+			add(list)
+		default:
+			paragraph := []string{trimmed}
+			for i++; i < len(lines) && !isBlank(lines[i]) && !p.startsBlock(lines[i]); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			add("<p>" + p.inline(strings.Join(paragraph, "\n")) + "</p>")
+		}
+	}
+	return blocks
+}
+
+// render renders lines nested in a list or block
+func (p *orgParser) render(lines []string) string {
+	var out []string
+	for _, block := range p.blocks(lines, false) {
+		out = append(out, block.HTML)
+		// The footnotes belong to the block rendering these lines
+		p.doc.notes.pending = append(p.doc.notes.pending, block.Notes...)
+	}
+	return strings.Join(out, "\n")
+}
+
+// block renders a #+BEGIN_kind ... #+END_kind block with the parameters
+// after its name
+func (p *orgParser) block(kind, params string, body []string) string {
+	switch kind {
+	case "src", "example":
+		lang := ""
+		if fields := strings.Fields(params); kind == "src" && len(fields) > 0 {
+			lang = fields[0]
+		}
+		return markupCode(strings.Join(trimCommonIndent(body), "\n"), lang)
+	case "quote":
+		return "<blockquote>\n" + p.render(body) + "\n</blockquote>"
+	case "center":
+		return `<div style="text-align: center">` + "\n" + p.render(body) + "\n</div>"
+	case "verse":
+		var verse []string
+		for _, line := range trimCommonIndent(body) {
+			// The indentation of verse is kept, the style preserves white space
+			verse = append(verse, line[:indentation(line)]+p.inline(line))
+		}
+		return `<p class="verse">` + strings.Join(verse, "<br/>\n") + "</p>"
+	case "export":
+		if strings.EqualFold(strings.TrimSpace(params), "html") {
+			return htmlToXHTML(strings.Join(body, "\n"), nil)
+		}
+		return ""
+	case "comment":
+		return ""
+	}
+	return "<div>\n" + p.render(body) + "\n</div>"
+}
+
+// table renders the rows of an Org table, rows above its first rule are
+// the header
+func (p *orgParser) table(lines []string) string {
+	var rows [][]string
+	header := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "|-") {
+			if header == 0 && len(rows) > 0 {
+				header = len(rows)
+			}
+			continue
+		}
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+		var row []string
+		for _, cell := range strings.Split(line, "|") {
+			row = append(row, p.inline(strings.TrimSpace(cell)))
+		}
+		rows = append(rows, row)
+	}
+	if header == len(rows) {
+		header = 0
+	}
+	return markupTable(rows, header, nil)
+}
+
+// list renders the list starting at lines[i] and returns the index after it
+func (p *orgParser) list(lines []string, i int) (string, int) {
+	first := orgListItemRe.FindStringSubmatch(lines[i])
+	indent := len(first[1])
+	ordered := strings.ContainsAny(first[2], ".)")
+	description := !ordered && orgDescriptionRe.MatchString(first[3])
+
+	var items []string
+	for i < len(lines) {
+		m := orgListItemRe.FindStringSubmatch(lines[i])
+		if m == nil || len(m[1]) != indent || strings.ContainsAny(m[2], ".)") != ordered {
+			break
+		}
+		body := []string{m[3]}
+		for i++; i < len(lines); i++ {
+			if isBlank(lines[i]) {
+				// Two blank lines end a list
+				if i+1 < len(lines) && isBlank(lines[i+1]) {
+					break
+				}
+				if i+1 < len(lines) && indentation(expandTabs(lines[i+1])) > indent {
+					body = append(body, "")
+					continue
+				}
+				break
+			}
+			if indentation(expandTabs(lines[i])) <= indent {
+				break
+			}
+			body = append(body, strings.TrimLeft(lines[i], " \t"))
+			if orgListItemRe.MatchString(lines[i]) {
+				// Keep the indentation of nested lists
+				body[len(body)-1] = expandTabs(lines[i])[indent+1:]
+			}
+		}
+
+		text := body[0]
+		box := ""
+		if c := orgCheckboxRe.FindStringSubmatch(text); c != nil {
+			box = map[string]string{" ": "☐ ", "x": "☑ ", "X": "☑ ", "-": "◪ "}[c[1]]
+			text = text[len(c[0]):]
+		}
+		if description {
+			if d := orgDescriptionRe.FindStringSubmatch(text); d != nil {
+				body[0] = d[2]
+				items = append(items, "<dt>"+p.inline(d[1])+"</dt>\n<dd>"+p.itemContent(body)+"</dd>")
+				continue
+			}
+		}
+		body[0] = text
+		items = append(items, "<li>"+box+p.itemContent(body)+"</li>")
+	}
+	tag := "ul"
+	switch {
+	case description:
+		tag = "dl"
+	case ordered:
+		tag = "ol"
+	}
+	return "<" + tag + ">\n" + strings.Join(items, "\n") + "\n</" + tag + ">", i
+}
+
+// itemContent renders the lines of a list item, a single paragraph
+// without <p>
+func (p *orgParser) itemContent(lines []string) string {
+	content := p.render(lines)
+	if strings.HasPrefix(content, "<p>") && strings.Count(content, "<p>") == 1 && strings.HasSuffix(content, "</p>") {
+		return strings.TrimSuffix(strings.TrimPrefix(content, "<p>"), "</p>")
+	}
+	if strings.HasPrefix(content, "<p>") && strings.Count(content, "<p>") == 1 {
+		// A paragraph followed by a nested list
+		end := strings.Index(content, "</p>")
+		return content[3:end] + content[end+4:]
+	}
+	return content
+}
+
+// trimCommonIndent removes the indentation all non-blank lines share
+func trimCommonIndent(lines []string) []string {
+	common := -1
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+		if !isBlank(lines[i]) && (common < 0 || indentation(lines[i]) < common) {
+			common = indentation(lines[i])
+		}
+	}
+	if common < 0 {
+		common = 0
+	}
+	trimmed := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed[i] = trimIndent(line, common)
+	}
+	for len(trimmed) > 0 && isBlank(trimmed[len(trimmed)-1]) {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	return trimmed
+}
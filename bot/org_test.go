@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOrg(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "headings",
+			content: "* TODO [#A] Plan the trip   :travel:\n  :PROPERTIES:\n  :ID: 42\n  :END:\n  SCHEDULED: <2026-10-18 Sun>\nText\n** Sub /heading/",
+			want:    "# Plan the trip\n<p>Text</p>\n## Sub <em>heading</em>",
+		},
+		{
+			name:    "emphasis",
+			content: "*bold* /italic/ _under_ =x < y= ~code~ +gone+ 2*3*4 a/b/c",
+			want:    "<p><strong>bold</strong> <em>italic</em> <u>under</u> <code>x &lt; y</code> <code>code</code> <del>gone</del> 2*3*4 a/b/c</p>",
+		},
+		{
+			name:    "links",
+			content: "[[https://orgmode.org][The *Org* site]] [[https://go.dev]] [[file:notes.org][notes]] [[#anchor]]",
+			want:    `<p><a href="https://orgmode.org">The <strong>Org</strong> site</a> <a href="https://go.dev">https://go.dev</a> notes #anchor</p>`,
+		},
+		{
+			name:    "lists",
+			content: "- one\n- two\n  continued\n  1. nested\n- [X] done\n- [ ] todo\n\n- Emacs :: an editor\n- Vim :: another",
+			want:    "<ul>\n<li>one</li>\n<li>two\ncontinued\n<ol>\n<li>nested</li>\n</ol></li>\n<li>☑ done</li>\n<li>☐ todo</li>\n</ul>\n<dl>\n<dt>Emacs</dt>\n<dd>an editor</dd>\n<dt>Vim</dt>\n<dd>another</dd>\n</dl>",
+		},
+		{
+			name:    "blocks",
+			content: "#+BEGIN_SRC go :tangle yes\n  if a < b {\n  }\n#+END_SRC\n#+begin_quote\nWise /words/.\n#+end_quote\n#+BEGIN_VERSE\nRoses\n  are red\n#+END_VERSE\n#+BEGIN_COMMENT\nhidden\n#+END_COMMENT\n: fixed\n:  width",
+			want:    "<pre><code class=\"language-go\">if a &lt; b {\n}</code></pre>\n<blockquote>\n<p>Wise <em>words</em>.</p>\n</blockquote>\n<p class=\"verse\">Roses<br/>\n  are red</p>\n<pre><code>fixed\n width</code></pre>",
+		},
+		{
+			name:    "table and rule",
+			content: "| Name | Qty |\n|------+-----|\n| a    |   1 |\n-----\n# a comment\nafter\\\\\nbreak",
+			want:    "<table>\n<thead>\n<tr><th>Name</th><th>Qty</th></tr>\n</thead>\n<tbody>\n<tr><td>a</td><td>1</td></tr>\n</tbody>\n</table>\n<hr/>\n<p>after<br/>\nbreak</p>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markupBlocks(parseOrg(tt.content)); got != tt.want {
+				t.Errorf("parseOrg() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrg_metadataAndFootnotes(t *testing.T) {
+	doc := parseOrg("#+TITLE: Field *Notes*\n#+AUTHOR: Jane Doe\n#+LANGUAGE: uk\n\nSee[fn:1] and[fn::inline /note/], again[fn:1], missing[fn:2].\n\n[fn:1] The first\nnote.\n")
+	if doc.Title != "Field Notes" || strings.Join(doc.Authors, ",") != "Jane Doe" || doc.Language != "uk" {
+		t.Errorf("parseOrg() metadata = %q, %q, %q", doc.Title, doc.Authors, doc.Language)
+	}
+	want := `<p>See<a epub:type="noteref" href="#fn-1"><sup>1</sup></a> and<a epub:type="noteref" href="#fn-2"><sup>2</sup></a>, ` +
+		`again<a epub:type="noteref" href="#fn-1"><sup>1</sup></a>, missing[fn:2].</p>`
+	if got := markupBlocks(doc); got != want {
+		t.Errorf("parseOrg() =\n%s\nwant\n%s", got, want)
+	}
+	if doc.notes.bodies[1] != "<p>The first\nnote.</p>" || doc.notes.bodies[2] != "<p>inline <em>note</em></p>" {
+		t.Errorf("footnotes = %q", doc.notes.bodies)
+	}
+}
@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"encoding/json"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	longPollTimeout = 10 * time.Second
+	// pollRetryDelay is the pause after a failed getUpdates call
+	pollRetryDelay = 3 * time.Second
+	// pollStaleAfter is how long without a successful getUpdates call
+	// the poller is considered dead
+	pollStaleAfter = 6 * longPollTimeout
+)
+
+// pollerHealth records whether updates are being received.
+// A nil *pollerHealth records nothing
+type pollerHealth struct {
+	mu         sync.Mutex
+	mode       string
+	running    bool
+	lastPoll   time.Time // last successful getUpdates call, or when the webhook started listening
+	lastUpdate time.Time
+}
+
+func (h *pollerHealth) started(now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.running = true
+	h.lastPoll = now
+	h.mu.Unlock()
+}
+
+func (h *pollerHealth) stopped() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.running = false
+	h.mu.Unlock()
+}
+
+func (h *pollerHealth) polled(now time.Time, updates int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.lastPoll = now
+	if updates > 0 {
+		h.lastUpdate = now
+	}
+	h.mu.Unlock()
+}
+
+// check reports whether the poller is running and, in polling mode,
+// whether Telegram answered recently
+func (h *pollerHealth) check(now time.Time) (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.running {
+		return false, h.mode + " not running"
+	}
+	if h.mode == UpdateModePolling && now.Sub(h.lastPoll) > pollStaleAfter {
+		return false, "no successful getUpdates for " + now.Sub(h.lastPoll).Truncate(time.Second).String()
+	}
+	if h.mode == UpdateModeWebhook {
+		return true, "webhook listening"
+	}
+	return true, "last poll " + now.Sub(h.lastPoll).Truncate(time.Second).String() + " ago"
+}
+
+// longPoller is a tb.Poller using getUpdates long polling which, unlike
+// tb.LongPoller, records every successful call for the health checks
+type longPoller struct {
+	timeout      time.Duration
+	lastUpdateID int
+	health       *pollerHealth
+}
+
+// Poll receives updates until stop is closed
+func (p *longPoller) Poll(bot *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	p.health.started(time.Now())
+	defer p.health.stopped()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		updates, err := p.getUpdates(bot)
+		if err != nil {
+			logging.Warn("Could not get updates", "err", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		p.health.polled(time.Now(), len(updates))
+		for _, update := range updates {
+			p.lastUpdateID = update.ID
+			dest <- update
+		}
+	}
+}
+
+func (p *longPoller) getUpdates(bot *tb.Bot) ([]tb.Update, error) {
+	data, err := bot.Raw("getUpdates", map[string]string{
+		"offset":  strconv.Itoa(p.lastUpdateID + 1),
+		"timeout": strconv.Itoa(int(p.timeout / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result []tb.Update `json:"result"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
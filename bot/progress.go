@@ -0,0 +1,251 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// progressEditInterval limits how often intermediate updates edit the
+	// status message, Telegram rejects bursts of edits to the same message
+	progressEditInterval = 2 * time.Second
+)
+
+// jobStage is a step of the download -> convert -> send pipeline
+type jobStage int
+
+const (
+	stageDownloading jobStage = iota
+	stageConverting
+	stageChoosingDevice
+	stageChoosingTime
+	stageScheduled
+	stageQueued
+	stageSending
+	stageDelivered
+	stageFailed
+)
+
+var convertProgressRegexp = regexp.MustCompile(`^\s*(\d{1,3})%\s`)
+
+// progressMessage is a single status message per job that is edited
+// in place as the job moves through its stages
+type progressMessage struct {
+	bot       *tb.Bot
+	msg       *tb.Message
+	fileName  string
+	startedAt time.Time
+
+	mu       sync.Mutex
+	stage    jobStage
+	percent  int
+	lastEdit time.Time
+}
+
+// newProgressMessage sends the initial status message to the recipient.
+// When sending fails, the returned progressMessage still works but all
+// updates become no-ops
+func newProgressMessage(bot *tb.Bot, to tb.Recipient, fileName string) *progressMessage {
+	p := &progressMessage{
+		bot:       bot,
+		fileName:  fileName,
+		startedAt: time.Now(),
+		stage:     stageDownloading,
+		percent:   -1,
+	}
+	msg, err := bot.Send(to, p.text(""))
+	if err != nil {
+		logging.Error("Could not send status message", "err", err)
+		return p
+	}
+	p.msg = msg
+	p.lastEdit = time.Now()
+	return p
+}
+
+// resumeProgressMessage continues a job whose status message already exists,
+// e.g. the device selection message a callback was triggered from
+func resumeProgressMessage(bot *tb.Bot, msg *tb.Message, fileName string, startedAt time.Time) *progressMessage {
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	return &progressMessage{
+		bot:       bot,
+		msg:       msg,
+		fileName:  fileName,
+		startedAt: startedAt,
+		stage:     stageChoosingDevice,
+		percent:   -1,
+	}
+}
+
+// setStage moves the job to the next stage and edits the status message
+func (p *progressMessage) setStage(stage jobStage) {
+	p.mu.Lock()
+	p.stage = stage
+	p.percent = -1
+	p.mu.Unlock()
+	p.edit("", nil, true)
+}
+
+// setPercent reports conversion progress. Edits are throttled
+func (p *progressMessage) setPercent(percent int) {
+	p.mu.Lock()
+	if percent == p.percent {
+		p.mu.Unlock()
+		return
+	}
+	p.percent = percent
+	p.mu.Unlock()
+	p.edit("", nil, false)
+}
+
+// askDevice turns the status message into the device selection prompt,
+// when is the time of a scheduled delivery, empty to send right away
+func (p *progressMessage) askDevice(when string, markup *tb.ReplyMarkup) error {
+	p.mu.Lock()
+	p.stage = stageChoosingDevice
+	p.percent = -1
+	p.mu.Unlock()
+	return p.edit(when, markup, true)
+}
+
+// askTime turns the status message into the "⏰ Send later" prompt, detail
+// explains the choices
+func (p *progressMessage) askTime(detail string, markup *tb.ReplyMarkup) error {
+	p.mu.Lock()
+	p.stage = stageChoosingTime
+	p.percent = -1
+	p.mu.Unlock()
+	return p.edit(detail, markup, true)
+}
+
+// scheduled marks the job as waiting for its delivery time
+func (p *progressMessage) scheduled(detail string) {
+	p.mu.Lock()
+	p.stage = stageScheduled
+	p.mu.Unlock()
+	p.edit(detail, nil, true)
+}
+
+// queued marks the file as added to the reading queue
+func (p *progressMessage) queued(detail string) {
+	p.mu.Lock()
+	p.stage = stageQueued
+	p.mu.Unlock()
+	p.edit(detail, nil, true)
+}
+
+// delivered marks the job as finished successfully
+func (p *progressMessage) delivered(detail string) {
+	p.mu.Lock()
+	p.stage = stageDelivered
+	p.mu.Unlock()
+	p.edit(detail, nil, true)
+}
+
+// failed marks the job as failed with a user facing reason
+func (p *progressMessage) failed(reason string) {
+	p.mu.Lock()
+	p.stage = stageFailed
+	p.mu.Unlock()
+	p.edit(reason, nil, true)
+}
+
+// failedWithKeyboard marks the job as failed but keeps the keyboard so the
+// user can retry
+func (p *progressMessage) failedWithKeyboard(reason string, markup *tb.ReplyMarkup) {
+	p.mu.Lock()
+	p.stage = stageFailed
+	p.mu.Unlock()
+	p.edit(reason, markup, true)
+}
+
+func (p *progressMessage) edit(detail string, markup *tb.ReplyMarkup, force bool) error {
+	if p.msg == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	if !force && time.Since(p.lastEdit) < progressEditInterval {
+		p.mu.Unlock()
+		return nil
+	}
+	p.lastEdit = time.Now()
+	text := p.text(detail)
+	p.mu.Unlock()
+
+	var err error
+	if markup != nil {
+		_, err = p.bot.Edit(p.msg, text, markup)
+	} else {
+		_, err = p.bot.Edit(p.msg, text)
+	}
+	if err != nil && err != tb.ErrSameMessageContent && err != tb.ErrMessageNotModified {
+		logging.Warn("Could not update status message", "err", err)
+	}
+	return err
+}
+
+// text must be called with p.mu held
+func (p *progressMessage) text(detail string) string {
+	return formatProgress(p.stage, p.fileName, p.percent, time.Since(p.startedAt), detail)
+}
+
+// formatProgress renders the status message body for a stage
+func formatProgress(stage jobStage, fileName string, percent int, elapsed time.Duration, detail string) string {
+	var status string
+	switch stage {
+	case stageDownloading:
+		status = "⬇️ Downloading..."
+	case stageConverting:
+		status = "🔄 Converting to EPUB..."
+		if percent >= 0 {
+			status = fmt.Sprintf("🔄 Converting to EPUB... %d%%", percent)
+		}
+	case stageChoosingDevice:
+		status = "📱 Which Kindle device would you like to send it to?\n\nSelect one:"
+		if detail != "" {
+			// A device for a delivery scheduled at detail
+			status, detail = fmt.Sprintf("📱 Which Kindle device should get it %s?\n\nSelect one:", detail), ""
+		}
+	case stageChoosingTime:
+		status = "⏰ When should it be sent?"
+		if detail != "" {
+			status, detail = status+"\n\n"+detail, ""
+		}
+	case stageScheduled:
+		status = "⏰ Scheduled"
+	case stageQueued:
+		status = "📥 Added to your reading queue"
+	case stageSending:
+		status = "📧 Sending..."
+	case stageDelivered:
+		status = "✅ Delivered"
+	case stageFailed:
+		status = "❌ Failed"
+	}
+	if detail != "" {
+		status = fmt.Sprintf("%s: %s", status, detail)
+	}
+	return fmt.Sprintf("📖 %s\n%s\n⏱ %s", fileName, status, elapsed.Round(time.Second))
+}
+
+// parseConvertProgress extracts the percentage from an ebook-convert output
+// line such as "34% Running transforms on e-book..."
+func parseConvertProgress(line string) (int, bool) {
+	matches := convertProgressRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		return 0, false
+	}
+	percent, err := strconv.Atoi(matches[1])
+	if err != nil || percent > 100 {
+		return 0, false
+	}
+	return percent, true
+}
@@ -0,0 +1,144 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseConvertProgress(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantPercent int
+		wantOK      bool
+	}{
+		{
+			name:        "progress line",
+			line:        "34% Running transforms on e-book...",
+			wantPercent: 34,
+			wantOK:      true,
+		},
+		{
+			name:        "first progress line",
+			line:        "1% Converting input to HTML...",
+			wantPercent: 1,
+			wantOK:      true,
+		},
+		{
+			name:        "completed",
+			line:        "100% Creating EPUB Output...",
+			wantPercent: 100,
+			wantOK:      true,
+		},
+		{
+			name:   "plugin output",
+			line:   "InputFormatPlugin: FB2 Input running",
+			wantOK: false,
+		},
+		{
+			name:   "percent in the middle of the line",
+			line:   "Compressed images by 12% to save space",
+			wantOK: false,
+		},
+		{
+			name:   "percent out of range",
+			line:   "250% nonsense",
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseConvertProgress(tt.line)
+			if ok != tt.wantOK {
+				t.Errorf("parseConvertProgress() ok = %v, want %v", ok, tt.wantOK)
+				return
+			}
+			if ok && got != tt.wantPercent {
+				t.Errorf("parseConvertProgress() got = %v, want %v", got, tt.wantPercent)
+			}
+		})
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	tests := []struct {
+		name    string
+		stage   jobStage
+		percent int
+		elapsed time.Duration
+		detail  string
+		want    string
+	}{
+		{
+			name:    "downloading",
+			stage:   stageDownloading,
+			percent: -1,
+			elapsed: 1200 * time.Millisecond,
+			want:    "📖 book.fb2\n⬇️ Downloading...\n⏱ 1s",
+		},
+		{
+			name:    "converting without percentage",
+			stage:   stageConverting,
+			percent: -1,
+			elapsed: 3 * time.Second,
+			want:    "📖 book.fb2\n🔄 Converting to EPUB...\n⏱ 3s",
+		},
+		{
+			name:    "converting with percentage",
+			stage:   stageConverting,
+			percent: 42,
+			elapsed: 65 * time.Second,
+			want:    "📖 book.fb2\n🔄 Converting to EPUB... 42%\n⏱ 1m5s",
+		},
+		{
+			name:    "delivered with detail",
+			stage:   stageDelivered,
+			percent: -1,
+			elapsed: 10 * time.Second,
+			detail:  "sent to Paperwhite",
+			want:    "📖 book.fb2\n✅ Delivered: sent to Paperwhite\n⏱ 10s",
+		},
+		{
+			name:    "choosing a device for a scheduled delivery",
+			stage:   stageChoosingDevice,
+			percent: -1,
+			elapsed: 4 * time.Second,
+			detail:  "tomorrow at 07:00",
+			want:    "📖 book.fb2\n📱 Which Kindle device should get it tomorrow at 07:00?\n\nSelect one:\n⏱ 4s",
+		},
+		{
+			name:    "scheduled",
+			stage:   stageScheduled,
+			percent: -1,
+			elapsed: 6 * time.Second,
+			detail:  "to Paperwhite tomorrow at 07:00",
+			want:    "📖 book.fb2\n⏰ Scheduled: to Paperwhite tomorrow at 07:00\n⏱ 6s",
+		},
+		{
+			name:    "queued",
+			stage:   stageQueued,
+			percent: -1,
+			elapsed: 3 * time.Second,
+			detail:  "2 item(s), /sendqueue sends them as one book",
+			want:    "📖 book.fb2\n📥 Added to your reading queue: 2 item(s), /sendqueue sends them as one book\n⏱ 3s",
+		},
+		{
+			name:    "failed with reason",
+			stage:   stageFailed,
+			percent: -1,
+			elapsed: 2 * time.Second,
+			detail:  "could not convert file",
+			want:    "📖 book.fb2\n❌ Failed: could not convert file\n⏱ 2s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatProgress(tt.stage, "book.fb2", tt.percent, tt.elapsed, tt.detail)
+			if got != tt.want {
+				t.Errorf("formatProgress() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
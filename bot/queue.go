@@ -0,0 +1,741 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	queueFileName = ".bot-queue.json"
+	// queueDir keeps the content of queued items inside tmpFilesPath, one
+	// XHTML file per item, out of the janitor's reach
+	queueDir            = "queue"
+	queueCallbackPrefix = "readq:"
+	queueAddCallback    = queueCallbackPrefix + "add"
+	queueFileCallback   = queueCallbackPrefix + "file"
+	queueSendCallback   = queueCallbackPrefix + "send:"
+	queueRemoveCallback = queueCallbackPrefix + "remove:"
+	queueClearCallback  = queueCallbackPrefix + "clear"
+	// maxQueueItems caps the reading queue of a user
+	maxQueueItems = 50
+	// maxQueueDocumentSize is the largest document that can be queued,
+	// larger ones are books of their own
+	maxQueueDocumentSize = 5 << 20
+	// maxLinkCaption is how much text may come with a link for a message to
+	// be queued as the linked page rather than as text
+	maxLinkCaption = 200
+	// maxQueueTitle is the length of titles made from the first line of a text
+	maxQueueTitle = 60
+
+	queueKindLink     = "link"
+	queueKindText     = "text"
+	queueKindDocument = "document"
+)
+
+var (
+	// ErrQueueFull - represents a reading queue with maxQueueItems items
+	ErrQueueFull = errors.New("reading queue is full")
+	// ErrQueueEmpty - represents sending a reading queue without items
+	ErrQueueEmpty = errors.New("reading queue is empty")
+	// ErrNotQueueable - represents a document that cannot be a chapter of the reading queue
+	ErrNotQueueable = errors.New("only EPUB, HTML and text documents can be queued")
+	// ErrNoText - represents a page or document without readable text
+	ErrNoText = errors.New("no text found")
+
+	linkRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+)
+
+// queueItem is a link, text or document in the reading queue of a user.
+// Its content is stored as an XHTML fragment next to the queue
+type queueItem struct {
+	ID     string    `json:"id"`
+	Kind   string    `json:"kind"`
+	Title  string    `json:"title"`
+	Source string    `json:"source,omitempty"` // URL of a link, file name of a document
+	Added  time.Time `json:"added"`
+}
+
+// queueStore keeps the reading queues of all users across restarts. All
+// methods do nothing on a nil store
+type queueStore struct {
+	mu      sync.Mutex
+	path    string
+	dir     string
+	queues  map[int][]queueItem
+	sending map[int]bool // users whose queue is being sent
+}
+
+// loadQueueStore reads the queues from path, their content lives in dir. A
+// missing file is an empty store, an unreadable one is reported but still
+// returns an empty store
+func loadQueueStore(path, dir string) (*queueStore, error) {
+	s := &queueStore{path: path, dir: dir, queues: make(map[int][]queueItem), sending: make(map[int]bool)}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var queues map[int][]queueItem
+	if err := json.Unmarshal(content, &queues); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if queues != nil {
+		s.queues = queues
+	}
+	return s, nil
+}
+
+func (s *queueStore) contentPath(item queueItem) string {
+	return filepath.Join(s.dir, item.ID+".xhtml")
+}
+
+// add appends an item with its XHTML content to the queue of a user and
+// returns the length of the queue
+func (s *queueStore) add(userID int, item queueItem, body string) (int, error) {
+	if s == nil {
+		return 0, ErrQueueFull
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queues[userID]) >= maxQueueItems {
+		return len(s.queues[userID]), ErrQueueFull
+	}
+	if item.ID == "" {
+		item.ID = newJobID()
+	}
+	if err := ensureDirectory(s.dir); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(s.contentPath(item), []byte(body), 0600); err != nil {
+		return 0, err
+	}
+	s.queues[userID] = append(s.queues[userID], item)
+	s.saveLocked()
+	return len(s.queues[userID]), nil
+}
+
+// list returns the queue of a user, oldest first
+func (s *queueStore) list(userID int) []queueItem {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]queueItem(nil), s.queues[userID]...)
+}
+
+// content returns the XHTML of an item
+func (s *queueStore) content(item queueItem) (string, error) {
+	content, err := ioutil.ReadFile(s.contentPath(item))
+	return string(content), err
+}
+
+// remove deletes items of a user with their content, all of them without
+// ids, and returns the removed items
+func (s *queueStore) remove(userID int, ids ...string) []queueItem {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var kept, removed []queueItem
+	for _, item := range s.queues[userID] {
+		if len(ids) > 0 && !wanted[item.ID] {
+			kept = append(kept, item)
+			continue
+		}
+		removed = append(removed, item)
+		if err := os.Remove(s.contentPath(item)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.Warn("Could not delete queued item", "path", s.contentPath(item), "err", err)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if len(kept) == 0 {
+		delete(s.queues, userID)
+	} else {
+		s.queues[userID] = kept
+	}
+	s.saveLocked()
+	return removed
+}
+
+// begin marks the queue of a user as being sent, false when it already is
+func (s *queueStore) begin(userID int) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sending[userID] {
+		return false
+	}
+	s.sending[userID] = true
+	return true
+}
+
+func (s *queueStore) end(userID int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sending, userID)
+}
+
+func (s *queueStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save reading queues", "path", s.path, "err", err)
+	}
+}
+
+func (s *queueStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.queues, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// queueLink returns the page a message shares: its only http(s) link when
+// little text comes with it, otherwise nothing and the message is queued
+// as text
+func queueLink(text string) string {
+	links := linkRe.FindAllString(text, -1)
+	if len(links) != 1 || utf8.RuneCountInString(strings.TrimSpace(strings.Replace(text, links[0], "", 1))) > maxLinkCaption {
+		return ""
+	}
+	return strings.TrimRight(links[0], `.,;:!?)]'»`)
+}
+
+// queueTitle returns the first line of a text, shortened to maxQueueTitle
+func queueTitle(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line == "" {
+			continue
+		}
+		if runes := []rune(line); len(runes) > maxQueueTitle {
+			return strings.TrimSpace(string(runes[:maxQueueTitle-1])) + "…"
+		}
+		return line
+	}
+	return "Untitled"
+}
+
+// queueMessage turns a text message into a queue item: the article of the
+// page it links to, or the text itself
+func queueMessage(ctx context.Context, text string, now time.Time) (queueItem, string, error) {
+	link := queueLink(text)
+	if link == "" {
+		return queueItem{Kind: queueKindText, Title: queueTitle(text), Added: now}, textToXHTML(text), nil
+	}
+	page, u, err := fetchPage(ctx, link)
+	if err != nil {
+		return queueItem{}, "", err
+	}
+	title, body := extractArticle(page, u)
+	if strings.TrimSpace(parseHTML([]byte(body)).textContent()) == "" {
+		return queueItem{}, "", fmt.Errorf("%w at %s", ErrNoText, u)
+	}
+	return queueItem{Kind: queueKindLink, Title: firstText(title, u.Host), Source: u.String(), Added: now}, body, nil
+}
+
+// documentContent returns the title and the text of a small document as an
+// XHTML fragment: an EPUB, HTML page or plain text file
+func documentContent(filePath string) (title, body string, err error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	if info.Size() > maxQueueDocumentSize {
+		return "", "", fmt.Errorf("document is larger than %s", formatFileSize(maxQueueDocumentSize))
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".epub":
+		title, body, err = epubContent(filePath)
+	case ".html", ".htm", ".xhtml":
+		var content []byte
+		if content, err = ioutil.ReadFile(filePath); err == nil {
+			title, body = extractArticle(content, nil)
+		}
+	case ".txt":
+		var content []byte
+		if content, err = ioutil.ReadFile(filePath); err == nil {
+			body = textToXHTML(strings.ToValidUTF8(string(content), "�"))
+		}
+	default:
+		return "", "", ErrNotQueueable
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if strings.TrimSpace(parseHTML([]byte(body)).textContent()) == "" {
+		return "", "", ErrNoText
+	}
+	return title, body, nil
+}
+
+// epubContainer is META-INF/container.xml of an EPUB
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// epubPackage is the part of the OPF file of an EPUB needed to read its
+// text in reading order
+type epubPackage struct {
+	Titles   []string `xml:"metadata>title"`
+	Manifest []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// epubContent returns the title of an EPUB and the text of its documents
+// in reading order. Images, styles and links between its documents are
+// left out
+func epubContent(filePath string) (title, body string, err error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer archive.Close()
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, maxFeedSize)
+	}
+
+	content, err := read("META-INF/container.xml")
+	if err != nil {
+		return "", "", err
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(content, &container); err != nil || len(container.Rootfiles) == 0 {
+		return "", "", fmt.Errorf("invalid EPUB container: %v", err)
+	}
+	opf := container.Rootfiles[0].FullPath
+	if content, err = read(opf); err != nil {
+		return "", "", err
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(content, &pkg); err != nil {
+		return "", "", fmt.Errorf("invalid EPUB package: %w", err)
+	}
+	hrefs := make(map[string]string, len(pkg.Manifest))
+	for _, item := range pkg.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+
+	var out strings.Builder
+	for _, ref := range pkg.Spine {
+		href, err := url.PathUnescape(hrefs[ref.IDRef])
+		if err != nil || href == "" {
+			continue
+		}
+		document, err := read(path.Join(path.Dir(opf), href))
+		if err != nil {
+			return "", "", err
+		}
+		root := parseHTML(document)
+		if bodies := root.find("body"); len(bodies) > 0 {
+			root = bodies[0]
+		}
+		if text := renderXHTML(root, nil); text != "" {
+			out.WriteString(text + "\n")
+		}
+	}
+	if len(pkg.Titles) > 0 {
+		title = strings.TrimSpace(pkg.Titles[0])
+	}
+	return title, strings.TrimSpace(out.String()), nil
+}
+
+// queueBook bundles queued items into a book that starts with a table of
+// contents, one chapter per item
+func queueBook(items []queueItem, bodies []string, now time.Time) epubBook {
+	book := epubBook{
+		Title:    "Reading Queue " + now.Format("2006-01-02"),
+		Modified: now,
+	}
+	var contents strings.Builder
+	contents.WriteString("<h1>" + html.EscapeString(book.Title) + "</h1>\n<ol>\n")
+	for i, item := range items {
+		// The contents page is the first chapter
+		contents.WriteString(`<li><a href="` + epubChapterHref(i+1) + `">` + html.EscapeString(item.Title) + "</a></li>\n")
+	}
+	contents.WriteString("</ol>\n")
+	book.Chapters = append(book.Chapters, epubChapter{Title: "Contents", Body: contents.String()})
+
+	for i, item := range items {
+		var byline []string
+		switch item.Kind {
+		case queueKindLink:
+			source := item.Source
+			if u, err := url.Parse(item.Source); err == nil && u.Host != "" {
+				source = u.Host
+			}
+			byline = append(byline, `<a href="`+html.EscapeString(item.Source)+`">`+html.EscapeString(source)+"</a>")
+		case queueKindDocument:
+			byline = append(byline, html.EscapeString(item.Source))
+		}
+		byline = append(byline, "added "+item.Added.Format("2 Jan 2006"))
+		book.Chapters = append(book.Chapters, epubChapter{
+			Title: item.Title,
+			Body: "<h1>" + html.EscapeString(item.Title) + "</h1>\n" +
+				`<p class="small">` + strings.Join(byline, " · ") + "</p>\n" + bodies[i],
+		})
+	}
+	return book
+}
+
+// sendQueue delivers the reading queue of a user as one EPUB and empties
+// it. Items added while it is sent stay in the queue
+func (b *SendToKindleBot) sendQueue(ctx context.Context, job *activeJob, userID int, device string, now time.Time) (int, error) {
+	logger := logging.FromContext(ctx)
+	queued := b.queue.list(userID)
+	if len(queued) == 0 {
+		return 0, ErrQueueEmpty
+	}
+	settings := b.current()
+	deliverer, err := b.deliverer(settings, device)
+	if err != nil {
+		return 0, err
+	}
+
+	var items []queueItem
+	var bodies []string
+	for _, item := range queued {
+		body, err := b.queue.content(item)
+		if err != nil {
+			logger.Warn("Could not read queued item, skipping it", "item", item.ID, "err", err)
+			continue
+		}
+		items = append(items, item)
+		bodies = append(bodies, body)
+	}
+	if len(items) == 0 {
+		return 0, ErrQueueEmpty
+	}
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		return 0, err
+	}
+	book := queueBook(items, bodies, now)
+	bookPath := filepath.Join(b.tmpFilesPath, "queue-"+newJobID()+".epub")
+	b.jobs.addFile(job, bookPath)
+	defer os.Remove(bookPath)
+	if err := writeEPUB(bookPath, book); err != nil {
+		return 0, err
+	}
+	fileName := book.Title + ".epub"
+	if err := deliverer.Deliver(ctx, bookPath, fileName); err != nil {
+		b.users.recordDelivery(userID, device, false)
+		return 0, err
+	}
+	b.metrics.delivered(device)
+	b.users.recordDelivery(userID, device, true)
+	ids := make([]string, len(queued))
+	for i, item := range queued {
+		ids[i] = item.ID
+	}
+	b.queue.remove(userID, ids...)
+	b.archiveBook(ctx, settings, userID, fileName, bookPath)
+	return len(items), nil
+}
+
+// runQueue sends the reading queue of a user and reports the outcome
+func (b *SendToKindleBot) runQueue(bot *tb.Bot, userID int, device, jobID string) {
+	user := &tb.User{ID: userID}
+	if !b.queue.begin(userID) {
+		bot.Send(user, "📥 Your reading queue is already being sent.")
+		return
+	}
+	defer b.queue.end(userID)
+	job, err := b.jobs.begin(jobRecord{ID: jobID, Kind: jobKindQueue, UserID: userID, FileName: "reading queue",
+		DeviceName: device})
+	if err != nil {
+		bot.Send(user, "⏳ The bot is restarting. Please try /sendqueue again in a minute.")
+		return
+	}
+	defer b.jobs.end(job)
+	logger := logging.Default().With("job", jobID, "user", userID, "device", device)
+	ctx := logging.NewContext(job.ctx, logger)
+
+	sent, err := b.sendQueue(ctx, job, userID, device, time.Now())
+	switch {
+	case errors.Is(err, ErrQueueEmpty):
+		bot.Send(user, queueEmptyText)
+	case err != nil:
+		logger.Error("Could not send reading queue", "err", err)
+		bot.Send(user, "❌ Could not send your reading queue, it is kept. Please try /sendqueue again.")
+	default:
+		logger.Info("Sent reading queue", "items", sent)
+		bot.Send(user, fmt.Sprintf("📥 Reading queue with %d item(s) %s.", sent, b.current().deliveredText(device)))
+	}
+}
+
+const queueEmptyText = "📥 Your reading queue is empty. Send a link or a text and tap 📥 Add to queue, " +
+	"or pick 📥 Add to queue for a small document."
+
+// textHandler offers to add a link or a text sent to the bot to the
+// reading queue
+func (b *SendToKindleBot) textHandler(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		// Unknown commands end up here too
+		if strings.HasPrefix(m.Text, "/") || strings.TrimSpace(m.Text) == "" {
+			return
+		}
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		text := "📝 Add this text to your reading queue?"
+		if queueLink(m.Text) != "" {
+			text = "🔗 Add this page to your reading queue?"
+		}
+		markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{{Text: "📥 Add to queue", Data: queueAddCallback}}}}
+		if _, err := bot.Reply(m, text+" /sendqueue sends the whole queue as one book.", markup); err != nil {
+			logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
+		}
+	}
+}
+
+// sendQueueCommand handles "/sendqueue [device|list|clear]"
+func (b *SendToKindleBot) sendQueueCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		arg := strings.TrimSpace(m.Payload)
+		switch strings.ToLower(arg) {
+		case "list":
+			text, markup := b.queueListText(m.Sender.ID)
+			bot.Send(m.Sender, text, markup)
+			return
+		case "clear":
+			removed := b.queue.remove(m.Sender.ID)
+			logging.Info("Cleared reading queue", "user", m.Sender.ID, "items", len(removed))
+			respond(bot, m, fmt.Sprintf("📥 Removed %d item(s) from your reading queue.", len(removed)))
+			return
+		}
+		items := b.queue.list(m.Sender.ID)
+		if len(items) == 0 {
+			respond(bot, m, queueEmptyText)
+			return
+		}
+		device, err := b.current().resolveDevice(arg)
+		if errors.Is(err, ErrDeviceRequired) {
+			bot.Send(m.Sender, fmt.Sprintf("📥 Which device should get your reading queue (%d item(s))?", len(items)),
+				b.queueDeviceKeyboard())
+			return
+		}
+		if err != nil {
+			respond(bot, m, fmt.Sprintf("❌ Unknown device %q, the devices are: %s.", arg,
+				strings.Join(b.current().deviceNames(), ", ")))
+			return
+		}
+		respond(bot, m, fmt.Sprintf("📥 Sending your reading queue (%d item(s))...", len(items)))
+		go b.runQueue(bot, m.Sender.ID, device, newJobID())
+	}
+}
+
+// queueListText lists the reading queue of a user with buttons to remove
+// items
+func (b *SendToKindleBot) queueListText(userID int) (string, *tb.ReplyMarkup) {
+	items := b.queue.list(userID)
+	if len(items) == 0 {
+		return queueEmptyText, &tb.ReplyMarkup{}
+	}
+	var text strings.Builder
+	var rows [][]tb.InlineButton
+	text.WriteString("📥 Your reading queue:\n")
+	for i, item := range items {
+		fmt.Fprintf(&text, "%d. %s", i+1, item.Title)
+		if item.Kind == queueKindLink {
+			if u, err := url.Parse(item.Source); err == nil {
+				fmt.Fprintf(&text, " (%s)", u.Host)
+			}
+		}
+		text.WriteString("\n")
+		if i%buttonsPerRow == 0 {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1],
+			tb.InlineButton{Text: fmt.Sprintf("✖️ %d", i+1), Data: queueRemoveCallback + item.ID})
+	}
+	text.WriteString("\n/sendqueue sends them as one book.")
+	rows = append(rows, []tb.InlineButton{{Text: "🗑 Clear", Data: queueClearCallback}})
+	return text.String(), &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// queueDeviceKeyboard offers the configured devices for the reading queue
+func (b *SendToKindleBot) queueDeviceKeyboard() *tb.ReplyMarkup {
+	var rows [][]tb.InlineButton
+	for i, name := range b.current().deviceNames() {
+		if i%buttonsPerRow == 0 {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], tb.InlineButton{Text: name, Data: queueSendCallback + name})
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// queueCallback handles the "📥 Add to queue" buttons, the device buttons
+// of /sendqueue and the buttons of /sendqueue list
+func (b *SendToKindleBot) queueCallback(bot *tb.Bot, c *tb.Callback) {
+	bot.Respond(c, &tb.CallbackResponse{})
+	switch {
+	case c.Data == queueAddCallback:
+		b.queueText(bot, c)
+	case c.Data == queueFileCallback:
+		b.queueDocument(bot, c)
+	case strings.HasPrefix(c.Data, queueSendCallback):
+		device := strings.TrimPrefix(c.Data, queueSendCallback)
+		if _, ok := b.current().devices[device]; !ok {
+			bot.Send(c.Sender, "❌ Device not found")
+			return
+		}
+		if c.Message != nil {
+			bot.Edit(c.Message, fmt.Sprintf("📥 Sending your reading queue to %s...", device))
+		}
+		b.runQueue(bot, c.Sender.ID, device, newJobID())
+	case strings.HasPrefix(c.Data, queueRemoveCallback), c.Data == queueClearCallback:
+		var removed []queueItem
+		if c.Data == queueClearCallback {
+			removed = b.queue.remove(c.Sender.ID)
+		} else {
+			removed = b.queue.remove(c.Sender.ID, strings.TrimPrefix(c.Data, queueRemoveCallback))
+		}
+		logging.Info("Removed from reading queue", "user", c.Sender.ID, "items", len(removed))
+		text, markup := b.queueListText(c.Sender.ID)
+		if c.Message == nil {
+			bot.Send(c.Sender, text, markup)
+			return
+		}
+		if _, err := bot.Edit(c.Message, text, markup); err != nil && err != tb.ErrMessageNotModified {
+			logging.Warn("Could not update reading queue", "err", err)
+		}
+	default:
+		logging.Debug("Invalid queue callback", "user", c.Sender.ID, "data", c.Data)
+	}
+}
+
+// queueText adds the message a "📥 Add to queue" prompt replies to
+func (b *SendToKindleBot) queueText(bot *tb.Bot, c *tb.Callback) {
+	if c.Message == nil || c.Message.ReplyTo == nil || c.Message.ReplyTo.Text == "" {
+		bot.Send(c.Sender, "❌ Message not found. Please send it again.")
+		return
+	}
+	logger := logging.Default().With("user", c.Sender.ID)
+	bot.Edit(c.Message, "⏳ Adding to your reading queue...")
+	item, body, err := queueMessage(logging.NewContext(context.Background(), logger), c.Message.ReplyTo.Text, time.Now())
+	if err != nil {
+		logger.Info("Could not queue link", "err", err)
+		bot.Edit(c.Message, fmt.Sprintf("❌ Could not read the page: %v", err))
+		return
+	}
+	b.finishQueueing(bot, c, item, body, nil)
+}
+
+// queueDocument adds the file waiting for a device to the reading queue
+func (b *SendToKindleBot) queueDocument(bot *tb.Bot, c *tb.Callback) {
+	b.cacheMutex.RLock()
+	fileInfo, exists := b.fileStateCache[c.Sender.ID]
+	var fileName, filePath string
+	var startedAt time.Time
+	if exists {
+		fileName, filePath, startedAt = fileInfo["originalFileName"], fileInfo["filePath"], pendingSince(fileInfo)
+	}
+	b.cacheMutex.RUnlock()
+	if !exists {
+		bot.Send(c.Sender, "❌ File not found. Please send it again.")
+		return
+	}
+	progress := resumeProgressMessage(bot, c.Message, fileName, startedAt)
+	title, body, err := documentContent(filePath)
+	if err != nil {
+		logging.Info("Could not queue document", "user", c.Sender.ID, "file", fileName, "err", err)
+		progress.failedWithKeyboard(fmt.Sprintf("cannot be queued: %v, send it on its own", err), b.devicesOnlyKeyboard())
+		return
+	}
+	if title == "" {
+		title = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+	item := queueItem{Kind: queueKindDocument, Title: title, Source: fileName, Added: time.Now()}
+	b.finishQueueing(bot, c, item, body, progress)
+}
+
+// finishQueueing stores an item and reports it in the message of the
+// button, the status message of a document when progress is set
+func (b *SendToKindleBot) finishQueueing(bot *tb.Bot, c *tb.Callback, item queueItem, body string, progress *progressMessage) {
+	count, err := b.queue.add(c.Sender.ID, item, body)
+	if err != nil {
+		logging.Warn("Could not add to reading queue", "user", c.Sender.ID, "err", err)
+		text := fmt.Sprintf("could not add to the reading queue: %v", err)
+		if errors.Is(err, ErrQueueFull) {
+			text = fmt.Sprintf("your reading queue has %d items, send it with /sendqueue first", count)
+		}
+		if progress != nil {
+			progress.failedWithKeyboard(text, b.devicesOnlyKeyboard())
+		} else {
+			bot.Edit(c.Message, "❌ Could not add it: "+text+".")
+		}
+		return
+	}
+	logging.Info("Added to reading queue", "user", c.Sender.ID, "kind", item.Kind, "items", count)
+	detail := fmt.Sprintf("%d item(s), /sendqueue sends them as one book", count)
+	if progress != nil {
+		b.cleanupFiles(c.Sender.ID)
+		progress.queued(detail)
+		return
+	}
+	bot.Edit(c.Message, fmt.Sprintf("📥 Added '%s' to your reading queue: %s.", item.Title, detail))
+}
@@ -0,0 +1,262 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueLink(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"bare link", "https://example.com/post", "https://example.com/post"},
+		{"link with a title", "A good read\nhttps://example.com/post?id=1.", "https://example.com/post?id=1"},
+		{"link in parentheses", "(see https://example.com/post)", "https://example.com/post"},
+		{"text without a link", "Remember to buy milk", ""},
+		{"two links", "https://a.test and https://b.test", ""},
+		{"long text with a link", strings.Repeat("word ", 50) + "https://example.com", ""},
+		{"not http", "ftp://example.com/file", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queueLink(tt.text); got != tt.want {
+				t.Errorf("queueLink(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueTitle(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"\n\n  Shopping   list \nmilk", "Shopping list"},
+		{strings.Repeat("a", 80), strings.Repeat("a", 59) + "…"},
+		{"  \n ", "Untitled"},
+	}
+	for _, tt := range tests {
+		if got := queueTitle(tt.text); got != tt.want {
+			t.Errorf("queueTitle(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestQueueMessage(t *testing.T) {
+	server := newFeedServer(t)
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	item, body, err := queueMessage(context.Background(), "Worth reading: "+server.URL+"/posts/short.html", now)
+	if err != nil {
+		t.Fatalf("queueMessage(link) error = %v", err)
+	}
+	if item.Kind != queueKindLink || item.Title != "Short & sweet" || item.Source != server.URL+"/posts/short.html" {
+		t.Errorf("queueMessage(link) = %+v", item)
+	}
+	if !strings.Contains(body, "This is the full text of the short post") {
+		t.Errorf("queueMessage(link) body = %s", body)
+	}
+
+	item, body, err = queueMessage(context.Background(), "Notes\n\nFirst & second", now)
+	if err != nil || item.Kind != queueKindText || item.Title != "Notes" || body != "<p>Notes</p>\n<p>First &amp; second</p>" {
+		t.Errorf("queueMessage(text) = %+v, %q, %v", item, body, err)
+	}
+
+	if _, _, err := queueMessage(context.Background(), server.URL+"/missing", now); err == nil {
+		t.Error("queueMessage(missing page) error = nil")
+	}
+}
+
+func TestDocumentContent(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	epub := filepath.Join(dir, "book.epub")
+	if err := writeEPUB(epub, epubBook{Title: "Small Book", Chapters: []epubChapter{
+		{Title: "One", Body: "<h1>One</h1><p>First chapter.</p>"},
+		{Title: "Two", Body: `<p>Second <a href="chapter-0.xhtml">chapter</a>.</p><img src="cover.jpg"/>`},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		wantTitle string
+		wantBody  string
+		wantErr   error
+	}{
+		{
+			name:      "epub",
+			path:      epub,
+			wantTitle: "Small Book",
+			wantBody:  "<h2>One</h2>\n<p>First chapter.</p>\n<p>Second <a>chapter</a>.</p>",
+		},
+		{
+			name:     "text",
+			path:     write("notes.txt", "Line one\n\nLine two"),
+			wantBody: "<p>Line one</p>\n<p>Line two</p>",
+		},
+		{
+			name:      "html",
+			path:      write("page.html", "<html><head><title>Page</title></head><body><p>Hello</p></body></html>"),
+			wantTitle: "Page",
+			wantBody:  "<p>Hello</p>",
+		},
+		{name: "unsupported", path: write("book.pdf", "%PDF-1.4"), wantErr: ErrNotQueueable},
+		{name: "empty", path: write("empty.txt", "  \n"), wantErr: ErrNoText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			title, body, err := documentContent(tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("documentContent() error = %v, want %v", err, tt.wantErr)
+			}
+			if title != tt.wantTitle || body != tt.wantBody {
+				t.Errorf("documentContent() = %q, %q, want %q, %q", title, body, tt.wantTitle, tt.wantBody)
+			}
+		})
+	}
+
+	large := filepath.Join(dir, "large.txt")
+	if err := ioutil.WriteFile(large, make([]byte, maxQueueDocumentSize+1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := documentContent(large); err == nil {
+		t.Error("documentContent(large) error = nil")
+	}
+}
+
+func TestQueueStore(t *testing.T) {
+	tmp := t.TempDir()
+	path, dir := filepath.Join(tmp, queueFileName), filepath.Join(tmp, queueDir)
+	s, err := loadQueueStore(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	for i, title := range []string{"First", "Second", "Third"} {
+		count, err := s.add(1, queueItem{ID: title, Kind: queueKindText, Title: title, Added: now}, "<p>"+title+"</p>")
+		if err != nil || count != i+1 {
+			t.Fatalf("add(%s) = %d, %v", title, count, err)
+		}
+	}
+
+	// Everything survives a restart
+	s, err = loadQueueStore(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := s.list(1)
+	if len(items) != 3 || items[0].Title != "First" || items[2].Title != "Third" {
+		t.Fatalf("list() after reload = %+v", items)
+	}
+	if body, err := s.content(items[1]); err != nil || body != "<p>Second</p>" {
+		t.Errorf("content() = %q, %v", body, err)
+	}
+	if removed := s.remove(2, "First"); removed != nil {
+		t.Errorf("remove() of another user = %+v", removed)
+	}
+	if removed := s.remove(1, "Second"); len(removed) != 1 || removed[0].Title != "Second" {
+		t.Errorf("remove(Second) = %+v", removed)
+	}
+	if _, err := os.Stat(s.contentPath(items[1])); !os.IsNotExist(err) {
+		t.Errorf("content of a removed item was kept: %v", err)
+	}
+	if removed := s.remove(1); len(removed) != 2 || len(s.list(1)) != 0 {
+		t.Errorf("remove(all) = %+v, left %+v", removed, s.list(1))
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("queue directory has %d files after clearing", len(entries))
+	}
+
+	for i := 0; i < maxQueueItems; i++ {
+		s.add(3, queueItem{Title: "x", Added: now}, "<p>x</p>")
+	}
+	if _, err := s.add(3, queueItem{Title: "x", Added: now}, "<p>x</p>"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("add() to a full queue error = %v, want ErrQueueFull", err)
+	}
+
+	if !s.begin(1) || s.begin(1) {
+		t.Error("begin() did not prevent sending a queue twice")
+	}
+	s.end(1)
+	if !s.begin(1) {
+		t.Error("begin() after end() = false")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	kobo := t.TempDir()
+	tmp := t.TempDir()
+	queue, _ := loadQueueStore(filepath.Join(tmp, queueFileName), filepath.Join(tmp, queueDir))
+	b := &SendToKindleBot{
+		DeviceTransports: map[string]TransportConfig{"Kobo": {Type: TransportDirectory, Path: kobo}},
+		tmpFilesPath:     tmp,
+		jobs:             newJobTracker(),
+		queue:            queue,
+	}
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	job, err := b.jobs.begin(jobRecord{Kind: jobKindQueue, UserID: 1, DeviceName: "Kobo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.jobs.end(job)
+
+	if _, err := b.sendQueue(context.Background(), job, 1, "Kobo", now); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("sendQueue() of an empty queue error = %v, want ErrQueueEmpty", err)
+	}
+	queue.add(1, queueItem{Kind: queueKindLink, Title: "An <article>", Source: "https://blog.test/post", Added: now},
+		"<p>Article text.</p>")
+	queue.add(1, queueItem{Kind: queueKindText, Title: "A note", Added: now}, "<p>Note text.</p>")
+
+	sent, err := b.sendQueue(context.Background(), job, 1, "Kobo", now)
+	if err != nil || sent != 2 {
+		t.Fatalf("sendQueue() = %d, %v, want 2 items", sent, err)
+	}
+	archive, err := zip.OpenReader(filepath.Join(kobo, "Reading Queue 2026-10-18.epub"))
+	if err != nil {
+		t.Fatalf("queue not delivered: %v", err)
+	}
+	defer archive.Close()
+	chapters := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		chapters[file.Name] = string(content)
+	}
+	for name, want := range map[string]string{
+		"OEBPS/chapter-0.xhtml": `<li><a href="chapter-2.xhtml">A note</a></li>`,
+		"OEBPS/chapter-1.xhtml": `<a href="https://blog.test/post">blog.test</a> · added 18 Oct 2026`,
+		"OEBPS/chapter-2.xhtml": "<p>Note text.</p>",
+		"OEBPS/nav.xhtml":       "An &lt;article&gt;",
+	} {
+		if !strings.Contains(chapters[name], want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, chapters[name])
+		}
+	}
+	if items := queue.list(1); len(items) != 0 {
+		t.Errorf("queue after sending = %+v, want empty", items)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(tmp, "*.epub")); len(entries) != 0 {
+		t.Errorf("sendQueue() left %v", entries)
+	}
+}
@@ -0,0 +1,337 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// settings is the part of the configuration that can change at runtime.
+// A snapshot is never modified: Reload swaps in a new one, so jobs keep
+// the snapshot they started with
+type settings struct {
+	emailTo          string
+	devices          map[string]string // device name -> email, or the address of its transport
+	transports       map[string]TransportConfig
+	deviceProfiles   map[string]string
+	smtp             SMTPProfile
+	smtpProfiles     map[string]SMTPProfile
+	allowedUsers     []int
+	adminUsers       []int
+	maxFileSize      int64
+	pendingTTL       time.Duration
+	converterCfgs    []ConverterConfig
+	converters       *converterRegistry
+	dryRun           dryRun
+	calibreServer    TransportConfig // every delivered book is added here when URL is set
+	vocabularyFormat string
+}
+
+// newSettings snapshots the exported fields, which must have been verified
+func (b *SendToKindleBot) newSettings() *settings {
+	s := &settings{
+		emailTo:        b.EmailTo,
+		devices:        make(map[string]string, len(b.KindleDevices)),
+		transports:     make(map[string]TransportConfig, len(b.DeviceTransports)),
+		deviceProfiles: make(map[string]string, len(b.DeviceProfiles)),
+		smtp: SMTPProfile{
+			Host:     b.SMTPHost,
+			Port:     b.SMTPPort,
+			From:     b.EmailFrom,
+			Password: b.Password,
+			Insecure: b.SMTPInsecure,
+		},
+		smtpProfiles:     make(map[string]SMTPProfile, len(b.SMTPProfiles)),
+		allowedUsers:     append([]int(nil), b.AllowedUsers...),
+		adminUsers:       append([]int(nil), b.AdminUsers...),
+		maxFileSize:      b.MaxFileSize,
+		pendingTTL:       b.PendingTTL,
+		converterCfgs:    b.Converters,
+		converters:       b.converters,
+		vocabularyFormat: b.VocabularyFormat,
+	}
+	if b.DryRunPath != "" {
+		s.dryRun = dryRun{format: b.DryRunFormat, path: b.DryRunPath}
+	}
+	if b.CalibreServer.URL != "" {
+		s.calibreServer = b.CalibreServer
+		s.calibreServer.Type = TransportCalibre
+	}
+	for name, email := range b.KindleDevices {
+		s.devices[name] = email
+	}
+	for name, transport := range b.DeviceTransports {
+		s.devices[name] = transport.address()
+		s.transports[name] = transport
+	}
+	for device, profile := range b.DeviceProfiles {
+		s.deviceProfiles[device] = profile
+	}
+	for name, profile := range b.SMTPProfiles {
+		s.smtpProfiles[name] = profile
+	}
+	return s
+}
+
+// current returns the active settings snapshot
+func (b *SendToKindleBot) current() *settings {
+	b.settingsMutex.RLock()
+	s := b.settings
+	b.settingsMutex.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	b.settingsMutex.Lock()
+	defer b.settingsMutex.Unlock()
+	if b.settings == nil {
+		b.settings = b.newSettings()
+	}
+	return b.settings
+}
+
+// smtpProfileFor returns the SMTP account used for a device
+func (s *settings) smtpProfileFor(deviceName string) SMTPProfile {
+	if name, ok := s.deviceProfiles[deviceName]; ok {
+		if profile, ok := s.smtpProfiles[name]; ok {
+			return profile
+		}
+	}
+	return s.smtp
+}
+
+// Reload verifies next and makes its devices, users, SMTP accounts, limits
+// and converters active. Running jobs finish with the settings they started
+// with. It returns a description of every change; changes to other fields
+// are reported once as requiring a restart
+func (b *SendToKindleBot) Reload(next *SendToKindleBot) ([]string, error) {
+	if err := next.verifyConfig(); err != nil {
+		return nil, err
+	}
+	s := next.newSettings()
+
+	b.settingsMutex.Lock()
+	old := b.settings
+	if old == nil {
+		old = b.newSettings()
+	}
+	b.settings = s
+	loaded := b.loaded
+	if loaded == nil {
+		loaded = b
+	}
+	restart := restartRequired(loaded, next)
+	b.loaded = next
+	b.settingsMutex.Unlock()
+
+	changes := diffSettings(old, s)
+	for _, field := range restart {
+		changes = append(changes, field+" changed, restart required")
+	}
+	return changes, nil
+}
+
+// restartRequired lists fields that only take effect after a restart and
+// changed from the previously loaded configuration prev to next
+func restartRequired(prev, next *SendToKindleBot) []string {
+	var fields []string
+	check := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	check("telegram token", prev.Token != next.Token)
+	check("telegram api server", prev.TelegramAPIURL != next.TelegramAPIURL || prev.TelegramAPILocal != next.TelegramAPILocal)
+	check("update mode", prev.UpdateMode != next.UpdateMode)
+	check("webhook", prev.WebhookURL != next.WebhookURL || prev.WebhookListen != next.WebhookListen ||
+		prev.WebhookSecret != next.WebhookSecret || prev.WebhookCert != next.WebhookCert || prev.WebhookKey != next.WebhookKey)
+	check("temporary files path", next.tmpFilesPath != "" && prev.GetTmpFilesPath() != next.GetTmpFilesPath())
+	check("shutdown timeout", prev.ShutdownTimeout != next.ShutdownTimeout)
+	check("metrics listen address", prev.MetricsListen != next.MetricsListen)
+	check("opds", prev.OPDSListen != next.OPDSListen || prev.OPDSURL != next.OPDSURL)
+	check("library", prev.LibraryPath != next.LibraryPath || prev.LibraryMaxAge != next.LibraryMaxAge)
+	check("calibre library", prev.CalibreLibrary != next.CalibreLibrary)
+	check("health checks", prev.MinFreeSpace != next.MinFreeSpace || prev.SMTPCheckInterval != next.SMTPCheckInterval)
+	return fields
+}
+
+// diffSettings describes the differences between two snapshots, e.g.
+// "devices: +Oasis -Paperwhite"
+func diffSettings(old, s *settings) []string {
+	var changes []string
+	if diff := diffKeys(old.devices, s.devices); diff != "" {
+		changes = append(changes, "devices: "+diff)
+	}
+	if !reflect.DeepEqual(old.transports, s.transports) {
+		changes = append(changes, "device transports changed")
+	}
+	if old.emailTo != s.emailTo {
+		changes = append(changes, "default kindle email changed")
+	}
+	if !reflect.DeepEqual(old.deviceProfiles, s.deviceProfiles) {
+		changes = append(changes, "device smtp profiles changed")
+	}
+	if old.smtp != s.smtp {
+		changes = append(changes, "smtp account changed")
+	}
+	if diff := diffKeys(profileKeys(old.smtpProfiles), profileKeys(s.smtpProfiles)); diff != "" {
+		changes = append(changes, "smtp profiles: "+diff)
+	}
+	if !reflect.DeepEqual(old.allowedUsers, s.allowedUsers) {
+		changes = append(changes, fmt.Sprintf("allowed users: %d -> %d", len(old.allowedUsers), len(s.allowedUsers)))
+	}
+	if !reflect.DeepEqual(old.adminUsers, s.adminUsers) {
+		changes = append(changes, fmt.Sprintf("admins: %d -> %d", len(old.adminUsers), len(s.adminUsers)))
+	}
+	if old.maxFileSize != s.maxFileSize {
+		changes = append(changes, fmt.Sprintf("max file size: %s -> %s", describeSize(old.maxFileSize), describeSize(s.maxFileSize)))
+	}
+	if old.pendingTTL != s.pendingTTL {
+		changes = append(changes, fmt.Sprintf("pending ttl: %s -> %s", old.pendingTTL, s.pendingTTL))
+	}
+	if !reflect.DeepEqual(old.converterCfgs, s.converterCfgs) {
+		changes = append(changes, "converters changed")
+	}
+	if old.dryRun != s.dryRun {
+		changes = append(changes, fmt.Sprintf("dry run: %s -> %s", old.dryRun, s.dryRun))
+	}
+	if old.calibreServer != s.calibreServer {
+		changes = append(changes, "calibre server changed")
+	}
+	if old.vocabularyFormat != s.vocabularyFormat {
+		changes = append(changes, fmt.Sprintf("vocabulary format: %s -> %s", old.vocabularyFormat, s.vocabularyFormat))
+	}
+	return changes
+}
+
+// diffKeys renders added (+), removed (-) and modified (~) keys
+func diffKeys(old, next map[string]string) string {
+	var parts []string
+	for key, value := range next {
+		previous, ok := old[key]
+		switch {
+		case !ok:
+			parts = append(parts, "+"+key)
+		case previous != value:
+			parts = append(parts, "~"+key)
+		}
+	}
+	for key := range old {
+		if _, ok := next[key]; !ok {
+			parts = append(parts, "-"+key)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i][1:] < parts[j][1:] })
+	return strings.Join(parts, " ")
+}
+
+func profileKeys(profiles map[string]SMTPProfile) map[string]string {
+	keys := make(map[string]string, len(profiles))
+	for name, profile := range profiles {
+		keys[name] = fmt.Sprintf("%+v", profile)
+	}
+	return keys
+}
+
+func describeSize(size int64) string {
+	if size <= 0 {
+		return "unlimited"
+	}
+	return formatFileSize(size)
+}
+
+// Passwords are the credentials that can be rotated while the bot is
+// running. Empty ones are left unchanged
+type Passwords struct {
+	SMTP          string
+	SMTPProfiles  map[string]string // by profile name
+	Devices       map[string]string // of WebDAV and Calibre devices, by device name
+	CalibreServer string
+}
+
+// UpdatePasswords replaces passwords in a new settings snapshot, so the
+// next delivery uses them. Passwords of unknown profiles and devices are
+// ignored
+func (b *SendToKindleBot) UpdatePasswords(p Passwords) {
+	b.current() // make sure there is a snapshot to copy
+
+	b.settingsMutex.Lock()
+	defer b.settingsMutex.Unlock()
+	s := *b.settings
+	if p.SMTP != "" && p.SMTP != s.smtp.Password {
+		s.smtp.Password = p.SMTP
+		logging.Info("SMTP password updated")
+	}
+	s.smtpProfiles = make(map[string]SMTPProfile, len(b.settings.smtpProfiles))
+	for name, profile := range b.settings.smtpProfiles {
+		if password := p.SMTPProfiles[name]; password != "" && password != profile.Password {
+			profile.Password = password
+			logging.Info("SMTP password updated", "profile", name)
+		}
+		s.smtpProfiles[name] = profile
+	}
+	s.transports = make(map[string]TransportConfig, len(b.settings.transports))
+	for name, transport := range b.settings.transports {
+		if password := p.Devices[name]; password != "" && password != transport.Password {
+			transport.Password = password
+			logging.Info("Device password updated", "device", name)
+		}
+		s.transports[name] = transport
+	}
+	if s.calibreServer.URL != "" && p.CalibreServer != "" && p.CalibreServer != s.calibreServer.Password {
+		s.calibreServer.Password = p.CalibreServer
+		logging.Info("Calibre server password updated")
+	}
+	b.settings = &s
+}
+
+// UpdateWebhookSecret registers the webhook again with a new secret token.
+// Requests with the old token are accepted until Telegram confirmed the
+// new one. It does nothing in polling mode
+func (b *SendToKindleBot) UpdateWebhookSecret(secret string) error {
+	b.settingsMutex.RLock()
+	bot := b.bot
+	b.settingsMutex.RUnlock()
+	if bot == nil {
+		return nil
+	}
+	poller, ok := bot.Poller.(*webhookPoller)
+	if !ok {
+		return nil
+	}
+	if !webhookSecretRegexp.MatchString(secret) {
+		return ErrInvalidWebhookSecret
+	}
+	if err := poller.rotateSecret(bot, secret); err != nil {
+		return fmt.Errorf("could not register webhook: %w", err)
+	}
+	b.settingsMutex.Lock()
+	b.WebhookSecret = secret
+	b.settingsMutex.Unlock()
+	logging.Info("Webhook secret updated")
+	return nil
+}
+
+// NotifyAdmins sends a message to every admin. It does nothing before Start
+func (b *SendToKindleBot) NotifyAdmins(text string) {
+	b.notifyAdmins(text)
+}
+
+// notifyAdmins sends a message with options such as a keyboard to every admin
+func (b *SendToKindleBot) notifyAdmins(text string, options ...interface{}) {
+	b.settingsMutex.RLock()
+	bot := b.bot
+	b.settingsMutex.RUnlock()
+	if bot == nil {
+		return
+	}
+	for _, id := range b.current().adminUsers {
+		if _, err := bot.Send(&tb.User{ID: id}, text, options...); err != nil {
+			logging.Warn("Could not notify admin", "user", id, "err", err)
+		}
+	}
+}
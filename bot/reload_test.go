@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func reloadTestBot() *SendToKindleBot {
+	return &SendToKindleBot{
+		Token:         "token",
+		EmailFrom:     "bot@example.com",
+		Password:      "secret",
+		SMTPHost:      "smtp.example.com",
+		KindleDevices: map[string]string{"Paperwhite": "pw@kindle.com", "Oasis": "oasis@kindle.com"},
+		AllowedUsers:  []int{1},
+	}
+}
+
+func TestReload(t *testing.T) {
+	b := reloadTestBot()
+	if err := b.verifyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	before := b.current()
+
+	next := reloadTestBot()
+	next.Token = "new-token"
+	next.KindleDevices = map[string]string{"Paperwhite": "pw2@kindle.com", "Scribe": "scribe@kindle.com"}
+	next.AllowedUsers = []int{1, 2}
+	next.PendingTTL = time.Hour
+	next.VocabularyFormat = "CSV"
+
+	changes, err := b.Reload(next)
+	if err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	want := []string{
+		"devices: -Oasis ~Paperwhite +Scribe",
+		"allowed users: 1 -> 2",
+		"pending ttl: 0s -> 1h0m0s",
+		"vocabulary format: tsv -> csv",
+		"telegram token changed, restart required",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Reload() changes = %q, want %q", changes, want)
+	}
+	if !b.isAllowed(2) || b.pendingTTL() != time.Hour {
+		t.Errorf("Reload() did not apply the new settings")
+	}
+	if _, ok := before.devices["Oasis"]; !ok || len(before.allowedUsers) != 1 {
+		t.Errorf("Reload() modified the previous snapshot")
+	}
+
+	// The token still differs from the running one but was already reported
+	again := reloadTestBot()
+	again.Token = "new-token"
+	again.KindleDevices = next.KindleDevices
+	again.AllowedUsers = next.AllowedUsers
+	again.PendingTTL = next.PendingTTL
+	again.VocabularyFormat = next.VocabularyFormat
+	if changes, err := b.Reload(again); err != nil || len(changes) != 0 {
+		t.Errorf("Reload() again = %q, %v, want no changes", changes, err)
+	}
+}
+
+func TestReload_invalid(t *testing.T) {
+	b := reloadTestBot()
+	if err := b.verifyConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := reloadTestBot()
+	next.DeviceProfiles = map[string]string{"Oasis": "missing"}
+	if _, err := b.Reload(next); err == nil {
+		t.Fatalf("Reload() expected an error")
+	}
+	if len(b.current().deviceProfiles) != 0 {
+		t.Errorf("Reload() applied an invalid configuration")
+	}
+}
+
+func TestUpdatePasswords(t *testing.T) {
+	b := reloadTestBot()
+	b.SMTPProfiles = map[string]SMTPProfile{"work": {Host: "smtp.work.com", From: "a@work.com", Password: "old"}}
+	b.DeviceProfiles = map[string]string{"Oasis": "work"}
+	b.DeviceTransports = map[string]TransportConfig{"Boox": {Type: TransportWebDAV, URL: "https://dav.example.com/books/", Password: "old-dav"}}
+	if err := b.verifyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	before := b.current()
+
+	b.UpdatePasswords(Passwords{
+		SMTP:         "new",
+		SMTPProfiles: map[string]string{"work": "new-work", "unknown": "x"},
+		Devices:      map[string]string{"Boox": "new-dav", "Kobo": "x"},
+	})
+
+	s := b.current()
+	if s.smtp.Password != "new" || s.smtpProfileFor("Oasis").Password != "new-work" {
+		t.Errorf("UpdatePasswords() password = %q, work = %q", s.smtp.Password, s.smtpProfileFor("Oasis").Password)
+	}
+	if s.transports["Boox"].Password != "new-dav" {
+		t.Errorf("UpdatePasswords() WebDAV password = %q", s.transports["Boox"].Password)
+	}
+	if _, ok := s.smtpProfiles["unknown"]; ok {
+		t.Errorf("UpdatePasswords() added an unknown profile")
+	}
+	if _, ok := s.transports["Kobo"]; ok {
+		t.Errorf("UpdatePasswords() added an unknown device")
+	}
+	if before.smtp.Password != "secret" || before.smtpProfileFor("Oasis").Password != "old" || before.transports["Boox"].Password != "old-dav" {
+		t.Errorf("UpdatePasswords() modified the previous snapshot")
+	}
+}
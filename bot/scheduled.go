@@ -0,0 +1,739 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scheduledFileName = ".bot-scheduled.json"
+	// scheduledDir keeps the files of scheduled deliveries inside
+	// tmpFilesPath, one directory per delivery, out of the janitor's reach
+	scheduledDir         = "scheduled"
+	laterCallbackPrefix  = "later:"
+	laterMenuCallback    = laterCallbackPrefix + "menu"
+	laterTonightCallback = laterCallbackPrefix + "tonight"
+	laterMorningCallback = laterCallbackPrefix + "morning"
+	laterCustomCallback  = laterCallbackPrefix + "custom"
+	laterBackCallback    = laterCallbackPrefix + "back"
+	laterCancelCallback  = laterCallbackPrefix + "cancel:"
+	// laterTonightHour and laterMorningHour are the times of the
+	// "tonight" and "tomorrow morning" buttons, in the user's time zone
+	laterTonightHour = 21
+	laterMorningHour = 7
+	// maxScheduleAhead bounds how long a file is kept for a delivery
+	maxScheduleAhead = 90 * 24 * time.Hour
+	// maxScheduledAttempts is how often a failing delivery is tried,
+	// scheduledRetryDelay apart
+	maxScheduledAttempts   = 3
+	scheduledRetryDelay    = 15 * time.Minute
+	scheduledCheckInterval = 30 * time.Second
+)
+
+var (
+	// ErrInvalidSendTime - represents a delivery time that cannot be parsed
+	ErrInvalidSendTime = errors.New(`time must be like "fri 18:00", "tomorrow 7:30", "2026-10-23 18:00" or "in 2h"`)
+	// ErrSendTimePassed - represents a delivery time in the past
+	ErrSendTimePassed = errors.New("time has passed")
+	// ErrSendTimeTooFar - represents a delivery time beyond maxScheduleAhead
+	ErrSendTimeTooFar = errors.New("time is more than 90 days ahead")
+	// ErrInvalidTimeZone - represents a time zone that is neither a name like Europe/Berlin nor an offset
+	ErrInvalidTimeZone = errors.New("time zone must be a name like Europe/Berlin or an offset like +3 or UTC-05:30")
+
+	timeZoneOffsetRe = regexp.MustCompile(`^(?:utc|gmt)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+)
+
+// scheduledDelivery is a prepared file waiting for its delivery time
+type scheduledDelivery struct {
+	ID       string    `json:"id"`
+	UserID   int       `json:"user_id"`
+	FileName string    `json:"file_name"`
+	Path     string    `json:"path"`               // the file to deliver, inside its own directory
+	Original string    `json:"original,omitempty"` // the upload before conversion, for the library
+	Device   string    `json:"device"`
+	SendAt   time.Time `json:"send_at"`
+	Created  time.Time `json:"created"`
+	Attempts int       `json:"attempts,omitempty"`
+}
+
+// scheduledStore keeps scheduled deliveries across restarts. All methods
+// do nothing on a nil store
+type scheduledStore struct {
+	mu         sync.Mutex
+	path       string
+	deliveries map[string]*scheduledDelivery
+}
+
+// loadScheduledStore reads the store from path. A missing file is an empty
+// store, an unreadable one is reported but still returns an empty store
+func loadScheduledStore(path string) (*scheduledStore, error) {
+	s := &scheduledStore{path: path, deliveries: make(map[string]*scheduledDelivery)}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var deliveries map[string]*scheduledDelivery
+	if err := json.Unmarshal(content, &deliveries); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if deliveries != nil {
+		s.deliveries = deliveries
+	}
+	return s, nil
+}
+
+func (s *scheduledStore) add(d scheduledDelivery) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.ID] = &d
+	s.saveLocked()
+}
+
+// list returns the deliveries of a user, or of everyone when userID is 0,
+// soonest first
+func (s *scheduledStore) list(userID int) []scheduledDelivery {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []scheduledDelivery
+	for _, d := range s.deliveries {
+		if userID == 0 || d.UserID == userID {
+			list = append(list, *d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].SendAt.Equal(list[j].SendAt) {
+			return list[i].SendAt.Before(list[j].SendAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// due returns the deliveries whose time has come, soonest first
+func (s *scheduledStore) due(now time.Time) []scheduledDelivery {
+	var due []scheduledDelivery
+	for _, d := range s.list(0) {
+		if !d.SendAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// remove deletes a delivery of a user, any user when userID is 0
+func (s *scheduledStore) remove(userID int, id string) (scheduledDelivery, bool) {
+	if s == nil {
+		return scheduledDelivery{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok || (userID != 0 && d.UserID != userID) {
+		return scheduledDelivery{}, false
+	}
+	delete(s.deliveries, id)
+	s.saveLocked()
+	return *d, true
+}
+
+// retry counts a failed attempt and moves the delivery to at. It returns
+// the number of attempts
+func (s *scheduledStore) retry(id string, at time.Time) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return 0
+	}
+	d.Attempts++
+	d.SendAt = at
+	s.saveLocked()
+	return d.Attempts
+}
+
+func (s *scheduledStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save scheduled deliveries", "path", s.path, "err", err)
+	}
+}
+
+func (s *scheduledStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.deliveries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// parseTimeZone parses an IANA time zone name such as Europe/Berlin or a
+// UTC offset such as +3, UTC+05:30 or GMT-4, and returns its canonical name
+func parseTimeZone(zone string) (*time.Location, string, error) {
+	zone = strings.TrimSpace(zone)
+	lower := strings.ToLower(strings.Replace(zone, " ", "", -1))
+	if lower == "utc" || lower == "gmt" {
+		return time.UTC, "UTC", nil
+	}
+	if matches := timeZoneOffsetRe.FindStringSubmatch(lower); matches != nil {
+		hours, _ := strconv.Atoi(matches[2])
+		minutes := 0
+		if matches[3] != "" {
+			minutes, _ = strconv.Atoi(matches[3])
+		}
+		if hours > 14 || minutes >= 60 {
+			return nil, "", ErrInvalidTimeZone
+		}
+		name := fmt.Sprintf("UTC%s%02d:%02d", matches[1], hours, minutes)
+		offset := (hours*60 + minutes) * 60
+		if matches[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), name, nil
+	}
+	if zone == "" || strings.EqualFold(zone, "local") {
+		return nil, "", ErrInvalidTimeZone
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w, got %q", ErrInvalidTimeZone, zone)
+	}
+	return loc, loc.String(), nil
+}
+
+// userLocation returns the time zone of a user, the one of the bot unless
+// set with /timezone
+func (b *SendToKindleBot) userLocation(userID int) *time.Location {
+	if zone := b.users.timeZone(userID); zone != "" {
+		if loc, _, err := parseTimeZone(zone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// parseSendTime parses when to send a file, relative to now in the time
+// zone of the user: "tonight", "tomorrow [HH:MM]", "today HH:MM", a day
+// of the week with an optional time, "YYYY-MM-DD [HH:MM]", "HH:MM" or
+// "in 2h30m". Times default to laterMorningHour
+func parseSendTime(s string, now time.Time) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return time.Time{}, ErrInvalidSendTime
+	}
+	day := func(offset int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+offset, 0, 0, 0, 0, now.Location())
+	}
+	at := func(date time.Time, hour, minute int) time.Time {
+		return time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, now.Location())
+	}
+	clock := func(i int) (int, int, error) {
+		if len(fields) <= i {
+			return laterMorningHour, 0, nil
+		}
+		t, err := time.Parse("15:04", fields[i])
+		if err != nil {
+			return 0, 0, ErrInvalidSendTime
+		}
+		return t.Hour(), t.Minute(), nil
+	}
+
+	var t time.Time
+	switch first := fields[0]; {
+	case first == "in" && len(fields) == 2:
+		d, err := time.ParseDuration(fields[1])
+		if strings.HasSuffix(fields[1], "d") {
+			var days int
+			days, err = strconv.Atoi(strings.TrimSuffix(fields[1], "d"))
+			d = time.Duration(days) * 24 * time.Hour
+		}
+		if err != nil {
+			return time.Time{}, ErrInvalidSendTime
+		}
+		t = now.Add(d).Truncate(time.Minute)
+	case first == "tonight" && len(fields) == 1:
+		t = at(day(0), laterTonightHour, 0)
+	case first == "today" || first == "tomorrow":
+		hour, minute, err := clock(1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		offset := 0
+		if first == "tomorrow" {
+			offset = 1
+		}
+		t = at(day(offset), hour, minute)
+	case strings.Contains(first, ":") && len(fields) == 1:
+		hour, minute, err := clock(0)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t = at(day(0), hour, minute); !t.After(now) {
+			t = at(day(1), hour, minute)
+		}
+	default:
+		hour, minute, err := clock(1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if date, err := time.ParseInLocation("2006-01-02", first, now.Location()); err == nil {
+			t = at(date, hour, minute)
+			break
+		}
+		weekday, ok := parseWeekday(first)
+		if !ok {
+			return time.Time{}, ErrInvalidSendTime
+		}
+		// The next such day, today while the time is still ahead
+		offset := (int(weekday) - int(now.Weekday()) + 7) % 7
+		if t = at(day(offset), hour, minute); !t.After(now) {
+			t = at(day(offset+7), hour, minute)
+		}
+	}
+	if !t.After(now) {
+		return time.Time{}, ErrSendTimePassed
+	}
+	if t.Sub(now) > maxScheduleAhead {
+		return time.Time{}, ErrSendTimeTooFar
+	}
+	return t, nil
+}
+
+// formatSendTime renders a delivery time for the user, e.g. "tomorrow at
+// 07:00" or "on Fri 23 Oct at 18:00"
+func formatSendTime(t, now time.Time) string {
+	t = t.In(now.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch {
+	case !t.Before(today) && t.Before(today.AddDate(0, 0, 1)):
+		return "today at " + t.Format("15:04")
+	case !t.Before(today.AddDate(0, 0, 1)) && t.Before(today.AddDate(0, 0, 2)):
+		return "tomorrow at " + t.Format("15:04")
+	case t.Year() != now.Year():
+		return t.Format("on Mon 2 Jan 2006 at 15:04")
+	}
+	return t.Format("on Mon 2 Jan at 15:04")
+}
+
+// laterKeyboard offers the delivery times of the "⏰ Send later" menu
+func laterKeyboard(now time.Time) *tb.ReplyMarkup {
+	var rows [][]tb.InlineButton
+	tonight := time.Date(now.Year(), now.Month(), now.Day(), laterTonightHour, 0, 0, 0, now.Location())
+	if now.Before(tonight) {
+		rows = append(rows, []tb.InlineButton{{Text: fmt.Sprintf("🌙 Tonight, %02d:00", laterTonightHour), Data: laterTonightCallback}})
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: append(rows,
+		[]tb.InlineButton{{Text: fmt.Sprintf("🌅 Tomorrow morning, %02d:00", laterMorningHour), Data: laterMorningCallback}},
+		[]tb.InlineButton{{Text: "🗓 Other time", Data: laterCustomCallback}},
+		[]tb.InlineButton{{Text: "↩️ Back", Data: laterBackCallback}},
+	)}
+}
+
+// laterCustomText explains /later
+func laterCustomText(loc *time.Location) string {
+	return fmt.Sprintf("Send /later with the time, e.g. /later fri 18:00, /later tomorrow 7:30, "+
+		"/later 2026-10-23 18:00 or /later in 3h. Times are in %s, change it with /timezone.", loc)
+}
+
+// pendingPrompt returns the status message of the pending file of a user
+func (b *SendToKindleBot) pendingPrompt(bot *tb.Bot, userID int) (*progressMessage, bool) {
+	b.cacheMutex.RLock()
+	defer b.cacheMutex.RUnlock()
+	fileInfo, exists := b.fileStateCache[userID]
+	if !exists {
+		return nil, false
+	}
+	var prompt *tb.Message
+	messageID, err := strconv.Atoi(fileInfo["messageID"])
+	chatID, chatErr := strconv.ParseInt(fileInfo["chatID"], 10, 64)
+	if err == nil && chatErr == nil {
+		prompt = &tb.Message{ID: messageID, Chat: &tb.Chat{ID: chatID}}
+	}
+	return resumeProgressMessage(bot, prompt, fileInfo["originalFileName"], pendingSince(fileInfo)), true
+}
+
+// setSendAt stores the delivery time of the pending file of a user, zero
+// to send it right away
+func (b *SendToKindleBot) setSendAt(userID int, at time.Time) bool {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+	fileInfo, exists := b.fileStateCache[userID]
+	if !exists {
+		return false
+	}
+	if at.IsZero() {
+		delete(fileInfo, "sendAt")
+	} else {
+		fileInfo["sendAt"] = strconv.FormatInt(at.Unix(), 10)
+	}
+	return true
+}
+
+// chooseSendTime sets the delivery time of the pending file and asks for
+// the device, or schedules it for the only one
+func (b *SendToKindleBot) chooseSendTime(bot *tb.Bot, user *tb.User, progress *progressMessage, at time.Time) {
+	if !b.setSendAt(user.ID, at) {
+		bot.Send(user, "❌ File not found. Please send it again.")
+		return
+	}
+	settings := b.current()
+	if len(settings.devices) > 1 {
+		when := formatSendTime(at, time.Now().In(b.userLocation(user.ID)))
+		if progress.msg == nil {
+			bot.Send(user, fmt.Sprintf("📱 Which Kindle device should get '%s' %s?", progress.fileName, when),
+				b.devicesOnlyKeyboard())
+			return
+		}
+		progress.askDevice(when, b.devicesOnlyKeyboard())
+		return
+	}
+	device, err := settings.resolveDevice("")
+	if err != nil {
+		progress.failed("no devices configured")
+		b.cleanupFiles(user.ID)
+		return
+	}
+	b.scheduleDelivery(bot, user.ID, device, progress)
+}
+
+// scheduleDelivery moves the pending file of a user out of the pending
+// requests into the schedule
+func (b *SendToKindleBot) scheduleDelivery(bot *tb.Bot, userID int, device string, progress *progressMessage) {
+	b.cacheMutex.Lock()
+	fileInfo, exists := b.fileStateCache[userID]
+	if exists {
+		delete(b.fileStateCache, userID)
+	}
+	b.cacheMutex.Unlock()
+	if !exists {
+		progress.failed("file not found, please send it again")
+		return
+	}
+	unix, err := strconv.ParseInt(fileInfo["sendAt"], 10, 64)
+	if err != nil {
+		progress.failed("invalid delivery time, please send the file again")
+		b.removePendingFiles(fileInfo)
+		return
+	}
+
+	d := scheduledDelivery{
+		ID:       newJobID(),
+		UserID:   userID,
+		FileName: fileInfo["originalFileName"],
+		Device:   device,
+		SendAt:   time.Unix(unix, 0),
+		Created:  time.Now(),
+	}
+	logger := logging.Default().With("job", fileInfo["jobID"], "user", userID, "device", device)
+	dir := filepath.Join(b.tmpFilesPath, scheduledDir, d.ID)
+	if err := ensureDirectory(dir); err != nil {
+		logger.Error("Could not create directory", "path", dir, "err", err)
+		progress.failed("system error, could not keep the file")
+		b.removePendingFiles(fileInfo)
+		return
+	}
+	// The converted file and the upload, which may be the same file
+	for _, key := range []string{"filePath", "originalFilePath"} {
+		path := fileInfo[key]
+		if path == "" || (key == "originalFilePath" && path == fileInfo["filePath"]) {
+			continue
+		}
+		moved := filepath.Join(dir, filepath.Base(path))
+		if key == "originalFilePath" && moved == d.Path {
+			moved = filepath.Join(dir, "original-"+filepath.Base(path))
+		}
+		if err := os.Rename(path, moved); err != nil {
+			logger.Error("Could not keep file for a scheduled delivery", "path", path, "err", err)
+			progress.failed("system error, could not keep the file")
+			os.RemoveAll(dir)
+			b.removePendingFiles(fileInfo)
+			return
+		}
+		if key == "filePath" {
+			d.Path = moved
+		} else {
+			d.Original = moved
+		}
+	}
+	if fileInfo["originalFilePath"] == fileInfo["filePath"] {
+		d.Original = d.Path
+	}
+	b.scheduled.add(d)
+	logger.Info("Scheduled delivery", "id", d.ID, "file", d.FileName, "send_at", d.SendAt)
+
+	when := fmt.Sprintf("to %s %s", deviceLabel(device), formatSendTime(d.SendAt, time.Now().In(b.userLocation(userID))))
+	if progress.msg == nil {
+		bot.Send(&tb.User{ID: userID}, fmt.Sprintf("⏰ '%s' is sent %s, /scheduled to cancel.", d.FileName, when))
+		return
+	}
+	progress.scheduled(when + ", /scheduled to cancel")
+}
+
+// deviceLabel names a device in messages
+func deviceLabel(device string) string {
+	if device == defaultDeviceName {
+		return "your Kindle"
+	}
+	return device
+}
+
+// removePendingFiles deletes the files of a pending request that was taken
+// out of fileStateCache
+func (b *SendToKindleBot) removePendingFiles(fileInfo map[string]string) {
+	for _, key := range []string{"filePath", "originalFilePath"} {
+		if path := fileInfo[key]; path != "" {
+			os.Remove(path)
+		}
+	}
+}
+
+// removeScheduledFiles deletes the directory of a scheduled delivery
+func removeScheduledFiles(d scheduledDelivery) {
+	if d.Path == "" {
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(d.Path)); err != nil {
+		logging.Warn("Could not delete scheduled files", "path", filepath.Dir(d.Path), "err", err)
+	}
+}
+
+// deliverScheduled sends a scheduled file whose time has come and tells
+// the user. A failed delivery is retried scheduledRetryDelay later, up to
+// maxScheduledAttempts times
+func (b *SendToKindleBot) deliverScheduled(bot *tb.Bot, d scheduledDelivery) {
+	user := &tb.User{ID: d.UserID}
+	logger := logging.Default().With("job", d.ID, "user", d.UserID, "device", d.Device)
+	job, err := b.jobs.begin(jobRecord{ID: d.ID, Kind: jobKindScheduled, UserID: d.UserID, FileName: d.FileName,
+		DeviceName: d.Device})
+	if err != nil {
+		return
+	}
+	defer b.jobs.end(job)
+	b.jobs.addFile(job, d.Path)
+	ctx := logging.NewContext(job.ctx, logger)
+
+	settings := b.current()
+	deliverer, err := b.deliverer(settings, d.Device)
+	if err == nil {
+		err = deliverer.Deliver(ctx, d.Path, d.FileName)
+	}
+	if err != nil {
+		logger.Error("Could not send scheduled file", "file", d.FileName, "err", err)
+		b.users.recordDelivery(d.UserID, d.Device, false)
+		if attempts := b.scheduled.retry(d.ID, time.Now().Add(scheduledRetryDelay)); attempts > 0 &&
+			attempts < maxScheduledAttempts {
+			return
+		}
+		b.scheduled.remove(0, d.ID)
+		removeScheduledFiles(d)
+		bot.Send(user, fmt.Sprintf("❌ Could not send '%s' to %s as scheduled. Please send it again.", d.FileName, deviceLabel(d.Device)))
+		return
+	}
+	b.scheduled.remove(0, d.ID)
+	b.metrics.delivered(d.Device)
+	b.users.recordDelivery(d.UserID, d.Device, true)
+	logger.Info("Sent scheduled file", "file", d.FileName)
+	b.archiveBook(ctx, settings, d.UserID, d.FileName, d.Path, d.Original)
+	removeScheduledFiles(d)
+	bot.Send(user, fmt.Sprintf("⏰ '%s' %s as scheduled.", d.FileName, settings.deliveredText(d.Device)))
+}
+
+// runScheduler sends scheduled files when their time comes until the bot
+// is stopped. Deliveries missed while the bot was down are sent right away
+func (b *SendToKindleBot) runScheduler(bot *tb.Bot) {
+	ticker := time.NewTicker(scheduledCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, d := range b.scheduled.due(now) {
+				b.deliverScheduled(bot, d)
+			}
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+// laterCallback handles the "⏰ Send later" menu and the cancel buttons of
+// /scheduled
+func (b *SendToKindleBot) laterCallback(bot *tb.Bot, c *tb.Callback) {
+	bot.Respond(c, &tb.CallbackResponse{})
+	if strings.HasPrefix(c.Data, laterCancelCallback) {
+		b.cancelScheduled(bot, c)
+		return
+	}
+
+	b.cacheMutex.RLock()
+	fileInfo, exists := b.fileStateCache[c.Sender.ID]
+	var fileName string
+	var startedAt time.Time
+	if exists {
+		fileName, startedAt = fileInfo["originalFileName"], pendingSince(fileInfo)
+	}
+	b.cacheMutex.RUnlock()
+	if !exists {
+		bot.Send(c.Sender, "❌ File not found. Please send it again.")
+		return
+	}
+	progress := resumeProgressMessage(bot, c.Message, fileName, startedAt)
+	loc := b.userLocation(c.Sender.ID)
+	now := time.Now().In(loc)
+
+	switch c.Data {
+	case laterMenuCallback:
+		progress.askTime("", laterKeyboard(now))
+	case laterTonightCallback, laterMorningCallback:
+		at := time.Date(now.Year(), now.Month(), now.Day(), laterTonightHour, 0, 0, 0, loc)
+		if c.Data == laterMorningCallback {
+			at = time.Date(now.Year(), now.Month(), now.Day()+1, laterMorningHour, 0, 0, 0, loc)
+		}
+		if !at.After(now) {
+			progress.askTime("It is too late for tonight.", laterKeyboard(now))
+			return
+		}
+		b.chooseSendTime(bot, c.Sender, progress, at)
+	case laterCustomCallback:
+		progress.askTime(laterCustomText(loc), &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{
+			{{Text: "↩️ Back", Data: laterBackCallback}},
+		}})
+	case laterBackCallback:
+		b.setSendAt(c.Sender.ID, time.Time{})
+		progress.askDevice("", b.deviceKeyboard())
+	default:
+		logging.Debug("Invalid send later callback", "user", c.Sender.ID, "data", c.Data)
+	}
+}
+
+// laterCommand handles "/later <time>" for the file waiting for a device
+func (b *SendToKindleBot) laterCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		progress, ok := b.pendingPrompt(bot, m.Sender.ID)
+		if !ok {
+			respond(bot, m, "❌ There is no file waiting to be sent. Send one and pick ⏰ Send later.")
+			return
+		}
+		loc := b.userLocation(m.Sender.ID)
+		if strings.TrimSpace(m.Payload) == "" {
+			respond(bot, m, laterCustomText(loc))
+			return
+		}
+		at, err := parseSendTime(m.Payload, time.Now().In(loc))
+		if err != nil {
+			respond(bot, m, fmt.Sprintf("❌ Could not schedule '%s': %v.", progress.fileName, err))
+			return
+		}
+		b.chooseSendTime(bot, m.Sender, progress, at)
+	}
+}
+
+// scheduledCommand handles "/scheduled": the scheduled deliveries of the
+// user with cancel buttons
+func (b *SendToKindleBot) scheduledCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		text, markup := b.scheduledMessage(m.Sender.ID, time.Now())
+		if _, err := bot.Send(m.Sender, text, markup); err != nil {
+			logging.Error("Could not send message", "user", m.Sender.ID, "err", err)
+		}
+	}
+}
+
+// scheduledMessage lists the scheduled deliveries of a user
+func (b *SendToKindleBot) scheduledMessage(userID int, now time.Time) (string, *tb.ReplyMarkup) {
+	deliveries := b.scheduled.list(userID)
+	loc := b.userLocation(userID)
+	if len(deliveries) == 0 {
+		return "⏰ Nothing is scheduled. Pick ⏰ Send later when choosing a device to send a book later.",
+			&tb.ReplyMarkup{}
+	}
+	var text strings.Builder
+	var rows [][]tb.InlineButton
+	text.WriteString("⏰ Scheduled deliveries:\n")
+	for i, d := range deliveries {
+		fmt.Fprintf(&text, "%d. '%s' to %s %s\n", i+1, d.FileName, deviceLabel(d.Device), formatSendTime(d.SendAt, now.In(loc)))
+		rows = append(rows, []tb.InlineButton{{Text: fmt.Sprintf("✖️ Cancel %d", i+1), Data: laterCancelCallback + d.ID}})
+	}
+	fmt.Fprintf(&text, "\nTimes are in %s, change it with /timezone.", loc)
+	return text.String(), &tb.ReplyMarkup{InlineKeyboard: rows}
+}
+
+// cancelScheduled handles the cancel buttons of /scheduled
+func (b *SendToKindleBot) cancelScheduled(bot *tb.Bot, c *tb.Callback) {
+	d, ok := b.scheduled.remove(c.Sender.ID, strings.TrimPrefix(c.Data, laterCancelCallback))
+	if ok {
+		removeScheduledFiles(d)
+		logging.Info("Cancelled scheduled delivery", "user", c.Sender.ID, "id", d.ID, "file", d.FileName)
+	}
+	text, markup := b.scheduledMessage(c.Sender.ID, time.Now())
+	if ok {
+		text = fmt.Sprintf("✖️ Cancelled '%s'.\n\n%s", d.FileName, text)
+	}
+	if c.Message == nil {
+		bot.Send(c.Sender, text, markup)
+		return
+	}
+	if _, err := bot.Edit(c.Message, text, markup); err != nil && err != tb.ErrMessageNotModified {
+		logging.Warn("Could not update scheduled deliveries", "err", err)
+	}
+}
+
+// timezoneCommand handles "/timezone [zone]"
+func (b *SendToKindleBot) timezoneCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		if strings.TrimSpace(m.Payload) == "" {
+			loc := b.userLocation(m.Sender.ID)
+			respond(bot, m, fmt.Sprintf("🕰 Your time zone is %s, it is %s there. Change it with /timezone "+
+				"Europe/Berlin or /timezone +3.", loc, time.Now().In(loc).Format("15:04")))
+			return
+		}
+		loc, name, err := parseTimeZone(m.Payload)
+		if err != nil {
+			respond(bot, m, fmt.Sprintf("❌ %v.", err))
+			return
+		}
+		b.users.setTimeZone(m.Sender.ID, name)
+		logging.Info("Changed time zone", "user", m.Sender.ID, "zone", name)
+		respond(bot, m, fmt.Sprintf("🕰 Your time zone is now %s, it is %s there.", name, time.Now().In(loc).Format("15:04")))
+	}
+}
@@ -0,0 +1,172 @@
+package bot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTimeZone(t *testing.T) {
+	tests := []struct {
+		zone     string
+		wantName string
+		wantErr  bool
+	}{
+		{"Europe/Berlin", "Europe/Berlin", false},
+		{"utc", "UTC", false},
+		{"+3", "UTC+03:00", false},
+		{"UTC-05:30", "UTC-05:30", false},
+		{"gmt+0530", "UTC+05:30", false},
+		{"UTC +1", "UTC+01:00", false},
+		{"+15", "", true},
+		{"+3:75", "", true},
+		{"Mars/Olympus", "", true},
+		{"local", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			loc, name, err := parseTimeZone(tt.zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeZone(%q) error = %v, wantErr %v", tt.zone, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTimeZone) {
+					t.Errorf("parseTimeZone(%q) error = %v, want ErrInvalidTimeZone", tt.zone, err)
+				}
+				return
+			}
+			if name != tt.wantName || loc == nil {
+				t.Errorf("parseTimeZone(%q) = %v, %q, want %q", tt.zone, loc, name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestParseSendTime(t *testing.T) {
+	loc := time.FixedZone("UTC+03:00", 3*60*60)
+	// A Sunday afternoon
+	now := time.Date(2026, 10, 18, 15, 20, 30, 0, loc)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, loc)
+	}
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr error
+	}{
+		{"tonight", at(10, 18, 21, 0), nil},
+		{"tomorrow", at(10, 19, 7, 0), nil},
+		{"Tomorrow 7:30", at(10, 19, 7, 30), nil},
+		{"today 18:00", at(10, 18, 18, 0), nil},
+		{"today 9:00", time.Time{}, ErrSendTimePassed},
+		{"18:45", at(10, 18, 18, 45), nil},
+		{"9:15", at(10, 19, 9, 15), nil},
+		{"fri", at(10, 23, 7, 0), nil},
+		{"friday 18:00", at(10, 23, 18, 0), nil},
+		{"sun 16:00", at(10, 18, 16, 0), nil},
+		{"sun 9:00", at(10, 25, 9, 0), nil},
+		{"2026-11-02 20:15", at(11, 2, 20, 15), nil},
+		{"2026-11-02", at(11, 2, 7, 0), nil},
+		{"2026-10-01", time.Time{}, ErrSendTimePassed},
+		{"2027-06-01", time.Time{}, ErrSendTimeTooFar},
+		{"in 2h30m", at(10, 18, 17, 50), nil},
+		{"in 3d", at(10, 21, 15, 20), nil},
+		{"in 100d", time.Time{}, ErrSendTimeTooFar},
+		{"in -1h", time.Time{}, ErrSendTimePassed},
+		{"in soon", time.Time{}, ErrInvalidSendTime},
+		{"someday", time.Time{}, ErrInvalidSendTime},
+		{"tomorrow 25:00", time.Time{}, ErrInvalidSendTime},
+		{"next friday at noon", time.Time{}, ErrInvalidSendTime},
+		{"", time.Time{}, ErrInvalidSendTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseSendTime(tt.input, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseSendTime(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseSendTime(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSendTime(t *testing.T) {
+	now := time.Date(2026, 10, 18, 15, 20, 0, 0, time.UTC)
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{time.Date(2026, 10, 18, 21, 0, 0, 0, time.UTC), "today at 21:00"},
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), "tomorrow at 07:00"},
+		{time.Date(2026, 10, 23, 18, 0, 0, 0, time.UTC), "on Fri 23 Oct at 18:00"},
+		{time.Date(2027, 1, 4, 7, 0, 0, 0, time.UTC), "on Mon 4 Jan 2027 at 07:00"},
+		// Rendered in the time zone of now
+		{time.Date(2026, 10, 18, 23, 30, 0, 0, time.FixedZone("UTC+03:00", 3*60*60)), "today at 20:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatSendTime(tt.at, now); got != tt.want {
+				t.Errorf("formatSendTime() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduledStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), scheduledFileName)
+	s, err := loadScheduledStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 18, 15, 0, 0, 0, time.UTC)
+	s.add(scheduledDelivery{ID: "b", UserID: 1, FileName: "b.epub", Device: "Oasis", SendAt: now.Add(2 * time.Hour)})
+	s.add(scheduledDelivery{ID: "a", UserID: 1, FileName: "a.epub", Device: "Oasis", SendAt: now.Add(time.Hour)})
+	s.add(scheduledDelivery{ID: "c", UserID: 2, FileName: "c.epub", Device: "Kobo", SendAt: now.Add(30 * time.Minute)})
+
+	// Everything survives a restart
+	s, err = loadScheduledStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s.list(1); len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("list(1) = %+v, want a, b", list)
+	}
+	if due := s.due(now.Add(time.Hour)); len(due) != 2 || due[0].ID != "c" || due[1].ID != "a" {
+		t.Errorf("due() = %+v, want c, a", due)
+	}
+	if _, ok := s.remove(2, "a"); ok {
+		t.Error("remove() removed the delivery of another user")
+	}
+	if d, ok := s.remove(1, "a"); !ok || d.FileName != "a.epub" {
+		t.Errorf("remove(1, a) = %+v, %v", d, ok)
+	}
+	if attempts := s.retry("b", now.Add(3*time.Hour)); attempts != 1 {
+		t.Errorf("retry() = %d, want 1", attempts)
+	}
+	if attempts := s.retry("missing", now); attempts != 0 {
+		t.Errorf("retry(missing) = %d, want 0", attempts)
+	}
+
+	s, _ = loadScheduledStore(path)
+	if list := s.list(0); len(list) != 2 || list[0].ID != "c" || list[1].Attempts != 1 ||
+		!list[1].SendAt.Equal(now.Add(3*time.Hour)) {
+		t.Errorf("list(0) after reload = %+v", list)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := loadScheduledStore(path); err == nil || len(s.list(0)) != 0 {
+		t.Errorf("loadScheduledStore(broken) = %v, %v, want an empty store and an error", s.list(0), err)
+	}
+	var nilStore *scheduledStore
+	nilStore.add(scheduledDelivery{ID: "x"})
+	if list := nilStore.list(0); list != nil {
+		t.Errorf("nil store list() = %v", list)
+	}
+}
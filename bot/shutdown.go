@@ -0,0 +1,395 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShutdownTimeout is how long Stop waits for running jobs
+	DefaultShutdownTimeout = 25 * time.Second
+	// stateFileName stores unfinished jobs between restarts inside tmpFilesPath
+	stateFileName = ".bot-state.json"
+
+	jobKindDocument = "document" // download and convert an uploaded document
+	jobKindSend     = "send"     // send an already prepared file to a device
+	jobKindDigest   = "digest"   // send the feed digest of a user
+	// jobKindScheduled sends a scheduled file, kept in the schedule until sent
+	jobKindScheduled = "scheduled"
+	jobKindQueue     = "queue" // send the reading queue of a user
+)
+
+// errShuttingDown is returned by jobTracker.begin once Stop has been called
+var errShuttingDown = errors.New("bot is shutting down")
+
+// jobRecord describes a job well enough to resume it after a restart
+type jobRecord struct {
+	// ID correlates the log lines of a job, also across restarts
+	ID         string `json:"id,omitempty"`
+	Kind       string `json:"kind"`
+	UserID     int    `json:"user_id"`
+	FileID     string `json:"file_id,omitempty"`
+	FilePath   string `json:"file_path,omitempty"` // local file instead of FileID, e.g. from /find
+	FileSize   int    `json:"file_size,omitempty"`
+	FileName   string `json:"file_name"`
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+// newJobID returns a short random job ID for log correlation
+func newJobID() string {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// activeJob is a job currently running in a handler
+type activeJob struct {
+	record  jobRecord
+	files   []string // temporary files created by the job so far
+	started time.Time
+
+	// ctx is cancelled when an admin cancels the job or on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// botState is persisted to stateFileName on shutdown
+type botState struct {
+	// Pending are prepared files waiting for a device to be selected
+	Pending map[int]map[string]string `json:"pending,omitempty"`
+	// Interrupted are jobs that did not finish before the shutdown deadline
+	Interrupted []jobRecord `json:"interrupted,omitempty"`
+}
+
+// jobTracker keeps track of running jobs so shutdown can drain them
+type jobTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	jobs     map[*activeJob]struct{}
+	draining bool
+
+	// ctx is cancelled when the shutdown deadline passes,
+	// long running steps such as conversions are bound to it
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobTracker() *jobTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobTracker{
+		jobs:   make(map[*activeJob]struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// begin registers a new job. It fails once draining started
+func (t *jobTracker) begin(record jobRecord) (*activeJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, errShuttingDown
+	}
+	job := &activeJob{record: record, started: time.Now()}
+	job.ctx, job.cancel = context.WithCancel(t.ctx)
+	t.jobs[job] = struct{}{}
+	t.wg.Add(1)
+	return job, nil
+}
+
+// addFile remembers a temporary file created by the job
+func (t *jobTracker) addFile(job *activeJob, path string) {
+	t.mu.Lock()
+	job.files = append(job.files, path)
+	t.mu.Unlock()
+}
+
+// end unregisters a finished job
+func (t *jobTracker) end(job *activeJob) {
+	t.mu.Lock()
+	if _, ok := t.jobs[job]; ok {
+		delete(t.jobs, job)
+		job.cancel()
+		t.wg.Done()
+	}
+	t.mu.Unlock()
+}
+
+// hasActive reports whether the user has a running job
+func (t *jobTracker) hasActive(userID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for job := range t.jobs {
+		if job.record.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// activeFiles returns the temporary files of all running jobs
+func (t *jobTracker) activeFiles() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var files []string
+	for job := range t.jobs {
+		files = append(files, job.files...)
+	}
+	return files
+}
+
+// count returns the number of running jobs
+func (t *jobTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.jobs)
+}
+
+// list returns the running jobs, oldest first
+func (t *jobTracker) list() []activeJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]activeJob, 0, len(t.jobs))
+	for job := range t.jobs {
+		jobs = append(jobs, activeJob{record: job.record, started: job.started})
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].started.Before(jobs[j].started) })
+	return jobs
+}
+
+// cancelJob cancels the running job with the ID. The job notices it at its
+// next step, conversions are killed right away
+func (t *jobTracker) cancelJob(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for job := range t.jobs {
+		if job.record.ID == id {
+			job.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// cancelled reports whether the job was cancelled by cancelJob, as opposed
+// to the shutdown deadline cancelling every job
+func (t *jobTracker) cancelled(job *activeJob) bool {
+	return job.ctx.Err() != nil && t.ctx.Err() == nil
+}
+
+// drain stops accepting jobs and waits for the running ones until timeout.
+// It returns the jobs that are still running afterwards
+func (t *jobTracker) drain(timeout time.Duration) []*activeJob {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.cancel()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unfinished := make([]*activeJob, 0, len(t.jobs))
+	for job := range t.jobs {
+		unfinished = append(unfinished, job)
+	}
+	return unfinished
+}
+
+// Stop stops receiving updates, lets running jobs finish until timeout,
+// persists unfinished jobs for the next start and removes their temporary files.
+// Start returns once Stop is done
+func (b *SendToKindleBot) Stop(timeout time.Duration) {
+	if b.bot == nil || b.jobs == nil {
+		return
+	}
+	b.stopOnce.Do(func() {
+		logging.Info("Shutting down: no longer accepting updates")
+		b.bot.Stop()
+
+		unfinished := b.jobs.drain(timeout)
+		if len(unfinished) > 0 {
+			logging.Warn("Jobs did not finish in time", "count", len(unfinished), "timeout", timeout)
+		}
+
+		state := b.collectState(unfinished)
+		if err := b.saveState(state); err != nil {
+			logging.Error("Could not persist unfinished jobs", "err", err)
+		} else if len(state.Pending) > 0 || len(state.Interrupted) > 0 {
+			logging.Info("Persisted unfinished jobs",
+				"pending", len(state.Pending), "interrupted", len(state.Interrupted))
+		}
+
+		logging.Info("Shutdown complete")
+		close(b.stopped)
+	})
+}
+
+// stopOnSignal calls Stop with ShutdownTimeout when one of the signals arrives
+func (b *SendToKindleBot) stopOnSignal(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	sig := <-ch
+	signal.Stop(ch)
+
+	timeout := b.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	logging.Info("Received signal, finishing running jobs", "signal", sig, "timeout", timeout)
+	b.Stop(timeout)
+}
+
+// collectState snapshots jobs that must survive the restart. Temporary files
+// of interrupted document jobs are removed, those jobs start from scratch
+func (b *SendToKindleBot) collectState(unfinished []*activeJob) botState {
+	state := botState{Pending: make(map[int]map[string]string)}
+
+	b.cacheMutex.RLock()
+	for userID, fileInfo := range b.fileStateCache {
+		entry := make(map[string]string, len(fileInfo))
+		for k, v := range fileInfo {
+			entry[k] = v
+		}
+		state.Pending[userID] = entry
+	}
+	b.cacheMutex.RUnlock()
+
+	for _, job := range unfinished {
+		state.Interrupted = append(state.Interrupted, job.record)
+		if job.record.Kind == jobKindDocument {
+			for _, path := range job.files {
+				removeSilently(path)
+			}
+			delete(state.Pending, job.record.UserID)
+		}
+	}
+	return state
+}
+
+func (b *SendToKindleBot) statePath() string {
+	return filepath.Join(b.tmpFilesPath, stateFileName)
+}
+
+func (b *SendToKindleBot) saveState(state botState) error {
+	if len(state.Pending) == 0 && len(state.Interrupted) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		return err
+	}
+	tmp := b.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.statePath())
+}
+
+// loadState reads and removes the state persisted by the previous run
+func (b *SendToKindleBot) loadState() (botState, error) {
+	var state botState
+	data, err := ioutil.ReadFile(b.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	defer removeSilently(b.statePath())
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("could not parse %s: %w", stateFileName, err)
+	}
+	return state, nil
+}
+
+// restoreState brings back pending device selections and resumes jobs
+// interrupted by the previous shutdown
+func (b *SendToKindleBot) restoreState(bot *tb.Bot) {
+	state, err := b.loadState()
+	if err != nil {
+		logging.Error("Could not restore unfinished jobs", "err", err)
+		return
+	}
+
+	b.cacheMutex.Lock()
+	for userID, fileInfo := range state.Pending {
+		if !pathWithin(b.tmpFilesPath, fileInfo["filePath"]) ||
+			(fileInfo["originalFilePath"] != "" && !pathWithin(b.tmpFilesPath, fileInfo["originalFilePath"])) {
+			logging.Warn("Not restoring a pending file outside the temporary files", "user", userID)
+			continue
+		}
+		b.fileStateCache[userID] = fileInfo
+	}
+	b.cacheMutex.Unlock()
+	if len(state.Pending) > 0 {
+		logging.Info("Restored pending device selections", "count", len(state.Pending))
+	}
+
+	for _, record := range state.Interrupted {
+		logging.Info("Resuming interrupted job", "job", record.ID, "kind", record.Kind,
+			"user", record.UserID, "file", record.FileName)
+		go b.resumeJob(bot, record)
+	}
+}
+
+func (b *SendToKindleBot) resumeJob(bot *tb.Bot, record jobRecord) {
+	user := &tb.User{ID: record.UserID}
+	switch record.Kind {
+	case jobKindDocument:
+		// Local files only come from the Calibre library
+		if record.FilePath != "" && (b.calibre == nil || !pathWithin(b.calibre.dir, record.FilePath)) {
+			logging.Warn("Not resuming a job with a file outside the Calibre library", "job", record.ID,
+				"user", record.UserID, "path", record.FilePath)
+			bot.Send(user, fmt.Sprintf("❌ Could not resume '%s' after a restart, please send it again.", record.FileName))
+			return
+		}
+		bot.Send(user, fmt.Sprintf("🔁 Resuming '%s' after a restart...", record.FileName))
+		b.processDocument(bot, &tb.Message{
+			Sender: user,
+			Document: &tb.Document{
+				File:     tb.File{FileID: record.FileID, FileSize: record.FileSize},
+				FileName: record.FileName,
+			},
+		}, record.ID, record.FilePath)
+	case jobKindSend:
+		progress := newProgressMessage(bot, user, record.FileName)
+		b.sendToDevice(bot, record.UserID, record.DeviceName, progress, record.ID)
+	case jobKindDigest:
+		b.runDigest(bot, record.UserID, record.ID, false)
+	case jobKindQueue:
+		b.runQueue(bot, record.UserID, record.DeviceName, record.ID)
+	case jobKindScheduled:
+		// Still in the schedule, runScheduler sends it again
+		logging.Info("Scheduled delivery interrupted, sending it again", "job", record.ID, "user", record.UserID)
+	default:
+		logging.Warn("Unknown job kind, skipping", "job", record.ID, "kind", record.Kind)
+	}
+}
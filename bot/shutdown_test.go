@@ -0,0 +1,172 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJobTracker_drain(t *testing.T) {
+	t.Run("waits for running jobs", func(t *testing.T) {
+		tracker := newJobTracker()
+		job, err := tracker.begin(jobRecord{Kind: jobKindDocument, UserID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			tracker.end(job)
+		}()
+
+		if unfinished := tracker.drain(time.Second); len(unfinished) != 0 {
+			t.Errorf("drain() unfinished = %d, want 0", len(unfinished))
+		}
+		if tracker.ctx.Err() != nil {
+			t.Errorf("drain() cancelled jobs that finished in time")
+		}
+	})
+
+	t.Run("returns jobs running past the deadline", func(t *testing.T) {
+		tracker := newJobTracker()
+		if _, err := tracker.begin(jobRecord{Kind: jobKindSend, UserID: 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		unfinished := tracker.drain(10 * time.Millisecond)
+		if len(unfinished) != 1 || unfinished[0].record.UserID != 2 {
+			t.Errorf("drain() unfinished = %v, want the running job", unfinished)
+		}
+		if tracker.ctx.Err() == nil {
+			t.Errorf("drain() did not cancel the jobs context")
+		}
+	})
+
+	t.Run("cancels a single job", func(t *testing.T) {
+		tracker := newJobTracker()
+		job, _ := tracker.begin(jobRecord{ID: "a", Kind: jobKindDocument, UserID: 1})
+		other, _ := tracker.begin(jobRecord{ID: "b", Kind: jobKindDocument, UserID: 2})
+
+		if !tracker.cancelJob("a") || tracker.cancelJob("missing") {
+			t.Errorf("cancelJob() found the wrong jobs")
+		}
+		if !tracker.cancelled(job) || tracker.cancelled(other) {
+			t.Errorf("cancelled() = %v, %v, want true, false", tracker.cancelled(job), tracker.cancelled(other))
+		}
+		if got := tracker.list(); len(got) != 2 || got[0].record.ID != "a" {
+			t.Errorf("list() = %+v, want both jobs oldest first", got)
+		}
+
+		// The shutdown deadline is not an admin cancellation
+		tracker.end(job)
+		tracker.drain(time.Millisecond)
+		if tracker.cancelled(other) {
+			t.Errorf("cancelled() = true after the shutdown deadline")
+		}
+	})
+
+	t.Run("rejects new jobs while draining", func(t *testing.T) {
+		tracker := newJobTracker()
+		tracker.drain(time.Millisecond)
+		if _, err := tracker.begin(jobRecord{}); err != errShuttingDown {
+			t.Errorf("begin() error = %v, want %v", err, errShuttingDown)
+		}
+	})
+}
+
+func TestSendToKindleBot_collectState(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "partial.fb2")
+	if err := os.WriteFile(partial, []byte("half a book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &SendToKindleBot{
+		fileStateCache: map[int]map[string]string{
+			1: {"filePath": filepath.Join(dir, "ready.epub"), "originalFileName": "ready.epub"},
+			2: {"filePath": filepath.Join(dir, "old.epub"), "originalFileName": "old.epub"},
+		},
+		tmpFilesPath: dir,
+	}
+	unfinished := []*activeJob{
+		{record: jobRecord{Kind: jobKindDocument, UserID: 2, FileID: "abc", FileName: "partial.fb2"}, files: []string{partial}},
+	}
+
+	state := b.collectState(unfinished)
+	if _, ok := state.Pending[1]; !ok {
+		t.Errorf("collectState() lost the pending selection of user 1")
+	}
+	if _, ok := state.Pending[2]; ok {
+		t.Errorf("collectState() kept the pending selection replaced by the interrupted upload")
+	}
+	if len(state.Interrupted) != 1 || state.Interrupted[0].FileID != "abc" {
+		t.Errorf("collectState() interrupted = %v", state.Interrupted)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("collectState() did not remove the partial download")
+	}
+}
+
+func TestSendToKindleBot_saveLoadState(t *testing.T) {
+	b := &SendToKindleBot{tmpFilesPath: t.TempDir()}
+	state := botState{
+		Pending: map[int]map[string]string{
+			7: {"filePath": "/files/book.epub", "originalFileName": "book.fb2"},
+		},
+		Interrupted: []jobRecord{
+			{Kind: jobKindSend, UserID: 7, FileName: "book.fb2", DeviceName: "Oasis"},
+		},
+	}
+
+	if err := b.saveState(state); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+	got, err := b.loadState()
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("loadState() got = %+v, want %+v", got, state)
+	}
+	if _, err := os.Stat(b.statePath()); !os.IsNotExist(err) {
+		t.Errorf("loadState() did not remove the state file")
+	}
+
+	empty, err := b.loadState()
+	if err != nil || len(empty.Pending) != 0 || len(empty.Interrupted) != 0 {
+		t.Errorf("loadState() without a state file = %+v, %v", empty, err)
+	}
+}
+
+func TestSendToKindleBot_restoreState_outsidePaths(t *testing.T) {
+	b := &SendToKindleBot{tmpFilesPath: t.TempDir(), fileStateCache: make(map[int]map[string]string)}
+	inside := filepath.Join(b.tmpFilesPath, "book.epub")
+	if err := b.saveState(botState{Pending: map[int]map[string]string{
+		7: {"filePath": inside, "originalFileName": "book.fb2"},
+		8: {"filePath": "/etc/passwd", "originalFileName": "passwd"},
+		9: {"filePath": inside, "originalFilePath": filepath.Join(b.tmpFilesPath, "..", "secret")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	b.restoreState(nil)
+	if len(b.fileStateCache) != 1 || b.fileStateCache[7]["filePath"] != inside {
+		t.Errorf("restoreState() pending = %v, want only user 7", b.fileStateCache)
+	}
+}
+
+func TestPathWithin(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/files/book.epub":          true,
+		"/files/scheduled/1/a.epub": true,
+		"/files/../etc/passwd":      false,
+		"/etc/passwd":               false,
+		"/files":                    true,
+		"/files-other/book.epub":    false,
+		"/files/..book.epub":        true,
+	} {
+		if got := pathWithin("/files", path); got != want {
+			t.Errorf("pathWithin(/files, %q) = %v, want %v", path, got, want)
+		}
+	}
+}
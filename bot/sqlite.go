@@ -0,0 +1,451 @@
+package bot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	sqliteMagic         = "SQLite format 3\x00"
+	sqliteHeaderSize    = 100
+	sqliteInteriorTable = 0x05
+	sqliteLeafTable     = 0x0d
+	// sqliteMaxDepth guards against cycles in a corrupt b-tree
+	sqliteMaxDepth = 64
+)
+
+var (
+	errNotSQLite     = errors.New("not an SQLite 3 database")
+	errSQLiteCorrupt = errors.New("sqlite database is corrupt")
+)
+
+// sqliteDB reads whole tables of an SQLite 3 database file. It supports
+// just what reading Calibre's metadata.db and the Kindle's vocab.db needs:
+// table b-trees, overflow pages and UTF-8 text. There are no queries,
+// indexes or writes, and a database in WAL mode is read as of its last
+// checkpoint
+type sqliteDB struct {
+	f        *os.File
+	pageSize int
+	usable   int // page size without the reserved bytes at the end of each page
+	tables   map[string]sqliteTable
+}
+
+// sqliteTable is a table from the sqlite_master schema table
+type sqliteTable struct {
+	root    uint32
+	columns []string
+	rowid   int // index of the INTEGER PRIMARY KEY column, -1 when there is none
+}
+
+// sqliteRow maps column names to int64, float64, string, []byte or nil
+type sqliteRow map[string]interface{}
+
+func (r sqliteRow) int(column string) int64 {
+	switch v := r[column].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func (r sqliteRow) float(column string) float64 {
+	switch v := r[column].(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func (r sqliteRow) text(column string) string {
+	switch v := r[column].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// openSQLite opens a database and reads its schema
+func openSQLite(path string) (*sqliteDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sqliteHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(sqliteMagic)]) != sqliteMagic {
+		f.Close()
+		return nil, errNotSQLite
+	}
+	db := &sqliteDB{f: f, pageSize: int(binary.BigEndian.Uint16(header[16:18]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	db.usable = db.pageSize - int(header[20])
+	if db.pageSize < 512 || db.usable < 480 {
+		f.Close()
+		return nil, errSQLiteCorrupt
+	}
+	if encoding := binary.BigEndian.Uint32(header[56:60]); encoding > 1 {
+		f.Close()
+		return nil, fmt.Errorf("sqlite text encoding %d is not supported, only UTF-8", encoding)
+	}
+	if err := db.readSchema(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqliteWALPending reports whether the database at path has a non-empty
+// write-ahead log. Its pages are not read, so the changes in it are missing
+// until SQLite checkpoints them into the database file
+func sqliteWALPending(path string) bool {
+	info, err := os.Stat(path + "-wal")
+	return err == nil && info.Size() > 0
+}
+
+func (db *sqliteDB) Close() error {
+	return db.f.Close()
+}
+
+// readSchema reads the tables from sqlite_master, the table on page 1
+func (db *sqliteDB) readSchema() error {
+	db.tables = make(map[string]sqliteTable)
+	return db.scan(1, 0, func(rowid int64, values []interface{}) error {
+		if len(values) < 5 {
+			return errSQLiteCorrupt
+		}
+		kind, _ := values[0].(string)
+		name, _ := values[1].(string)
+		root, _ := values[3].(int64)
+		sql, _ := values[4].(string)
+		if kind != "table" || root <= 0 {
+			return nil
+		}
+		columns, rowidColumn := parseTableColumns(sql)
+		db.tables[strings.ToLower(name)] = sqliteTable{root: uint32(root), columns: columns, rowid: rowidColumn}
+		return nil
+	})
+}
+
+// table returns every row of a table in rowid order
+func (db *sqliteDB) table(name string) ([]sqliteRow, error) {
+	t, ok := db.tables[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("sqlite table %q not found", name)
+	}
+	var rows []sqliteRow
+	err := db.scan(t.root, 0, func(rowid int64, values []interface{}) error {
+		row := make(sqliteRow, len(t.columns))
+		for i, column := range t.columns {
+			// Columns added later with ALTER TABLE are missing from old rows
+			if i < len(values) {
+				row[column] = values[i]
+			}
+		}
+		if t.rowid >= 0 {
+			row[t.columns[t.rowid]] = rowid
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+func (db *sqliteDB) page(number uint32) ([]byte, error) {
+	if number == 0 {
+		return nil, errSQLiteCorrupt
+	}
+	page := make([]byte, db.pageSize)
+	if _, err := db.f.ReadAt(page, int64(number-1)*int64(db.pageSize)); err != nil {
+		return nil, fmt.Errorf("could not read sqlite page %d: %w", number, err)
+	}
+	return page, nil
+}
+
+// scan calls fn with the decoded record of every row of the table b-tree
+// rooted at page root
+func (db *sqliteDB) scan(root uint32, depth int, fn func(rowid int64, values []interface{}) error) error {
+	if depth > sqliteMaxDepth {
+		return errSQLiteCorrupt
+	}
+	page, err := db.page(root)
+	if err != nil {
+		return err
+	}
+	header := 0
+	if root == 1 {
+		header = sqliteHeaderSize
+	}
+	if len(page) < header+12 {
+		return errSQLiteCorrupt
+	}
+	kind := page[header]
+	cells := int(binary.BigEndian.Uint16(page[header+3 : header+5]))
+	pointers := header + 8
+	if kind == sqliteInteriorTable {
+		pointers = header + 12
+	}
+	if pointers+2*cells > len(page) {
+		return errSQLiteCorrupt
+	}
+
+	for i := 0; i < cells; i++ {
+		offset := int(binary.BigEndian.Uint16(page[pointers+2*i:]))
+		if offset >= db.usable {
+			return errSQLiteCorrupt
+		}
+		switch kind {
+		case sqliteInteriorTable:
+			if offset+4 > len(page) {
+				return errSQLiteCorrupt
+			}
+			if err := db.scan(binary.BigEndian.Uint32(page[offset:]), depth+1, fn); err != nil {
+				return err
+			}
+		case sqliteLeafTable:
+			rowid, payload, err := db.leafCell(page, offset)
+			if err != nil {
+				return err
+			}
+			values, err := decodeSQLiteRecord(payload)
+			if err != nil {
+				return err
+			}
+			if err := fn(rowid, values); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: page %d is not a table page", errSQLiteCorrupt, root)
+		}
+	}
+	if kind == sqliteInteriorTable {
+		return db.scan(binary.BigEndian.Uint32(page[header+8:]), depth+1, fn)
+	}
+	return nil
+}
+
+// leafCell returns the rowid and the whole payload of a table leaf cell,
+// following overflow pages when the payload does not fit the page
+func (db *sqliteDB) leafCell(page []byte, offset int) (int64, []byte, error) {
+	size, n := readSQLiteVarint(page[offset:])
+	if n == 0 || size < 0 || size > math.MaxInt32 {
+		return 0, nil, errSQLiteCorrupt
+	}
+	offset += n
+	rowid, n := readSQLiteVarint(page[offset:])
+	if n == 0 {
+		return 0, nil, errSQLiteCorrupt
+	}
+	offset += n
+
+	total := int(size)
+	local := db.localPayload(total)
+	if offset+local > len(page) {
+		return 0, nil, errSQLiteCorrupt
+	}
+	payload := make([]byte, 0, total)
+	payload = append(payload, page[offset:offset+local]...)
+	if local == total {
+		return rowid, payload, nil
+	}
+
+	if offset+local+4 > len(page) {
+		return 0, nil, errSQLiteCorrupt
+	}
+	next := binary.BigEndian.Uint32(page[offset+local:])
+	for pages := 0; len(payload) < total; pages++ {
+		if next == 0 || pages > total/(db.usable-4)+1 {
+			return 0, nil, errSQLiteCorrupt
+		}
+		overflow, err := db.page(next)
+		if err != nil {
+			return 0, nil, err
+		}
+		next = binary.BigEndian.Uint32(overflow)
+		chunk := overflow[4:db.usable]
+		if rest := total - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+	}
+	return rowid, payload, nil
+}
+
+// localPayload returns how much of a payload is stored on a table leaf
+// page, as defined by the file format
+func (db *sqliteDB) localPayload(size int) int {
+	max := db.usable - 35
+	if size <= max {
+		return size
+	}
+	min := (db.usable-12)*32/255 - 23
+	local := min + (size-min)%(db.usable-4)
+	if local > max {
+		return min
+	}
+	return local
+}
+
+// decodeSQLiteRecord decodes a record into int64, float64, string, []byte
+// and nil values
+func decodeSQLiteRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := readSQLiteVarint(payload)
+	if n == 0 || headerSize < int64(n) || headerSize > int64(len(payload)) {
+		return nil, errSQLiteCorrupt
+	}
+	header := payload[n:headerSize]
+	body := payload[headerSize:]
+	var values []interface{}
+	for len(header) > 0 {
+		serial, n := readSQLiteVarint(header)
+		if n == 0 {
+			return nil, errSQLiteCorrupt
+		}
+		header = header[n:]
+
+		var size int
+		switch {
+		case serial >= 12:
+			size = int((serial - 12) / 2)
+		case serial >= 1 && serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		case serial == 10 || serial == 11:
+			return nil, errSQLiteCorrupt
+		}
+		if size > len(body) {
+			return nil, errSQLiteCorrupt
+		}
+		data := body[:size]
+		body = body[size:]
+
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial <= 6:
+			// Big-endian two's complement of 1 to 8 bytes
+			v := int64(int8(data[0]))
+			for _, b := range data[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serial == 8:
+			values = append(values, int64(0))
+		case serial == 9:
+			values = append(values, int64(1))
+		case serial%2 == 0:
+			values = append(values, append([]byte(nil), data...))
+		default:
+			values = append(values, string(data))
+		}
+	}
+	return values, nil
+}
+
+// readSQLiteVarint reads a big-endian variable-length integer of 1 to 9
+// bytes, returning 0 bytes read when b is too short
+func readSQLiteVarint(b []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return int64(v<<8 | uint64(b[i])), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return int64(v), i + 1
+		}
+	}
+	return 0, 0
+}
+
+// parseTableColumns returns the column names of a CREATE TABLE statement
+// and the index of its INTEGER PRIMARY KEY column, which holds the rowid
+func parseTableColumns(sql string) ([]string, int) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, -1
+	}
+	var columns []string
+	rowid := -1
+	for _, definition := range splitSQLList(sql[start+1 : end]) {
+		fields := strings.Fields(definition)
+		if len(fields) == 0 {
+			continue
+		}
+		// Table constraints such as "UNIQUE(book, format)" are not columns
+		switch strings.ToUpper(strings.SplitN(fields[0], "(", 2)[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			continue
+		}
+		upper := strings.ToUpper(definition)
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == "INTEGER" && strings.Contains(upper, "PRIMARY KEY") {
+			rowid = len(columns)
+		}
+		columns = append(columns, unquoteSQLName(fields[0]))
+	}
+	return columns, rowid
+}
+
+// splitSQLList splits at commas outside parentheses and quotes
+func splitSQLList(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func unquoteSQLName(name string) string {
+	if len(name) >= 2 {
+		switch name[0] {
+		case '"', '`', '\'':
+			if name[len(name)-1] == name[0] {
+				return name[1 : len(name)-1]
+			}
+		case '[':
+			if name[len(name)-1] == ']' {
+				return name[1 : len(name)-1]
+			}
+		}
+	}
+	return name
+}
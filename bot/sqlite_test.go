@@ -0,0 +1,131 @@
+package bot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenSQLite(t *testing.T) {
+	db, err := openSQLite(filepath.Join("testdata", "calibre", calibreDatabaseName))
+	if err != nil {
+		t.Fatalf("openSQLite() error = %v", err)
+	}
+	defer db.Close()
+
+	// The fixture has 1 KB pages, so books spans interior pages and the
+	// long title overflow pages
+	books, err := db.table("books")
+	if err != nil {
+		t.Fatalf("table(books) error = %v", err)
+	}
+	if len(books) != 205 {
+		t.Errorf("table(books) = %d rows, want 205", len(books))
+	}
+	var long sqliteRow
+	for i, row := range books {
+		if i > 0 && row.int("id") <= books[i-1].int("id") {
+			t.Fatalf("table(books) is not in rowid order at %d", i)
+		}
+		if strings.HasPrefix(row.text("title"), "The Long") {
+			long = row
+		}
+	}
+	if want := "The Long " + strings.Repeat("Long ", 800) + "Title"; long.text("title") != want {
+		t.Errorf("overflowing title has %d characters, want %d", len(long.text("title")), len(want))
+	}
+	if books[0].int("id") != 1 || books[0].text("title") != "Dune" || books[0].float("series_index") != 1 {
+		t.Errorf("first book = %v", books[0])
+	}
+
+	wantColumns := []string{"id", "book", "format", "uncompressed_size", "name"}
+	if got := db.tables["data"].columns; !reflect.DeepEqual(got, wantColumns) {
+		t.Errorf("data columns = %v, want %v", got, wantColumns)
+	}
+	if _, err := db.table("comments"); err == nil {
+		t.Errorf("table(comments) expected an error for a missing table")
+	}
+}
+
+func TestOpenSQLite_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.db")
+	if err := os.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSQLite(path); !errors.Is(err, errNotSQLite) {
+		t.Errorf("openSQLite() error = %v, want errNotSQLite", err)
+	}
+}
+
+func TestDecodeSQLiteRecord(t *testing.T) {
+	record := []byte{
+		7,          // header size
+		0, 1, 2, 9, // NULL, 8-bit and 16-bit integers, constant 1
+		7, 19, // float, 3 byte text
+		0xfe,       // -2
+		0x01, 0x00, // 256
+		0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18, // pi
+		'a', 'b', 'c',
+	}
+	want := []interface{}{nil, int64(-2), int64(256), int64(1), 3.141592653589793, "abc"}
+	got, err := decodeSQLiteRecord(record)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeSQLiteRecord() = %#v, %v, want %#v", got, err, want)
+	}
+	if _, err := decodeSQLiteRecord(record[:10]); !errors.Is(err, errSQLiteCorrupt) {
+		t.Errorf("decodeSQLiteRecord() of a truncated record error = %v, want errSQLiteCorrupt", err)
+	}
+}
+
+func TestParseTableColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		columns []string
+		rowid   int
+	}{
+		{
+			name:    "calibre books",
+			sql:     `CREATE TABLE books ( id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL DEFAULT 'Unknown, really' COLLATE NOCASE, isbn TEXT DEFAULT "" COLLATE NOCASE)`,
+			columns: []string{"id", "title", "isbn"},
+			rowid:   0,
+		},
+		{
+			name:    "constraints and quoted names",
+			sql:     "CREATE TABLE \"data\" (book INTEGER NOT NULL, [format] TEXT, `name` TEXT, UNIQUE(book, format), CHECK (book > 0))",
+			columns: []string{"book", "format", "name"},
+			rowid:   -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, rowid := parseTableColumns(tt.sql)
+			if !reflect.DeepEqual(columns, tt.columns) || rowid != tt.rowid {
+				t.Errorf("parseTableColumns() = %v, %d, want %v, %d", columns, rowid, tt.columns, tt.rowid)
+			}
+		})
+	}
+}
+
+func TestSQLiteWALPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.db")
+	if sqliteWALPending(path) {
+		t.Errorf("sqliteWALPending() without a log = true, want false")
+	}
+	if err := os.WriteFile(path+"-wal", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if sqliteWALPending(path) {
+		t.Errorf("sqliteWALPending() with an empty log = true, want false")
+	}
+	if err := os.WriteFile(path+"-wal", []byte("frames"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !sqliteWALPending(path) {
+		t.Errorf("sqliteWALPending() with a log = false, want true")
+	}
+}
@@ -0,0 +1,108 @@
+#!/usr/bin/env python3
+"""Generates metadata.db, a small Calibre library database for the tests.
+
+The schema is the relevant part of Calibre's. Small pages and filler books
+make the tables span interior and overflow pages. Run it from this
+directory: python3 metadata.py
+"""
+import os
+import sqlite3
+
+SCHEMA = """
+CREATE TABLE books ( id      INTEGER PRIMARY KEY AUTOINCREMENT,
+                     title     TEXT NOT NULL DEFAULT 'Unknown' COLLATE NOCASE,
+                     sort      TEXT COLLATE NOCASE,
+                     timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                     pubdate   TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                     series_index REAL NOT NULL DEFAULT 1.0,
+                     author_sort TEXT COLLATE NOCASE,
+                     isbn TEXT DEFAULT "" COLLATE NOCASE,
+                     lccn TEXT DEFAULT "" COLLATE NOCASE,
+                     path TEXT NOT NULL DEFAULT "",
+                     flags INTEGER NOT NULL DEFAULT 1,
+                     uuid TEXT,
+                     has_cover BOOL DEFAULT 0,
+                     last_modified TIMESTAMP NOT NULL DEFAULT "2000-01-01 00:00:00+00:00");
+CREATE TABLE authors ( id   INTEGER PRIMARY KEY,
+                       name TEXT NOT NULL COLLATE NOCASE,
+                       sort TEXT COLLATE NOCASE,
+                       link TEXT NOT NULL DEFAULT "",
+                       UNIQUE(name));
+CREATE TABLE books_authors_link ( id INTEGER PRIMARY KEY,
+                                  book INTEGER NOT NULL,
+                                  author INTEGER NOT NULL,
+                                  UNIQUE(book, author));
+CREATE TABLE series ( id   INTEGER PRIMARY KEY,
+                      name TEXT NOT NULL COLLATE NOCASE,
+                      sort TEXT COLLATE NOCASE,
+                      UNIQUE (name));
+CREATE TABLE books_series_link ( id INTEGER PRIMARY KEY,
+                                 book INTEGER NOT NULL,
+                                 series INTEGER NOT NULL,
+                                 UNIQUE(book));
+CREATE TABLE tags ( id   INTEGER PRIMARY KEY,
+                    name TEXT NOT NULL COLLATE NOCASE,
+                    link TEXT NOT NULL DEFAULT "",
+                    UNIQUE (name));
+CREATE TABLE books_tags_link ( id INTEGER PRIMARY KEY,
+                               book INTEGER NOT NULL,
+                               tag INTEGER NOT NULL,
+                               UNIQUE(book, tag));
+CREATE TABLE data ( id     INTEGER PRIMARY KEY,
+                    book   INTEGER NOT NULL,
+                    format TEXT NOT NULL COLLATE NOCASE,
+                    uncompressed_size INTEGER NOT NULL,
+                    name TEXT NOT NULL,
+                    UNIQUE(book, format));
+CREATE INDEX books_idx ON books (sort COLLATE NOCASE);
+"""
+
+BOOKS = [
+    # title, authors, series, index, tags, formats
+    ("Dune", ["Frank Herbert"], "Dune", 1.0, ["Science Fiction"], ["EPUB", "AZW3"]),
+    ("Dune Messiah", ["Frank Herbert"], "Dune", 2.0, ["Science Fiction"], ["PDF"]),
+    ("War and Peace", ["Leo Tolstoy"], None, 1.0, ["Classics", "Russian"], ["EPUB"]),
+    ("Good Omens", ["Terry Pratchett", "Neil Gaiman"], None, 1.0, ["Fantasy"], ["EPUB"]),
+    # Calibre stores a comma in an author's name as "|"
+    ("The Hobbit", ["Tolkien| J.R.R."], None, 1.0, ["Fantasy"], ["MOBI"]),
+    ("The Long " + "Long " * 800 + "Title", ["Anonymous"], None, 1.0, [], ["TXT"]),
+]
+
+path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "metadata.db")
+if os.path.exists(path):
+    os.remove(path)
+db = sqlite3.connect(path)
+db.execute("PRAGMA page_size = 1024")
+db.executescript(SCHEMA)
+
+
+def lookup(table, name):
+    row = db.execute(f"SELECT id FROM {table} WHERE name = ?", (name,)).fetchone()
+    if row:
+        return row[0]
+    return db.execute(f"INSERT INTO {table} (name) VALUES (?)", (name,)).lastrowid
+
+
+for n in range(200):
+    BOOKS.append((f"Filler {n}", [f"Author {n % 7}"], None, 1.0, ["Filler"], ["EPUB"]))
+
+for title, authors, series, index, tags, formats in BOOKS:
+    author_dir = authors[0]
+    book = db.execute("INSERT INTO books (title, series_index) VALUES (?, ?)", (title, index)).lastrowid
+    short = title[:30].strip()
+    db.execute("UPDATE books SET path = ? WHERE id = ?", (f"{author_dir}/{short} ({book})", book))
+    for author in authors:
+        db.execute("INSERT INTO books_authors_link (book, author) VALUES (?, ?)", (book, lookup("authors", author)))
+    if series:
+        db.execute("INSERT INTO books_series_link (book, series) VALUES (?, ?)", (book, lookup("series", series)))
+    for tag in tags:
+        db.execute("INSERT INTO books_tags_link (book, tag) VALUES (?, ?)", (book, lookup("tags", tag)))
+    for fmt in formats:
+        db.execute("INSERT INTO data (book, format, uncompressed_size, name) VALUES (?, ?, ?, ?)",
+                   (book, fmt, 1000 * book, f"{short} - {author_dir}"))
+
+# Links of deleted books may be left behind
+db.execute("DELETE FROM books WHERE title = 'Filler 3'")
+db.commit()
+db.execute("VACUUM")
+db.close()
@@ -0,0 +1,61 @@
+#!/usr/bin/env python3
+"""Generates vocab.db, a small Kindle vocabulary builder database for the
+tests.
+
+The schema is the Kindle's. Run it from this directory: python3 vocab.py
+"""
+import os
+import sqlite3
+
+SCHEMA = """
+CREATE TABLE WORDS (id TEXT PRIMARY KEY NOT NULL, word TEXT, stem TEXT, lang TEXT,
+                    category INTEGER DEFAULT 0, timestamp INTEGER DEFAULT 0, profileid TEXT);
+CREATE TABLE LOOKUPS (id TEXT PRIMARY KEY NOT NULL, word_key TEXT, book_key TEXT, dict_key TEXT,
+                      pos TEXT, usage TEXT, timestamp INTEGER DEFAULT 0);
+CREATE TABLE BOOK_INFO (id TEXT PRIMARY KEY NOT NULL, asin TEXT, guid TEXT, lang TEXT, title TEXT, authors TEXT);
+CREATE TABLE DICT_INFO (id TEXT PRIMARY KEY NOT NULL, asin TEXT, langin TEXT, langout TEXT);
+CREATE TABLE METADATA (id TEXT PRIMARY KEY NOT NULL, dsname TEXT, sscnt INTEGER, profileid TEXT);
+CREATE TABLE VERSION (id TEXT PRIMARY KEY NOT NULL, dsname TEXT, value INTEGER);
+CREATE INDEX lookupwordkey ON LOOKUPS(word_key);
+CREATE INDEX lookupbookkey ON LOOKUPS(book_key);
+"""
+
+BOOKS = [
+    ("dune", "B000", "en", "Dune", "Frank Herbert"),
+    ("emma", "B001", "en", "Emma", "Jane Austen"),
+]
+
+# id, word, stem, lang, category, timestamp
+WORDS = [
+    ("en:sietch", "sietch", "sietch", "en", 0, 1551650000000),
+    ("en:gom jabbar", "gom jabbar", "gom jabbar", "en", 0, 1551640000000),
+    ("en:vexed", "vexed", "vex", "en", 100, 1551660000000),
+    ("en:unused", "unused", "unused", "en", 0, 1551670000000),
+]
+
+# word, book, usage, timestamp
+LOOKUPS = [
+    ("en:sietch", "dune", "They came to the sietch at dawn.", 1551650000000),
+    ("en:gom jabbar", "dune", "Put your hand in the box. The Gom Jabbar <is> at your neck.", 1551640000000),
+    ("en:vexed", "emma", "Emma was vexed; she had\tnot expected it.", 1551660000000),
+    ("en:sietch", "dune", "The sietch was hidden, the Sietch was safe.", 1551680000000),
+    ("en:sietch", "dune", "They came to the sietch at dawn.", 1551690000000),
+    ("en:missing", "dune", "A lookup of a deleted word.", 1551700000000),
+]
+
+path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "vocab.db")
+if os.path.exists(path):
+    os.remove(path)
+db = sqlite3.connect(path)
+db.executescript(SCHEMA)
+for key, asin, lang, title, authors in BOOKS:
+    db.execute("INSERT INTO BOOK_INFO VALUES (?, ?, ?, ?, ?, ?)", (key, asin, key + "-guid", lang, title, authors))
+for row in WORDS:
+    db.execute("INSERT INTO WORDS VALUES (?, ?, ?, ?, ?, ?, 'profile')", row)
+for n, (word, book, usage, timestamp) in enumerate(LOOKUPS):
+    db.execute("INSERT INTO LOOKUPS VALUES (?, ?, ?, 'dict', '0', ?, ?)",
+               (f"{book}:{n}", word, book, usage, timestamp))
+db.execute("DELETE FROM WORDS WHERE id = 'en:unused'")
+db.commit()
+db.execute("VACUUM")
+db.close()
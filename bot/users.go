@@ -0,0 +1,332 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// usersFileName stores known users, their access status and delivery
+	// statistics inside tmpFilesPath
+	usersFileName = ".bot-users.json"
+
+	userPending  = "pending"  // asked to use the bot, waiting for an admin
+	userApproved = "approved" // approved by an admin
+	userBlocked  = "blocked"  // blocked by an admin
+)
+
+// deliveryStats counts delivered and failed books
+type deliveryStats struct {
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+func (s deliveryStats) total() int {
+	return s.Delivered + s.Failed
+}
+
+// failureRate returns the share of failed deliveries in percent
+func (s deliveryStats) failureRate() float64 {
+	if s.total() == 0 {
+		return 0
+	}
+	return float64(s.Failed) * 100 / float64(s.total())
+}
+
+// userRecord is a user who talked to the bot
+type userRecord struct {
+	ID       int           `json:"id"`
+	Name     string        `json:"name,omitempty"`
+	Status   string        `json:"status,omitempty"` // empty unless set by an access request or an admin
+	LastSeen time.Time     `json:"last_seen"`
+	Stats    deliveryStats `json:"stats"`
+	OPDSHash string        `json:"opds_hash,omitempty"` // SHA-256 of the OPDS catalog password
+	TimeZone string        `json:"time_zone,omitempty"` // set with /timezone, the zone of the bot when empty
+}
+
+// displayName returns "@name (id)" or just the ID
+func (u userRecord) displayName() string {
+	if u.Name == "" {
+		return fmt.Sprintf("%d", u.ID)
+	}
+	return fmt.Sprintf("%s (%d)", u.Name, u.ID)
+}
+
+// userData is persisted to usersFileName
+type userData struct {
+	Since   time.Time                 `json:"since"` // when statistics started
+	Users   map[int]*userRecord       `json:"users"`
+	Devices map[string]*deliveryStats `json:"devices"`
+}
+
+// userStore keeps track of users and deliveries across restarts.
+// All methods do nothing on a nil store
+type userStore struct {
+	mu   sync.Mutex
+	path string
+	data userData
+}
+
+// loadUserStore reads the store from path. A missing file is an empty store,
+// an unreadable one is reported but still returns an empty store
+func loadUserStore(path string, now time.Time) (*userStore, error) {
+	s := &userStore{path: path, data: userData{
+		Since:   now,
+		Users:   make(map[int]*userRecord),
+		Devices: make(map[string]*deliveryStats),
+	}}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var data userData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if data.Users != nil {
+		s.data.Users = data.Users
+	}
+	if data.Devices != nil {
+		s.data.Devices = data.Devices
+	}
+	if !data.Since.IsZero() {
+		s.data.Since = data.Since
+	}
+	return s, nil
+}
+
+// seen records that the user talked to the bot. The file is only written
+// for new users and name changes, LastSeen is saved with the next change
+func (s *userStore) seen(user *tb.User, now time.Time) (record userRecord, isNew bool) {
+	if s == nil || user == nil {
+		return userRecord{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := userName(user)
+	u, exists := s.data.Users[user.ID]
+	if !exists {
+		u = &userRecord{ID: user.ID}
+		s.data.Users[user.ID] = u
+	}
+	changed := !exists || (name != "" && u.Name != name)
+	if name != "" {
+		u.Name = name
+	}
+	u.LastSeen = now
+	if changed {
+		s.saveLocked()
+	}
+	return *u, !exists
+}
+
+// status returns the access status set for the user, empty when none
+func (s *userStore) status(userID int) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		return u.Status
+	}
+	return ""
+}
+
+// setStatus changes the access status of a user, adding unknown users
+func (s *userStore) setStatus(userID int, status string) userRecord {
+	if s == nil {
+		return userRecord{ID: userID, Status: status}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		u = &userRecord{ID: userID}
+		s.data.Users[userID] = u
+	}
+	u.Status = status
+	s.saveLocked()
+	return *u
+}
+
+// setOPDSHash stores the hash of a new OPDS password of a user
+func (s *userStore) setOPDSHash(userID int, hash string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		u = &userRecord{ID: userID}
+		s.data.Users[userID] = u
+	}
+	u.OPDSHash = hash
+	s.saveLocked()
+}
+
+// opdsHash returns the hash of the user's OPDS password, empty when none
+func (s *userStore) opdsHash(userID int) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		return u.OPDSHash
+	}
+	return ""
+}
+
+// setTimeZone stores the time zone of a user, see parseTimeZone
+func (s *userStore) setTimeZone(userID int, zone string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		u = &userRecord{ID: userID}
+		s.data.Users[userID] = u
+	}
+	u.TimeZone = zone
+	s.saveLocked()
+}
+
+// timeZone returns the time zone of a user, empty when not set
+func (s *userStore) timeZone(userID int) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		return u.TimeZone
+	}
+	return ""
+}
+
+// recordDelivery counts a delivered or failed book. device is empty for
+// jobs that failed before a device was chosen
+func (s *userStore) recordDelivery(userID int, device string, delivered bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		u = &userRecord{ID: userID}
+		s.data.Users[userID] = u
+	}
+	u.Stats.add(delivered)
+	if device != "" {
+		d, ok := s.data.Devices[device]
+		if !ok {
+			d = &deliveryStats{}
+			s.data.Devices[device] = d
+		}
+		d.add(delivered)
+	}
+	s.saveLocked()
+}
+
+func (s *deliveryStats) add(delivered bool) {
+	if delivered {
+		s.Delivered++
+	} else {
+		s.Failed++
+	}
+}
+
+// users returns all known users, most recently seen first
+func (s *userStore) users() []userRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]userRecord, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].LastSeen.Equal(users[j].LastSeen) {
+			return users[i].LastSeen.After(users[j].LastSeen)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+// devices returns a copy of the statistics per device
+func (s *userStore) devices() map[string]deliveryStats {
+	devices := make(map[string]deliveryStats)
+	if s == nil {
+		return devices
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, stats := range s.data.Devices {
+		devices[name] = *stats
+	}
+	return devices
+}
+
+// since returns when statistics started
+func (s *userStore) since() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Since
+}
+
+func (s *userStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save users", "path", s.path, "err", err)
+	}
+}
+
+func (s *userStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// userName returns "@username" or the first and last name
+func userName(user *tb.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
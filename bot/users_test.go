@@ -0,0 +1,74 @@
+package bot
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), usersFileName)
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := loadUserStore(path, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isNew := store.seen(&tb.User{ID: 1, Username: "john"}, since.Add(time.Hour)); !isNew {
+		t.Errorf("seen() isNew = false for a new user")
+	}
+	if _, isNew := store.seen(&tb.User{ID: 1, Username: "john"}, since.Add(2*time.Hour)); isNew {
+		t.Errorf("seen() isNew = true for a known user")
+	}
+	store.seen(&tb.User{ID: 2, FirstName: "Jane", LastName: "Doe"}, since.Add(3*time.Hour))
+	store.setStatus(2, userBlocked)
+	store.recordDelivery(1, "Oasis", true)
+	store.recordDelivery(1, "Oasis", false)
+	store.recordDelivery(1, "", false)
+
+	reloaded, err := loadUserStore(path, time.Now())
+	if err != nil {
+		t.Fatalf("loadUserStore() error = %v", err)
+	}
+	if got := reloaded.since(); !got.Equal(since) {
+		t.Errorf("since() = %v, want %v", got, since)
+	}
+	if got := reloaded.status(2); got != userBlocked {
+		t.Errorf("status(2) = %q, want %q", got, userBlocked)
+	}
+	users := reloaded.users()
+	if len(users) != 2 || users[0].ID != 2 || users[0].Name != "Jane Doe" || users[1].Name != "@john" {
+		t.Fatalf("users() = %+v, want Jane Doe then @john", users)
+	}
+	if want := (deliveryStats{Delivered: 1, Failed: 2}); users[1].Stats != want {
+		t.Errorf("user stats = %+v, want %+v", users[1].Stats, want)
+	}
+	if want := (deliveryStats{Delivered: 1, Failed: 1}); reloaded.devices()["Oasis"] != want {
+		t.Errorf("device stats = %+v, want %+v", reloaded.devices()["Oasis"], want)
+	}
+}
+
+func TestLoadUserStore_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), usersFileName)
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := loadUserStore(path, time.Now())
+	if err == nil {
+		t.Errorf("loadUserStore() expected an error")
+	}
+	if store == nil || len(store.users()) != 0 {
+		t.Errorf("loadUserStore() should return an empty store on errors")
+	}
+}
+
+func TestUserStore_nil(t *testing.T) {
+	var store *userStore
+	store.seen(&tb.User{ID: 1}, time.Now())
+	store.recordDelivery(1, "Oasis", true)
+	if store.status(1) != "" || store.users() != nil || len(store.devices()) != 0 {
+		t.Errorf("nil store should be empty")
+	}
+}
@@ -0,0 +1,569 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vocabularyFileName stores which words were exported per user inside
+	// tmpFilesPath
+	vocabularyFileName = ".bot-vocabulary.json"
+	// vocabCallbackPrefix starts the callback data of the review deck button
+	vocabCallbackPrefix = "vocab:"
+	vocabDeckCallback   = vocabCallbackPrefix + "deck"
+
+	VocabularyTSV = "tsv" // tab separated, the default of Anki
+	VocabularyCSV = "csv"
+
+	// kindleMastered is the category of words marked as learned
+	kindleMastered = 100
+	// maxVocabularyUsages limits the sentences exported per word
+	maxVocabularyUsages = 3
+)
+
+var (
+	// ErrInvalidVocabularyFormat - represents a vocabulary export format other than tsv or csv
+	ErrInvalidVocabularyFormat = errors.New("vocabulary format must be tsv or csv")
+	// ErrNoVocabulary - represents a vocab.db without looked up words
+	ErrNoVocabulary = errors.New("no words in the vocabulary builder")
+)
+
+// vocabLookup is one look up of a word while reading
+type vocabLookup struct {
+	Usage   string    `json:"usage,omitempty"` // the sentence the word was found in
+	Book    string    `json:"book,omitempty"`
+	Authors string    `json:"authors,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// vocabWord is a word of the Kindle vocabulary builder
+type vocabWord struct {
+	ID       string        `json:"id"` // "<language>:<word>", as stored by the Kindle
+	Word     string        `json:"word"`
+	Stem     string        `json:"stem,omitempty"`
+	Language string        `json:"language,omitempty"`
+	Mastered bool          `json:"mastered,omitempty"`
+	Lookups  []vocabLookup `json:"lookups,omitempty"` // oldest first
+}
+
+// books returns the distinct titles the word was looked up in
+func (w vocabWord) books() []string {
+	var books []string
+	seen := make(map[string]bool)
+	for _, l := range w.Lookups {
+		if l.Book != "" && !seen[l.Book] {
+			seen[l.Book] = true
+			books = append(books, l.Book)
+		}
+	}
+	return books
+}
+
+// usages returns up to maxVocabularyUsages distinct sentences as HTML with
+// the word in bold
+func (w vocabWord) usages() []string {
+	var usages []string
+	seen := make(map[string]bool)
+	for _, l := range w.Lookups {
+		usage := strings.Join(strings.Fields(l.Usage), " ")
+		if usage == "" || seen[usage] {
+			continue
+		}
+		seen[usage] = true
+		usages = append(usages, emphasizeWord(usage, w.Word))
+		if len(usages) == maxVocabularyUsages {
+			break
+		}
+	}
+	return usages
+}
+
+// emphasizeWord escapes text for HTML and puts every occurrence of word in
+// <b>, ignoring case
+func emphasizeWord(text, word string) string {
+	if word == "" {
+		return html.EscapeString(text)
+	}
+	re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(word))
+	var out strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		out.WriteString(html.EscapeString(text[last:m[0]]))
+		out.WriteString("<b>" + html.EscapeString(text[m[0]:m[1]]) + "</b>")
+		last = m[1]
+	}
+	out.WriteString(html.EscapeString(text[last:]))
+	return out.String()
+}
+
+// readVocabulary reads the words of a Kindle vocab.db with the sentences
+// and books they were looked up in, ordered by their first look up
+func readVocabulary(path string) ([]vocabWord, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tables := make(map[string][]sqliteRow)
+	for _, name := range []string{"WORDS", "LOOKUPS", "BOOK_INFO"} {
+		rows, err := db.table(name)
+		if err != nil {
+			return nil, err
+		}
+		tables[name] = rows
+	}
+	books := make(map[string]sqliteRow, len(tables["BOOK_INFO"]))
+	for _, row := range tables["BOOK_INFO"] {
+		books[row.text("id")] = row
+	}
+	index := make(map[string]*vocabWord, len(tables["WORDS"]))
+	words := make([]*vocabWord, 0, len(tables["WORDS"]))
+	for _, row := range tables["WORDS"] {
+		word := &vocabWord{
+			ID:       row.text("id"),
+			Word:     row.text("word"),
+			Stem:     row.text("stem"),
+			Language: row.text("lang"),
+			Mastered: row.int("category") == kindleMastered,
+		}
+		if word.ID == "" || word.Word == "" {
+			continue
+		}
+		index[word.ID] = word
+		words = append(words, word)
+	}
+	for _, row := range tables["LOOKUPS"] {
+		word, ok := index[row.text("word_key")]
+		if !ok {
+			continue
+		}
+		lookup := vocabLookup{Usage: strings.TrimSpace(row.text("usage")), Time: kindleTime(row.int("timestamp"))}
+		if book, ok := books[row.text("book_key")]; ok {
+			lookup.Book, lookup.Authors = book.text("title"), book.text("authors")
+		}
+		word.Lookups = append(word.Lookups, lookup)
+	}
+	if len(words) == 0 {
+		return nil, ErrNoVocabulary
+	}
+
+	result := make([]vocabWord, 0, len(words))
+	for _, word := range words {
+		sort.SliceStable(word.Lookups, func(i, j int) bool { return word.Lookups[i].Time.Before(word.Lookups[j].Time) })
+		result = append(result, *word)
+	}
+	first := func(w vocabWord) time.Time {
+		if len(w.Lookups) == 0 {
+			return time.Time{}
+		}
+		return w.Lookups[0].Time
+	}
+	sort.SliceStable(result, func(i, j int) bool { return first(result[i]).Before(first(result[j])) })
+	return result, nil
+}
+
+// kindleTime converts the milliseconds the Kindle stores
+func kindleTime(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// ankiExport renders words as a file Anki imports as is: a header names
+// the separator, the columns and the tags column, fields are HTML
+func ankiExport(words []vocabWord, format string) ([]byte, error) {
+	columns := []string{"Word", "Stem", "Context", "Book", "Language", "Tags"}
+	var buf bytes.Buffer
+	separator := "tab"
+	if format == VocabularyCSV {
+		separator = "comma"
+	}
+	fmt.Fprintf(&buf, "#separator:%s\n#html:true\n#tags column:%d\n", separator, len(columns))
+
+	rows := [][]string{columns}
+	for _, word := range words {
+		tags := []string{"kindle"}
+		if word.Mastered {
+			tags = append(tags, "mastered")
+		}
+		rows = append(rows, []string{
+			html.EscapeString(word.Word),
+			html.EscapeString(word.Stem),
+			strings.Join(word.usages(), "<br><br>"),
+			html.EscapeString(strings.Join(word.books(), "; ")),
+			html.EscapeString(word.Language),
+			strings.Join(tags, " "),
+		})
+	}
+
+	if format == VocabularyCSV {
+		fmt.Fprintf(&buf, "#columns:%s\n", strings.Join(rows[0], ","))
+		w := csv.NewWriter(&buf)
+		if err := w.WriteAll(rows[1:]); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	// Tabs and line breaks would split fields and notes
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	for i, row := range rows {
+		for j := range row {
+			row[j] = clean.Replace(row[j])
+		}
+		if i == 0 {
+			buf.WriteString("#columns:")
+		}
+		buf.WriteString(strings.Join(row, "\t") + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// vocabularyDeck returns an EPUB to review words on the Kindle, with a
+// chapter per book the words were first looked up in
+func vocabularyDeck(words []vocabWord, now time.Time) epubBook {
+	title := "Kindle Vocabulary " + now.Format("2006-01-02")
+	book := epubBook{Title: title, Modified: now}
+	if len(words) > 0 {
+		book.Language = strings.ToLower(words[0].Language)
+	}
+
+	var order []string
+	chapters := make(map[string]*strings.Builder)
+	for _, word := range words {
+		name := "Other words"
+		if books := word.books(); len(books) > 0 {
+			name = books[0]
+		}
+		body, ok := chapters[name]
+		if !ok {
+			body = &strings.Builder{}
+			fmt.Fprintf(body, "<h1>%s</h1>\n", html.EscapeString(name))
+			chapters[name] = body
+			order = append(order, name)
+		}
+		fmt.Fprintf(body, "<h2>%s</h2>\n", html.EscapeString(word.Word))
+		if word.Stem != "" && word.Stem != word.Word {
+			fmt.Fprintf(body, "<p class=\"small\">%s</p>\n", html.EscapeString(word.Stem))
+		}
+		for _, usage := range word.usages() {
+			fmt.Fprintf(body, "<blockquote><p>%s</p></blockquote>\n", usage)
+		}
+	}
+	for _, name := range order {
+		book.Chapters = append(book.Chapters, epubChapter{Title: name, Body: chapters[name].String()})
+	}
+	return book
+}
+
+// vocabularyUser is what the store keeps per user
+type vocabularyUser struct {
+	Exported map[string]time.Time `json:"exported"`       // word ID -> when it was exported
+	Deck     []vocabWord          `json:"deck,omitempty"` // the words of the last export
+}
+
+// vocabularyStore tracks which words were exported per user across
+// restarts, so each upload only exports new words. All methods do nothing
+// on a nil store
+type vocabularyStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[int]*vocabularyUser
+}
+
+// loadVocabularyStore reads the store from path. A missing file is an empty
+// store, an unreadable one is reported but still returns an empty store
+func loadVocabularyStore(path string) (*vocabularyStore, error) {
+	s := &vocabularyStore{path: path, users: make(map[int]*vocabularyUser)}
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var users map[int]*vocabularyUser
+	if err := json.Unmarshal(content, &users); err != nil {
+		return s, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	if users != nil {
+		s.users = users
+	}
+	return s, nil
+}
+
+// fresh returns the words that were not exported before
+func (s *vocabularyStore) fresh(userID int, words []vocabWord) []vocabWord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[userID]
+	var fresh []vocabWord
+	for _, word := range words {
+		if u != nil {
+			if _, exported := u.Exported[word.ID]; exported {
+				continue
+			}
+		}
+		fresh = append(fresh, word)
+	}
+	return fresh
+}
+
+// markExported records words as exported once the user received them.
+// They become the review deck of the user
+func (s *vocabularyStore) markExported(userID int, words []vocabWord, now time.Time) {
+	if s == nil || len(words) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		u = &vocabularyUser{}
+		s.users[userID] = u
+	}
+	if u.Exported == nil {
+		u.Exported = make(map[string]time.Time)
+	}
+	for _, word := range words {
+		u.Exported[word.ID] = now
+	}
+	u.Deck = words
+	s.saveLocked()
+}
+
+// deck returns the words of the last export
+func (s *vocabularyStore) deck(userID int) []vocabWord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		return append([]vocabWord(nil), u.Deck...)
+	}
+	return nil
+}
+
+// exported returns how many words of the user were exported
+func (s *vocabularyStore) exported(userID int) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		return len(u.Exported)
+	}
+	return 0
+}
+
+// reset forgets the exported words of the user and returns how many
+func (s *vocabularyStore) reset(userID int) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return 0
+	}
+	delete(s.users, userID)
+	s.saveLocked()
+	return len(u.Exported)
+}
+
+func (s *vocabularyStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		logging.Warn("Could not save vocabulary", "path", s.path, "err", err)
+	}
+}
+
+func (s *vocabularyStore) writeLocked() error {
+	content, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDirectory(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// verifyVocabulary checks and normalizes VocabularyFormat
+func (b *SendToKindleBot) verifyVocabulary() error {
+	b.VocabularyFormat = strings.ToLower(b.VocabularyFormat)
+	switch b.VocabularyFormat {
+	case "":
+		b.VocabularyFormat = VocabularyTSV
+	case VocabularyTSV, VocabularyCSV:
+	default:
+		return fmt.Errorf("%w, got %q", ErrInvalidVocabularyFormat, b.VocabularyFormat)
+	}
+	return nil
+}
+
+// isVocabularyFile reports whether an upload is the vocab.db of a Kindle,
+// also when renamed on the way, e.g. "vocab (1).db"
+func isVocabularyFile(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "vocab") && strings.HasSuffix(name, ".db")
+}
+
+// importVocabulary exports the words of an uploaded vocab.db that were not
+// exported before as an Anki deck, instead of sending it to a device
+func (b *SendToKindleBot) importVocabulary(bot *tb.Bot, m *tb.Message) {
+	jobID := newJobID()
+	logger := logging.Default().With("job", jobID, "user", m.Sender.ID)
+	ctx := logging.NewContext(context.Background(), logger)
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		logger.Error("Could not create directory", "path", b.tmpFilesPath, "err", err)
+		respond(bot, m, "❌ Could not read your vocabulary. Please try again later.")
+		return
+	}
+	path := filepath.Join(b.tmpFilesPath, "vocab-"+jobID+".db")
+	defer os.Remove(path)
+	if err := b.downloadFile(ctx, bot, &m.Document.File, path); err != nil {
+		logger.Error("Could not download vocabulary", "err", err)
+		if errors.Is(err, ErrFileTooLarge) {
+			respond(bot, m, fmt.Sprintf("❌ The file is too large, the limit is %s.", formatFileSize(b.fileSizeLimit())))
+			return
+		}
+		respond(bot, m, "❌ Could not download your vocabulary. Please try again.")
+		return
+	}
+	words, err := readVocabulary(path)
+	if err != nil {
+		logger.Warn("Could not read vocabulary", "err", err)
+		respond(bot, m, "❌ This is not a vocabulary builder database. Please send the vocab.db from the "+
+			"system/vocabulary folder of your Kindle.")
+		return
+	}
+
+	now := time.Now()
+	fresh := b.vocabulary.fresh(m.Sender.ID, words)
+	if len(fresh) == 0 {
+		respond(bot, m, fmt.Sprintf("📖 No new words since the last export, all %d were exported before.\n\n"+
+			"Use /vocab reset to export every word again.", len(words)))
+		return
+	}
+	format := b.current().vocabularyFormat
+	export, err := ankiExport(fresh, format)
+	if err != nil {
+		logger.Error("Could not export vocabulary", "err", err)
+		respond(bot, m, "❌ Could not export your vocabulary. Please try again later.")
+		return
+	}
+	books := make(map[string]bool)
+	for _, word := range fresh {
+		for _, book := range word.books() {
+			books[book] = true
+		}
+	}
+	caption := fmt.Sprintf("📖 %d new word(s) from %d book(s). Import the file in Anki with File → Import, "+
+		"the columns and tags are set up by the file.", len(fresh), len(books))
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{
+		{Text: "📚 Send review deck to Kindle", Data: vocabDeckCallback},
+	}}}
+	if _, err := bot.Send(m.Sender, &tb.Document{
+		File:     tb.FromReader(bytes.NewReader(export)),
+		FileName: "kindle-vocabulary-" + now.Format("2006-01-02") + "." + format,
+		Caption:  caption,
+	}, markup); err != nil {
+		// The words stay new, the next upload exports them again
+		logger.Error("Could not send vocabulary export", "err", err)
+		respond(bot, m, "❌ Could not send your vocabulary. Please try again later.")
+		return
+	}
+	b.vocabulary.markExported(m.Sender.ID, fresh, now)
+	logger.Info("Exported Kindle vocabulary", "words", len(words), "new", len(fresh))
+}
+
+// vocabCommand handles "/vocab [reset]": how many words were exported, or
+// forgetting them so the next upload exports every word
+func (b *SendToKindleBot) vocabCommand(bot *tb.Bot) func(m *tb.Message) {
+	return func(m *tb.Message) {
+		if !b.checkAllowed(bot, m.Sender) {
+			return
+		}
+		if strings.EqualFold(strings.TrimSpace(m.Payload), "reset") {
+			n := b.vocabulary.reset(m.Sender.ID)
+			logging.Info("Reset exported vocabulary", "user", m.Sender.ID, "words", n)
+			respond(bot, m, fmt.Sprintf("📖 Forgot %d exported word(s), the next upload exports every word.", n))
+			return
+		}
+		respond(bot, m, fmt.Sprintf("📖 %d word(s) exported so far.\n\nSend the vocab.db from the system/vocabulary "+
+			"folder of your Kindle to export new words for Anki. /vocab reset exports every word again.",
+			b.vocabulary.exported(m.Sender.ID)))
+	}
+}
+
+// vocabCallback sends the review deck of the last export through the usual
+// pipeline, as if the user had uploaded it
+func (b *SendToKindleBot) vocabCallback(bot *tb.Bot, c *tb.Callback) {
+	bot.Respond(c, &tb.CallbackResponse{})
+	if c.Data != vocabDeckCallback {
+		logging.Debug("Invalid vocabulary callback", "user", c.Sender.ID, "data", c.Data)
+		return
+	}
+	words := b.vocabulary.deck(c.Sender.ID)
+	if len(words) == 0 {
+		bot.Send(c.Sender, "📖 There is no review deck, send your vocab.db first.")
+		return
+	}
+	now := time.Now()
+	deck := vocabularyDeck(words, now)
+	if err := ensureDirectory(b.tmpFilesPath); err != nil {
+		logging.Error("Could not create directory", "path", b.tmpFilesPath, "err", err)
+		return
+	}
+	// processDocument copies the file under its own name
+	path := filepath.Join(b.tmpFilesPath, "vocab-deck-"+newJobID()+".epub")
+	defer os.Remove(path)
+	if err := writeEPUB(path, deck); err != nil {
+		logging.Error("Could not write review deck", "user", c.Sender.ID, "err", err)
+		bot.Send(c.Sender, "❌ Could not create the review deck. Please try again later.")
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		logging.Error("Could not write review deck", "user", c.Sender.ID, "err", err)
+		return
+	}
+	logging.Info("Sending vocabulary review deck", "user", c.Sender.ID, "words", len(words))
+	b.processDocument(bot, &tb.Message{
+		Sender: c.Sender,
+		Document: &tb.Document{
+			File:     tb.File{FileSize: int(info.Size())},
+			FileName: deck.Title + ".epub",
+		},
+	}, "", path)
+}
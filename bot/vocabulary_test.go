@@ -0,0 +1,241 @@
+package bot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadVocabulary(t *testing.T) {
+	words, err := readVocabulary(filepath.Join("testdata", "vocab", "vocab.db"))
+	if err != nil {
+		t.Fatalf("readVocabulary() error = %v", err)
+	}
+	var ids []string
+	for _, word := range words {
+		ids = append(ids, word.ID)
+	}
+	if want := []string{"en:gom jabbar", "en:sietch", "en:vexed"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("readVocabulary() = %q, want %q in the order of their first look up", ids, want)
+	}
+	sietch := words[1]
+	if sietch.Word != "sietch" || sietch.Language != "en" || sietch.Mastered || len(sietch.Lookups) != 3 {
+		t.Errorf("readVocabulary() sietch = %+v", sietch)
+	}
+	want := vocabLookup{
+		Usage:   "They came to the sietch at dawn.",
+		Book:    "Dune",
+		Authors: "Frank Herbert",
+		Time:    time.Date(2019, 3, 3, 21, 53, 20, 0, time.UTC),
+	}
+	if sietch.Lookups[0] != want {
+		t.Errorf("readVocabulary() first look up = %+v, want %+v", sietch.Lookups[0], want)
+	}
+	if vexed := words[2]; vexed.Stem != "vex" || !vexed.Mastered || vexed.Lookups[0].Book != "Emma" {
+		t.Errorf("readVocabulary() vexed = %+v", vexed)
+	}
+
+	if _, err := readVocabulary(filepath.Join("testdata", "calibre", "metadata.db")); err == nil {
+		t.Error("readVocabulary(metadata.db) error = nil, want a missing table")
+	}
+	text := filepath.Join(t.TempDir(), "vocab.db")
+	if err := os.WriteFile(text, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readVocabulary(text); !errors.Is(err, errNotSQLite) {
+		t.Errorf("readVocabulary(text) error = %v, want errNotSQLite", err)
+	}
+}
+
+func TestEmphasizeWord(t *testing.T) {
+	tests := []struct {
+		text, word, want string
+	}{
+		{text: "The sietch was safe", word: "sietch", want: "The <b>sietch</b> was safe"},
+		{text: "Sietch and sietch", word: "sietch", want: "<b>Sietch</b> and <b>sietch</b>"},
+		{text: "a <b> & c", word: "c", want: "a &lt;b&gt; &amp; <b>c</b>"},
+		{text: "no match", word: "x.y", want: "no match"},
+		{text: "no word", word: "", want: "no word"},
+	}
+	for _, tt := range tests {
+		if got := emphasizeWord(tt.text, tt.word); got != tt.want {
+			t.Errorf("emphasizeWord(%q, %q) = %q, want %q", tt.text, tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestAnkiExport(t *testing.T) {
+	words := []vocabWord{
+		{ID: "en:vexed", Word: "vexed", Stem: "vex", Language: "en", Mastered: true, Lookups: []vocabLookup{
+			{Usage: "Emma was vexed;\tshe was", Book: "Emma"},
+			{Usage: "Emma  was vexed;\tshe was", Book: "Emma"},
+			{Usage: "Vexed, again", Book: "Emma, Again"},
+		}},
+		{ID: "en:sietch", Word: "sietch", Language: "en"},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: VocabularyTSV,
+			want: "#separator:tab\n#html:true\n#tags column:6\n" +
+				"#columns:Word\tStem\tContext\tBook\tLanguage\tTags\n" +
+				"vexed\tvex\tEmma was <b>vexed</b>; she was<br><br><b>Vexed</b>, again\tEmma; Emma, Again\ten\tkindle mastered\n" +
+				"sietch\t\t\t\ten\tkindle\n",
+		},
+		{
+			format: VocabularyCSV,
+			want: "#separator:comma\n#html:true\n#tags column:6\n" +
+				"#columns:Word,Stem,Context,Book,Language,Tags\n" +
+				"vexed,vex,\"Emma was <b>vexed</b>; she was<br><br><b>Vexed</b>, again\",\"Emma; Emma, Again\",en,kindle mastered\n" +
+				"sietch,,,,en,kindle\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := ankiExport(words, tt.format)
+			if err != nil {
+				t.Fatalf("ankiExport() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ankiExport() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVocabularyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), vocabularyFileName)
+	s, err := loadVocabularyStore(path)
+	if err != nil {
+		t.Fatalf("loadVocabularyStore() error = %v", err)
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	first := []vocabWord{{ID: "en:a", Word: "a"}, {ID: "en:b", Word: "b"}}
+	if fresh := s.fresh(1, first); len(fresh) != 2 {
+		t.Errorf("fresh() = %d words, want 2", len(fresh))
+	}
+	// Words only count as exported once they were sent
+	if fresh := s.fresh(1, first); len(fresh) != 2 {
+		t.Errorf("fresh() before markExported() = %d words, want 2", len(fresh))
+	}
+	export := func(s *vocabularyStore, userID int, words []vocabWord) []vocabWord {
+		fresh := s.fresh(userID, words)
+		s.markExported(userID, fresh, now)
+		return fresh
+	}
+	if fresh := export(s, 1, first); len(fresh) != 2 {
+		t.Errorf("export() = %d words, want 2", len(fresh))
+	}
+	// The next upload of the same Kindle has every word again
+	second := append(first, vocabWord{ID: "en:c", Word: "c"})
+	fresh := export(s, 1, second)
+	if len(fresh) != 1 || fresh[0].ID != "en:c" {
+		t.Errorf("export() again = %+v, want only en:c", fresh)
+	}
+	if fresh := export(s, 1, second); len(fresh) != 0 {
+		t.Errorf("export() without new words = %+v", fresh)
+	}
+	if deck := s.deck(1); len(deck) != 1 || deck[0].ID != "en:c" {
+		t.Errorf("deck() = %+v, want the last export", deck)
+	}
+	if fresh := export(s, 2, first); len(fresh) != 2 {
+		t.Errorf("export() of another user = %d words, want 2", len(fresh))
+	}
+
+	reloaded, err := loadVocabularyStore(path)
+	if err != nil {
+		t.Fatalf("loadVocabularyStore() reload error = %v", err)
+	}
+	if n := reloaded.exported(1); n != 3 {
+		t.Errorf("exported(1) after reload = %d, want 3", n)
+	}
+	if n := reloaded.reset(1); n != 3 {
+		t.Errorf("reset(1) = %d, want 3", n)
+	}
+	if fresh := export(reloaded, 1, second); len(fresh) != 3 {
+		t.Errorf("export() after reset = %d words, want 3", len(fresh))
+	}
+	if n := reloaded.exported(2); n != 2 {
+		t.Errorf("exported(2) = %d, want 2", n)
+	}
+
+	var nilStore *vocabularyStore
+	nilStore.markExported(1, first, now)
+	if nilStore.fresh(1, first) != nil || nilStore.deck(1) != nil || nilStore.reset(1) != 0 || nilStore.exported(1) != 0 {
+		t.Error("nil store returned words")
+	}
+}
+
+func TestVocabularyDeck(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	words := []vocabWord{
+		{Word: "sietch", Stem: "sietch", Language: "EN", Lookups: []vocabLookup{{Usage: "The sietch & more", Book: "Dune"}}},
+		{Word: "vexed", Stem: "vex", Lookups: []vocabLookup{{Usage: "Emma was vexed", Book: "Emma"}}},
+		{Word: "spice", Lookups: []vocabLookup{{Usage: "The spice must flow", Book: "Dune"}}},
+		{Word: "lonely"},
+	}
+	deck := vocabularyDeck(words, now)
+	if deck.Title != "Kindle Vocabulary 2026-10-18" || deck.Language != "en" {
+		t.Errorf("vocabularyDeck() = %q, %q", deck.Title, deck.Language)
+	}
+	var titles []string
+	for _, c := range deck.Chapters {
+		titles = append(titles, c.Title)
+	}
+	if want := []string{"Dune", "Emma", "Other words"}; !reflect.DeepEqual(titles, want) {
+		t.Fatalf("vocabularyDeck() chapters = %q, want %q", titles, want)
+	}
+	dune := deck.Chapters[0].Body
+	for _, want := range []string{"<h1>Dune</h1>", "<h2>sietch</h2>", "The <b>sietch</b> &amp; more", "<h2>spice</h2>"} {
+		if !strings.Contains(dune, want) {
+			t.Errorf("Dune chapter does not contain %q:\n%s", want, dune)
+		}
+	}
+	if strings.Contains(dune, `<p class="small">sietch</p>`) {
+		t.Errorf("Dune chapter repeats a stem equal to the word:\n%s", dune)
+	}
+	if !strings.Contains(deck.Chapters[1].Body, `<p class="small">vex</p>`) {
+		t.Errorf("Emma chapter has no stem:\n%s", deck.Chapters[1].Body)
+	}
+
+	path := filepath.Join(t.TempDir(), "deck.epub")
+	if err := writeEPUB(path, deck); err != nil {
+		t.Fatalf("writeEPUB() error = %v", err)
+	}
+	if m := extractMetadata("deck.epub", path); m.Title != deck.Title {
+		t.Errorf("extractMetadata() = %+v", m)
+	}
+}
+
+func TestVerifyVocabulary(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+		err    error
+	}{
+		{format: "", want: VocabularyTSV},
+		{format: "CSV", want: VocabularyCSV},
+		{format: "xlsx", err: ErrInvalidVocabularyFormat},
+	}
+	for _, tt := range tests {
+		b := &SendToKindleBot{VocabularyFormat: tt.format}
+		err := b.verifyVocabulary()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("verifyVocabulary(%q) error = %v, want %v", tt.format, err, tt.err)
+		}
+		if err == nil && b.VocabularyFormat != tt.want {
+			t.Errorf("verifyVocabulary(%q) format = %q, want %q", tt.format, b.VocabularyFormat, tt.want)
+		}
+	}
+	for name, want := range map[string]bool{"vocab.db": true, "Vocab (1).DB": true, "metadata.db": false, "vocab.txt": false} {
+		if got := isVocabularyFile(name); got != want {
+			t.Errorf("isVocabularyFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// UpdateModePolling - receive updates with getUpdates long polling
+	UpdateModePolling = "polling"
+	// UpdateModeWebhook - receive updates with an HTTPS webhook
+	UpdateModeWebhook = "webhook"
+
+	defaultWebhookListen = ":8443"
+	// webhookSecretHeader is set by Telegram on every webhook request
+	// when secret_token was passed to setWebhook
+	webhookSecretHeader  = "X-Telegram-Bot-Api-Secret-Token"
+	maxWebhookBodySize   = 1 << 20
+	webhookShutdownGrace = 5 * time.Second
+	setWebhookTimeout    = 30 * time.Second
+)
+
+var (
+	// ErrInvalidUpdateMode - represents a validation error when UpdateMode is unknown
+	ErrInvalidUpdateMode = errors.New("update mode must be polling or webhook")
+	// ErrNoWebhookURL - represents a validation error when webhook mode has no public URL
+	ErrNoWebhookURL = errors.New("webhook url not set")
+	// ErrInvalidWebhookSecret - represents a validation error for a malformed secret token
+	ErrInvalidWebhookSecret = errors.New("webhook secret must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+	// ErrWebhookKeyPair - represents a validation error when only one of cert and key is set
+	ErrWebhookKeyPair = errors.New("webhook certificate and key must be set together")
+
+	webhookSecretRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+	// setWebhookClient keeps an unreachable Bot API from blocking startup
+	// and secret rotations
+	setWebhookClient = &http.Client{Timeout: setWebhookTimeout}
+)
+
+// webhookPoller is a tb.Poller receiving updates over a webhook.
+// Unlike tb.Webhook it verifies the secret token Telegram sends with
+// every request and can run behind a reverse proxy terminating TLS
+type webhookPoller struct {
+	listen    string
+	publicURL string
+	certFile  string // self-signed certificate, uploaded to Telegram and used for TLS
+	keyFile   string
+	health    *pollerHealth
+
+	listener net.Listener // bound by bind before the bot starts
+
+	mu       sync.RWMutex
+	secret   string
+	previous string // also accepted while a new secret is registered
+
+	dest chan<- tb.Update
+}
+
+// bind opens the listen address, so an address in use stops the bot from
+// starting instead of leaving it without updates
+func (w *webhookPoller) bind() error {
+	listener, err := net.Listen("tcp", w.listen)
+	if err != nil {
+		return fmt.Errorf("webhook server could not listen: %w", err)
+	}
+	w.listener = listener
+	return nil
+}
+
+// Poll serves the webhook until stop is closed. The listener is bound and
+// the webhook registered by prepareUpdates before the bot starts
+func (w *webhookPoller) Poll(bot *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	w.dest = dest
+	if w.listener == nil {
+		if err := w.bind(); err != nil {
+			logging.Error("Webhook server could not listen", "err", err)
+			return
+		}
+	}
+	logging.Info("Webhook server listening", "listen", w.listen)
+
+	server := &http.Server{
+		Addr:    w.listen,
+		Handler: w,
+	}
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownGrace)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logging.Warn("Could not shut down webhook server", "err", err)
+		}
+	}()
+
+	w.health.started(time.Now())
+	defer w.health.stopped()
+
+	var err error
+	if w.certFile != "" {
+		err = server.ServeTLS(w.listener, w.certFile, w.keyFile)
+	} else {
+		err = server.Serve(w.listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logging.Error("Webhook server stopped", "err", err)
+	}
+}
+
+// ServeHTTP accepts a single update from Telegram
+func (w *webhookPoller) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.mu.RLock()
+	secret, previous := w.secret, w.previous
+	w.mu.RUnlock()
+	if secret != "" {
+		got := r.Header.Get(webhookSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 &&
+			(previous == "" || subtle.ConstantTimeCompare([]byte(got), []byte(previous)) != 1) {
+			logging.Warn("Rejected webhook request: bad secret token", "remote", r.RemoteAddr)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var update tb.Update
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBodySize)).Decode(&update); err != nil {
+		logging.Warn("Could not decode webhook update", "err", err)
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.health.polled(time.Now(), 1)
+	w.dest <- update
+	rw.WriteHeader(http.StatusOK)
+}
+
+// rotateSecret registers the webhook with a new secret, accepting both
+// secrets until Telegram confirmed it
+func (w *webhookPoller) rotateSecret(bot *tb.Bot, secret string) error {
+	w.mu.Lock()
+	w.previous, w.secret = w.secret, secret
+	w.mu.Unlock()
+
+	err := w.register(bot)
+	w.mu.Lock()
+	if err != nil {
+		w.secret = w.previous
+	}
+	w.previous = ""
+	w.mu.Unlock()
+	return err
+}
+
+// register calls setWebhook. It is sent as multipart form so the
+// optional self-signed certificate can be uploaded in the same request
+func (w *webhookPoller) register(bot *tb.Bot) error {
+	w.mu.RLock()
+	secret := w.secret
+	w.mu.RUnlock()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("url", w.publicURL); err != nil {
+		return err
+	}
+	if secret != "" {
+		if err := form.WriteField("secret_token", secret); err != nil {
+			return err
+		}
+	}
+	if w.certFile != "" {
+		if err := attachFormFile(form, "certificate", w.certFile); err != nil {
+			return fmt.Errorf("could not attach webhook certificate: %w", err)
+		}
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	url := bot.URL + "/bot" + bot.Token + "/setWebhook"
+	resp, err := setWebhookClient.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("could not call setWebhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("could not decode setWebhook response: %w", err)
+	}
+	if !result.Ok {
+		return fmt.Errorf("setWebhook failed: %s", result.Description)
+	}
+	return nil
+}
+
+func attachFormFile(form *multipart.Writer, field, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	part, err := form.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// newPoller returns the poller for the configured update mode
+func (b *SendToKindleBot) newPoller() tb.Poller {
+	b.pollerHealth = &pollerHealth{mode: b.UpdateMode}
+	if b.UpdateMode == UpdateModeWebhook {
+		return &webhookPoller{
+			listen:    b.WebhookListen,
+			publicURL: b.WebhookURL,
+			secret:    b.WebhookSecret,
+			certFile:  b.WebhookCert,
+			keyFile:   b.WebhookKey,
+			health:    b.pollerHealth,
+		}
+	}
+	return &longPoller{timeout: longPollTimeout, health: b.pollerHealth}
+}
+
+// prepareUpdates binds the webhook server and registers the webhook in
+// webhook mode. In polling mode it removes any previously registered
+// webhook, Telegram refuses getUpdates while one is set
+func (b *SendToKindleBot) prepareUpdates(bot *tb.Bot) error {
+	if poller, ok := bot.Poller.(*webhookPoller); ok {
+		if err := poller.bind(); err != nil {
+			return err
+		}
+		if err := poller.register(bot); err != nil {
+			poller.listener.Close()
+			return fmt.Errorf("could not register webhook: %w", err)
+		}
+		logging.Info("Receiving updates via webhook", "url", b.WebhookURL)
+		return nil
+	}
+
+	if err := bot.RemoveWebhook(); err != nil {
+		return fmt.Errorf("could not remove webhook: %w", err)
+	}
+	logging.Info("Receiving updates via long polling")
+	return nil
+}
+
+// verifyWebhookConfig validates the update mode settings
+func (b *SendToKindleBot) verifyWebhookConfig() error {
+	if b.UpdateMode == "" {
+		b.UpdateMode = UpdateModePolling
+	}
+	switch b.UpdateMode {
+	case UpdateModePolling:
+		return nil
+	case UpdateModeWebhook:
+	default:
+		return ErrInvalidUpdateMode
+	}
+
+	if b.WebhookURL == "" {
+		return ErrNoWebhookURL
+	}
+	if b.WebhookListen == "" {
+		b.WebhookListen = defaultWebhookListen
+	}
+	if b.WebhookSecret != "" && !webhookSecretRegexp.MatchString(b.WebhookSecret) {
+		return ErrInvalidWebhookSecret
+	}
+	if (b.WebhookCert == "") != (b.WebhookKey == "") {
+		return ErrWebhookKeyPair
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package bot
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendToKindleBot_verifyWebhookConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		bot        *SendToKindleBot
+		wantErr    error
+		wantListen string
+	}{
+		{
+			name:    "polling by default",
+			bot:     &SendToKindleBot{},
+			wantErr: nil,
+		},
+		{
+			name:    "unknown mode",
+			bot:     &SendToKindleBot{UpdateMode: "push"},
+			wantErr: ErrInvalidUpdateMode,
+		},
+		{
+			name:    "webhook without url",
+			bot:     &SendToKindleBot{UpdateMode: UpdateModeWebhook},
+			wantErr: ErrNoWebhookURL,
+		},
+		{
+			name:       "webhook with default listen address",
+			bot:        &SendToKindleBot{UpdateMode: UpdateModeWebhook, WebhookURL: "https://bot.example.com/hook"},
+			wantErr:    nil,
+			wantListen: defaultWebhookListen,
+		},
+		{
+			name: "webhook with invalid secret",
+			bot: &SendToKindleBot{
+				UpdateMode:    UpdateModeWebhook,
+				WebhookURL:    "https://bot.example.com/hook",
+				WebhookSecret: "not allowed!",
+			},
+			wantErr: ErrInvalidWebhookSecret,
+		},
+		{
+			name: "webhook with certificate but no key",
+			bot: &SendToKindleBot{
+				UpdateMode:  UpdateModeWebhook,
+				WebhookURL:  "https://bot.example.com/hook",
+				WebhookCert: "/certs/public.pem",
+			},
+			wantErr: ErrWebhookKeyPair,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.bot.verifyWebhookConfig()
+			if err != tt.wantErr {
+				t.Errorf("verifyWebhookConfig() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantListen != "" && tt.bot.WebhookListen != tt.wantListen {
+				t.Errorf("verifyWebhookConfig() listen = %v, want %v", tt.bot.WebhookListen, tt.wantListen)
+			}
+		})
+	}
+}
+
+func TestWebhookPoller_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		secret     string
+		body       string
+		wantStatus int
+		wantUpdate bool
+	}{
+		{
+			name:       "valid update",
+			method:     http.MethodPost,
+			secret:     "s3cret",
+			body:       `{"update_id": 42}`,
+			wantStatus: http.StatusOK,
+			wantUpdate: true,
+		},
+		{
+			name:       "wrong secret",
+			method:     http.MethodPost,
+			secret:     "guess",
+			body:       `{"update_id": 42}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "malformed body",
+			method:     http.MethodPost,
+			secret:     "s3cret",
+			body:       `{`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodGet,
+			secret:     "s3cret",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updates := make(chan tb.Update, 1)
+			poller := &webhookPoller{secret: "s3cret", dest: updates}
+
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.Header.Set(webhookSecretHeader, tt.secret)
+			rec := httptest.NewRecorder()
+			poller.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			select {
+			case upd := <-updates:
+				if !tt.wantUpdate {
+					t.Errorf("ServeHTTP() unexpected update %d", upd.ID)
+				} else if upd.ID != 42 {
+					t.Errorf("ServeHTTP() update id = %d, want 42", upd.ID)
+				}
+			default:
+				if tt.wantUpdate {
+					t.Errorf("ServeHTTP() no update delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookPoller_register(t *testing.T) {
+	certFile := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(certFile, []byte("CERTIFICATE"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotURL, gotSecret, gotCert string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botTOKEN/setWebhook" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		gotURL = r.FormValue("url")
+		gotSecret = r.FormValue("secret_token")
+		if f, _, err := r.FormFile("certificate"); err == nil {
+			data, _ := ioutil.ReadAll(f)
+			gotCert = string(data)
+		}
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	defer api.Close()
+
+	bot, err := tb.NewBot(tb.Settings{URL: api.URL, Token: "TOKEN", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poller := &webhookPoller{
+		publicURL: "https://bot.example.com/hook",
+		secret:    "s3cret",
+		certFile:  certFile,
+	}
+	if err := poller.register(bot); err != nil {
+		t.Fatalf("register() error = %v", err)
+	}
+	if gotURL != "https://bot.example.com/hook" {
+		t.Errorf("register() url = %v", gotURL)
+	}
+	if gotSecret != "s3cret" {
+		t.Errorf("register() secret_token = %v", gotSecret)
+	}
+	if gotCert != "CERTIFICATE" {
+		t.Errorf("register() certificate = %v", gotCert)
+	}
+}
+
+func TestWebhookPoller_rotateSecret(t *testing.T) {
+	var gotSecret string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSecret = r.FormValue("secret_token")
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	defer api.Close()
+	bot, err := tb.NewBot(tb.Settings{URL: api.URL, Token: "TOKEN", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := make(chan tb.Update, 2)
+	poller := &webhookPoller{publicURL: "https://bot.example.com/hook", secret: "old", dest: dest}
+	if err := poller.rotateSecret(bot, "new"); err != nil {
+		t.Fatalf("rotateSecret() error = %v", err)
+	}
+	if gotSecret != "new" {
+		t.Errorf("rotateSecret() registered secret_token = %q", gotSecret)
+	}
+	for secret, want := range map[string]int{"new": http.StatusOK, "old": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(`{"update_id": 1}`))
+		req.Header.Set(webhookSecretHeader, secret)
+		rec := httptest.NewRecorder()
+		poller.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("ServeHTTP() with %q = %d, want %d", secret, rec.Code, want)
+		}
+	}
+}
+
+func TestSendToKindleBot_prepareUpdates_addressInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("webhook registered although the server could not listen")
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	defer api.Close()
+	b := &SendToKindleBot{UpdateMode: UpdateModeWebhook, WebhookURL: "https://bot.example.com/hook", WebhookListen: taken.Addr().String()}
+	bot, err := tb.NewBot(tb.Settings{URL: api.URL, Token: "TOKEN", Offline: true, Poller: b.newPoller()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.prepareUpdates(bot); err == nil {
+		t.Error("prepareUpdates() error = nil, want the listen error")
+	}
+}
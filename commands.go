@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/config"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const healthcheckTimeout = 15 * time.Second
+
+// runCommand runs a subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "validate-config":
+		return validateConfigCommand(args)
+	case "healthcheck":
+		return healthcheckCommand(args)
+	case "send":
+		return sendCommand(args)
+	case "convert":
+		return convertCommand(args)
+	case "smtp-test":
+		return smtpTestCommand(args)
+	case "devices":
+		return devicesCommand(args)
+	case "-h", "-help", "--help", "help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [command]
+
+Without a command the bot is started.
+
+Commands:
+  validate-config [-config file]   check the configuration file and environment
+  healthcheck [-url url]           query /healthz of a running bot, e.g. for Docker
+  send <file> [-device name]       convert a file if needed and send it to a device
+  convert <in> <out>               convert a file with the configured converters
+  smtp-test [-device name]         walk through an SMTP session without sending
+  devices                          list the configured devices
+
+send, convert, smtp-test and devices read the same configuration as the
+bot and accept -config file and -v for debug logs.
+`, os.Args[0])
+}
+
+// commandFlags are the flags shared by the commands using the configuration
+type commandFlags struct {
+	*flag.FlagSet
+	config  *string
+	verbose *bool
+}
+
+func newCommandFlags(name string) commandFlags {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	return commandFlags{
+		FlagSet: flags,
+		config:  flags.String("config", os.Getenv("UBOT_CONFIG_FILE"), "configuration file (YAML or TOML)"),
+		verbose: flags.Bool("v", false, "log debug messages"),
+	}
+}
+
+// parse parses flags given before or after the positional arguments, e.g.
+// "send book.fb2 -device Oasis", and returns the positional arguments
+func (f commandFlags) parse(args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := f.Parse(args); err != nil {
+			return nil, err
+		}
+		args = f.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// load loads the configuration and sets up logging to stderr
+func (f commandFlags) load() (*config.Config, bool) {
+	cfg, err := config.Load(*f.config, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration is invalid:")
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	logger := cfg.Logger(os.Stderr)
+	if *f.verbose {
+		logger.SetLevel(logging.LevelDebug)
+	}
+	logging.SetDefault(logger)
+	return cfg, true
+}
+
+// interruptible returns a context cancelled on Ctrl+C, which stops conversions
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// printProgress shows the conversion percentage on one line of stderr
+func printProgress(percent int) {
+	fmt.Fprintf(os.Stderr, "\rconverting... %d%%", percent)
+}
+
+// sendCommand sends a local file to a device through the bot's pipeline
+func sendCommand(args []string) int {
+	flags := newCommandFlags("send")
+	device := flags.String("device", "", "device to send to, required with several devices")
+	files, err := flags.parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: send <file> [-device name]")
+		return 2
+	}
+	cfg, ok := flags.load()
+	if !ok {
+		return 1
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+	converting := false
+	err = cfg.Bot().SendFile(ctx, files[0], *device, func(percent int) {
+		converting = true
+		printProgress(percent)
+	})
+	if converting {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not send:", err)
+		return 1
+	}
+	destination := *device
+	if destination == "" {
+		destination = "your Kindle"
+	}
+	if cfg.DryRun.Path != "" {
+		fmt.Printf("dry run: wrote the email for %s to %s instead of sending it\n", destination, cfg.DryRun.Path)
+		return 0
+	}
+	fmt.Printf("sent %s to %s\n", files[0], destination)
+	return 0
+}
+
+// convertCommand converts a file with the converter registry
+func convertCommand(args []string) int {
+	flags := newCommandFlags("convert")
+	files, err := flags.parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: convert <in> <out>")
+		return 2
+	}
+	cfg, ok := flags.load()
+	if !ok {
+		return 1
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+	converting := false
+	name, err := cfg.Bot().ConvertFile(ctx, files[0], files[1], func(percent int) {
+		converting = true
+		printProgress(percent)
+	})
+	if converting {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not convert with %s: %v\n", name, err)
+		return 1
+	}
+	fmt.Printf("converted %s to %s with %s\n", files[0], files[1], name)
+	return 0
+}
+
+// smtpTestCommand walks through an SMTP session for each account
+func smtpTestCommand(args []string) int {
+	flags := newCommandFlags("smtp-test")
+	device := flags.String("device", "", "only test the SMTP account of this device")
+	if _, err := flags.parse(args); err != nil {
+		return 2
+	}
+	cfg, ok := flags.load()
+	if !ok {
+		return 1
+	}
+
+	if err := cfg.Bot().TestSMTP(*device, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// devicesCommand lists the devices parsed from the configuration
+func devicesCommand(args []string) int {
+	flags := newCommandFlags("devices")
+	if _, err := flags.parse(args); err != nil {
+		return 2
+	}
+	cfg, ok := flags.load()
+	if !ok {
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tADDRESS\tSMTP PROFILE")
+	if cfg.EmailTo != "" {
+		fmt.Fprintf(w, "(default)\temail\t%s\t-\n", cfg.EmailTo)
+	}
+	for _, device := range cfg.Devices {
+		kind, address, profile := strings.ToLower(device.Type), device.Email, device.SMTPProfile
+		switch kind {
+		case "":
+			kind = "email"
+		case "directory":
+			address = device.Path
+		case "webdav":
+			address = device.URL
+		}
+		if profile == "" {
+			profile = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", device.Name, kind, address, profile)
+	}
+	w.Flush()
+	return 0
+}
+
+// validateConfigCommand loads the configuration and reports every problem,
+// exiting non-zero when it is invalid
+func validateConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("UBOT_CONFIG_FILE"), "configuration file (YAML or TOML)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*file, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration is invalid:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("configuration is valid: %d device(s), %d smtp profile(s), %d converter(s)\n",
+		len(cfg.Devices), len(cfg.SMTPProfiles), len(cfg.Converters))
+	return 0
+}
+
+// healthcheckCommand queries a health endpoint of the running bot and exits
+// non-zero unless it reports ok. The default URL is derived from
+// UBOT_METRICS_LISTEN
+func healthcheckCommand(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	url := flags.String("url", defaultHealthURL(os.Getenv("UBOT_METRICS_LISTEN")), "health endpoint to query")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(*url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// defaultHealthURL turns a listen address such as ":9090" into a local URL
+func defaultHealthURL(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, port = "", "9090"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/healthz"
+}
@@ -0,0 +1,578 @@
+// Package config loads the bot configuration from an optional YAML or TOML
+// file merged with UBOT_* environment variables, which take precedence
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/bot"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the complete bot configuration
+type Config struct {
+	Telegram     Telegram        `yaml:"telegram"`
+	SMTP         SMTP            `yaml:"smtp"`
+	SMTPProfiles map[string]SMTP `yaml:"smtp_profiles"`
+	EmailTo      string          `yaml:"email_to"`
+	Devices      []Device        `yaml:"devices"`
+	Users        Users           `yaml:"users"`
+	Limits       Limits          `yaml:"limits"`
+	Converters   []Converter     `yaml:"converters"`
+	TmpFilesPath string          `yaml:"tmp_files_path"`
+	Secrets      Secrets         `yaml:"secrets"`
+	Reload       Reload          `yaml:"reload"`
+	Metrics      Metrics         `yaml:"metrics"`
+	Health       Health          `yaml:"health"`
+	Logging      Logging         `yaml:"logging"`
+	DryRun       DryRun          `yaml:"dry_run"`
+	Library      Library         `yaml:"library"`
+	OPDS         OPDS            `yaml:"opds"`
+	Calibre      Calibre         `yaml:"calibre"`
+	Vocabulary   Vocabulary      `yaml:"vocabulary"`
+
+	file      string
+	positions map[string]int    // field path -> line in file
+	sources   map[string]string // field path -> environment variable or secret it came from
+	providers []SecretProvider
+	rotating  []secretField // secrets read from files and providers, see RefreshSecrets
+}
+
+// Telegram configures the Bot API connection
+type Telegram struct {
+	Token      string  `yaml:"token"`
+	APIURL     string  `yaml:"api_url"`
+	APILocal   bool    `yaml:"api_local"`
+	UpdateMode string  `yaml:"update_mode"`
+	Webhook    Webhook `yaml:"webhook"`
+}
+
+// Webhook configures webhook mode
+type Webhook struct {
+	URL    string `yaml:"url"`
+	Listen string `yaml:"listen"`
+	Secret string `yaml:"secret"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+}
+
+// SMTP is an SMTP account
+type SMTP struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	From     string `yaml:"from"`
+	Password string `yaml:"password"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+// Device is a Kindle (or other reader) books are sent to
+type Device struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"` // email (default), directory, webdav or calibre
+	Email       string `yaml:"email"`
+	SMTPProfile string `yaml:"smtp_profile"`
+	Path        string `yaml:"path"`     // directory to copy books into
+	URL         string `yaml:"url"`      // WebDAV collection or Calibre content server to upload books to
+	Library     string `yaml:"library"`  // Calibre library ID, empty for the server's default library
+	Username    string `yaml:"username"` // basic auth
+	Password    string `yaml:"password"`
+}
+
+// mailed reports whether books are emailed to the device
+func (d Device) mailed() bool {
+	return d.Type == "" || strings.ToLower(d.Type) == bot.TransportEmail
+}
+
+// Users restricts who may use the bot
+type Users struct {
+	Allowed []int `yaml:"allowed"`
+	Admins  []int `yaml:"admins"`
+}
+
+// Limits are resource limits and timeouts
+type Limits struct {
+	MaxFileSize     string        `yaml:"max_file_size"`
+	PendingTTL      time.Duration `yaml:"pending_ttl"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Reload configures picking up configuration changes at runtime
+type Reload struct {
+	Watch    *bool         `yaml:"watch"`    // check the config file for changes, true by default
+	Interval time.Duration `yaml:"interval"` // how often the file is checked
+	Announce bool          `yaml:"announce"` // message admins about reloads
+}
+
+// Metrics configures the Prometheus endpoint
+type Metrics struct {
+	Listen string `yaml:"listen"` // e.g. ":9090", empty disables it
+}
+
+// Health configures the /readyz checks
+type Health struct {
+	MinFreeSpace      string        `yaml:"min_free_space"`      // e.g. "100MB"
+	SMTPCheckInterval time.Duration `yaml:"smtp_check_interval"` // how long an SMTP check result is reused
+}
+
+// Logging configures the log output
+type Logging struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // text or json
+}
+
+// DryRun writes emails to disk instead of sending them, e.g. for staging
+type DryRun struct {
+	Path   string `yaml:"path"`   // maildir, mbox file or .eml directory, empty sends emails
+	Format string `yaml:"format"` // maildir (default), mbox or eml
+}
+
+// Library keeps delivered books for the OPDS catalog
+type Library struct {
+	Path   string        `yaml:"path"`    // <tmp_files_path>/library when only opds.listen is set
+	MaxAge time.Duration `yaml:"max_age"` // books older than this are removed, 0 keeps them
+}
+
+// OPDS configures the catalog of the library for e-reader apps
+type OPDS struct {
+	Listen string `yaml:"listen"` // e.g. ":8081", empty disables it
+	URL    string `yaml:"url"`    // public catalog URL shown by /opds
+}
+
+// Calibre configures the Calibre library searched by /find and the
+// content server delivered books are added to
+type Calibre struct {
+	Library string        `yaml:"library"` // directory with metadata.db, empty disables /find
+	Server  CalibreServer `yaml:"server"`
+}
+
+// CalibreServer is a Calibre content server every delivered book is added to
+type CalibreServer struct {
+	URL      string `yaml:"url"`     // e.g. "http://localhost:8080", empty disables it
+	Library  string `yaml:"library"` // library ID, empty for the server's default library
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Vocabulary configures the Anki export of uploaded Kindle vocab.db files
+type Vocabulary struct {
+	Format string `yaml:"format"` // tsv (default) or csv
+}
+
+// Converter configures a conversion backend
+type Converter struct {
+	Name    string        `yaml:"name"`
+	Type    string        `yaml:"type"`
+	Command string        `yaml:"command"`
+	Args    []string      `yaml:"args"`
+	Timeout time.Duration `yaml:"timeout"`
+	Formats []string      `yaml:"formats"`
+}
+
+// Load reads the configuration file at path (optional, may be empty), applies
+// environment overrides using getenv and validates the result. Validation
+// problems are returned as ValidationErrors
+func Load(path string, getenv func(string) string) (*Config, error) {
+	cfg := &Config{
+		file:      path,
+		positions: make(map[string]int),
+		sources:   make(map[string]string),
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		if err := cfg.parse(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if errs := cfg.applyEnv(getenv); len(errs) > 0 {
+		return nil, errs
+	}
+	if errs := cfg.resolveSecrets(getenv); len(errs) > 0 {
+		return nil, errs
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// parse decodes YAML, or TOML for files ending in .toml, rejecting unknown
+// fields, and records the line of every field
+func (c *Config) parse(data []byte) error {
+	var root yaml.Node
+	var lines map[int]int // lines of the YAML decoded to lines of the file
+	if strings.EqualFold(filepath.Ext(c.file), ".toml") {
+		document, err := parseTOML(data)
+		if err != nil {
+			return c.yamlErrors([]string{err.Error()})
+		}
+		if data, err = yaml.Marshal(document); err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return err
+		}
+		lines = make(map[int]int)
+		mapLines(&root, document, lines)
+		root = *document
+	} else if err := yaml.Unmarshal(data, &root); err != nil {
+		return c.yamlErrors([]string{err.Error()})
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		messages := []string{err.Error()}
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			messages = typeErr.Errors
+		}
+		errs := c.yamlErrors(messages)
+		for _, err := range errs {
+			if line, ok := lines[err.Line]; ok {
+				err.Line = line
+			}
+		}
+		return errs
+	}
+	recordPositions(&root, "", c.positions)
+	return nil
+}
+
+// mapLines maps the lines of a YAML tree to the lines of the same tree
+// parsed from another format. A mapping starts on the line of its first
+// key, the key wins
+func mapLines(node, original *yaml.Node, lines map[int]int) {
+	if _, ok := lines[node.Line]; !ok || node.Kind == yaml.ScalarNode {
+		lines[node.Line] = original.Line
+	}
+	if len(node.Content) != len(original.Content) {
+		return
+	}
+	for i := range node.Content {
+		mapLines(node.Content[i], original.Content[i], lines)
+	}
+}
+
+// recordPositions walks a YAML tree storing the line of each value under
+// its path, e.g. "devices[1].email"
+func recordPositions(node *yaml.Node, path string, positions map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			recordPositions(child, path, positions)
+		}
+	case yaml.MappingNode:
+		positions[path] = node.Line
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := key.Value
+			if path != "" {
+				childPath = path + "." + key.Value
+			}
+			positions[childPath] = key.Line
+			recordPositions(value, childPath, positions)
+		}
+	case yaml.SequenceNode:
+		positions[path] = node.Line
+		for i, child := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[childPath] = child.Line
+			recordPositions(child, childPath, positions)
+		}
+	}
+}
+
+// applyEnv overrides file values with the UBOT_* environment variables
+func (c *Config) applyEnv(getenv func(string) string) ValidationErrors {
+	var errs ValidationErrors
+
+	str := func(name, path string, dest *string) {
+		if value := getenv(name); value != "" {
+			*dest = value
+			c.sources[path] = name
+		}
+	}
+	flag := func(name, path string, dest *bool) {
+		if value := getenv(name); value != "" {
+			*dest = strings.ToLower(value) == "true" || value == "1"
+			c.sources[path] = name
+		}
+	}
+	duration := func(name, path string, dest *time.Duration) {
+		value := getenv(name)
+		if value == "" {
+			return
+		}
+		c.sources[path] = name
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, c.fieldError(path, "invalid duration %q", value))
+			return
+		}
+		*dest = d
+	}
+	optionalFlag := func(name, path string, dest **bool) {
+		if value := getenv(name); value != "" {
+			enabled := strings.ToLower(value) == "true" || value == "1"
+			*dest = &enabled
+			c.sources[path] = name
+		}
+	}
+	users := func(name, path string, dest *[]int) {
+		value := getenv(name)
+		if value == "" {
+			return
+		}
+		c.sources[path] = name
+		ids, err := parseUserIDs(value)
+		if err != nil {
+			errs = append(errs, c.fieldError(path, "%v", err))
+			return
+		}
+		*dest = ids
+	}
+
+	str("UBOT_TELEGRAM_TOKEN", "telegram.token", &c.Telegram.Token)
+	str("UBOT_TELEGRAM_API_URL", "telegram.api_url", &c.Telegram.APIURL)
+	flag("UBOT_TELEGRAM_API_LOCAL", "telegram.api_local", &c.Telegram.APILocal)
+	str("UBOT_UPDATE_MODE", "telegram.update_mode", &c.Telegram.UpdateMode)
+	str("UBOT_WEBHOOK_URL", "telegram.webhook.url", &c.Telegram.Webhook.URL)
+	str("UBOT_WEBHOOK_LISTEN", "telegram.webhook.listen", &c.Telegram.Webhook.Listen)
+	str("UBOT_WEBHOOK_SECRET", "telegram.webhook.secret", &c.Telegram.Webhook.Secret)
+	str("UBOT_WEBHOOK_CERT", "telegram.webhook.cert", &c.Telegram.Webhook.Cert)
+	str("UBOT_WEBHOOK_KEY", "telegram.webhook.key", &c.Telegram.Webhook.Key)
+	str("UBOT_SMTP_HOST", "smtp.host", &c.SMTP.Host)
+	str("UBOT_SMTP_PORT", "smtp.port", &c.SMTP.Port)
+	str("UBOT_EMAIL_FROM", "smtp.from", &c.SMTP.From)
+	str("UBOT_PASSWORD", "smtp.password", &c.SMTP.Password)
+	flag("UBOT_SMTP_INSECURE", "smtp.insecure", &c.SMTP.Insecure)
+	str("UBOT_EMAIL_TO", "email_to", &c.EmailTo)
+	users("UBOT_ALLOWED_USERS", "users.allowed", &c.Users.Allowed)
+	users("UBOT_ADMIN_USERS", "users.admins", &c.Users.Admins)
+	str("UBOT_MAX_FILE_SIZE", "limits.max_file_size", &c.Limits.MaxFileSize)
+	duration("UBOT_PENDING_TTL", "limits.pending_ttl", &c.Limits.PendingTTL)
+	duration("UBOT_SHUTDOWN_TIMEOUT", "limits.shutdown_timeout", &c.Limits.ShutdownTimeout)
+	str("UBOT_TMP_FILES_PATH", "tmp_files_path", &c.TmpFilesPath)
+	str("UBOT_SECRETS_DIR", "secrets.dir", &c.Secrets.Dir)
+	duration("UBOT_SECRETS_REFRESH", "secrets.refresh_interval", &c.Secrets.RefreshInterval)
+	str("UBOT_VAULT_ADDR", "secrets.vault.address", &c.Secrets.Vault.Address)
+	str("UBOT_VAULT_TOKEN", "secrets.vault.token", &c.Secrets.Vault.Token)
+	str("UBOT_VAULT_TOKEN_FILE", "secrets.vault.token_file", &c.Secrets.Vault.TokenFile)
+	str("UBOT_VAULT_NAMESPACE", "secrets.vault.namespace", &c.Secrets.Vault.Namespace)
+	str("UBOT_VAULT_MOUNT", "secrets.vault.mount", &c.Secrets.Vault.Mount)
+	str("UBOT_VAULT_PATH", "secrets.vault.path", &c.Secrets.Vault.Path)
+	optionalFlag("UBOT_CONFIG_WATCH", "reload.watch", &c.Reload.Watch)
+	duration("UBOT_CONFIG_WATCH_INTERVAL", "reload.interval", &c.Reload.Interval)
+	flag("UBOT_ANNOUNCE_RELOADS", "reload.announce", &c.Reload.Announce)
+	str("UBOT_METRICS_LISTEN", "metrics.listen", &c.Metrics.Listen)
+	str("UBOT_MIN_FREE_SPACE", "health.min_free_space", &c.Health.MinFreeSpace)
+	duration("UBOT_SMTP_CHECK_INTERVAL", "health.smtp_check_interval", &c.Health.SMTPCheckInterval)
+	str("UBOT_LOG_LEVEL", "logging.level", &c.Logging.Level)
+	str("UBOT_LOG_FORMAT", "logging.format", &c.Logging.Format)
+	str("UBOT_DRY_RUN_PATH", "dry_run.path", &c.DryRun.Path)
+	str("UBOT_DRY_RUN_FORMAT", "dry_run.format", &c.DryRun.Format)
+	str("UBOT_LIBRARY_PATH", "library.path", &c.Library.Path)
+	duration("UBOT_LIBRARY_MAX_AGE", "library.max_age", &c.Library.MaxAge)
+	str("UBOT_OPDS_LISTEN", "opds.listen", &c.OPDS.Listen)
+	str("UBOT_OPDS_URL", "opds.url", &c.OPDS.URL)
+	str("UBOT_CALIBRE_LIBRARY", "calibre.library", &c.Calibre.Library)
+	str("UBOT_CALIBRE_SERVER_URL", "calibre.server.url", &c.Calibre.Server.URL)
+	str("UBOT_CALIBRE_SERVER_LIBRARY", "calibre.server.library", &c.Calibre.Server.Library)
+	str("UBOT_CALIBRE_SERVER_USERNAME", "calibre.server.username", &c.Calibre.Server.Username)
+	str("UBOT_VOCABULARY_FORMAT", "vocabulary.format", &c.Vocabulary.Format)
+
+	if value := getenv("UBOT_KINDLE_DEVICES"); value != "" {
+		devices, deviceErrs := parseDevices(value)
+		errs = append(errs, deviceErrs...)
+		c.Devices = devices
+		for i := range devices {
+			c.sources[fmt.Sprintf("devices[%d]", i)] = "UBOT_KINDLE_DEVICES"
+		}
+		c.sources["devices"] = "UBOT_KINDLE_DEVICES"
+	}
+	return errs
+}
+
+// parseDevices parses UBOT_KINDLE_DEVICES
+// Format: "Device1:email1@kindle.com|Device2:email2@kindle.com"
+func parseDevices(value string) ([]Device, ValidationErrors) {
+	var (
+		devices []Device
+		errs    ValidationErrors
+	)
+	for i, pair := range strings.Split(value, "|") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			errs = append(errs, &FieldError{
+				Field:   fmt.Sprintf("UBOT_KINDLE_DEVICES entry %d", i+1),
+				Message: fmt.Sprintf("expected 'Name:email', got %q", pair),
+			})
+			continue
+		}
+		devices = append(devices, Device{
+			Name:  strings.TrimSpace(parts[0]),
+			Email: strings.TrimSpace(parts[1]),
+		})
+	}
+	return devices, errs
+}
+
+func parseUserIDs(value string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseSize parses sizes such as "50MB", "512KB" or a plain number of bytes
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.size
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// Bot builds the bot from a validated configuration
+func (c *Config) Bot() *bot.SendToKindleBot {
+	b := &bot.SendToKindleBot{
+		Token:             c.Telegram.Token,
+		EmailFrom:         c.SMTP.From,
+		EmailTo:           c.EmailTo,
+		KindleDevices:     make(map[string]string),
+		SMTPHost:          c.SMTP.Host,
+		SMTPPort:          c.SMTP.Port,
+		Password:          c.SMTP.Password,
+		SMTPInsecure:      c.SMTP.Insecure,
+		UpdateMode:        strings.ToLower(c.Telegram.UpdateMode),
+		WebhookURL:        c.Telegram.Webhook.URL,
+		WebhookListen:     c.Telegram.Webhook.Listen,
+		WebhookSecret:     c.Telegram.Webhook.Secret,
+		WebhookCert:       c.Telegram.Webhook.Cert,
+		WebhookKey:        c.Telegram.Webhook.Key,
+		TelegramAPIURL:    strings.TrimSuffix(c.Telegram.APIURL, "/"),
+		TelegramAPILocal:  c.Telegram.APILocal,
+		ShutdownTimeout:   c.Limits.ShutdownTimeout,
+		PendingTTL:        c.Limits.PendingTTL,
+		SMTPProfiles:      make(map[string]bot.SMTPProfile),
+		DeviceProfiles:    make(map[string]string),
+		AllowedUsers:      c.Users.Allowed,
+		AdminUsers:        c.Users.Admins,
+		MetricsListen:     c.Metrics.Listen,
+		SMTPCheckInterval: c.Health.SMTPCheckInterval,
+		DryRunFormat:      strings.ToLower(c.DryRun.Format),
+		DryRunPath:        c.DryRun.Path,
+		LibraryPath:       c.Library.Path,
+		LibraryMaxAge:     c.Library.MaxAge,
+		OPDSListen:        c.OPDS.Listen,
+		OPDSURL:           strings.TrimSuffix(c.OPDS.URL, "/"),
+		CalibreLibrary:    c.Calibre.Library,
+		CalibreServer: bot.TransportConfig{
+			URL:      c.Calibre.Server.URL,
+			Library:  c.Calibre.Server.Library,
+			Username: c.Calibre.Server.Username,
+			Password: c.Calibre.Server.Password,
+		},
+		VocabularyFormat: strings.ToLower(c.Vocabulary.Format),
+	}
+	if c.Limits.MaxFileSize != "" {
+		b.MaxFileSize, _ = parseSize(c.Limits.MaxFileSize)
+	}
+	if c.Health.MinFreeSpace != "" {
+		b.MinFreeSpace, _ = parseSize(c.Health.MinFreeSpace)
+	}
+	for name, profile := range c.SMTPProfiles {
+		b.SMTPProfiles[name] = bot.SMTPProfile{
+			Host:     profile.Host,
+			Port:     profile.Port,
+			From:     profile.From,
+			Password: profile.Password,
+			Insecure: profile.Insecure,
+		}
+	}
+	for _, device := range c.Devices {
+		if !device.mailed() {
+			if b.DeviceTransports == nil {
+				b.DeviceTransports = make(map[string]bot.TransportConfig)
+			}
+			b.DeviceTransports[device.Name] = bot.TransportConfig{
+				Type:     strings.ToLower(device.Type),
+				Path:     device.Path,
+				URL:      device.URL,
+				Library:  device.Library,
+				Username: device.Username,
+				Password: device.Password,
+			}
+			continue
+		}
+		b.KindleDevices[device.Name] = device.Email
+		if device.SMTPProfile != "" {
+			b.DeviceProfiles[device.Name] = device.SMTPProfile
+		}
+	}
+	for _, converter := range c.Converters {
+		b.Converters = append(b.Converters, bot.ConverterConfig{
+			Name:    converter.Name,
+			Type:    converter.Type,
+			Command: converter.Command,
+			Args:    converter.Args,
+			Timeout: converter.Timeout,
+			Formats: converter.Formats,
+		})
+	}
+	b.SetTmpFilesPath(c.TmpFilesPath)
+	return b
+}
+
+// LogLevel returns the configured log level, info when unset
+func (c *Config) LogLevel() logging.Level {
+	level, _ := logging.ParseLevel(c.Logging.Level)
+	return level
+}
+
+// Logger creates the logger described by the logging section
+func (c *Config) Logger(out io.Writer) *logging.Logger {
+	format := c.Logging.Format
+	if format == "" {
+		format = logging.FormatText
+	}
+	return logging.New(out, format, c.LogLevel())
+}
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validConfig = `telegram:
+  token: "123:abc"
+smtp:
+  host: smtp.example.com
+  port: "587"
+  from: bot@example.com
+  password: secret
+smtp_profiles:
+  work:
+    host: smtp.work.example.com
+    from: bot@work.example.com
+    password: other-secret
+devices:
+  - name: Paperwhite
+    email: paperwhite@kindle.com
+  - name: Work Kindle
+    email: work@kindle.com
+    smtp_profile: work
+users:
+  allowed: [100, 200]
+  admins: [100]
+limits:
+  max_file_size: 50MB
+  pending_ttl: 12h
+converters:
+  - name: calibre
+    command: ebook-convert
+    args: ["--enable-heuristics"]
+    timeout: 10m
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, validConfig)
+
+	cfg, err := Load(path, env(map[string]string{"UBOT_PASSWORD": "from-env"}))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.SMTP.Password != "from-env" {
+		t.Errorf("Load() environment did not override the file, password = %q", cfg.SMTP.Password)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices[1].SMTPProfile != "work" {
+		t.Errorf("Load() devices = %+v", cfg.Devices)
+	}
+	if cfg.Limits.PendingTTL != 12*time.Hour {
+		t.Errorf("Load() pending_ttl = %v", cfg.Limits.PendingTTL)
+	}
+
+	b := cfg.Bot()
+	if b.KindleDevices["Work Kindle"] != "work@kindle.com" || b.DeviceProfiles["Work Kindle"] != "work" {
+		t.Errorf("Bot() devices = %v, profiles = %v", b.KindleDevices, b.DeviceProfiles)
+	}
+	if b.MaxFileSize != 50<<20 {
+		t.Errorf("Bot() max file size = %d", b.MaxFileSize)
+	}
+	if len(b.Converters) != 1 || b.Converters[0].Timeout != 10*time.Minute {
+		t.Errorf("Bot() converters = %+v", b.Converters)
+	}
+}
+
+func TestLoad_toml(t *testing.T) {
+	content := `[telegram]
+token = "123:abc"
+
+[smtp]
+host = "smtp.example.com"
+port = "587"
+from = "bot@example.com"
+password = "secret"
+
+[smtp_profiles.work]
+host = "smtp.work.example.com"
+from = "bot@work.example.com"
+password = "other-secret"
+
+[[devices]]
+name = "Paperwhite"
+email = "paperwhite@kindle.com"
+
+[[devices]]
+name = "Work Kindle"
+email = "work@kindle.com"
+smtp_profile = "work"
+
+[users]
+allowed = [100, 200]
+admins = [100]
+
+[limits]
+max_file_size = "50MB"
+pending_ttl = "12h"
+`
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path, env(nil))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	b := cfg.Bot()
+	if b.KindleDevices["Work Kindle"] != "work@kindle.com" || b.DeviceProfiles["Work Kindle"] != "work" ||
+		b.MaxFileSize != 50<<20 || len(b.AllowedUsers) != 2 {
+		t.Errorf("Bot() = devices %v, profiles %v, max file size %d, allowed %v",
+			b.KindleDevices, b.DeviceProfiles, b.MaxFileSize, b.AllowedUsers)
+	}
+
+	// Errors point to the lines of the TOML file
+	for _, tt := range []struct{ from, to, want string }{
+		{`pending_ttl = "12h"`, `pending_tll = "12h"`, "config.toml:30: field pending_tll not found"},
+		{`email = "work@kindle.com"`, `email = "not-an-email"`, `config.toml:21: devices[1].email: invalid email address "not-an-email"`},
+		{`admins = [100]`, `admins = [100], 1`, "config.toml:26: unexpected ',' after value"},
+	} {
+		os.WriteFile(path, []byte(strings.Replace(content, tt.from, tt.to, 1)), 0600)
+		_, err := Load(path, env(nil))
+		if err == nil {
+			t.Fatalf("Load(%s) expected an error", tt.to)
+		}
+		if got := strings.Replace(err.Error(), filepath.Dir(path)+string(filepath.Separator), "", -1); !strings.Contains(got, tt.want) {
+			t.Errorf("Load(%s) error =\n%s\nwant it to contain\n%s", tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestLoad_environmentOnly(t *testing.T) {
+	cfg, err := Load("", env(map[string]string{
+		"UBOT_TELEGRAM_TOKEN": "123:abc",
+		"UBOT_EMAIL_FROM":     "bot@example.com",
+		"UBOT_PASSWORD":       "secret",
+		"UBOT_SMTP_HOST":      "smtp.example.com",
+		"UBOT_KINDLE_DEVICES": "Paperwhite:pw@kindle.com|Oasis:oasis@kindle.com",
+		"UBOT_ALLOWED_USERS":  "1, 2,3",
+	}))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices[1].Name != "Oasis" {
+		t.Errorf("Load() devices = %+v", cfg.Devices)
+	}
+	if len(cfg.Users.Allowed) != 3 {
+		t.Errorf("Load() allowed users = %v", cfg.Users.Allowed)
+	}
+}
+
+func TestLoad_transports(t *testing.T) {
+	path := writeConfig(t, `telegram:
+  token: "123:abc"
+devices:
+  - name: Kobo
+    type: directory
+    path: /media/KOBOeReader
+  - name: PocketBook
+    type: WebDAV
+    url: https://dav.example.com/books/
+    username: reader
+  - name: Calibre
+    type: calibre
+    url: http://localhost:8080
+    library: Books
+calibre:
+  server:
+    url: http://localhost:8080
+    username: bot
+`)
+	secrets := t.TempDir()
+	writeSecret(t, secrets, "device_PocketBook_password", "dav-secret")
+	writeSecret(t, secrets, "calibre_server_password", "calibre-secret")
+	cfg, err := Load(path, env(map[string]string{"UBOT_SECRETS_DIR": secrets}))
+	if err != nil {
+		t.Fatalf("Load() without SMTP for devices that are not mailed error = %v", err)
+	}
+	b := cfg.Bot()
+	if len(b.KindleDevices) != 0 || len(b.DeviceTransports) != 3 {
+		t.Fatalf("Bot() devices = %v, transports = %+v", b.KindleDevices, b.DeviceTransports)
+	}
+	if got := b.DeviceTransports["PocketBook"]; got.Type != "webdav" || got.Password != "dav-secret" {
+		t.Errorf("Bot() PocketBook = %+v", got)
+	}
+	if got := b.DeviceTransports["Kobo"]; got.Type != "directory" || got.Path != "/media/KOBOeReader" {
+		t.Errorf("Bot() Kobo = %+v", got)
+	}
+	if got := b.DeviceTransports["Calibre"]; got.Type != "calibre" || got.Library != "Books" {
+		t.Errorf("Bot() Calibre = %+v", got)
+	}
+	if got := b.CalibreServer; got.URL != "http://localhost:8080" || got.Username != "bot" || got.Password != "calibre-secret" {
+		t.Errorf("Bot() calibre server = %+v", got)
+	}
+}
+
+func TestLoad_dryRun(t *testing.T) {
+	cfg, err := Load("", env(map[string]string{
+		"UBOT_TELEGRAM_TOKEN": "123:abc",
+		"UBOT_EMAIL_FROM":     "bot@example.com",
+		"UBOT_EMAIL_TO":       "me@kindle.com",
+		"UBOT_DRY_RUN_PATH":   "/files/outbox",
+		"UBOT_DRY_RUN_FORMAT": "MBOX",
+	}))
+	if err != nil {
+		t.Fatalf("Load() without an SMTP server in dry run error = %v", err)
+	}
+	b := cfg.Bot()
+	if b.DryRunPath != "/files/outbox" || b.DryRunFormat != "mbox" {
+		t.Errorf("Bot() dry run = %q %q", b.DryRunFormat, b.DryRunPath)
+	}
+}
+
+func TestLoad_library(t *testing.T) {
+	cfg, err := Load("", env(map[string]string{
+		"UBOT_TELEGRAM_TOKEN":    "123:abc",
+		"UBOT_EMAIL_FROM":        "bot@example.com",
+		"UBOT_EMAIL_TO":          "me@kindle.com",
+		"UBOT_PASSWORD":          "secret",
+		"UBOT_SMTP_HOST":         "smtp.example.com",
+		"UBOT_LIBRARY_MAX_AGE":   "720h",
+		"UBOT_OPDS_LISTEN":       ":8081",
+		"UBOT_OPDS_URL":          "https://books.example.com/opds/",
+		"UBOT_CALIBRE_LIBRARY":   "/books/Calibre Library",
+		"UBOT_VOCABULARY_FORMAT": "CSV",
+	}))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	b := cfg.Bot()
+	if b.OPDSListen != ":8081" || b.OPDSURL != "https://books.example.com/opds" || b.LibraryMaxAge != 720*time.Hour {
+		t.Errorf("Bot() opds = %q %q %v", b.OPDSListen, b.OPDSURL, b.LibraryMaxAge)
+	}
+	if b.CalibreLibrary != "/books/Calibre Library" {
+		t.Errorf("Bot() calibre library = %q", b.CalibreLibrary)
+	}
+	if b.VocabularyFormat != "csv" {
+		t.Errorf("Bot() vocabulary format = %q", b.VocabularyFormat)
+	}
+}
+
+func TestLoad_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{
+			name:    "unknown field",
+			content: strings.Replace(validConfig, "  pending_ttl: 12h", "  pending_tll: 12h", 1),
+			want:    []string{"config.yaml:24: field pending_tll not found"},
+		},
+		{
+			name:    "invalid device email and unknown profile",
+			content: strings.Replace(strings.Replace(validConfig, "work@kindle.com", "not-an-email", 1), "smtp_profile: work", "smtp_profile: home", 1),
+			want: []string{
+				`config.yaml:17: devices[1].email: invalid email address "not-an-email"`,
+				`config.yaml:18: devices[1].smtp_profile: unknown smtp profile "home"`,
+			},
+		},
+		{
+			name:    "malformed duration",
+			content: strings.Replace(validConfig, "pending_ttl: 12h", "pending_ttl: soon", 1),
+			want:    []string{"config.yaml:24: cannot unmarshal"},
+		},
+		{
+			name:    "missing required values",
+			content: "devices:\n  - name: Paperwhite\n    email: pw@kindle.com\n",
+			want: []string{
+				"telegram.token: required",
+				"smtp.host: required",
+			},
+		},
+		{
+			name:    "malformed devices in environment",
+			content: validConfig,
+			env:     map[string]string{"UBOT_KINDLE_DEVICES": "Paperwhite:pw@kindle.com|broken"},
+			want:    []string{`UBOT_KINDLE_DEVICES entry 2: expected 'Name:email', got "broken"`},
+		},
+		{
+			name:    "invalid device email in environment",
+			content: validConfig,
+			env:     map[string]string{"UBOT_KINDLE_DEVICES": "Paperwhite:pw-at-kindle.com"},
+			want:    []string{`UBOT_KINDLE_DEVICES (devices[0].email): invalid email address "pw-at-kindle.com"`},
+		},
+		{
+			name:    "webhook without url",
+			content: validConfig + "\n",
+			env:     map[string]string{"UBOT_UPDATE_MODE": "webhook"},
+			want:    []string{"telegram.webhook.url: required in webhook mode"},
+		},
+		{
+			name:    "two fallback converters",
+			content: validConfig + "  - name: pandoc\n    command: pandoc\n",
+			want:    []string{`config.yaml:30: converters[1].formats: only one converter may handle all formats, "calibre" already does`},
+		},
+		{
+			name:    "fb2 converter with other formats",
+			content: validConfig + "  - name: fb2\n    type: fb2\n    formats: [fb2.zip, epub]\n",
+			want:    []string{`config.yaml:32: converters[1].formats[1]: fb2 converters read fb2, fb2.zip, got "epub"`},
+		},
+		{
+			name:    "markup converter with other formats",
+			content: validConfig + "  - name: markdown\n    type: markup\n    formats: [md, fb2]\n",
+			want:    []string{`config.yaml:32: converters[1].formats[1]: markup converters render adoc, asciidoc, markdown, md, mdown, mkd, org, got "fb2"`},
+		},
+		{
+			name:    "invalid log level and format",
+			content: validConfig,
+			env:     map[string]string{"UBOT_LOG_LEVEL": "verbose", "UBOT_LOG_FORMAT": "xml"},
+			want: []string{
+				`UBOT_LOG_LEVEL: log level must be debug, info, warn or error, got "verbose"`,
+				`UBOT_LOG_FORMAT: must be text or json, got "xml"`,
+			},
+		},
+		{
+			name: "invalid transports",
+			content: strings.Replace(validConfig, "users:", `  - name: Kobo
+    type: directory
+    path: media/kobo
+  - name: PocketBook
+    type: webdav
+    url: dav.example.com
+  - name: Tablet
+    type: usb
+users:`, 1),
+			want: []string{
+				`config.yaml:21: devices[2].path: must be an absolute path, got "media/kobo"`,
+				`config.yaml:24: devices[3].url: must be an http(s) URL, got "dav.example.com"`,
+				`config.yaml:26: devices[4].type: must be email, directory, webdav or calibre, got "usb"`,
+			},
+		},
+		{
+			name:    "invalid dry run format",
+			content: validConfig + "dry_run:\n  path: /files/outbox\n  format: pst\n",
+			want:    []string{`config.yaml:32: dry_run.format: must be maildir, mbox or eml, got "pst"`},
+		},
+		{
+			name:    "invalid opds",
+			content: validConfig + "opds:\n  listen: 8081\n  url: books.example.com\n",
+			want: []string{
+				`config.yaml:31: opds.listen: invalid listen address "8081", expected e.g. ":8081"`,
+				`config.yaml:32: opds.url: invalid URL "books.example.com"`,
+			},
+		},
+		{
+			name:    "relative calibre library",
+			content: validConfig + "calibre:\n  library: Calibre Library\n",
+			want:    []string{`config.yaml:31: calibre.library: must be an absolute path, got "Calibre Library"`},
+		},
+		{
+			name:    "invalid vocabulary format",
+			content: validConfig + "vocabulary:\n  format: apkg\n",
+			want:    []string{`config.yaml:31: vocabulary.format: must be tsv or csv, got "apkg"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.content)
+			_, err := Load(path, env(tt.env))
+			if err == nil {
+				t.Fatalf("Load() expected an error")
+			}
+			got := strings.Replace(err.Error(), filepath.Dir(path)+string(filepath.Separator), "", -1)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Load() error =\n%s\nwant it to contain\n%s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "50MB", want: 50 << 20},
+		{value: "512 kb", want: 512 << 10},
+		{value: "1GB", want: 1 << 30},
+		{value: "1048576", want: 1 << 20},
+		{value: "lots", wantErr: true},
+		{value: "-5MB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/bot"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSecretsRefresh is how often rotated secrets are picked up
+	DefaultSecretsRefresh = 5 * time.Minute
+
+	defaultVaultMount   = "secret"
+	vaultRequestTimeout = 10 * time.Second
+)
+
+// ErrSecretNotFound - represents a secret a provider does not have
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Secrets configures where secrets not set directly are looked up
+type Secrets struct {
+	Dir             string        `yaml:"dir"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Vault           Vault         `yaml:"vault"`
+}
+
+// Vault configures a HashiCorp Vault compatible KV version 2 secrets engine
+type Vault struct {
+	Address   string `yaml:"address"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+	Mount     string `yaml:"mount"`
+	Path      string `yaml:"path"`
+}
+
+// SecretProvider looks up secrets by name, e.g. "smtp_password"
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// DirProvider reads each secret from a file named after it, such as
+// Docker secrets in /run/secrets or a mounted Kubernetes Secret
+type DirProvider struct {
+	Dir string
+}
+
+// Secret returns the content of Dir/name without the trailing newline
+func (p DirProvider) Secret(name string) (string, error) {
+	value, err := readSecretFile(filepath.Join(p.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrSecretNotFound
+	}
+	return value, err
+}
+
+// VaultProvider reads secrets from the keys of a single KV version 2 secret
+// over Vault's HTTP API. The token file is read on every request so tokens
+// renewed by Vault Agent are picked up
+type VaultProvider struct {
+	Address   string
+	Token     string
+	TokenFile string
+	Namespace string
+	Mount     string
+	Path      string
+	Client    *http.Client
+}
+
+// Secret returns the key name of the configured secret
+func (p *VaultProvider) Secret(name string) (string, error) {
+	data, err := p.read()
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault key %q is not a string", name)
+	}
+	return s, nil
+}
+
+func (p *VaultProvider) read() (map[string]interface{}, error) {
+	token := p.Token
+	if p.TokenFile != "" {
+		var err error
+		if token, err = readSecretFile(p.TokenFile); err != nil {
+			return nil, fmt.Errorf("could not read vault token: %w", err)
+		}
+	}
+	mount := p.Mount
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(p.Address, "/"),
+		strings.Trim(mount, "/"), strings.Trim(p.Path, "/"))
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: vaultRequestTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrSecretNotFound
+	case resp.StatusCode != http.StatusOK:
+		if len(body.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(body.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("could not decode vault response: %w", decodeErr)
+	}
+	return body.Data.Data, nil
+}
+
+// secretField is a configuration value that may come from a secret
+type secretField struct {
+	name string // provider name, e.g. "smtp_password"
+	path string // field path, e.g. "smtp.password"
+	env  string // environment variable, <env>_FILE is read as a file
+	file string // file the value was read from, empty for providers
+	get  func() string
+	set  func(string)
+}
+
+func (c *Config) secretFields() []secretField {
+	fields := []secretField{
+		{
+			name: "telegram_token", path: "telegram.token", env: "UBOT_TELEGRAM_TOKEN",
+			get: func() string { return c.Telegram.Token },
+			set: func(v string) { c.Telegram.Token = v },
+		},
+		{
+			name: "webhook_secret", path: "telegram.webhook.secret", env: "UBOT_WEBHOOK_SECRET",
+			get: func() string { return c.Telegram.Webhook.Secret },
+			set: func(v string) { c.Telegram.Webhook.Secret = v },
+		},
+		{
+			name: "smtp_password", path: "smtp.password", env: "UBOT_PASSWORD",
+			get: func() string { return c.SMTP.Password },
+			set: func(v string) { c.SMTP.Password = v },
+		},
+		{
+			name: "calibre_server_password", path: "calibre.server.password", env: "UBOT_CALIBRE_SERVER_PASSWORD",
+			get: func() string { return c.Calibre.Server.Password },
+			set: func(v string) { c.Calibre.Server.Password = v },
+		},
+	}
+	for name := range c.SMTPProfiles {
+		name := name
+		fields = append(fields, secretField{
+			name: "smtp_profile_" + name + "_password",
+			path: "smtp_profiles." + name + ".password",
+			get:  func() string { return c.SMTPProfiles[name].Password },
+			set: func(v string) {
+				profile := c.SMTPProfiles[name]
+				profile.Password = v
+				c.SMTPProfiles[name] = profile
+			},
+		})
+	}
+	for i, device := range c.Devices {
+		if t := strings.ToLower(device.Type); t != bot.TransportWebDAV && t != bot.TransportCalibre {
+			continue
+		}
+		i := i
+		fields = append(fields, secretField{
+			name: "device_" + device.Name + "_password",
+			path: fmt.Sprintf("devices[%d].password", i),
+			get:  func() string { return c.Devices[i].Password },
+			set:  func(v string) { c.Devices[i].Password = v },
+		})
+	}
+	return fields
+}
+
+// secretProviders returns the configured providers in lookup order
+func (c *Config) secretProviders() []SecretProvider {
+	var providers []SecretProvider
+	if c.Secrets.Dir != "" {
+		providers = append(providers, DirProvider{Dir: c.Secrets.Dir})
+	}
+	vault := c.Secrets.Vault
+	if vault.Address != "" && vault.Path != "" && (vault.Token != "" || vault.TokenFile != "") {
+		providers = append(providers, &VaultProvider{
+			Address:   vault.Address,
+			Token:     vault.Token,
+			TokenFile: vault.TokenFile,
+			Namespace: vault.Namespace,
+			Mount:     vault.Mount,
+			Path:      vault.Path,
+		})
+	}
+	return providers
+}
+
+// resolveSecrets fills secret fields. A plain environment variable wins, then
+// <env>_FILE, then the config file value, then the providers. Values read from
+// files and providers are remembered so RefreshSecrets can pick up rotations
+func (c *Config) resolveSecrets(getenv func(string) string) ValidationErrors {
+	var errs ValidationErrors
+	c.providers = c.secretProviders()
+	c.rotating = nil
+
+	for _, field := range c.secretFields() {
+		if field.env != "" {
+			file := getenv(field.env + "_FILE")
+			if file != "" && getenv(field.env) != "" {
+				errs = append(errs, c.fieldError(field.path, "both %s and %s_FILE are set", field.env, field.env))
+				continue
+			}
+			if file != "" {
+				c.sources[field.path] = field.env + "_FILE"
+				field.file = file
+			}
+		}
+		if field.file == "" && field.get() != "" {
+			continue
+		}
+
+		value, err := c.readSecret(field)
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, c.fieldError(field.path, "could not read secret: %v", err))
+			continue
+		}
+		if field.file == "" {
+			c.sources[field.path] = "secret " + field.name
+		}
+		field.set(value)
+		c.rotating = append(c.rotating, field)
+	}
+	return errs
+}
+
+// readSecret reads a secret field from its file or the first provider having it
+func (c *Config) readSecret(field secretField) (string, error) {
+	if field.file != "" {
+		return readSecretFile(field.file)
+	}
+	for _, provider := range c.providers {
+		value, err := provider.Secret(field.name)
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		return value, err
+	}
+	return "", ErrSecretNotFound
+}
+
+// RefreshSecrets reads the secrets that came from files and providers again
+// and returns the paths of the fields whose value changed
+func (c *Config) RefreshSecrets() ([]string, error) {
+	var (
+		changed  []string
+		problems []string
+	)
+	for _, field := range c.rotating {
+		value, err := c.readSecret(field)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field.path, err))
+			continue
+		}
+		if value != "" && value != field.get() {
+			field.set(value)
+			changed = append(changed, field.path)
+		}
+	}
+	if len(problems) > 0 {
+		return changed, errors.New(strings.Join(problems, "; "))
+	}
+	return changed, nil
+}
+
+// applySecrets refreshes rotating secrets and hands them to b: passwords
+// are used by the next delivery and a new webhook secret is registered
+// with Telegram. A new Telegram token is rejected, telebot can't switch
+// tokens while polling, so the bot keeps the old one until a restart and
+// the admins are told
+func (c *Config) applySecrets(b *bot.SendToKindleBot) {
+	changed, err := c.RefreshSecrets()
+	if err != nil {
+		logging.Warn("Could not refresh secrets", "err", err)
+	}
+
+	passwordsChanged := false
+	for _, path := range changed {
+		switch path {
+		case "telegram.token":
+			logging.Error("Telegram token changed, it is only used after a restart", "name", path)
+			b.NotifyAdmins("⚠️ The Telegram token was rotated. The bot keeps using the old one until it is restarted.")
+		case "telegram.webhook.secret":
+			if err := b.UpdateWebhookSecret(c.Telegram.Webhook.Secret); err != nil {
+				logging.Error("Could not update the webhook secret", "err", err)
+			}
+		default:
+			passwordsChanged = true
+		}
+	}
+	if !passwordsChanged {
+		return
+	}
+	passwords := bot.Passwords{
+		SMTP:          c.SMTP.Password,
+		SMTPProfiles:  make(map[string]string, len(c.SMTPProfiles)),
+		Devices:       make(map[string]string, len(c.Devices)),
+		CalibreServer: c.Calibre.Server.Password,
+	}
+	for name, profile := range c.SMTPProfiles {
+		passwords.SMTPProfiles[name] = profile.Password
+	}
+	for _, device := range c.Devices {
+		passwords.Devices[device.Name] = device.Password
+	}
+	b.UpdatePasswords(passwords)
+}
+
+// readSecretFile returns a file's content without the trailing newline
+// editors and `echo` add
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// vaultStub serves a single KV version 2 secret
+type vaultStub struct {
+	mu    sync.Mutex
+	token string
+	path  string
+	data  map[string]string
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("X-Vault-Token") != s.token {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	if r.URL.Path != s.path {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+	var pairs []string
+	for k, v := range s.data {
+		pairs = append(pairs, `"`+k+`":"`+v+`"`)
+	}
+	w.Write([]byte(`{"data":{"data":{` + strings.Join(pairs, ",") + `},"metadata":{"version":1}}}`))
+}
+
+func (s *vaultStub) set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+}
+
+func writeSecret(t *testing.T, dir, name, value string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVaultProvider(t *testing.T) {
+	stub := &vaultStub{token: "s.token", path: "/v1/kv/data/kindle", data: map[string]string{"smtp_password": "hunter2"}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		provider *VaultProvider
+		secret   string
+		want     string
+		wantErr  error
+		errText  string
+	}{
+		{
+			name:     "found",
+			provider: &VaultProvider{Address: server.URL, Token: "s.token", Mount: "kv", Path: "kindle"},
+			secret:   "smtp_password",
+			want:     "hunter2",
+		},
+		{
+			name:     "missing key",
+			provider: &VaultProvider{Address: server.URL, Token: "s.token", Mount: "kv", Path: "kindle"},
+			secret:   "telegram_token",
+			wantErr:  ErrSecretNotFound,
+		},
+		{
+			name:     "missing path",
+			provider: &VaultProvider{Address: server.URL, Token: "s.token", Mount: "kv", Path: "other"},
+			secret:   "smtp_password",
+			wantErr:  ErrSecretNotFound,
+		},
+		{
+			name:     "wrong token",
+			provider: &VaultProvider{Address: server.URL, Token: "wrong", Mount: "kv", Path: "kindle"},
+			secret:   "smtp_password",
+			errText:  "permission denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.provider.Secret(tt.secret)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Secret() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.errText != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errText) {
+					t.Errorf("Secret() error = %v, want it to contain %q", err, tt.errText)
+				}
+			case err != nil:
+				t.Errorf("Secret() error = %v", err)
+			case got != tt.want:
+				t.Errorf("Secret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_secrets(t *testing.T) {
+	dir := t.TempDir()
+	stub := &vaultStub{token: "s.token", path: "/v1/secret/data/kindle", data: map[string]string{"smtp_profile_work_password": "from-vault"}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	content := strings.Replace(strings.Replace(validConfig, "  password: secret\n", "", 1), "    password: other-secret\n", "", 1)
+	path := writeConfig(t, content)
+	tokenFile := writeSecret(t, dir, "token", "123:from-file\n")
+	secretsDir := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secretsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeSecret(t, secretsDir, "smtp_password", "from-dir\n")
+
+	cfg, err := Load(path, env(map[string]string{
+		"UBOT_TELEGRAM_TOKEN_FILE": tokenFile,
+		"UBOT_SECRETS_DIR":         secretsDir,
+		"UBOT_VAULT_ADDR":          server.URL,
+		"UBOT_VAULT_TOKEN":         "s.token",
+		"UBOT_VAULT_PATH":          "kindle",
+	}))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Telegram.Token != "123:from-file" || cfg.SMTP.Password != "from-dir" || cfg.SMTPProfiles["work"].Password != "from-vault" {
+		t.Fatalf("Load() token = %q, password = %q, work password = %q",
+			cfg.Telegram.Token, cfg.SMTP.Password, cfg.SMTPProfiles["work"].Password)
+	}
+
+	b := cfg.Bot()
+
+	// Rotate every secret
+	writeSecret(t, dir, "token", "123:rotated")
+	writeSecret(t, secretsDir, "smtp_password", "rotated-dir")
+	stub.set("smtp_profile_work_password", "rotated-vault")
+
+	cfg.applySecrets(b)
+	if cfg.SMTP.Password != "rotated-dir" || cfg.SMTPProfiles["work"].Password != "rotated-vault" {
+		t.Errorf("applySecrets() password = %q, work password = %q", cfg.SMTP.Password, cfg.SMTPProfiles["work"].Password)
+	}
+	if cfg.Telegram.Token != "123:rotated" {
+		t.Errorf("applySecrets() token = %q", cfg.Telegram.Token)
+	}
+
+	changed, err := cfg.RefreshSecrets()
+	if err != nil || len(changed) != 0 {
+		t.Errorf("RefreshSecrets() = %v, %v, want no changes", changed, err)
+	}
+}
+
+func TestLoad_secretErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "value and file",
+			env:  map[string]string{"UBOT_PASSWORD": "a", "UBOT_PASSWORD_FILE": filepath.Join(dir, "password")},
+			want: "UBOT_PASSWORD: both UBOT_PASSWORD and UBOT_PASSWORD_FILE are set",
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"UBOT_PASSWORD_FILE": filepath.Join(dir, "missing")},
+			want: "UBOT_PASSWORD_FILE: could not read secret",
+		},
+		{
+			name: "vault without token",
+			env:  map[string]string{"UBOT_VAULT_ADDR": "http://127.0.0.1:8200", "UBOT_VAULT_PATH": "kindle"},
+			want: "secrets.vault.token: token or token_file required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, validConfig), env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML converts a TOML document to the YAML tree the configuration is
+// decoded from, keeping the line of every key and value. It reads the
+// subset of TOML the configuration needs: comments, [tables] and
+// [[arrays of tables]] with dotted headers, one key per line, single-line
+// strings, integers, booleans and arrays of them. Anything else, such as
+// inline tables, multi-line strings, floats or dates, is rejected
+func parseTOML(data []byte) (*yaml.Node, error) {
+	p := &tomlParser{src: string(data), line: 1, defined: make(map[*yaml.Node]bool), arrays: make(map[*yaml.Node]bool)}
+	p.root = tomlMapping(1)
+	p.table = p.root
+	if err := p.document(); err != nil {
+		return nil, err
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Content: []*yaml.Node{p.root}}, nil
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+
+	root  *yaml.Node
+	table *yaml.Node // the table key/value pairs are added to
+	// defined are tables with a header, they can't be defined again
+	defined map[*yaml.Node]bool
+	arrays  map[*yaml.Node]bool // arrays of tables, unlike arrays of values
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) document() error {
+	for {
+		p.skipBlank(true)
+		if p.pos >= len(p.src) {
+			return nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			err = p.arrayTable()
+		case p.src[p.pos] == '[':
+			err = p.tableHeader()
+		default:
+			err = p.keyValue()
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// tableHeader reads "[a.b]"
+func (p *tomlParser) tableHeader() error {
+	p.pos++
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if !p.consume("]") {
+		return p.errorf("expected ] after table %s", strings.Join(keys, "."))
+	}
+	table, err := p.descend(keys)
+	if err != nil {
+		return err
+	}
+	if p.defined[table] {
+		return p.errorf("table %s defined twice", strings.Join(keys, "."))
+	}
+	p.defined[table] = true
+	p.table = table
+	return nil
+}
+
+// arrayTable reads "[[a.b]]", adding a table to the array a.b
+func (p *tomlParser) arrayTable() error {
+	p.pos += 2
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if !p.consume("]]") {
+		return p.errorf("expected ]] after table %s", strings.Join(keys, "."))
+	}
+	parent, err := p.descend(keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	name := keys[len(keys)-1]
+	array := tomlLookup(parent, name)
+	switch {
+	case array == nil:
+		array = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: p.line}
+		tomlSet(parent, name, array, p.line)
+		p.arrays[array] = true
+	case !p.arrays[array]:
+		return p.errorf("%s is not an array of tables", strings.Join(keys, "."))
+	}
+	table := tomlMapping(p.line)
+	array.Content = append(array.Content, table)
+	p.table = table
+	return nil
+}
+
+// descend returns the table at keys below the root, creating missing ones.
+// In an array of tables it continues in the last one
+func (p *tomlParser) descend(keys []string) (*yaml.Node, error) {
+	table := p.root
+	for i, key := range keys {
+		next := tomlLookup(table, key)
+		if next == nil {
+			next = tomlMapping(p.line)
+			tomlSet(table, key, next, p.line)
+		}
+		if p.arrays[next] {
+			next = next.Content[len(next.Content)-1]
+		}
+		if next.Kind != yaml.MappingNode {
+			return nil, p.errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+		table = next
+	}
+	return table, nil
+}
+
+// keyValue reads "key = value" into the current table
+func (p *tomlParser) keyValue() error {
+	line := p.line
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipBlank(false)
+	if p.consume(".") {
+		return p.errorf("dotted keys are not supported, put %s in a [%s] table", key, key)
+	}
+	if !p.consume("=") {
+		return p.errorf("expected = after %s", key)
+	}
+	p.skipBlank(false)
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if tomlLookup(p.table, key) != nil {
+		return p.errorf("%s defined twice", key)
+	}
+	tomlSet(p.table, key, value, line)
+	return nil
+}
+
+// keys reads the dotted key of a table header
+func (p *tomlParser) keys() ([]string, error) {
+	var keys []string
+	for {
+		p.skipBlank(false)
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		p.skipBlank(false)
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+// key reads a bare or quoted key
+func (p *tomlParser) key() (string, error) {
+	if p.pos >= len(p.src) {
+		return "", p.errorf("expected a key")
+	}
+	if c := p.src[p.pos]; c == '"' || c == '\'' {
+		return p.str()
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isBareKeyChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("unexpected %q, expected a key", p.src[p.pos])
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) value() (*yaml.Node, error) {
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected a value")
+	}
+	line := p.line
+	switch p.src[p.pos] {
+	case '"', '\'':
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s, Line: line}, nil
+	case '[':
+		return p.array()
+	case '{':
+		return nil, p.errorf("inline tables are not supported, use a [table]")
+	}
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n#,]", p.src[p.pos]) < 0 {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	scalar := func(tag string) (*yaml.Node, error) {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: token, Line: line}, nil
+	}
+	if token == "true" || token == "false" {
+		return scalar("!!bool")
+	}
+	if isTOMLInteger(token) {
+		if _, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return scalar("!!int")
+		}
+		return nil, p.errorf("integer %s out of range", token)
+	}
+	return nil, p.errorf("unsupported value %q, quote strings, durations and sizes", token)
+}
+
+// isTOMLInteger reports whether token is a decimal integer such as -12,
+// without leading zeros
+func isTOMLInteger(token string) bool {
+	digits := strings.TrimPrefix(strings.TrimPrefix(token, "+"), "-")
+	if digits == "" || len(digits) > 1 && digits[0] == '0' {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// array reads "[1, 2, 3]", which may span lines
+func (p *tomlParser) array() (*yaml.Node, error) {
+	array := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: p.line}
+	p.pos++
+	for {
+		p.skipBlank(true)
+		if p.consume("]") {
+			return array, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		array.Content = append(array.Content, value)
+		p.skipBlank(true)
+		if p.consume("]") {
+			return array, nil
+		}
+		if !p.consume(",") {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// str reads a single-line basic or literal string
+func (p *tomlParser) str() (string, error) {
+	quote := p.src[p.pos]
+	if strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return sb.String(), nil
+		case c == '\\' && quote == '"':
+			if err := p.escape(&sb); err != nil {
+				return "", err
+			}
+			continue
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+}
+
+// escape reads an escape sequence of a basic string
+func (p *tomlParser) escape(sb *strings.Builder) error {
+	p.pos++
+	if p.pos >= len(p.src) {
+		return p.errorf("unterminated string")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 't':
+		sb.WriteByte('\t')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'r':
+		sb.WriteByte('\r')
+	case '"', '\\':
+		sb.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return p.errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape %q", p.src[p.pos:p.pos+size])
+		}
+		sb.WriteRune(rune(code))
+		p.pos += size
+	default:
+		return p.errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// skipBlank skips spaces, and comments and line breaks with newlines
+func (p *tomlParser) skipBlank(newlines bool) {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r':
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.line++
+		case '#':
+			if !newlines {
+				return
+			}
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+// endOfLine expects nothing but a comment until the end of the line
+func (p *tomlParser) endOfLine() error {
+	p.skipBlank(false)
+	if p.pos < len(p.src) && p.src[p.pos] == '#' {
+		for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+			p.pos++
+		}
+	}
+	if p.pos < len(p.src) && p.src[p.pos] != '\n' {
+		return p.errorf("unexpected %q after value", p.src[p.pos])
+	}
+	return nil
+}
+
+func (p *tomlParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func tomlMapping(line int) *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+}
+
+// tomlLookup returns the value of key in a mapping, nil when it has none
+func tomlLookup(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func tomlSet(mapping *yaml.Node, key string, value *yaml.Node, line int) {
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: line}, value)
+}
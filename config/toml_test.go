@@ -0,0 +1,176 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string // the document as YAML
+		wantErr string
+	}{
+		{
+			name: "tables and values",
+			content: `# comment
+email_to = "a \"b\"\tc \u00e9" # trailing comment
+tmp_files_path = 'C:\path'
+[smtp]
+port = "587"
+insecure = false
+[ smtp_profiles . "Work Kindle" ]
+host = "smtp.example.com"
+[users]
+allowed = [100, -2, +3, 0]
+`,
+			want: `email_to: "a \"b\"\tc é"
+tmp_files_path: C:\path
+smtp:
+    port: "587"
+    insecure: false
+smtp_profiles:
+    Work Kindle:
+        host: smtp.example.com
+users:
+    allowed:
+        - 100
+        - -2
+        - +3
+        - 0
+`,
+		},
+		{
+			name: "arrays and arrays of tables",
+			content: `[[devices]]
+name = "Paperwhite"
+[devices.limits]
+max = 1
+[[devices]]
+args = [
+  "--input", # the file
+  '--output',
+]
+formats = []
+`,
+			want: `devices:
+    - name: Paperwhite
+      limits:
+        max: 1
+    - args:
+        - --input
+        - --output
+      formats: []
+`,
+		},
+		{
+			name:    "empty document",
+			content: "\n# nothing\n",
+			want:    "{}",
+		},
+		{
+			name:    "key defined twice",
+			content: "[smtp]\nhost = \"a\"\nhost = \"b\"\n",
+			wantErr: "line 3: host defined twice",
+		},
+		{
+			name:    "table defined twice",
+			content: "[smtp]\n[smtp]\n",
+			wantErr: "line 2: table smtp defined twice",
+		},
+		{
+			name:    "value of a table is not a table",
+			content: "smtp = 1\n[smtp.profile]\n",
+			wantErr: "line 2: smtp is not a table",
+		},
+		{
+			name:    "array of values is not an array of tables",
+			content: "devices = []\n[[devices]]\n",
+			wantErr: "line 2: devices is not an array of tables",
+		},
+		{
+			name:    "table is not an array of tables",
+			content: "[converters.extra]\n[[converters]]\n",
+			wantErr: "line 2: converters is not an array of tables",
+		},
+		{
+			name:    "dotted key",
+			content: "smtp.host = \"a\"\n",
+			wantErr: "line 1: dotted keys are not supported, put smtp in a [smtp] table",
+		},
+		{
+			name:    "inline table",
+			content: "smtp = { host = \"a\" }\n",
+			wantErr: "line 1: inline tables are not supported, use a [table]",
+		},
+		{
+			name:    "multi-line string",
+			content: "email_to = \"\"\"\na\"\"\"\n",
+			wantErr: "line 1: multi-line strings are not supported",
+		},
+		{
+			name:    "date",
+			content: "since = 2026-10-18\n",
+			wantErr: `line 1: unsupported value "2026-10-18", quote strings, durations and sizes`,
+		},
+		{
+			name:    "float",
+			content: "\n\nratio = 0.5\n",
+			wantErr: `line 3: unsupported value "0.5", quote strings, durations and sizes`,
+		},
+		{
+			name:    "leading zero",
+			content: "port = 0587\n",
+			wantErr: `line 1: unsupported value "0587", quote strings, durations and sizes`,
+		},
+		{
+			name:    "integer out of range",
+			content: "id = 99999999999999999999\n",
+			wantErr: "line 1: integer 99999999999999999999 out of range",
+		},
+		{
+			name:    "invalid escape",
+			content: "path = \"C:\\books\"\n",
+			wantErr: `line 1: invalid escape \b`,
+		},
+		{
+			name:    "unterminated string",
+			content: "\nhost = \"smtp\n",
+			wantErr: "line 2: unterminated string",
+		},
+		{
+			name:    "unterminated array",
+			content: "allowed = [1, 2\n",
+			wantErr: "line 2: expected , or ] in array",
+		},
+		{
+			name:    "two values on a line",
+			content: "a = 1 b = 2\n",
+			wantErr: `line 1: unexpected 'b' after value`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document, err := parseTOML([]byte(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseTOML() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTOML() error = %v", err)
+			}
+			got, err := yaml.Marshal(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(got)) != strings.TrimSpace(tt.want) {
+				t.Errorf("parseTOML() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package config
+
+import (
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/bot"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxDeviceNameLength = 100
+
+var (
+	webhookSecretRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+	yamlLineRegexp      = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+)
+
+// FieldError is a problem with a single configuration field
+type FieldError struct {
+	File    string // config file, empty for environment variables
+	Line    int    // line in File, 0 when unknown
+	Field   string // field path such as devices[1].email or the environment variable
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	var b strings.Builder
+	if e.File != "" && e.Line > 0 {
+		fmt.Fprintf(&b, "%s:%d: ", e.File, e.Line)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&b, "%s: ", e.Field)
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors collects every problem found in a configuration
+type ValidationErrors []*FieldError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fieldError builds an error for a field path, pointing to the environment
+// variable or the file line the value came from
+func (c *Config) fieldError(path, format string, args ...interface{}) *FieldError {
+	err := &FieldError{Field: path, Message: fmt.Sprintf(format, args...)}
+	for _, p := range pathWithParents(path) {
+		if source, ok := c.sources[p]; ok {
+			err.Field = source
+			if p != path {
+				err.Field = fmt.Sprintf("%s (%s)", source, path)
+			}
+			return err
+		}
+	}
+	err.File = c.file
+	for _, p := range pathWithParents(path) {
+		if line, ok := c.positions[p]; ok {
+			err.Line = line
+			break
+		}
+	}
+	return err
+}
+
+// pathWithParents returns "a.b[1].c", "a.b[1]", "a.b", "a"
+func pathWithParents(path string) []string {
+	paths := []string{path}
+	for {
+		i := strings.LastIndexAny(path, ".[")
+		if i <= 0 {
+			return paths
+		}
+		path = path[:i]
+		paths = append(paths, path)
+	}
+}
+
+// yamlErrors converts decoder messages ("line 3: field foo not found") to FieldErrors
+func (c *Config) yamlErrors(messages []string) ValidationErrors {
+	errs := make(ValidationErrors, 0, len(messages))
+	for _, message := range messages {
+		err := &FieldError{File: c.file, Message: message}
+		if m := yamlLineRegexp.FindStringSubmatch(message); m != nil {
+			err.Line, _ = strconv.Atoi(m[1])
+			err.Message = m[2]
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Validate checks the whole configuration and returns every problem found
+func (c *Config) Validate() ValidationErrors {
+	var errs ValidationErrors
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, c.fieldError(path, format, args...))
+	}
+
+	if c.Telegram.Token == "" {
+		add("telegram.token", "required")
+	}
+	c.validateTelegram(add)
+	if c.usesEmail() {
+		c.validateSMTP("smtp", c.SMTP, add)
+	}
+	for name, profile := range c.SMTPProfiles {
+		c.validateSMTP("smtp_profiles."+name, profile, add)
+	}
+
+	if c.EmailTo == "" && len(c.Devices) == 0 {
+		add("devices", "at least one device (or email_to) is required")
+	}
+	if c.EmailTo != "" && !validEmail(c.EmailTo) {
+		add("email_to", "invalid email address %q", c.EmailTo)
+	}
+	names := make(map[string]int)
+	for i, device := range c.Devices {
+		path := fmt.Sprintf("devices[%d]", i)
+		switch {
+		case device.Name == "":
+			add(path+".name", "required")
+		case len(device.Name) > maxDeviceNameLength:
+			add(path+".name", "too long (max %d characters)", maxDeviceNameLength)
+		default:
+			if first, ok := names[device.Name]; ok {
+				add(path+".name", "duplicate device %q (also devices[%d])", device.Name, first)
+			}
+			names[device.Name] = i
+		}
+		c.validateDevice(path, device, add)
+	}
+
+	for i, id := range c.Users.Allowed {
+		if id <= 0 {
+			add(fmt.Sprintf("users.allowed[%d]", i), "invalid user id %d", id)
+		}
+	}
+	for i, id := range c.Users.Admins {
+		if id <= 0 {
+			add(fmt.Sprintf("users.admins[%d]", i), "invalid user id %d", id)
+		}
+	}
+
+	if c.Limits.MaxFileSize != "" {
+		if _, err := parseSize(c.Limits.MaxFileSize); err != nil {
+			add("limits.max_file_size", "%v, expected e.g. 50MB", err)
+		}
+	}
+	if c.Limits.PendingTTL < 0 {
+		add("limits.pending_ttl", "must not be negative")
+	}
+	if c.Limits.ShutdownTimeout < 0 {
+		add("limits.shutdown_timeout", "must not be negative")
+	}
+
+	c.validateConverters(add)
+	c.validateSecrets(add)
+	if c.Reload.Interval < 0 {
+		add("reload.interval", "must not be negative")
+	}
+	if c.Health.MinFreeSpace != "" {
+		if _, err := parseSize(c.Health.MinFreeSpace); err != nil {
+			add("health.min_free_space", "%v, expected e.g. 100MB", err)
+		}
+	}
+	if c.Health.SMTPCheckInterval < 0 {
+		add("health.smtp_check_interval", "must not be negative")
+	}
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		add("logging.level", "%v", err)
+	}
+	switch strings.ToLower(c.Logging.Format) {
+	case "", logging.FormatText, logging.FormatJSON:
+	default:
+		add("logging.format", "must be text or json, got %q", c.Logging.Format)
+	}
+	switch strings.ToLower(c.DryRun.Format) {
+	case "", bot.DryRunMaildir, bot.DryRunMbox, bot.DryRunEML:
+	default:
+		add("dry_run.format", "must be maildir, mbox or eml, got %q", c.DryRun.Format)
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			add("metrics.listen", "invalid listen address %q, expected e.g. \":9090\"", c.Metrics.Listen)
+		}
+	}
+	if c.Library.MaxAge < 0 {
+		add("library.max_age", "must not be negative")
+	}
+	if c.OPDS.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.OPDS.Listen); err != nil {
+			add("opds.listen", "invalid listen address %q, expected e.g. \":8081\"", c.OPDS.Listen)
+		}
+	}
+	if c.OPDS.URL != "" && !validURL(c.OPDS.URL) {
+		add("opds.url", "invalid URL %q", c.OPDS.URL)
+	}
+	if c.Calibre.Library != "" && !filepath.IsAbs(c.Calibre.Library) {
+		add("calibre.library", "must be an absolute path, got %q", c.Calibre.Library)
+	}
+	if server := c.Calibre.Server; server.URL != "" {
+		if !validURL(server.URL) {
+			add("calibre.server.url", "must be an http(s) URL, got %q", server.URL)
+		}
+		if server.Password != "" && server.Username == "" {
+			add("calibre.server.username", "required when password is set")
+		}
+	}
+	switch strings.ToLower(c.Vocabulary.Format) {
+	case "", bot.VocabularyTSV, bot.VocabularyCSV:
+	default:
+		add("vocabulary.format", "must be tsv or csv, got %q", c.Vocabulary.Format)
+	}
+	return errs
+}
+
+func (c *Config) validateTelegram(add func(path, format string, args ...interface{})) {
+	if c.Telegram.APIURL != "" && !validURL(c.Telegram.APIURL) {
+		add("telegram.api_url", "invalid URL %q", c.Telegram.APIURL)
+	}
+
+	switch strings.ToLower(c.Telegram.UpdateMode) {
+	case "", bot.UpdateModePolling:
+		return
+	case bot.UpdateModeWebhook:
+	default:
+		add("telegram.update_mode", "must be %q or %q, got %q",
+			bot.UpdateModePolling, bot.UpdateModeWebhook, c.Telegram.UpdateMode)
+		return
+	}
+
+	webhook := c.Telegram.Webhook
+	if webhook.URL == "" {
+		add("telegram.webhook.url", "required in webhook mode")
+	} else if !strings.HasPrefix(webhook.URL, "https://") || !validURL(webhook.URL) {
+		add("telegram.webhook.url", "must be an https URL, got %q", webhook.URL)
+	}
+	if webhook.Secret != "" && !webhookSecretRegexp.MatchString(webhook.Secret) {
+		add("telegram.webhook.secret", "must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+	}
+	if webhook.Cert != "" && webhook.Key == "" {
+		add("telegram.webhook.key", "required when cert is set")
+	}
+	if webhook.Key != "" && webhook.Cert == "" {
+		add("telegram.webhook.cert", "required when key is set")
+	}
+}
+
+func (c *Config) validateDevice(path string, device Device, add func(path, format string, args ...interface{})) {
+	switch strings.ToLower(device.Type) {
+	case "", bot.TransportEmail:
+		if !validEmail(device.Email) {
+			add(path+".email", "invalid email address %q", device.Email)
+		}
+		if device.SMTPProfile != "" {
+			if _, ok := c.SMTPProfiles[device.SMTPProfile]; !ok {
+				add(path+".smtp_profile", "unknown smtp profile %q", device.SMTPProfile)
+			}
+		}
+	case bot.TransportDirectory:
+		if device.Path == "" {
+			add(path+".path", "required for a directory device")
+		} else if !filepath.IsAbs(device.Path) {
+			add(path+".path", "must be an absolute path, got %q", device.Path)
+		}
+	case bot.TransportWebDAV, bot.TransportCalibre:
+		if !validURL(device.URL) {
+			add(path+".url", "must be an http(s) URL, got %q", device.URL)
+		}
+		if device.Password != "" && device.Username == "" {
+			add(path+".username", "required when password is set")
+		}
+	default:
+		add(path+".type", "must be %s, %s, %s or %s, got %q",
+			bot.TransportEmail, bot.TransportDirectory, bot.TransportWebDAV, bot.TransportCalibre, device.Type)
+		return
+	}
+	if device.Library != "" && strings.ToLower(device.Type) != bot.TransportCalibre {
+		add(path+".library", "only used by calibre devices")
+	}
+	if !device.mailed() && (device.Email != "" || device.SMTPProfile != "") {
+		add(path+".email", "only used by email devices")
+	}
+}
+
+// usesEmail reports whether any book is mailed, which needs the SMTP account
+func (c *Config) usesEmail() bool {
+	if c.EmailTo != "" {
+		return true
+	}
+	for _, device := range c.Devices {
+		if device.mailed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateSMTP(path string, profile SMTP, add func(path, format string, args ...interface{})) {
+	// A dry run only needs the sender for the From header
+	dryRun := c.DryRun.Path != ""
+	if profile.Host == "" && !dryRun {
+		add(path+".host", "required")
+	}
+	if profile.From == "" {
+		add(path+".from", "required")
+	} else if !validEmail(profile.From) {
+		add(path+".from", "invalid email address %q", profile.From)
+	}
+	if profile.Password == "" && !dryRun {
+		add(path+".password", "required")
+	}
+	if profile.Port != "" {
+		if port, err := strconv.Atoi(profile.Port); err != nil || port < 1 || port > 65535 {
+			add(path+".port", "invalid port %q", profile.Port)
+		}
+	}
+}
+
+func (c *Config) validateConverters(add func(path, format string, args ...interface{})) {
+	names := make(map[string]bool)
+	formats := make(map[string]string)
+	fallback := ""
+	for i, converter := range c.Converters {
+		path := fmt.Sprintf("converters[%d]", i)
+		if converter.Name == "" {
+			add(path+".name", "required")
+		} else if names[converter.Name] {
+			add(path+".name", "duplicate converter %q", converter.Name)
+		}
+		names[converter.Name] = true
+
+		switch converter.Type {
+		case "", bot.ConverterTypeCommand:
+			if converter.Command == "" {
+				add(path+".command", "required for command converters")
+			}
+		case bot.ConverterTypeMarkup:
+			markup := bot.MarkupFormats()
+			for j, format := range converter.Formats {
+				if !containsFormat(markup, format) {
+					add(fmt.Sprintf("%s.formats[%d]", path, j), "markup converters render %s, got %q",
+						strings.Join(markup, ", "), format)
+				}
+			}
+			if len(converter.Formats) == 0 {
+				converter.Formats = markup
+			}
+		case bot.ConverterTypeFB2:
+			fb2 := bot.FB2Formats()
+			for j, format := range converter.Formats {
+				if !containsFormat(fb2, format) {
+					add(fmt.Sprintf("%s.formats[%d]", path, j), "fb2 converters read %s, got %q",
+						strings.Join(fb2, ", "), format)
+				}
+			}
+			if len(converter.Formats) == 0 {
+				converter.Formats = fb2
+			}
+		default:
+			add(path+".type", "unknown converter type %q", converter.Type)
+		}
+		if converter.Timeout < 0 {
+			add(path+".timeout", "must not be negative")
+		}
+
+		if len(converter.Formats) == 0 {
+			if fallback != "" {
+				add(path+".formats", "only one converter may handle all formats, %q already does", fallback)
+			}
+			fallback = converter.Name
+		}
+		for j, format := range converter.Formats {
+			format = strings.TrimPrefix(strings.ToLower(format), ".")
+			if other, ok := formats[format]; ok {
+				add(fmt.Sprintf("%s.formats[%d]", path, j), "format %q is already handled by %q", format, other)
+			}
+			formats[format] = converter.Name
+		}
+	}
+}
+
+// containsFormat reports whether formats has the file extension format
+func containsFormat(formats []string, format string) bool {
+	format = strings.TrimPrefix(strings.ToLower(format), ".")
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateSecrets(add func(path, format string, args ...interface{})) {
+	if c.Secrets.Dir != "" {
+		if info, err := os.Stat(c.Secrets.Dir); err != nil || !info.IsDir() {
+			add("secrets.dir", "not a directory: %q", c.Secrets.Dir)
+		}
+	}
+	if c.Secrets.RefreshInterval < 0 {
+		add("secrets.refresh_interval", "must not be negative")
+	}
+
+	vault := c.Secrets.Vault
+	if vault == (Vault{}) {
+		return
+	}
+	if vault.Address == "" {
+		add("secrets.vault.address", "required")
+	} else if !validURL(vault.Address) {
+		add("secrets.vault.address", "invalid URL %q", vault.Address)
+	}
+	if vault.Path == "" {
+		add("secrets.vault.path", "required")
+	}
+	if vault.Token == "" && vault.TokenFile == "" {
+		add("secrets.vault.token", "token or token_file required")
+	}
+}
+
+func validEmail(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address
+}
+
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
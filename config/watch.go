@@ -0,0 +1,142 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/bot"
+	"github.com/michaelfmnk/send-to-kindle-telegram-bot/logging"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often the config file is checked for changes
+const DefaultWatchInterval = 10 * time.Second
+
+// Watcher applies configuration changes to a running bot. It reloads the
+// configuration on SIGHUP and when the config file changes, and refreshes
+// rotated secrets
+type Watcher struct {
+	path   string
+	getenv func(string) string
+	bot    *bot.SendToKindleBot
+
+	mu     sync.Mutex
+	cfg    *Config
+	digest [sha256.Size]byte
+}
+
+// NewWatcher creates a watcher for a bot started from cfg, which was loaded
+// from path with getenv
+func NewWatcher(path string, getenv func(string) string, cfg *Config, b *bot.SendToKindleBot) *Watcher {
+	w := &Watcher{path: path, getenv: getenv, bot: b, cfg: cfg}
+	w.fileChanged()
+	return w
+}
+
+// Run watches for changes until stop is closed
+func (w *Watcher) Run(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var fileTicks <-chan time.Time
+	if w.path != "" && (w.cfg.Reload.Watch == nil || *w.cfg.Reload.Watch) {
+		interval := w.cfg.Reload.Interval
+		if interval <= 0 {
+			interval = DefaultWatchInterval
+		}
+		logging.Info("Watching config file for changes", "path", w.path, "interval", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		fileTicks = ticker.C
+	}
+
+	refresh := w.cfg.Secrets.RefreshInterval
+	if refresh <= 0 {
+		refresh = DefaultSecretsRefresh
+	}
+	secretsTicker := time.NewTicker(refresh)
+	defer secretsTicker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			w.fileChanged()
+			w.Reload("SIGHUP")
+		case <-fileTicks:
+			if w.fileChanged() {
+				w.Reload("config file changed")
+			}
+		case <-secretsTicker.C:
+			w.mu.Lock()
+			w.cfg.applySecrets(w.bot)
+			w.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reload loads the configuration again and applies it to the bot. An invalid
+// configuration is reported and the current one is kept
+func (w *Watcher) Reload(trigger string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cfg, err := Load(w.path, w.getenv)
+	var changes []string
+	if err == nil {
+		changes, err = w.bot.Reload(cfg.Bot())
+	}
+	if err != nil {
+		logging.Error("Configuration reload failed, keeping the current configuration",
+			"trigger", trigger, "err", err)
+		w.announce(fmt.Sprintf("⚠️ Configuration reload failed, keeping the current configuration:\n%v", err))
+		return err
+	}
+
+	if level := cfg.LogLevel(); level != w.cfg.LogLevel() {
+		logging.Default().SetLevel(level)
+		changes = append(changes, fmt.Sprintf("log level: %s -> %s", w.cfg.LogLevel(), level))
+	}
+	if cfg.Logging.Format != w.cfg.Logging.Format {
+		changes = append(changes, "log format changed, restart required")
+	}
+	w.cfg = cfg
+	if len(changes) == 0 {
+		logging.Info("Configuration reloaded: no changes", "trigger", trigger)
+		return nil
+	}
+	logging.Info("Configuration reloaded", "trigger", trigger, "changes", strings.Join(changes, "; "))
+	w.announce("🔄 Configuration reloaded:\n• " + strings.Join(changes, "\n• "))
+	return nil
+}
+
+func (w *Watcher) announce(text string) {
+	if w.cfg.Reload.Announce {
+		w.bot.NotifyAdmins(text)
+	}
+}
+
+// fileChanged reports whether the config file content changed since the
+// last call. Comparing content also catches Kubernetes ConfigMap updates,
+// which swap a symlink instead of writing the file
+func (w *Watcher) fileChanged() bool {
+	if w.path == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		logging.Warn("Could not read config file", "path", w.path, "err", err)
+		return false
+	}
+	digest := sha256.Sum256(data)
+	changed := digest != w.digest
+	w.digest = digest
+	return changed
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWatcher_Reload(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	cfg, err := Load(path, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(path, env(nil), cfg, cfg.Bot())
+	if w.fileChanged() {
+		t.Errorf("fileChanged() = true for an unchanged file")
+	}
+
+	added := strings.Replace(validConfig, "users:", "  - name: Oasis\n    email: oasis@kindle.com\nusers:", 1)
+	if err := os.WriteFile(path, []byte(added), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !w.fileChanged() {
+		t.Fatalf("fileChanged() = false after an edit")
+	}
+	if err := w.Reload("test"); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if len(w.cfg.Devices) != 3 {
+		t.Errorf("Reload() devices = %+v", w.cfg.Devices)
+	}
+
+	// An invalid file keeps the current configuration
+	broken := strings.Replace(added, "oasis@kindle.com", "oasis", 1)
+	if err := os.WriteFile(path, []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = w.Reload("test")
+	if err == nil || !strings.Contains(err.Error(), `devices[2].email: invalid email address "oasis"`) {
+		t.Errorf("Reload() error = %v", err)
+	}
+	if len(w.cfg.Devices) != 3 || w.cfg.Devices[2].Email != "oasis@kindle.com" {
+		t.Errorf("Reload() replaced the configuration with an invalid one")
+	}
+}
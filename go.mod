@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/scorredoira/email v0.0.0-20191107070024-dc7b732c55da
 	gopkg.in/tucnak/telebot.v2 v2.4.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/pkg/errors v0.8.1 // indirect
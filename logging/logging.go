@@ -0,0 +1,279 @@
+// Package logging is a small leveled, structured logger writing one line per
+// entry as logfmt-style text or JSON. Email addresses, Telegram bot tokens
+// and values of secret fields are redacted before anything is written
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int32
+
+const (
+	// LevelDebug - details useful when tracking down a problem
+	LevelDebug Level = iota
+	// LevelInfo - normal operation
+	LevelInfo
+	// LevelWarn - something went wrong but was handled
+	LevelWarn
+	// LevelError - an operation failed
+	LevelError
+)
+
+const (
+	// FormatText writes logfmt-style lines: time=... level=info msg="..." key=value
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line
+	FormatJSON = "json"
+)
+
+// ErrInvalidLevel - represents an unknown level name
+var ErrInvalidLevel = errors.New("log level must be debug, info, warn or error")
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses "debug", "info", "warn" (or "warning") and "error"
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("%w, got %q", ErrInvalidLevel, name)
+}
+
+// core is the output shared by a logger and the loggers derived from it
+type core struct {
+	mu    sync.Mutex
+	out   io.Writer
+	json  bool
+	level int32
+	now   func() time.Time
+}
+
+// Logger writes entries at or above its level. Loggers derived with With
+// share output and level with their parent
+type Logger struct {
+	core   *core
+	fields []interface{} // key/value pairs added to every entry
+}
+
+// New creates a logger. An unknown format falls back to text
+func New(out io.Writer, format string, level Level) *Logger {
+	return &Logger{core: &core{
+		out:   out,
+		json:  strings.EqualFold(format, FormatJSON),
+		level: int32(level),
+		now:   time.Now,
+	}}
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(New(os.Stderr, FormatText, LevelInfo))
+}
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	return defaultLogger.Load().(*Logger)
+}
+
+// SetDefault replaces the logger used by the package level functions
+func SetDefault(l *Logger) {
+	defaultLogger.Store(l)
+}
+
+// Debug logs at LevelDebug with the default logger
+func Debug(msg string, keyvals ...interface{}) { Default().log(LevelDebug, msg, keyvals) }
+
+// Info logs at LevelInfo with the default logger
+func Info(msg string, keyvals ...interface{}) { Default().log(LevelInfo, msg, keyvals) }
+
+// Warn logs at LevelWarn with the default logger
+func Warn(msg string, keyvals ...interface{}) { Default().log(LevelWarn, msg, keyvals) }
+
+// Error logs at LevelError with the default logger
+func Error(msg string, keyvals ...interface{}) { Default().log(LevelError, msg, keyvals) }
+
+// Debug logs at LevelDebug
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+
+// Info logs at LevelInfo
+func (l *Logger) Info(msg string, keyvals ...interface{}) { l.log(LevelInfo, msg, keyvals) }
+
+// Warn logs at LevelWarn
+func (l *Logger) Warn(msg string, keyvals ...interface{}) { l.log(LevelWarn, msg, keyvals) }
+
+// Error logs at LevelError
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// With returns a logger adding the key/value pairs to every entry,
+// e.g. With("job", id)
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{core: l.core, fields: fields}
+}
+
+// SetLevel changes the level of the logger and every logger sharing its output
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.core.level, int32(level))
+}
+
+// Level returns the current level
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.core.level))
+}
+
+// Enabled reports whether entries at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	pairs = append(pairs, "time", l.core.now().UTC().Format(time.RFC3339), "level", level.String(), "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, keyvals...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(missing)")
+	}
+
+	if l.core.json {
+		writeJSON(&buf, pairs)
+	} else {
+		writeText(&buf, pairs)
+	}
+
+	l.core.mu.Lock()
+	l.core.out.Write(buf.Bytes())
+	l.core.mu.Unlock()
+}
+
+func writeText(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key := fmt.Sprint(pairs[i])
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		value := redactValue(key, pairs[i+1])
+		if s, ok := value.(string); ok {
+			if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+				s = strconv.Quote(s)
+			}
+			buf.WriteString(s)
+			continue
+		}
+		buf.WriteString(fmt.Sprint(value))
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := fmt.Sprint(pairs[i])
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(redactValue(key, pairs[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+}
+
+// redactValue converts a value for output, redacting secrets: numbers and
+// booleans are kept, everything else becomes a redacted string
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case error:
+		return Redact(v.Error())
+	case fmt.Stringer:
+		return RedactField(key, v.String())
+	case string:
+		return RedactField(key, v)
+	default:
+		return RedactField(key, fmt.Sprint(v))
+	}
+}
+
+// Writer returns an io.Writer logging each line written to it at level,
+// e.g. for log.SetOutput or http.Server.ErrorLog
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			if line != "" {
+				l.log(level, line, nil)
+			}
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger, e.g. one with a job ID
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger stored by NewContext or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(format string, level Level) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, format, level)
+	l.core.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"", LevelInfo, false},
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warning", LevelWarn, false},
+		{" error ", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidLevel) {
+				t.Errorf("ParseLevel() error = %v, want %v", err, ErrInvalidLevel)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogger_text(t *testing.T) {
+	l, buf := newTestLogger(FormatText, LevelDebug)
+	l.With("job", "1a2b3c4d").Info("Successfully sent file", "file", "My Book.epub", "user", 42, "duration", 1500*time.Millisecond)
+
+	want := `time=2024-05-01T12:00:00Z level=info msg="Successfully sent file" job=1a2b3c4d file="My Book.epub" user=42 duration=1.5s` + "\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLogger_json(t *testing.T) {
+	l, buf := newTestLogger(FormatJSON, LevelDebug)
+	l.Error("Could not send file", "err", errors.New("smtp: 550 rejected"), "attempt", 2, "odd")
+
+	want := `{"time":"2024-05-01T12:00:00Z","level":"error","msg":"Could not send file","err":"smtp: 550 rejected","attempt":2,"odd":"(missing)"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Errorf("output is not valid JSON: %v", err)
+	}
+}
+
+func TestLogger_levels(t *testing.T) {
+	l, buf := newTestLogger(FormatText, LevelWarn)
+	child := l.With("job", "x")
+
+	l.Debug("debug")
+	child.Info("info")
+	child.Warn("warn")
+	l.Error("error")
+	if got := strings.Count(buf.String(), "\n"); got != 2 {
+		t.Errorf("wrote %d lines at warn, want 2:\n%s", got, buf)
+	}
+
+	// The level is shared with derived loggers
+	buf.Reset()
+	l.SetLevel(LevelDebug)
+	child.Debug("debug")
+	if !strings.Contains(buf.String(), "msg=debug job=x") {
+		t.Errorf("SetLevel() did not apply to derived logger, output = %q", buf)
+	}
+	if l.Level() != LevelDebug || !child.Enabled(LevelDebug) {
+		t.Errorf("Level() = %v, want %v", l.Level(), LevelDebug)
+	}
+}
+
+func TestLogger_redaction(t *testing.T) {
+	token := "123456789:AAH" + strings.Repeat("x", 32)
+	tests := []struct {
+		name    string
+		log     func(l *Logger)
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "email field",
+			log:     func(l *Logger) { l.Info("Sent", "email", "john.doe@kindle.com") },
+			want:    []string{"email=***@kindle.com"},
+			notWant: []string{"john.doe"},
+		},
+		{
+			name: "email in message and error",
+			log: func(l *Logger) {
+				l.Warn("Rejected for jane@example.org", "err", errors.New("550 jane@example.org unknown"))
+			},
+			want:    []string{"***@example.org"},
+			notWant: []string{"jane"},
+		},
+		{
+			name: "bot token in url",
+			log: func(l *Logger) {
+				l.Warn("Could not get updates", "err", fmt.Errorf("Get https://api.telegram.org/bot%s/getUpdates: timeout", token))
+			},
+			want:    []string{"bot[REDACTED]/getUpdates"},
+			notWant: []string{token},
+		},
+		{
+			name: "secret keys",
+			log: func(l *Logger) {
+				l.Info("Loaded", "smtp_password", "hunter2", "Authorization", "Bearer abc", "host", "smtp.gmail.com")
+			},
+			want:    []string{"smtp_password=[REDACTED]", "Authorization=[REDACTED]", "host=smtp.gmail.com"},
+			notWant: []string{"hunter2", "Bearer"},
+		},
+		{
+			name:    "empty secret is kept empty",
+			log:     func(l *Logger) { l.Info("Loaded", "token", "") },
+			want:    []string{`token=""`},
+			notWant: []string{"[REDACTED]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, format := range []string{FormatText, FormatJSON} {
+				l, buf := newTestLogger(format, LevelDebug)
+				tt.log(l)
+				out := buf.String()
+				for _, w := range tt.want {
+					// want is written in text form, JSON only checks what must not leak
+					if format == FormatText && !strings.Contains(out, w) {
+						t.Errorf("%s output = %q, want it to contain %q", format, out, w)
+					}
+				}
+				for _, nw := range tt.notWant {
+					if strings.Contains(out, nw) {
+						t.Errorf("%s output = %q, must not contain %q", format, out, nw)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLogger_Writer(t *testing.T) {
+	l, buf := newTestLogger(FormatText, LevelInfo)
+	w := l.Writer(LevelWarn)
+	fmt.Fprint(w, "first line\nsecond line\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if !strings.HasSuffix(lines[1], `level=warn msg="second line"`) {
+		t.Errorf("line = %q", lines[1])
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != Default() {
+		t.Errorf("FromContext() without logger = %p, want default %p", got, Default())
+	}
+	l, _ := newTestLogger(FormatText, LevelInfo)
+	if got := FromContext(NewContext(context.Background(), l)); got != l {
+		t.Errorf("FromContext() = %p, want %p", got, l)
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"user@kindle.com", "***@kindle.com"},
+		{"invalid", "***@***"},
+		{"a@b@c", "***@***"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := MaskEmail(tt.email); got != tt.want {
+				t.Errorf("MaskEmail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// botTokenRegexp matches Telegram bot tokens, also inside Bot API URLs
+	botTokenRegexp = regexp.MustCompile(`\d{5,}:[A-Za-z0-9_\-]{30,}`)
+
+	// secretKeys are field names whose values are never logged
+	secretKeys = []string{"password", "token", "secret", "authorization", "api_key", "apikey"}
+)
+
+// MaskEmail hides the local part of an email address: "***@kindle.com"
+func MaskEmail(email string) string {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		return "***@***"
+	}
+	return "***@" + parts[1]
+}
+
+// Redact masks email addresses and Telegram bot tokens in s
+func Redact(s string) string {
+	if strings.Contains(s, "@") {
+		s = emailRegexp.ReplaceAllStringFunc(s, MaskEmail)
+	}
+	if strings.Contains(s, ":") {
+		s = botTokenRegexp.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// RedactField redacts the value of a field: secrets entirely, anything else
+// with Redact
+func RedactField(key, value string) string {
+	if value != "" && isSecretKey(key) {
+		return redacted
+	}
+	return Redact(value)
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}